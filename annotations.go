@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// outputAnnotations returns the manifest annotations for the squashed
+// version of img: the given index annotations and img's manifest
+// annotations (with the manifest's taking precedence), minus any matching
+// -drop-annotation.
+func outputAnnotations(indexAnnotations map[string]string, img v1.Image) (map[string]string, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("get source manifest: %w", err)
+	}
+	annotations := map[string]string{}
+	for _, in := range []map[string]string{indexAnnotations, m.Annotations} {
+		filtered, err := filterAnnotations(in)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range filtered {
+			annotations[k] = v
+		}
+	}
+	return annotations, nil
+}
+
+// filterAnnotations returns annotations minus any matching
+// -drop-annotation.
+func filterAnnotations(annotations map[string]string) (map[string]string, error) {
+	var out map[string]string
+	for k, v := range annotations {
+		drop, err := matchesAny(dropAnnotations, k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -drop-annotation: %w", err)
+		}
+		if !drop {
+			if out == nil {
+				out = map[string]string{}
+			}
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// matchesAny returns whether s matches any of the given glob patterns.
+func matchesAny(patterns []string, s string) (bool, error) {
+	for _, p := range patterns {
+		ok, err := path.Match(p, s)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// outputLabels returns the source config labels to keep in the squashed
+// image. A label is dropped if it matches a -drop-labels pattern, or if
+// -preserve-labels is given and it matches none of those patterns; a label
+// matching -preserve-labels is always kept.
+func outputLabels(labels map[string]string) (map[string]string, error) {
+	if len(dropLabels) == 0 && len(preserveLabels) == 0 {
+		return labels, nil
+	}
+	out := map[string]string{}
+	for k, v := range labels {
+		preserve, err := matchesAny(preserveLabels, k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -preserve-labels: %w", err)
+		}
+		drop, err := matchesAny(dropLabels, k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -drop-labels: %w", err)
+		}
+		if preserve || (!drop && len(preserveLabels) == 0) {
+			out[k] = v
+		} else {
+			logf("Dropping label %q", k)
+		}
+	}
+	return out, nil
+}
+
+const (
+	// sourceDigestLabel is the label holding the digest of the source
+	// image's manifest.
+	sourceDigestLabel = "io.github.bduffany.docker-squash.source-digest"
+	// sourceLayersLabel is the label holding the comma-separated digests of
+	// the source layer blobs that were squashed, from the bottom up.
+	sourceLayersLabel = "io.github.bduffany.docker-squash.source-layers"
+)
+
+// withSourceLabels returns a copy of labels with the source digest and
+// layer labels set for squashing img, so that the blobs flattened into the
+// output can be traced. The bottom layers img shares with base, the
+// -previous or foreign base image if not nil, are carried over rather than
+// squashed, so they aren't listed.
+func withSourceLabels(labels map[string]string, img v1.Image, base *source) (map[string]string, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("get source image digest: %w", err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("get source manifest: %w", err)
+	}
+	carried := 0
+	if base != nil {
+		if carried, err = sharedBaseLayers(img, base.Image); err != nil {
+			return nil, err
+		}
+	}
+	var layers []string
+	for _, l := range m.Layers[min(carried, len(m.Layers)):] {
+		layers = append(layers, l.Digest.String())
+	}
+	out := maps.Clone(labels)
+	if out == nil {
+		out = map[string]string{}
+	}
+	out[sourceDigestLabel] = digest.String()
+	out[sourceLayersLabel] = strings.Join(layers, ",")
+	return out, nil
+}
+
+// sharedBaseLayers returns how many of the bottom layers of img are those
+// of base, by diffID, so that recompressed blobs match too.
+func sharedBaseLayers(img, base v1.Image) (int, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return 0, fmt.Errorf("get source config: %w", err)
+	}
+	baseCfg, err := base.ConfigFile()
+	if err != nil {
+		return 0, fmt.Errorf("get base config: %w", err)
+	}
+	n := 0
+	for n < len(cfg.RootFS.DiffIDs) && n < len(baseCfg.RootFS.DiffIDs) && cfg.RootFS.DiffIDs[n] == baseCfg.RootFS.DiffIDs[n] {
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// archiveOptions sets the metadata of the members of local output archives
+// themselves, like manifest.json, index.json, the config and layer blobs
+// and docker-squash.json, rather than of the files in the image, so that
+// the archive file can be as reproducible as the image it holds.
+type archiveOptions struct {
+	// ModTime is the modification time of every member. If zero, members
+	// keep their own: none for docker-archives, and the time each was
+	// staged for oci-archives.
+	ModTime time.Time
+	// UID and GID own every member, with the names Uname and Gname, if
+	// any.
+	UID, GID     int
+	Uname, Gname string
+}
+
+// outputArchive is the metadata of output archive members, as set by the
+// -archive-mtime and -archive-owner flags.
+var outputArchive archiveOptions
+
+// parseArchiveOptions returns the archiveOptions set by flags. With
+// -reproducible, members are dated the image's creation time unless
+// -archive-mtime says otherwise.
+func parseArchiveOptions() (archiveOptions, error) {
+	var o archiveOptions
+	var err error
+	switch {
+	case *archiveMtime != "":
+		if o.ModTime, err = parseCreated(*archiveMtime); err != nil {
+			return o, fmt.Errorf("invalid -archive-mtime: %w", err)
+		}
+	case *reproducible:
+		if o.ModTime, err = outputCreated(); err != nil {
+			return o, err
+		}
+	}
+	parts := strings.Split(*archiveOwner, ":")
+	if len(parts) != 2 && len(parts) != 4 {
+		return o, fmt.Errorf("invalid -archive-owner %q (expected UID:GID or UID:GID:USER:GROUP)", *archiveOwner)
+	}
+	if o.UID, o.GID, err = parseOwner(parts[0] + ":" + parts[1]); err != nil {
+		return o, fmt.Errorf("invalid -archive-owner: %w", err)
+	}
+	if len(parts) == 4 {
+		o.Uname, o.Gname = parts[2], parts[3]
+	}
+	return o, nil
+}
+
+// apply sets the metadata of the output archive member hdr.
+func (o archiveOptions) apply(hdr *tar.Header) {
+	hdr.Uid, hdr.Gid = o.UID, o.GID
+	hdr.Uname, hdr.Gname = o.Uname, o.Gname
+	if !o.ModTime.IsZero() {
+		hdr.ModTime = o.ModTime
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	}
+}
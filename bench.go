@@ -0,0 +1,142 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// benchResult is the measured throughput of one phase of a squash.
+type benchResult struct {
+	Phase    string
+	In       int64
+	Out      int64
+	Duration time.Duration
+}
+
+func (r *benchResult) throughput() string {
+	if r.Duration <= 0 {
+		return "-"
+	}
+	return humanize.Bytes(uint64(float64(r.In)/r.Duration.Seconds())) + "/s"
+}
+
+// benchFlags returns the flags of the bench subcommand, and its -levels.
+func benchFlags() (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	return flags, flags.String("levels", "1,6,9", "Comma-separated gzip compression levels to benchmark")
+}
+
+func benchMain(args []string) error {
+	flags, levels := benchFlags()
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 1 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s bench [-levels LEVELS] SOURCE", os.Args[0]))
+	}
+	var gzipLevels []int
+	for _, s := range strings.Split(*levels, ",") {
+		level, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || level < gzip.BestSpeed || level > gzip.BestCompression {
+			return withExitCode(exitUsage, fmt.Errorf("invalid -levels entry %q: must be a gzip level from %d to %d", s, gzip.BestSpeed, gzip.BestCompression))
+		}
+		gzipLevels = append(gzipLevels, level)
+	}
+	defer removeTemps()
+
+	src, err := openSource(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var results []*benchResult
+
+	// Extraction, including pulling and decompressing the source layers.
+	tmp, err := createTemp("docker-squash-bench-*.tar")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	logf("Extracting squashed image to %q", tmp.Name())
+	start := time.Now()
+	rc := extractImage(src.Image)
+	n, err := io.Copy(tmp, rc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("extract squashed image: %w", err)
+	}
+	results = append(results, &benchResult{Phase: "extract", In: n, Out: n, Duration: time.Since(start)})
+
+	rootfs := func() (io.ReadCloser, error) { return os.Open(tmp.Name()) }
+	measure := func(phase string, w io.Writer, out func() int64) error {
+		logf("Benchmarking %s", phase)
+		f, err := rootfs()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		start := time.Now()
+		n, err := io.Copy(w, f)
+		if err != nil {
+			return err
+		}
+		if c, ok := w.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				return err
+			}
+		}
+		results = append(results, &benchResult{Phase: phase, In: n, Out: out(), Duration: time.Since(start)})
+		return nil
+	}
+
+	h := sha256.New()
+	if err := measure("sha256", h, func() int64 { return 0 }); err != nil {
+		return err
+	}
+	for _, level := range gzipLevels {
+		cw := &countingWriter{w: io.Discard}
+		zw, err := gzip.NewWriterLevel(cw, level)
+		if err != nil {
+			return err
+		}
+		if err := measure(fmt.Sprintf("gzip -%d", level), zw, func() int64 { return cw.n }); err != nil {
+			return err
+		}
+	}
+
+	// The digest/compression pipeline used for squashed layers.
+	logf("Benchmarking layer digest")
+	start = time.Now()
+	layer, err := digestLayer(rootfs)
+	if err != nil {
+		return err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return err
+	}
+	results = append(results, &benchResult{Phase: "layer digest", In: n, Out: size, Duration: time.Since(start)})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tINPUT\tOUTPUT\tRATIO\tDURATION\tTHROUGHPUT")
+	for _, r := range results {
+		out, ratio := "-", "-"
+		if r.Out > 0 {
+			out = humanize.Bytes(uint64(r.Out))
+			ratio = fmt.Sprintf("%.2f", float64(r.In)/float64(r.Out))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Phase, humanize.Bytes(uint64(r.In)), out, ratio, r.Duration.Round(time.Millisecond), r.throughput())
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// With -buildx-compat, docker-archive outputs are written the way
+// BuildKit's docker exporter ('docker buildx build --output type=docker',
+// through containerd's archive exporter) writes them, rather than the way
+// ggcr does, for tools that parse those archives strictly: an OCI layout
+// whose blobs are under blobs/sha256, with an index.json and a manifest.json
+// referring to them, in name order with directory entries, and RepoTags
+// spelled the way docker does, like "app:1.0".
+
+// buildxDescriptor is an index.json entry, with the fields in the order the
+// OCI image spec (and so containerd) declares them, unlike v1.Descriptor.
+type buildxDescriptor struct {
+	MediaType   types.MediaType   `json:"mediaType"`
+	Digest      v1.Hash           `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type buildxIndex struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	MediaType     types.MediaType    `json:"mediaType"`
+	Manifests     []buildxDescriptor `json:"manifests"`
+}
+
+// buildxManifest is a manifest.json entry, which unlike ggcr's has no
+// LayerSources.
+type buildxManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// buildxRecord is a member of a -buildx-compat archive.
+type buildxRecord struct {
+	hdr *tar.Header
+	// open returns the contents of a regular file.
+	open func() (io.ReadCloser, error)
+}
+
+// writeBuildxArchive writes img to outputPath as a -buildx-compat
+// docker-archive, tagged with the tags among outRefs. Unlike other
+// docker-archive outputs, it has no provenanceFile, which buildx's don't.
+func writeBuildxArchive(outputPath string, outRefs []name.Reference, img v1.Image) error {
+	records, err := buildxRecords(outRefs, img)
+	if err != nil {
+		return fmt.Errorf("write image to %q: %w", outputPath, err)
+	}
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output file: %w", err)
+	}
+	defer out.Close()
+	progress := &progressWriter{}
+	tw := tar.NewWriter(io.MultiWriter(out, progress))
+	for _, r := range records {
+		if err := writeBuildxRecord(tw, r); err != nil {
+			return fmt.Errorf("write image to %q: %w", outputPath, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("write image to %q: %w", outputPath, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("write image to %q: %w", outputPath, err)
+	}
+	progress.Print()
+	return nil
+}
+
+func writeBuildxRecord(tw *tar.Writer, r buildxRecord) error {
+	outputArchive.apply(r.hdr)
+	if err := tw.WriteHeader(r.hdr); err != nil {
+		return err
+	}
+	if r.open == nil {
+		return nil
+	}
+	rc, err := r.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if _, err := io.Copy(tw, rc); err != nil {
+		return fmt.Errorf("write %s: %w", r.hdr.Name, err)
+	}
+	return nil
+}
+
+// buildxRecords returns the members of the -buildx-compat archive of img,
+// sorted by name as containerd writes them.
+func buildxRecords(outRefs []name.Reference, img v1.Image) ([]buildxRecord, error) {
+	byName := map[string]buildxRecord{}
+	file := func(name string, mode int64, data []byte) {
+		byName[name] = buildxRecord{
+			hdr:  &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: mode, Size: int64(len(data))},
+			open: func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil },
+		}
+	}
+	blob := func(h v1.Hash, size int64, open func() (io.ReadCloser, error)) string {
+		name := "blobs/" + h.Algorithm + "/" + h.Hex
+		byName[name] = buildxRecord{hdr: &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0444, Size: size}, open: open}
+		byName["blobs/"+h.Algorithm+"/"] = buildxRecord{hdr: &tar.Header{Typeflag: tar.TypeDir, Name: "blobs/" + h.Algorithm + "/", Mode: 0755}}
+		return name
+	}
+	byName["blobs/"] = buildxRecord{hdr: &tar.Header{Typeflag: tar.TypeDir, Name: "blobs/", Mode: 0755}}
+	bytesBlob := func(h v1.Hash, data []byte) string {
+		return blob(h, int64(len(data)), func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil })
+	}
+
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %w", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("get manifest digest: %w", err)
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("get manifest media type: %w", err)
+	}
+	bytesBlob(digest, rawManifest)
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("get config: %w", err)
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		return nil, fmt.Errorf("get config digest: %w", err)
+	}
+	m := buildxManifest{Config: bytesBlob(configName, rawConfig)}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("get layers: %w", err)
+	}
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("get layer digest: %w", err)
+		}
+		size, err := l.Size()
+		if err != nil {
+			return nil, fmt.Errorf("get layer size: %w", err)
+		}
+		m.Layers = append(m.Layers, blob(d, size, l.Compressed))
+	}
+
+	index := buildxIndex{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	desc := buildxDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(rawManifest))}
+	for _, ref := range outRefs {
+		// Like in 'docker save' archives, only tags are names.
+		t, ok := ref.(name.Tag)
+		if !ok {
+			continue
+		}
+		named := desc
+		named.Annotations = map[string]string{
+			containerdNameAnnotation: containerdName(t),
+			refNameAnnotation:        t.TagStr(),
+		}
+		index.Manifests = append(index.Manifests, named)
+		m.RepoTags = append(m.RepoTags, familiarName(t))
+	}
+	if len(index.Manifests) == 0 {
+		index.Manifests = []buildxDescriptor{desc}
+	}
+	for _, f := range []struct {
+		name string
+		mode int64
+		v    any
+	}{
+		{"oci-layout", 0444, map[string]string{"imageLayoutVersion": "1.0.0"}},
+		{"index.json", 0644, index},
+		{"manifest.json", 0644, []buildxManifest{m}},
+	} {
+		data, err := json.Marshal(f.v)
+		if err != nil {
+			return nil, err
+		}
+		file(f.name, f.mode, data)
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	records := make([]buildxRecord, len(names))
+	for i, name := range names {
+		records[i] = byName[name]
+	}
+	return records, nil
+}
+
+// containerdName returns the name containerd gives the image t, which
+// spells Docker Hub "docker.io".
+func containerdName(t name.Tag) string {
+	registry := t.RegistryStr()
+	if registry == name.DefaultRegistry {
+		registry = "docker.io"
+	}
+	return registry + "/" + t.RepositoryStr() + ":" + t.TagStr()
+}
+
+// familiarName returns the name docker shows for the image t, like
+// "app:1.0" for "index.docker.io/library/app:1.0".
+func familiarName(t name.Tag) string {
+	if t.RegistryStr() != name.DefaultRegistry {
+		return t.RegistryStr() + "/" + t.RepositoryStr() + ":" + t.TagStr()
+	}
+	return strings.TrimPrefix(t.RepositoryStr(), "library/") + ":" + t.TagStr()
+}
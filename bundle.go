@@ -0,0 +1,417 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+)
+
+// bundleManifestName is the name of the bundle's table of contents, next
+// to the OCI layout's index.json.
+const bundleManifestName = "bundle.json"
+
+// bundleManifest describes the contents of an air-gap bundle.
+type bundleManifest struct {
+	// Image is the bundled image (or multi-platform index).
+	Image bundleImage `json:"image"`
+	// Artifacts are the image's cosign signatures, attestations and SBOMs,
+	// stored under tags derived from the image digest.
+	Artifacts []bundleArtifact `json:"artifacts,omitempty"`
+	// Files are the files attached with -file, stored under "files/".
+	Files []bundleFile `json:"files,omitempty"`
+}
+
+type bundleImage struct {
+	Name   string `json:"name,omitempty"`
+	Digest string `json:"digest"`
+}
+
+type bundleArtifact struct {
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+}
+
+type bundleFile struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// cosignSuffixes are the tag suffixes cosign uses for signatures,
+// attestations and SBOMs, as in "sha256-<hex>.sig".
+var cosignSuffixes = []string{".sig", ".att", ".sbom"}
+
+// bundleCreateFlags returns the flags of the "bundle create" subcommand,
+// and its -file values.
+func bundleCreateFlags() (*flag.FlagSet, *stringsFlag) {
+	flags := flag.NewFlagSet("bundle create", flag.ContinueOnError)
+	files := new(stringsFlag)
+	flags.Var(files, "file", "File to include in the bundle, like an SBOM, provenance statement or detached signature. Can be repeated")
+	return flags, files
+}
+
+// bundleCreateMain implements the "bundle create" subcommand.
+func bundleCreateMain(args []string) error {
+	flags, files := bundleCreateFlags()
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 2 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s bundle create [-file PATH ...] SOURCE BUNDLE", os.Args[0]))
+	}
+	defer removeTemps()
+	return createBundle(flags.Arg(0), flags.Arg(1), *files)
+}
+
+// createBundle writes the image at inputPath, its cosign artifacts if it's
+// in a registry, and files, to a tarball at bundlePath.
+func createBundle(inputPath, bundlePath string, files []string) error {
+	src, err := openSource(inputPath)
+	if err != nil {
+		return err
+	}
+	dir, err := mkdirTemp("docker-squash-bundle-*")
+	if err != nil {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return fmt.Errorf("write OCI layout: %w", err)
+	}
+
+	var bm bundleManifest
+	var annotations map[string]string
+	if len(src.Refs) > 0 {
+		bm.Image.Name = src.Refs[0].Name()
+		annotations = map[string]string{"io.containerd.image.name": bm.Image.Name}
+	}
+	var digest v1.Hash
+	if src.Index != nil {
+		digest, err = src.Index.Digest()
+		if err == nil {
+			logf("Adding image index %s", digest)
+			err = lp.AppendIndex(src.Index, layout.WithAnnotations(annotations))
+		}
+	} else {
+		digest, err = src.Image.Digest()
+		if err == nil {
+			logf("Adding image %s", digest)
+			err = lp.AppendImage(src.Image, layout.WithAnnotations(annotations))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("add image to bundle: %w", err)
+	}
+	bm.Image.Digest = digest.String()
+
+	if isRegistrySource(inputPath) {
+		repo := src.Refs[0].Context()
+		for _, suffix := range cosignSuffixes {
+			tag := strings.Replace(digest.String(), ":", "-", 1) + suffix
+			desc, err := remote.Get(repo.Tag(tag), remote.WithAuthFromKeychain(keychain), remote.WithTransport(pullTransport))
+			if isNotFound(err) {
+				continue
+			}
+			if err == nil && desc.MediaType.IsIndex() {
+				err = fmt.Errorf("%s is an index, not a cosign artifact", desc.MediaType)
+			}
+			var img v1.Image
+			if err == nil {
+				img, err = desc.Image()
+			}
+			if err == nil {
+				logf("Adding %s", repo.Tag(tag))
+				err = lp.AppendImage(img, layout.WithAnnotations(map[string]string{"org.opencontainers.image.ref.name": tag}))
+			}
+			if err != nil {
+				return fmt.Errorf("add %s to bundle: %w", repo.Tag(tag), err)
+			}
+			bm.Artifacts = append(bm.Artifacts, bundleArtifact{Tag: tag, Digest: desc.Digest.String()})
+		}
+	}
+
+	if len(files) > 0 {
+		if err := os.Mkdir(filepath.Join(dir, "files"), 0755); err != nil {
+			return err
+		}
+	}
+	seen := map[string]bool{}
+	for _, f := range files {
+		base := filepath.Base(f)
+		if seen[base] {
+			return withExitCode(exitUsage, fmt.Errorf("-file: more than one file is named %q", base))
+		}
+		seen[base] = true
+		bf, err := copyBundleFile(f, filepath.Join(dir, "files", base))
+		if err != nil {
+			return fmt.Errorf("add %q to bundle: %w", f, err)
+		}
+		logf("Adding %q", f)
+		bm.Files = append(bm.Files, *bf)
+	}
+
+	b, err := json.MarshalIndent(bm, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, bundleManifestName), append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	logf("Writing bundle to %q", bundlePath)
+	if err := tarDir(dir, bundlePath); err != nil {
+		return fmt.Errorf("write bundle to %q: %w", bundlePath, err)
+	}
+	return nil
+}
+
+// copyBundleFile copies src to dst, returning its bundle entry.
+func copyBundleFile(src, dst string) (*bundleFile, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), in)
+	if err != nil {
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	return &bundleFile{Name: filepath.Base(src), SHA256: hex.EncodeToString(h.Sum(nil)), Size: n}, nil
+}
+
+// bundleApplyFlags returns the flags of the "bundle apply" subcommand, and
+// its -files-dir.
+func bundleApplyFlags() (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("bundle apply", flag.ContinueOnError)
+	return flags, flags.String("files-dir", "", "Directory to extract the bundle's attached files to")
+}
+
+// bundleApplyMain implements the "bundle apply" subcommand.
+func bundleApplyMain(args []string) error {
+	flags, filesDir := bundleApplyFlags()
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 2 || !isRegistryDest(flags.Arg(1)) {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s bundle apply [-files-dir DIR] BUNDLE docker://DEST", os.Args[0]))
+	}
+	defer removeTemps()
+	return applyBundle(flags.Arg(0), flags.Arg(1), *filesDir)
+}
+
+// applyBundle verifies the bundle at bundlePath, then pushes its image to
+// outputPath and its cosign artifacts to the same repository. Attached
+// files are copied to filesDir, if set.
+func applyBundle(bundlePath, outputPath, filesDir string) error {
+	ref, err := parseRegistryDest(outputPath)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if err := checkPushPermission(ref); err != nil {
+		return err
+	}
+	dir, err := mkdirTemp("docker-squash-bundle-*")
+	if err != nil {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+	logf("Unpacking bundle %q", bundlePath)
+	if err := untarDir(bundlePath, dir); err != nil {
+		return fmt.Errorf("unpack bundle %q: %w", bundlePath, err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, bundleManifestName))
+	if err != nil {
+		return fmt.Errorf("read bundle manifest: %w", err)
+	}
+	var bm bundleManifest
+	if err := json.Unmarshal(b, &bm); err != nil {
+		return fmt.Errorf("read bundle manifest: %w", err)
+	}
+
+	logf("Verifying bundle contents")
+	for _, f := range bm.Files {
+		if err := verifyBundleFile(dir, f); err != nil {
+			return withExitCode(exitVerification, err)
+		}
+	}
+	lp, err := layout.FromPath(dir)
+	if err != nil {
+		return fmt.Errorf("read bundle OCI layout: %w", err)
+	}
+	idx, err := lp.ImageIndex()
+	if err != nil {
+		return fmt.Errorf("read bundle OCI layout: %w", err)
+	}
+	digest, err := v1.NewHash(bm.Image.Digest)
+	if err != nil {
+		return fmt.Errorf("read bundle manifest: %w", err)
+	}
+	isIndex, err := bundleEntryIsIndex(idx, digest)
+	if err != nil {
+		return err
+	}
+	var push func() error
+	if isIndex {
+		imgIdx, err := idx.ImageIndex(digest)
+		if err == nil {
+			err = validate.Index(imgIdx)
+		}
+		if err != nil {
+			return withExitCode(exitVerification, fmt.Errorf("verify bundled image index %s: %w", digest, err))
+		}
+		push = func() error { return pushIndex(ref, imgIdx) }
+	} else {
+		img, err := idx.Image(digest)
+		if err == nil {
+			err = validate.Image(img)
+		}
+		if err != nil {
+			return withExitCode(exitVerification, fmt.Errorf("verify bundled image %s: %w", digest, err))
+		}
+		push = func() error { return pushImage(ref, img) }
+	}
+	artifacts := make([]v1.Image, len(bm.Artifacts))
+	for i, a := range bm.Artifacts {
+		h, err := v1.NewHash(a.Digest)
+		if err == nil {
+			artifacts[i], err = idx.Image(h)
+		}
+		if err == nil {
+			err = validate.Image(artifacts[i])
+		}
+		if err != nil {
+			return withExitCode(exitVerification, fmt.Errorf("verify bundled %s: %w", a.Tag, err))
+		}
+	}
+
+	if err := push(); err != nil {
+		return err
+	}
+	for i, a := range bm.Artifacts {
+		if err := pushImage(ref.Context().Tag(a.Tag), artifacts[i]); err != nil {
+			return err
+		}
+	}
+	if filesDir != "" && len(bm.Files) > 0 {
+		if err := os.MkdirAll(filesDir, 0755); err != nil {
+			return err
+		}
+		for _, f := range bm.Files {
+			if _, err := copyBundleFile(filepath.Join(dir, "files", f.Name), filepath.Join(filesDir, f.Name)); err != nil {
+				return fmt.Errorf("extract %q: %w", f.Name, err)
+			}
+		}
+		logf("Extracted %d files to %q", len(bm.Files), filesDir)
+	}
+	return nil
+}
+
+// bundleEntryIsIndex returns whether the manifest with the given digest in
+// the bundle's index.json is an image index.
+func bundleEntryIsIndex(idx v1.ImageIndex, digest v1.Hash) (bool, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return false, fmt.Errorf("read bundle OCI layout: %w", err)
+	}
+	for _, desc := range im.Manifests {
+		if desc.Digest == digest {
+			return desc.MediaType.IsIndex(), nil
+		}
+	}
+	return false, withExitCode(exitVerification, fmt.Errorf("bundle has no manifest %s", digest))
+}
+
+func verifyBundleFile(dir string, f bundleFile) error {
+	if f.Name != filepath.Base(f.Name) || f.Name == "." || f.Name == ".." {
+		return fmt.Errorf("invalid bundled file name %q", f.Name)
+	}
+	in, err := os.Open(filepath.Join(dir, "files", f.Name))
+	if err != nil {
+		return fmt.Errorf("bundled file %q: %w", f.Name, err)
+	}
+	defer in.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, in); err != nil {
+		return fmt.Errorf("bundled file %q: %w", f.Name, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != f.SHA256 {
+		return fmt.Errorf("bundled file %q has sha256 %s, expected %s", f.Name, got, f.SHA256)
+	}
+	return nil
+}
+
+// untarDir extracts the regular files and directories of the tarball at
+// tarPath into dir, refusing entries that would land outside it.
+func untarDir(tarPath, dir string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid entry %q", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.Create(target)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected entry %q of type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// nonContentFlags are flags that don't affect the contents of the squashed
+// image, and so are not part of the result cache key.
+var nonContentFlags = map[string]bool{
+	"also-output":        true,
+	"archive-mtime":      true,
+	"archive-owner":      true,
+	"buildx-compat":      true,
+	"cache-dir":          true,
+	"cache-max-size":     true,
+	"cpu-limit":          true,
+	"cred-helper":        true,
+	"decryption-key":     true,
+	"dns":                true,
+	"docker-config":      true,
+	"encrypt-recipient":  true,
+	"encrypt-tmp":        true,
+	"encryption-key":     true,
+	"estimate":           true,
+	"fail-on":            true,
+	"force-push":         true,
+	"json":               true,
+	"keep-source-tags":   true,
+	"keep-loaded":        true,
+	"licenses-output":    true,
+	"load-check":         true,
+	"low-priority":       true,
+	"max-layers":         true,
+	"max-metadata-size":  true,
+	"metadata-ttl":       true,
+	"no-github-token":    true,
+	"notify-cmd":         true,
+	"notify-webhook":     true,
+	"output-mode":        true,
+	"output-owner":       true,
+	"preallocate":        true,
+	"print-exit-codes":   true,
+	"provenance-map":     true,
+	"quiet":              true,
+	"report-packages":    true,
+	"resolve":            true,
+	"resume":             true,
+	"scan":               true,
+	"scan-report":        true,
+	"severity-threshold": true,
+	"size-budget":        true,
+	"tag":                true,
+	"tmp-prefix":         true,
+	"trust-policy":       true,
+	"verify-output":      true,
+	"version":            true,
+	"warn-on":            true,
+	"yes":                true,
+}
+
+// fileFlags are flags whose values are paths to files that affect the
+// squashed image, so the file contents are part of the cache key.
+var fileFlags = map[string]bool{
+	"apply":         true,
+	"exclude-rules": true,
+	"layer-map":     true,
+}
+
+// templateFlags are flags whose values are -label style templates. They're
+// part of the key as rendered, without the creation time, so that a change
+// in an environment variable they use isn't hidden by the cache.
+var templateFlags = map[string]*stringsFlag{
+	"annotation": &addAnnotations,
+	"label":      &addLabels,
+}
+
+// resultCacheKey returns the result cache key for squashing the source
+// image with the given digest using the current flags. Any extra inputs
+// that affect the result, like the digests of other images referenced by
+// flags, are also included in the key.
+func resultCacheKey(srcDigest v1.Hash, extra ...string) (string, error) {
+	opts := map[string]string{}
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if nonContentFlags[f.Name] || err != nil {
+			return
+		}
+		value := f.Value.String()
+		if fileFlags[f.Name] && value != "" {
+			var b []byte
+			b, err = os.ReadFile(value)
+			sum := sha256.Sum256(b)
+			value = hex.EncodeToString(sum[:])
+		}
+		if values := templateFlags[f.Name]; values != nil {
+			var rendered map[string]string
+			rendered, err = renderMetadata(nil, f.Name, *values, metadataVars{SourceDigest: srcDigest.String()})
+			value = fmt.Sprint(rendered)
+		}
+		opts[f.Name] = value
+	})
+	if err != nil {
+		return "", err
+	}
+	// With -created or -reproducible (and $SOURCE_DATE_EPOCH), the creation
+	// time is an input, and is set in the config and annotations and clamps
+	// mtimes. Otherwise it's the time of the squash, and a cached result
+	// keeps its own.
+	var created string
+	if *createdFlag != "" || *reproducible {
+		t, err := outputCreated()
+		if err != nil {
+			return "", err
+		}
+		created = t.UTC().Format(time.RFC3339Nano)
+	}
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := struct {
+		Source  string
+		Options [][2]string
+		Created string   `json:",omitempty"`
+		Extra   []string `json:",omitempty"`
+	}{Source: srcDigest.String(), Created: created, Extra: extra}
+	for _, name := range names {
+		key.Options = append(key.Options, [2]string{name, opts[name]})
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// resultCache stores squashed images as OCI layouts, keyed by
+// resultCacheKey.
+//
+// The cache may be shared by concurrent processes. Each entry has a lock
+// file which is held by a process while it reads, computes or writes that
+// entry, and by the pruner while it deletes the entry.
+type resultCache struct {
+	dir string
+}
+
+func (c *resultCache) path(key string) string {
+	return filepath.Join(c.dir, "results", key)
+}
+
+func (c *resultCache) lockPath(key string) string {
+	return filepath.Join(c.dir, "locks", key+".lock")
+}
+
+// Lock takes the lock for the cache entry with the given key, waiting for
+// any other process that is currently computing or using the same entry.
+func (c *resultCache) Lock(key string) (*fileLock, error) {
+	return acquireLock(c.lockPath(key), func() {
+		logf("Waiting for another docker-squash process using cache entry %s", key)
+	})
+}
+
+// Get returns the cached result for key, or nil if there is none. The
+// caller must hold the entry's lock.
+func (c *resultCache) Get(key string) (v1.Image, error) {
+	p, err := layout.FromPath(c.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Manifests) != 1 {
+		return nil, fmt.Errorf("cache entry %s: expected 1 image, got %d", key, len(m.Manifests))
+	}
+	if err := c.touch(key); err != nil {
+		return nil, err
+	}
+	return p.Image(m.Manifests[0].Digest)
+}
+
+// Put stores img as the result for key, and returns the stored image, which
+// should be used in place of img to avoid recomputing layer contents. The
+// caller must hold the entry's lock.
+func (c *resultCache) Put(key string, img v1.Image) (v1.Image, error) {
+	if err := os.MkdirAll(filepath.Join(c.dir, "results"), 0755); err != nil {
+		return nil, err
+	}
+	// Write to a temp dir and rename into place, so that an interrupted
+	// write never leaves behind a partial entry.
+	tmp, err := os.MkdirTemp(filepath.Join(c.dir, "results"), ".tmp-"+key+"-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	p, err := layout.Write(tmp, empty.Index)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.AppendImage(img); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, c.path(key)); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	return c.Get(key)
+}
+
+// touch marks the cache entry for key as recently used, for LRU eviction.
+func (c *resultCache) touch(key string) error {
+	now := time.Now()
+	return os.Chtimes(c.path(key), now, now)
+}
+
+type cacheEntry struct {
+	key      string
+	size     int64
+	lastUsed time.Time
+}
+
+// entries returns all complete cache entries, least recently used first.
+func (c *resultCache) entries() ([]cacheEntry, error) {
+	des, err := os.ReadDir(filepath.Join(c.dir, "results"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []cacheEntry
+	for _, de := range des {
+		if !de.IsDir() || strings.HasPrefix(de.Name(), ".") {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+		size, err := dirSize(c.path(de.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, cacheEntry{key: de.Name(), size: size, lastUsed: info.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUsed.Before(entries[j].lastUsed) })
+	return entries, nil
+}
+
+// Prune evicts least recently used entries until the total cache size is
+// at most maxSize bytes, and returns the number of bytes freed. Entries
+// listed in keep, and entries currently locked by other processes, are
+// never evicted.
+func (c *resultCache) Prune(maxSize int64, keep ...string) (int64, error) {
+	if err := c.removeStaleTemps(keep); err != nil {
+		return 0, err
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	var freed int64
+	for _, e := range entries {
+		if total <= maxSize {
+			break
+		}
+		if slices.Contains(keep, e.key) {
+			continue
+		}
+		lock, err := tryAcquireLock(c.lockPath(e.key))
+		if err == errLocked {
+			continue
+		}
+		if err != nil {
+			return freed, err
+		}
+		err = os.RemoveAll(c.path(e.key))
+		if rerr := c.release(e.key, lock); err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return freed, err
+		}
+		total -= e.size
+		freed += e.size
+	}
+	return freed, nil
+}
+
+// removeStaleTemps removes partially written entries left behind by
+// processes that were killed while writing to the cache.
+func (c *resultCache) removeStaleTemps(keep []string) error {
+	des, err := os.ReadDir(filepath.Join(c.dir, "results"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, de := range des {
+		// Temp dirs are named ".tmp-$KEY-$RANDOM".
+		rest, ok := strings.CutPrefix(de.Name(), ".tmp-")
+		if !ok {
+			continue
+		}
+		key, _, _ := strings.Cut(rest, "-")
+		if slices.Contains(keep, key) {
+			continue
+		}
+		lock, err := tryAcquireLock(c.lockPath(key))
+		if err == errLocked {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = os.RemoveAll(filepath.Join(c.dir, "results", de.Name()))
+		if rerr := c.release(key, lock); err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRuns removes the -resume state of squashes that didn't finish,
+// other than those in progress, and returns the number of bytes freed.
+func (c *resultCache) removeRuns() (int64, error) {
+	des, err := os.ReadDir(filepath.Join(c.dir, "runs"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var freed int64
+	for _, de := range des {
+		lock, err := tryAcquireLock(c.lockPath(de.Name()))
+		if err == errLocked {
+			continue
+		}
+		if err != nil {
+			return freed, err
+		}
+		size, err := dirSize(c.runPath(de.Name()))
+		if err == nil {
+			err = os.RemoveAll(c.runPath(de.Name()))
+		}
+		if rerr := c.release(de.Name(), lock); err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return freed, err
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+// release releases the lock of the entry for key, which the caller has
+// just removed all or part of, and removes the lock file if there's nothing
+// left for it to guard.
+func (c *resultCache) release(key string, lock *fileLock) error {
+	for _, p := range []string{c.path(key), c.runPath(key)} {
+		if _, err := os.Stat(p); err == nil {
+			return lock.Unlock()
+		}
+	}
+	return lock.Remove()
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// cachePruneOptions are the flags of the "cache prune" subcommand.
+type cachePruneOptions struct {
+	dir, maxSize *string
+}
+
+// cachePruneFlags returns the flags of the "cache prune" subcommand.
+func cachePruneFlags() (*flag.FlagSet, cachePruneOptions) {
+	flags := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+	return flags, cachePruneOptions{
+		dir:     flags.String("cache-dir", *cacheDir, "Cache directory to prune"),
+		maxSize: flags.String("max-size", "0", `Keep the most recently used entries up to this total size, like "10GB". By default, all entries are removed`),
+	}
+}
+
+// cachePruneMain implements the "cache prune" subcommand.
+func cachePruneMain(args []string) error {
+	flags, opts := cachePruneFlags()
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if *opts.dir == "" {
+		return fmt.Errorf("no cache directory specified (pass -cache-dir or set DOCKER_SQUASH_CACHE_DIR)")
+	}
+	max, err := humanize.ParseBytes(*opts.maxSize)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("invalid -max-size: %w", err))
+	}
+	c := &resultCache{dir: *opts.dir}
+	freed, err := c.Prune(int64(max))
+	if err != nil {
+		return err
+	}
+	// Cached registry metadata is small and cheap to fetch again, so it's
+	// always removed.
+	metadata := filepath.Join(*opts.dir, "metadata")
+	if size, err := dirSize(metadata); err == nil {
+		if err := os.RemoveAll(metadata); err != nil {
+			return err
+		}
+		freed += size
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	runs, err := c.removeRuns()
+	if err != nil {
+		return err
+	}
+	freed += runs
+	fmt.Printf("Freed %s\n", humanize.Bytes(uint64(freed)))
+	return nil
+}
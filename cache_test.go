@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestResultCacheKeyCreated(t *testing.T) {
+	src := v1.Hash{Algorithm: "sha256", Hex: "0000000000000000000000000000000000000000000000000000000000000000"}
+	key := func(epoch string) string {
+		t.Helper()
+		t.Setenv("SOURCE_DATE_EPOCH", epoch)
+		k, err := resultCacheKey(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	// The time of the squash isn't an input.
+	if key("1700000000") != key("1800000000") {
+		t.Error("without -reproducible, $SOURCE_DATE_EPOCH changed the cache key")
+	}
+	*reproducible = true
+	t.Cleanup(func() { *reproducible = false })
+	if key("1700000000") == key("1800000000") {
+		t.Error("with -reproducible, a different $SOURCE_DATE_EPOCH gave the same cache key")
+	}
+	if key("1700000000") != key("1700000000") {
+		t.Error("with -reproducible, the same $SOURCE_DATE_EPOCH gave different cache keys")
+	}
+}
+
+func TestInvalidCacheMaxSize(t *testing.T) {
+	// Rejected before anything is pulled, or squashed only to fail when
+	// pruning.
+	out, err := runSquash(t, "-cache-max-size", "20 gigs", "docker://localhost:1/test:source", "docker://localhost:1/test:squashed")
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != exitUsage {
+		t.Fatalf("got %v, want exit status %d\n%s", err, exitUsage, out)
+	}
+}
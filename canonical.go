@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseOwner parses a "UID:GID" owner.
+func parseOwner(s string) (uid, gid int, err error) {
+	u, g, ok := strings.Cut(s, ":")
+	if ok {
+		uid, err = strconv.Atoi(u)
+	}
+	if ok && err == nil {
+		gid, err = strconv.Atoi(g)
+	}
+	if !ok || err != nil || uid < 0 || gid < 0 {
+		return 0, 0, fmt.Errorf("invalid owner %q (expected UID:GID)", s)
+	}
+	return uid, gid, nil
+}
+
+// canonicalEntry is a tar entry whose content was spooled to a temp file.
+type canonicalEntry struct {
+	hdr    *tar.Header
+	name   string
+	offset int64
+}
+
+// canonicalizeTar returns a canonical rewrite of the tar stream r, as
+// described by -canonical-tar. r is read to the end (and its content
+// spooled to a temp file) before anything is returned, since the entries
+// must be sorted.
+func canonicalizeTar(r io.Reader) (io.ReadCloser, error) {
+	uid, gid := -1, -1
+	if *canonicalOwner != "" {
+		var err error
+		if uid, gid, err = parseOwner(*canonicalOwner); err != nil {
+			return nil, err
+		}
+	}
+	spool, err := createTemp("docker-squash-canonical-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	w := tempWriter(spool)
+	var entries []*canonicalEntry
+	byName := map[string]*canonicalEntry{}
+	var offset int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read squashed rootfs: %w", err)
+		}
+		name := cleanTarPath(hdr.Name)
+		if name == "" {
+			continue
+		}
+		n, err := io.Copy(w, tr)
+		if err != nil {
+			return nil, fmt.Errorf("spool squashed rootfs: %w", err)
+		}
+		e := &canonicalEntry{hdr: canonicalHeader(hdr, uid, gid), name: name, offset: offset}
+		offset += n
+		entries = append(entries, e)
+		byName[name] = e
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	relinkHardlinks(entries, byName)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeCanonical(pw, spool, entries))
+	}()
+	return pr, nil
+}
+
+// canonicalHeader returns the normalized form of hdr. If uid and gid are
+// non-negative, they replace the entry's owner.
+func canonicalHeader(hdr *tar.Header, uid, gid int) *tar.Header {
+	c := &tar.Header{
+		Typeflag: hdr.Typeflag,
+		Name:     cleanTarPath(hdr.Name),
+		Linkname: hdr.Linkname,
+		Size:     hdr.Size,
+		Mode:     hdr.Mode,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		ModTime:  hdr.ModTime.Truncate(time.Second),
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		c.Name += "/"
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		c.Linkname = cleanTarPath(hdr.Linkname)
+	}
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		c.Devmajor, c.Devminor = hdr.Devmajor, hdr.Devminor
+	}
+	if uid >= 0 {
+		c.Uid, c.Gid = uid, gid
+	}
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "SCHILY.xattr.") {
+			if c.PAXRecords == nil {
+				c.PAXRecords = map[string]string{}
+			}
+			c.PAXRecords[k] = v
+		}
+	}
+	return c
+}
+
+// relinkHardlinks makes the first of each set of hardlinked entries, in
+// sorted order, the one holding the content, so that links never precede
+// their target and the result doesn't depend on the input's order.
+func relinkHardlinks(sorted []*canonicalEntry, byName map[string]*canonicalEntry) {
+	first := map[string]*canonicalEntry{}
+	for _, e := range sorted {
+		if e.hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+		target := e.hdr.Linkname
+		f, ok := first[target]
+		if !ok {
+			t, ok := byName[target]
+			if !ok || t.hdr.Typeflag == tar.TypeLink {
+				continue
+			}
+			f = t
+			if e.name < t.name {
+				// Move the content to this entry, and link the target to it.
+				e.hdr.Typeflag, e.hdr.Linkname, e.hdr.Size = t.hdr.Typeflag, "", t.hdr.Size
+				e.offset = t.offset
+				t.hdr.Typeflag, t.hdr.Linkname, t.hdr.Size = tar.TypeLink, e.name, 0
+				f = e
+			}
+			first[target] = f
+		}
+		if e != f {
+			e.hdr.Linkname = f.name
+		}
+	}
+}
+
+func writeCanonical(w io.Writer, spool *os.File, entries []*canonicalEntry) error {
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			return err
+		}
+		if e.hdr.Size > 0 {
+			if _, err := io.Copy(tw, io.NewSectionReader(tempReaderAt(spool), e.offset, e.hdr.Size)); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// flagValues are the values of flags that take one of a few, for
+// completion.
+var flagValues = map[string][]string{
+	"compressor":  {"gzip", "pgzip", "zstd", "none", "exec:"},
+	"format":      {"docker", "oci", "wsl"},
+	"load-check":  {"docker", "containerd"},
+	"media-types": {"auto", "docker", "oci"},
+	"profile":     {"lambda"},
+	"run-runtime": {"chroot", "runc", "crun"},
+}
+
+// completionMain implements the completion subcommand, which prints a
+// completion script for a shell. The scripts get their candidates by
+// running "docker-squash __complete", so that they follow the flags and
+// the cache of the installed binary.
+func completionMain(args []string) error {
+	if len(args) != 1 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s completion bash|zsh|fish|powershell", os.Args[0]))
+	}
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		return withExitCode(exitUsage, fmt.Errorf("unsupported shell %q (expected bash, zsh, fish or powershell)", args[0]))
+	}
+	fmt.Print(script)
+	return nil
+}
+
+// completeMain implements the hidden __complete subcommand that completion
+// scripts run as "__complete CWORD ARG...", where ARG[CWORD], or "" if
+// there are only CWORD args, is the word being completed. It prints the
+// candidates for that word, one per line, and nothing if the shell should
+// complete file names instead. CWORD is passed, rather than the word, since
+// not every shell can pass an empty argument.
+func completeMain(args []string) error {
+	if len(args) == 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s __complete CWORD ARG...", os.Args[0]))
+	}
+	cword, err := strconv.Atoi(args[0])
+	if err != nil || cword < 0 || cword > len(args)-1 {
+		return withExitCode(exitUsage, fmt.Errorf("invalid CWORD %q", args[0]))
+	}
+	words := args[1:]
+	cur := ""
+	if cword < len(words) {
+		cur = words[cword]
+	}
+	for _, c := range completions(words[:cword], cur) {
+		fmt.Println(c)
+	}
+	return nil
+}
+
+// completions returns the candidates for the word cur, which follows the
+// words prev.
+func completions(prev []string, cur string) []string {
+	var candidates []string
+	switch {
+	case strings.HasPrefix(cur, "-"):
+		if name, _, ok := strings.Cut(strings.TrimLeft(cur, "-"), "="); ok {
+			prefix := cur[:strings.Index(cur, "=")+1]
+			for _, v := range flagValueCandidates(name, cur[len(prefix):]) {
+				candidates = append(candidates, prefix+v)
+			}
+			return candidates
+		}
+		dashes := "-"
+		if strings.HasPrefix(cur, "--") {
+			dashes = "--"
+		}
+		flag.VisitAll(func(f *flag.Flag) {
+			candidates = append(candidates, dashes+f.Name)
+		})
+	case len(prev) > 0 && takesValue(prev[len(prev)-1]):
+		return flagValueCandidates(strings.TrimLeft(prev[len(prev)-1], "-"), cur)
+	default:
+		if len(prev) == 0 {
+			candidates = append(candidates, commandNames()...)
+		}
+		candidates = append(candidates, "docker://")
+		candidates = append(candidates, cachedRefs(completionCacheDir(prev))...)
+	}
+	return filterPrefix(candidates, cur)
+}
+
+// takesValue returns whether arg is a flag followed by its value, like
+// "-format" but not "-quiet" or "-format=oci".
+func takesValue(arg string) bool {
+	name := strings.TrimLeft(arg, "-")
+	if !strings.HasPrefix(arg, "-") || strings.Contains(name, "=") {
+		return false
+	}
+	f := flag.Lookup(name)
+	if f == nil {
+		return false
+	}
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return !ok || !b.IsBoolFlag()
+}
+
+// flagValueCandidates returns the candidates for the value cur of the flag
+// name, or none to complete file names.
+func flagValueCandidates(name, cur string) []string {
+	if name == "optimize" {
+		// A comma-separated list, of which cur's last element is completed.
+		prefix := cur[:strings.LastIndex(cur, ",")+1]
+		values := []string{prefix + "all"}
+		for _, o := range optimizers {
+			values = append(values, prefix+o.Name, prefix+"-"+o.Name)
+		}
+		return filterPrefix(values, cur)
+	}
+	return filterPrefix(flagValues[name], cur)
+}
+
+func filterPrefix(candidates []string, prefix string) []string {
+	var matched []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) && !slices.Contains(matched, c) {
+			matched = append(matched, c)
+		}
+	}
+	return matched
+}
+
+// completionCacheDir returns the -cache-dir given in args, or else its
+// default.
+func completionCacheDir(args []string) string {
+	dir := *cacheDir
+	for i, arg := range args {
+		name, value, ok := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "cache-dir" || !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if ok {
+			dir = value
+		} else if i+1 < len(args) {
+			dir = args[i+1]
+		}
+	}
+	return dir
+}
+
+// cachedRefs returns the "docker://" refs of the manifests in the metadata
+// cache of dir, sorted, for completing SOURCE.
+func cachedRefs(dir string) []string {
+	if dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "metadata", "*.json"))
+	if err != nil {
+		return nil
+	}
+	var refs []string
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var e metadataEntry
+		if json.Unmarshal(b, &e) != nil || e.Ref == "" {
+			continue
+		}
+		ref := e.Ref
+		if host, repo, _ := strings.Cut(ref, "/"); isDockerHub(host) {
+			ref = strings.TrimPrefix(repo, "library/")
+		}
+		refs = append(refs, "docker://"+ref)
+	}
+	slices.Sort(refs)
+	return slices.Compact(refs)
+}
+
+// completionScripts are the completion scripts of each shell.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for docker-squash. Load it with:
+#   source <(docker-squash completion bash)
+_docker_squash() {
+	local line=${COMP_LINE:0:COMP_POINT} words cur=
+	read -ra words <<<"$line"
+	local cword=$((${#words[@]} - 1))
+	if [[ $line != *[[:space:]] ]]; then
+		cur=${words[cword]}
+		cword=$((cword - 1))
+	fi
+	local IFS=$'\n'
+	COMPREPLY=($("${words[0]}" __complete "$cword" "${words[@]:1}" 2>/dev/null))
+	# bash replaces only the text after the last ":" or "=" of the word.
+	local prefix=${cur%"${cur##*[:=]}"}
+	COMPREPLY=("${COMPREPLY[@]#"$prefix"}")
+	if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == *[/:=] ]]; then
+		compopt -o nospace
+	fi
+}
+complete -o default -F _docker_squash docker-squash
+`,
+	"zsh": `#compdef docker-squash
+# zsh completion for docker-squash. Load it with:
+#   source <(docker-squash completion zsh)
+_docker_squash() {
+	local out c
+	out=$("${words[1]}" __complete $((CURRENT - 2)) "${(@)words[2,CURRENT-1]}" "$PREFIX" 2>/dev/null)
+	if [[ -z $out ]]; then
+		_files
+		return
+	fi
+	for c in "${(@f)out}"; do
+		if [[ $c == *[/:=] ]]; then
+			compadd -Q -S '' -- "$c"
+		else
+			compadd -Q -- "$c"
+		fi
+	done
+}
+compdef _docker_squash docker-squash
+`,
+	"fish": `# fish completion for docker-squash. Load it with:
+#   docker-squash completion fish | source
+function __docker_squash_complete
+	set -l args (commandline -opc)
+	set -l cmd $args[1]
+	set -e args[1]
+	$cmd __complete (count $args) $args (commandline -ct) 2>/dev/null
+end
+complete -c docker-squash -a '(__docker_squash_complete)'
+`,
+	"powershell": `# PowerShell completion for docker-squash. Load it with:
+#   docker-squash completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName docker-squash, docker-squash.exe -ScriptBlock {
+	param($wordToComplete, $commandAst, $cursorPosition)
+	$words = @($commandAst.CommandElements | Select-Object -Skip 1 |
+		Where-Object { $_.Extent.StartOffset -lt $cursorPosition } |
+		ForEach-Object { $_.Extent.Text })
+	$cword = $words.Count
+	if ($wordToComplete) { $cword-- }
+	& $commandAst.CommandElements[0].Extent.Text __complete $cword @words 2>$null | ForEach-Object {
+		[System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+	}
+}
+`,
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/mattn/go-isatty"
+)
+
+// canPrompt returns whether confirmation prompts can be answered, which
+// needs a terminal on stdin. Without one, as in CI or with a piped stdin,
+// nothing is asked and destructive actions go ahead as they always did.
+func canPrompt() bool {
+	fd := os.Stdin.Fd()
+	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
+}
+
+// confirm asks question on stderr and returns whether the answer was yes.
+// Anything else, including just pressing enter, is no.
+func confirm(question string) (bool, error) {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("read answer: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// confirmOverwrite asks before replacing what's already at dest: an
+// existing local file, or, for the registry reference ref, an existing tag
+// (unless -force-push). It returns an error if the answer is no. With -yes,
+// or when there's no terminal to ask, it doesn't ask.
+func confirmOverwrite(dest string, ref name.Reference) error {
+	if *assumeYes {
+		return nil
+	}
+	question, skip := "", "-yes"
+	if ref == nil {
+		// Writing to a directory fails, and to a pipe or device replaces
+		// nothing.
+		info, err := os.Stat(dest)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		question = fmt.Sprintf("%s already exists. Overwrite it?", dest)
+	} else {
+		tag, ok := ref.(name.Tag)
+		if !ok || *forcePush {
+			return nil
+		}
+		desc, err := remote.Head(tag, remote.WithAuthFromKeychain(keychain))
+		if err != nil {
+			var terr *transport.Error
+			if !errors.As(err, &terr) || terr.StatusCode != http.StatusNotFound {
+				// Not worth failing over; pushing will surface real problems.
+				logf("Warning: check for existing tag %s: %v", tag, err)
+			}
+			return nil
+		}
+		if !canPrompt() {
+			logf("%s already exists (%s) and will be replaced", tag, desc.Digest)
+			return nil
+		}
+		question, skip = fmt.Sprintf("%s already exists (%s). Push over it?", tag, desc.Digest), "-force-push"
+	}
+	if !canPrompt() {
+		return nil
+	}
+	ok, err := confirm(question)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("not replacing %s (use %s to skip this question)", dest, skip)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"sort"
+)
+
+// pathConflicts records the paths that layers give different types, like a
+// directory in one layer and a symlink in a layer above it without a
+// whiteout in between. The upper one wins, hiding what's below, which
+// usually means a broken Dockerfile, like a COPY over a directory that a
+// base image made a symlink. Its methods do nothing on a nil
+// *pathConflicts.
+type pathConflicts struct {
+	// provider maps paths to the layer that provided them, and its type.
+	provider map[string]layerEntry
+	// whiteouts maps whited out paths to the highest layer that whites
+	// them out.
+	whiteouts map[string]int
+	found     []string
+}
+
+type layerEntry struct {
+	layer int
+	kind  string
+}
+
+func newPathConflicts() *pathConflicts {
+	return &pathConflicts{provider: map[string]layerEntry{}, whiteouts: map[string]int{}}
+}
+
+// entryKind returns the kind of path that hdr is, for comparing types.
+func entryKind(hdr *tar.Header) string {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return "directory"
+	case tar.TypeSymlink:
+		return "symlink"
+	default:
+		return "file"
+	}
+}
+
+// provided records that layer provides hdr as name in the flattened
+// filesystem.
+func (c *pathConflicts) provided(name string, layer int, hdr *tar.Header) {
+	if c == nil {
+		return
+	}
+	c.provider[name] = layerEntry{layer, entryKind(hdr)}
+}
+
+// whiteout records that layer whites out name.
+func (c *pathConflicts) whiteout(name string, layer int) {
+	if c == nil {
+		return
+	}
+	if _, ok := c.whiteouts[name]; !ok {
+		c.whiteouts[name] = layer
+	}
+}
+
+// hidden records that layer has hdr as name, which a layer above hides.
+func (c *pathConflicts) hidden(name string, layer int, hdr *tar.Header) {
+	if c == nil {
+		return
+	}
+	upper, ok := c.provider[name]
+	if !ok || upper.layer == layer || upper.kind == entryKind(hdr) {
+		return
+	}
+	// Replacing a path is fine if it was removed first.
+	if w, ok := c.whiteouts[name]; ok && w > layer {
+		return
+	}
+	c.found = append(c.found, fmt.Sprintf("%s: %s in layer %d hides %s in layer %d", name, upper.kind, upper.layer, entryKind(hdr), layer))
+	// Only the nearest conflict is reported.
+	delete(c.provider, name)
+}
+
+// report warns about the conflicts found, or fails with -fail-on-conflicts.
+func (c *pathConflicts) report() error {
+	if c == nil || len(c.found) == 0 {
+		return nil
+	}
+	sort.Strings(c.found)
+	msg := fmt.Sprintf("%d paths have conflicting types across layers, which usually means a broken Dockerfile:", len(c.found))
+	for i, f := range c.found {
+		if i == maxPolicyDetails {
+			msg += fmt.Sprintf("\n  ... and %d more", len(c.found)-i)
+			break
+		}
+		msg += "\n  " + f
+	}
+	if *failOnConflicts {
+		return withExitCode(exitVerification, fmt.Errorf("-fail-on-conflicts: %s", msg))
+	}
+	logf("Warning: %s", msg)
+	return nil
+}
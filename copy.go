@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// squashOnlyFlags are flags that change or check the squashed image, and
+// so make no sense with -no-squash.
+var squashOnlyFlags = map[string]bool{
+	"annotation":           true,
+	"apply":                true,
+	"audit-permissions":    true,
+	"audit-symlinks":       true,
+	"auto-exclude-largest": true,
+	"canonical-owner":      true,
+	"canonical-tar":        true,
+	"compressor":           true,
+	"created":              true,
+	"decryption-key":       true,
+	"drop-annotation":      true,
+	"drop-labels":          true,
+	"encrypt-recipient":    true,
+	"encryption-key":       true,
+	"enforce-owner":        true,
+	"estimate":             true,
+	"exclude-rules":        true,
+	"fail-on":              true,
+	"fail-on-conflicts":    true,
+	"filter":               true,
+	"fix-owner":            true,
+	"keep-foreign-layers":  true,
+	"label":                true,
+	"layer-map":            true,
+	"licenses-output":      true,
+	"no-source-labels":     true,
+	"numeric-owner":        true,
+	"optimize":             true,
+	"override-arch":        true,
+	"override-os":          true,
+	"preserve-labels":      true,
+	"previous":             true,
+	"profile":              true,
+	"provenance-map":       true,
+	"recompress":           true,
+	"report-packages":      true,
+	"resume":               true,
+	"reproducible":         true,
+	"run":                  true,
+	"scan":                 true,
+	"target-size":          true,
+	"warn-on":              true,
+}
+
+// checkNoSquashFlags returns an error naming the flags that can't be used
+// with -no-squash.
+func checkNoSquashFlags() error {
+	var bad []string
+	flag.Visit(func(f *flag.Flag) {
+		if squashOnlyFlags[f.Name] {
+			bad = append(bad, "-"+f.Name)
+		}
+	})
+	if *format == "wsl" {
+		bad = append(bad, "-format=wsl")
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	sort.Strings(bad)
+	return fmt.Errorf("%s can't be used with -no-squash, which copies SOURCE unchanged", strings.Join(bad, ", "))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// rootfsIndex maps each path in a flattened rootfs to a signature of its
+// contents and metadata.
+type rootfsIndex map[string]string
+
+// indexRootfs reads a flattened rootfs tarball and computes the signature
+// of every entry. Modification times are deliberately not part of the
+// signature, since rebuilt images typically touch every file without
+// changing it.
+func indexRootfs(r io.Reader) (rootfsIndex, error) {
+	idx := rootfsIndex{}
+	contents := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return idx, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := cleanTarPath(hdr.Name)
+		if name == "" {
+			continue
+		}
+		sig := *hdr
+		var content string
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, err
+			}
+			content = hex.EncodeToString(h.Sum(nil))
+			contents[name] = content
+		case tar.TypeLink:
+			// Which of a set of hardlinked paths is stored as the regular
+			// file depends on archive order, so compare hardlinks as
+			// regular files with their target's content.
+			content = contents[cleanTarPath(hdr.Linkname)]
+			contents[name] = content
+			sig.Typeflag = tar.TypeReg
+			sig.Linkname = ""
+		case tar.TypeSymlink:
+			// Symlink permissions are meaningless on Linux and vary
+			// between tools.
+			sig.Mode = 0
+		}
+		idx[name] = entrySignature(&sig, content)
+	}
+}
+
+func entrySignature(hdr *tar.Header, content string) string {
+	var xattrs []string
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "SCHILY.xattr.") {
+			xattrs = append(xattrs, k+"="+v)
+		}
+	}
+	sort.Strings(xattrs)
+	return fmt.Sprintf("%c|%o|%d:%d|%d,%d|%s|%s|%s",
+		hdr.Typeflag, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Devmajor, hdr.Devminor,
+		hdr.Linkname, content, strings.Join(xattrs, ","))
+}
+
+// deltaStats summarizes the differences found by writeDelta.
+type deltaStats struct {
+	Unchanged, Changed, Added, Removed int
+}
+
+// writeDelta writes a layer to w which, when applied on top of the
+// flattened rootfs of prev (described in messages as what), produces the
+// flattened rootfs in the tarball at rootfsPath. Unchanged entries are
+// omitted and removed entries are written as whiteouts.
+func writeDelta(w io.Writer, rootfsPath string, prev v1.Image, what string) (*deltaStats, error) {
+	logf("Indexing %s", what)
+	rc := extractImage(prev)
+	prevIdx, err := indexRootfs(rc)
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("index %s: %w", what, err)
+	}
+
+	f, err := openTemp(rootfsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	newIdx, err := indexRootfs(f)
+	if err != nil {
+		return nil, fmt.Errorf("index squashed image: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	stats := &deltaStats{}
+	tw := tar.NewWriter(w)
+
+	// Write whiteouts for removed paths, skipping descendants of paths that
+	// are already whited out.
+	var removed []string
+	for name := range prevIdx {
+		if _, ok := newIdx[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	whited := map[string]bool{}
+	for _, name := range removed {
+		stats.Removed++
+		if hasWhitedOutAncestor(name, whited) {
+			continue
+		}
+		whited[name] = true
+		dir, base := path.Split(name)
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: dir + ".wh." + base, Mode: 0644}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := cleanTarPath(hdr.Name)
+		prevSig, existed := prevIdx[name]
+		if existed && prevSig == newIdx[name] {
+			stats.Unchanged++
+			continue
+		}
+		if existed {
+			stats.Changed++
+		} else {
+			stats.Added++
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func hasWhitedOutAncestor(name string, whited map[string]bool) bool {
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if whited[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// previousLayers returns an image containing just the layers of prev (the
+// what of messages), along with their diff IDs and history, as a base on
+// which to append a delta.
+func previousLayers(prev *source, what string) (v1.Image, []v1.Hash, []v1.History, error) {
+	layers, err := prev.Image.Layers()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("get %s layers: %w", what, err)
+	}
+	cfg, err := prev.Image.ConfigFile()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("get %s config: %w", what, err)
+	}
+	var adds []mutate.Addendum
+	if prev.Uncompressed {
+		// Compress each layer once up front, rather than each time its
+		// digest or blob is read.
+		for _, layer := range layers {
+			l, err := digestLayer(layer.Uncompressed)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("compress %s layer: %w", what, err)
+			}
+			adds = append(adds, mutate.Addendum{Layer: l})
+		}
+	} else {
+		// Carry the blobs over byte-for-byte with their original
+		// descriptors, so digests are unchanged and registries can dedupe
+		// them.
+		m, err := prev.Image.Manifest()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("get %s manifest: %w", what, err)
+		}
+		for i, layer := range layers {
+			add := mutate.Addendum{Layer: layer}
+			if i < len(m.Layers) {
+				add.MediaType = m.Layers[i].MediaType
+				add.Annotations = m.Layers[i].Annotations
+				add.URLs = m.Layers[i].URLs
+			}
+			adds = append(adds, add)
+		}
+	}
+	img, err := mutate.Append(empty.Image, adds...)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("append %s layers: %w", what, err)
+	}
+	logf("Reusing %d layers from the %s", len(layers), what)
+	history := cfg.History
+	if len(history) == 0 {
+		// Squashed images have no history, but a delta image has more than
+		// one layer, so synthesize an entry for each previous layer.
+		for range layers {
+			history = append(history, v1.History{CreatedBy: "docker-squash", Comment: "previous"})
+		}
+	}
+	return img, append([]v1.Hash(nil), cfg.RootFS.DiffIDs...), append([]v1.History(nil), history...), nil
+}
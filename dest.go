@@ -0,0 +1,271 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	tarball "github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// isRegistryDest returns whether the DEST argument refers to a remote
+// registry rather than a local tarball path.
+func isRegistryDest(outputPath string) bool {
+	return strings.HasPrefix(outputPath, "docker://")
+}
+
+// isStreamDest returns whether the local DEST path is a named pipe, socket
+// or device, like a FIFO read by 'pv' or 'ssh', or /dev/stdout, rather than
+// a file: it's written once, in order, and can't be read back.
+func isStreamDest(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice) != 0
+}
+
+// parseRegistryDest parses a "docker://" DEST argument into an image
+// reference.
+func parseRegistryDest(outputPath string) (name.Reference, error) {
+	ref, err := parseDockerRef(strings.TrimPrefix(outputPath, "docker://"))
+	if err != nil {
+		return nil, fmt.Errorf("parse output reference: %w", err)
+	}
+	return ref, nil
+}
+
+// checkPushPermission verifies up front that the current credentials are
+// allowed to push to ref, so that we don't spend minutes pulling and
+// flattening an image only to fail at the very end.
+func checkPushPermission(ref name.Reference) error {
+	logf("Checking push permission for %q", ref.Context())
+	err := remote.CheckPushPermission(ref, keychain, http.DefaultTransport)
+	if err == nil {
+		return nil
+	}
+	var terr *transport.Error
+	if errors.As(err, &terr) && (terr.StatusCode == http.StatusUnauthorized || terr.StatusCode == http.StatusForbidden) {
+		return fmt.Errorf("credentials for %s do not allow pushing to %s (try 'docker login %s', or check that the repository exists and you have write access): %w", ref.Context().RegistryStr(), ref.Context(), ref.Context().RegistryStr(), err)
+	}
+	return fmt.Errorf("check push permission for %s: %w", ref.Context(), err)
+}
+
+// writeImage writes img to outputPath, which is either a local tarball path
+// or a "docker://" registry reference. For tarballs, the image is tagged
+// with all of outRefs; for registries, it's pushed to the first one.
+func writeImage(outputPath string, outRefs []name.Reference, img v1.Image, prov *provenance) error {
+	if isRegistryDest(outputPath) {
+		return pushImage(outRefs[0], img)
+	}
+	logf("Writing image to %q", outputPath)
+	if *buildxCompat {
+		return writeBuildxArchive(outputPath, outRefs, img)
+	}
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output file: %w", err)
+	}
+	defer out.Close()
+	refToImage := map[name.Reference]v1.Image{}
+	for _, ref := range outRefs {
+		refToImage[ref] = img
+	}
+	progress := &progressWriter{}
+	err = writeTarWithProvenance(io.MultiWriter(out, progress), prov, img, func(w io.Writer) error {
+		return tarball.MultiRefWrite(refToImage, w)
+	})
+	if err != nil {
+		return fmt.Errorf("write image to %q: %w", outputPath, err)
+	}
+	progress.Print()
+	return nil
+}
+
+func pushImage(ref name.Reference, img v1.Image) error {
+	logf("Pushing image to %q", ref)
+	logExistingLayers(ref.Context(), img)
+	_, err := pushWithFallback(ref.Context().RegistryStr(), img, func(t remote.Taggable) error {
+		return writeWithProgress(func(opts ...remote.Option) error {
+			return remote.Write(ref, t.(v1.Image), opts...)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("push image to %q: %w", ref, err)
+	}
+	return nil
+}
+
+// writeWithProgress calls write with authentication and progress options,
+// printing progress until it returns.
+func writeWithProgress(write func(opts ...remote.Option) error) error {
+	updates := make(chan v1.Update, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		progress := &progressWriter{}
+		for u := range updates {
+			progress.written = u.Complete
+			progress.maybePrint()
+		}
+		progress.Print()
+	}()
+	err := write(remote.WithAuthFromKeychain(keychain), remote.WithProgress(updates))
+	<-done
+	return err
+}
+
+// logExistingLayers reports which of img's layers are already in repo.
+// remote.Write checks each blob the same way and skips uploading the ones
+// that exist, so when repeated squashes of a slowly-changing image produce
+// the same layer, pushing only uploads the config and manifest.
+func logExistingLayers(repo name.Repository, img v1.Image) {
+	layers, err := img.Layers()
+	if err != nil {
+		return
+	}
+	existing := 0
+	var digest v1.Hash
+	for _, layer := range layers {
+		if digest, err = layer.Digest(); err != nil {
+			return
+		}
+		ok, err := blobExists(repo, digest)
+		if err != nil {
+			// Not worth failing over; remote.Write will check again.
+			logf("Warning: check for existing layer %s in %s: %v", digest, repo, err)
+			return
+		}
+		if ok {
+			existing++
+		}
+	}
+	switch {
+	case existing == 1 && len(layers) == 1:
+		logf("Layer %s already exists in %s; only pushing the config and manifest", digest, repo)
+	case existing > 0 && existing == len(layers):
+		logf("All %d layers already exist in %s; only pushing the config and manifest", len(layers), repo)
+	case existing > 0:
+		logf("%d of %d layers already exist in %s and won't be uploaded", existing, len(layers), repo)
+	}
+}
+
+// blobExists returns whether the blob with the given digest is in repo.
+func blobExists(repo name.Repository, digest v1.Hash) (bool, error) {
+	auth, err := keychain.Resolve(repo.Registry)
+	if err != nil {
+		return false, err
+	}
+	t, err := transport.NewWithContext(context.Background(), repo.Registry, auth, http.DefaultTransport, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return false, err
+	}
+	u := url.URL{Scheme: repo.Registry.Scheme(), Host: repo.RegistryStr(), Path: fmt.Sprintf("/v2/%s/blobs/%s", repo.RepositoryStr(), digest)}
+	resp, err := (&http.Client{Transport: t}).Head(u.String())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusNotFound); err != nil {
+		return false, err
+	}
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// alsoOutput is an -also-output value: a local path the output is written
+// to as well as DEST.
+type alsoOutput struct {
+	path string
+	// format is "docker-archive", "oci-archive", "oci" (an OCI layout
+	// directory), or "" to write it the way a local DEST would be.
+	format string
+}
+
+// alsoOutputs are the parsed -also-output values.
+var alsoOutputs []alsoOutput
+
+// parseAlsoOutputs parses -also-output values. A trailing ":FORMAT" is only
+// taken as the format if it names one, so that other colons stay part of
+// the path.
+func parseAlsoOutputs(values []string) ([]alsoOutput, error) {
+	var outputs []alsoOutput
+	for _, v := range values {
+		o := alsoOutput{path: v}
+		if i := strings.LastIndex(v, ":"); i >= 0 {
+			switch v[i+1:] {
+			case "docker-archive", "oci-archive", "oci":
+				o.path, o.format = v[:i], v[i+1:]
+			}
+		}
+		if o.path == "" {
+			return nil, fmt.Errorf("%q: no path", v)
+		}
+		if isRegistryDest(o.path) {
+			return nil, fmt.Errorf("%q: must be a local path", v)
+		}
+		outputs = append(outputs, o)
+	}
+	return outputs, nil
+}
+
+// writeOutput writes the image or index t to outputPath, as writeImage or
+// writeIndex do, and then to each -also-output path.
+func writeOutput(outputPath string, outRefs []name.Reference, t remote.Taggable, prov *provenance) error {
+	_, isIndex := t.(v1.ImageIndex)
+	for _, o := range alsoOutputs {
+		if isIndex && o.format == "docker-archive" {
+			return fmt.Errorf("-also-output %s: docker-archive tarballs can't hold a multi-platform image; use oci-archive", o.path)
+		}
+	}
+	// format is an -also-output format, or the -format of DEST.
+	write := func(path, format string) error {
+		if err := writeFormat(path, format, outRefs, t, prov); err != nil {
+			return err
+		}
+		if err := outputPerms.apply(path); err != nil {
+			return err
+		}
+		if *verifyOutputFlag {
+			return verifyOutput(path, t)
+		}
+		return nil
+	}
+	if err := write(outputPath, *format); err != nil {
+		return err
+	}
+	for _, o := range alsoOutputs {
+		if err := write(o.path, cmp.Or(o.format, *format)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFormat writes the image or index t to path in format, for
+// writeOutput.
+func writeFormat(path, format string, outRefs []name.Reference, t remote.Taggable, prov *provenance) error {
+	idx, isIndex := t.(v1.ImageIndex)
+	phase := phaseWrite
+	if isRegistryDest(path) {
+		phase = phasePush
+	}
+	defer startPhase(phase, phasePull, phaseCompress, phaseHash).end()
+	switch {
+	case format == "oci":
+		return writeOCILayout(path, outRefs, t, prov)
+	case format == "oci-archive" && !isIndex:
+		logf("Writing image to %q as an oci-archive", path)
+		return writeOCIArchive(path, outRefs, t, prov)
+	case isIndex:
+		return writeIndex(path, outRefs, idx, prov)
+	}
+	return writeImage(path, outRefs, t.(v1.Image), prov)
+}
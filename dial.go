@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// resolveOverride is a parsed -resolve value.
+type resolveOverride struct {
+	Host string
+	// Port is empty to match any port.
+	Port string
+	Addr string
+}
+
+var (
+	// resolveOverrides holds the parsed -resolve flag values.
+	resolveOverrides []resolveOverride
+	// resolver looks up registry hosts. -dns replaces it.
+	resolver = net.DefaultResolver
+)
+
+func init() {
+	// Everything talks to registries through one of these two transports,
+	// so customizing how they dial covers every request.
+	for _, rt := range []http.RoundTripper{http.DefaultTransport, remote.DefaultTransport} {
+		t, ok := rt.(*http.Transport)
+		if !ok {
+			continue
+		}
+		proxy := t.Proxy
+		t.DialContext = dialContext
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			if _, ok := unixSockets.Load(req.URL.Hostname()); ok || proxy == nil {
+				return nil, nil
+			}
+			return proxy(req)
+		}
+	}
+}
+
+// dialContext dials registries on unix sockets, hosts overridden by
+// -resolve, and hosts looked up with the -dns servers.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	// The same timeouts as http.DefaultTransport.
+	d := &net.Dialer{Resolver: resolver, Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	if sock, ok := unixSockets.Load(host); ok {
+		return d.DialContext(ctx, "unix", sock.(string))
+	}
+	for _, o := range resolveOverrides {
+		if strings.EqualFold(o.Host, host) && (o.Port == "" || o.Port == port) {
+			return d.DialContext(ctx, network, net.JoinHostPort(o.Addr, port))
+		}
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// parseResolveOverrides parses -resolve values, which are either HOST:ADDR
+// or, like curl's --resolve, HOST:PORT:ADDR. IPv6 addresses may be given in
+// brackets.
+func parseResolveOverrides(values []string) ([]resolveOverride, error) {
+	var overrides []resolveOverride
+	for _, v := range values {
+		host, rest, ok := strings.Cut(v, ":")
+		if !ok || host == "" || rest == "" {
+			return nil, fmt.Errorf("%q: expected HOST:ADDR or HOST:PORT:ADDR", v)
+		}
+		o := resolveOverride{Host: host, Addr: rest}
+		if net.ParseIP(strings.Trim(rest, "[]")) == nil {
+			if port, addr, ok := strings.Cut(rest, ":"); ok {
+				if _, err := strconv.ParseUint(port, 10, 16); err == nil {
+					o.Port, o.Addr = port, addr
+				}
+			}
+		}
+		o.Addr = strings.Trim(o.Addr, "[]")
+		if net.ParseIP(o.Addr) == nil {
+			return nil, fmt.Errorf("%q: %q is not an IP address", v, o.Addr)
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, nil
+}
+
+// newDNSResolver returns a resolver that sends its queries to server, an
+// IP[:PORT] address.
+func newDNSResolver(server string) (*net.Resolver, error) {
+	addr := server
+	if ip := net.ParseIP(strings.Trim(server, "[]")); ip != nil {
+		addr = net.JoinHostPort(ip.String(), "53")
+	} else if host, _, err := net.SplitHostPort(server); err != nil || net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("%q is not an IP[:PORT] address", server)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// digestMain implements the digest subcommand, which prints the manifest
+// digest, image ID (config digest) and layer diffIDs of a local image, such
+// as a squashed output tarball, one "KEY VALUE" line each, for
+// verification scripts.
+func digestMain(args []string) error {
+	flags := flag.NewFlagSet("digest", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 1 || isRegistrySource(flags.Arg(0)) {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s digest DEST.tar", os.Args[0]))
+	}
+	defer removeTemps()
+	src, err := openSource(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := checkManifestLimits(src.Image); err != nil {
+		return err
+	}
+	if src.Uncompressed {
+		// The manifest would be of layers compressed just to compute it,
+		// which no registry would have.
+		logf("Warning: %q stores its layers uncompressed, so its manifest digest depends on how they're compressed when pushed", flags.Arg(0))
+	} else {
+		digest, err := src.Image.Digest()
+		if err != nil {
+			return fmt.Errorf("get manifest digest: %w", err)
+		}
+		fmt.Printf("manifest %s\n", digest)
+	}
+	id, err := src.Image.ConfigName()
+	if err != nil {
+		return fmt.Errorf("get image ID: %w", err)
+	}
+	fmt.Printf("image-id %s\n", id)
+	cfg, err := src.Image.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("get config: %w", err)
+	}
+	for _, diffID := range cfg.RootFS.DiffIDs {
+		fmt.Printf("diff-id %s\n", diffID)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// tagsMain implements the tags subcommand, which lists the tags in a
+// repository, one per line.
+func tagsMain(args []string) error {
+	flags := flag.NewFlagSet("tags", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 1 || !isRegistrySource(flags.Arg(0)) {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s tags docker://REPO", os.Args[0]))
+	}
+	ref, err := parseDockerRef(strings.TrimPrefix(flags.Arg(0), "docker://"))
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("parse repository: %w", err))
+	}
+	repo := ref.Context()
+	tags, err := remote.List(repo, remote.WithAuthFromKeychain(keychain))
+	if err != nil {
+		err = fmt.Errorf("list tags in %s: %w", repo, err)
+		if isNotFound(err) {
+			err = withExitCode(exitSourceNotFound, err)
+		}
+		return err
+	}
+	for _, t := range tags {
+		fmt.Println(t)
+	}
+	return nil
+}
+
+// existsMain implements the exists subcommand, which prints the digest of
+// an image and exits with status 0 if it exists, or exits with the
+// source-not-found status if it doesn't.
+func existsMain(args []string) error {
+	flags := flag.NewFlagSet("exists", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 1 || !isRegistrySource(flags.Arg(0)) {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s exists docker://IMAGE", os.Args[0]))
+	}
+	ref, err := parseDockerRef(strings.TrimPrefix(flags.Arg(0), "docker://"))
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("parse image reference: %w", err))
+	}
+	desc, err := remote.Head(ref, remote.WithAuthFromKeychain(keychain))
+	if err != nil {
+		if isNotFound(err) {
+			return withExitCode(exitSourceNotFound, fmt.Errorf("%s does not exist", ref))
+		}
+		return fmt.Errorf("check %s: %w", ref, err)
+	}
+	if _, ok := ref.(name.Digest); ok {
+		fmt.Println(ref)
+	} else {
+		fmt.Println(ref.Context().Digest(desc.Digest.String()))
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// dockerfileInstruction is a single parsed instruction from a -apply
+// Dockerfile fragment.
+type dockerfileInstruction struct {
+	// Cmd is the upper-cased instruction name, like "ENV".
+	Cmd string
+	// Args is the raw instruction arguments.
+	Args string
+	// Line is the line number the instruction started on.
+	Line int
+}
+
+// supportedDockerfileInstructions are the metadata-only instructions that
+// may appear in a -apply fragment.
+var supportedDockerfileInstructions = map[string]bool{
+	"ENV":        true,
+	"LABEL":      true,
+	"ENTRYPOINT": true,
+	"CMD":        true,
+	"USER":       true,
+	"WORKDIR":    true,
+	"EXPOSE":     true,
+}
+
+// readDockerfileFragment reads and parses the Dockerfile fragment at path.
+func readDockerfileFragment(path string) ([]dockerfileInstruction, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	instrs, err := parseDockerfileFragment(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return instrs, nil
+}
+
+// parseDockerfileFragment parses a Dockerfile consisting only of
+// metadata instructions. Comments and backslash line continuations are
+// supported; variable substitution and parser directives are not.
+func parseDockerfileFragment(r io.Reader) ([]dockerfileInstruction, error) {
+	var instrs []dockerfileInstruction
+	var cur strings.Builder
+	start := 0
+	sc := bufio.NewScanner(r)
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		line := strings.TrimSpace(sc.Text())
+		// Like docker build, blank lines and comments are skipped, even
+		// within a continuation.
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if cur.Len() == 0 {
+			start = lineNum
+		}
+		if cont, ok := strings.CutSuffix(line, "\\"); ok {
+			cur.WriteString(cont)
+			cur.WriteString(" ")
+			continue
+		}
+		cur.WriteString(line)
+		instr, err := parseDockerfileLine(cur.String(), start)
+		if err != nil {
+			return nil, err
+		}
+		instrs = append(instrs, instr)
+		cur.Reset()
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if cur.Len() > 0 {
+		return nil, fmt.Errorf("line %d: unterminated line continuation", start)
+	}
+	return instrs, nil
+}
+
+func parseDockerfileLine(line string, lineNum int) (dockerfileInstruction, error) {
+	cmd, args, _ := strings.Cut(line, " ")
+	instr := dockerfileInstruction{
+		Cmd:  strings.ToUpper(cmd),
+		Args: strings.TrimSpace(args),
+		Line: lineNum,
+	}
+	if !supportedDockerfileInstructions[instr.Cmd] {
+		return instr, fmt.Errorf("line %d: unsupported instruction %q (only ENV, LABEL, ENTRYPOINT, CMD, USER, WORKDIR and EXPOSE are allowed)", lineNum, cmd)
+	}
+	if instr.Args == "" {
+		return instr, fmt.Errorf("line %d: %s requires at least one argument", lineNum, instr.Cmd)
+	}
+	return instr, nil
+}
+
+// applyDockerfile applies the given instructions to cfg, in order, with the
+// same semantics as a Dockerfile build.
+func applyDockerfile(cfg *v1.Config, instrs []dockerfileInstruction) error {
+	cmdSet := false
+	for _, instr := range instrs {
+		var err error
+		switch instr.Cmd {
+		case "ENV":
+			err = applyEnv(cfg, instr.Args)
+		case "LABEL":
+			err = applyLabel(cfg, instr.Args)
+		case "ENTRYPOINT":
+			cfg.Entrypoint = parseCommandForm(instr.Args)
+			// Like docker build, setting ENTRYPOINT resets any CMD
+			// inherited from the base image.
+			if !cmdSet {
+				cfg.Cmd = nil
+			}
+		case "CMD":
+			cfg.Cmd = parseCommandForm(instr.Args)
+			cmdSet = true
+		case "USER":
+			cfg.User = instr.Args
+		case "WORKDIR":
+			// A relative WORKDIR is relative to the previous one.
+			dir := instr.Args
+			if !path.IsAbs(dir) {
+				dir = path.Join("/", cfg.WorkingDir, dir)
+			}
+			cfg.WorkingDir = path.Clean(dir)
+		case "EXPOSE":
+			err = applyExpose(cfg, instr.Args)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %s: %w", instr.Line, instr.Cmd, err)
+		}
+	}
+	return nil
+}
+
+func applyEnv(cfg *v1.Config, args string) error {
+	words, err := splitWords(args)
+	if err != nil {
+		return err
+	}
+	var pairs [][2]string
+	if !strings.Contains(words[0], "=") {
+		// Legacy "ENV key value" form.
+		key, value, _ := strings.Cut(args, " ")
+		pairs = append(pairs, [2]string{key, strings.TrimSpace(value)})
+	} else {
+		for _, w := range words {
+			key, value, ok := strings.Cut(w, "=")
+			if !ok || key == "" {
+				return fmt.Errorf("invalid key=value pair %q", w)
+			}
+			pairs = append(pairs, [2]string{key, value})
+		}
+	}
+	env := append([]string(nil), cfg.Env...)
+	for _, kv := range pairs {
+		entry := kv[0] + "=" + kv[1]
+		replaced := false
+		for i, e := range env {
+			if strings.HasPrefix(e, kv[0]+"=") {
+				env[i] = entry
+				replaced = true
+			}
+		}
+		if !replaced {
+			env = append(env, entry)
+		}
+	}
+	cfg.Env = env
+	return nil
+}
+
+func applyLabel(cfg *v1.Config, args string) error {
+	words, err := splitWords(args)
+	if err != nil {
+		return err
+	}
+	labels := make(map[string]string, len(cfg.Labels)+len(words))
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+	for _, w := range words {
+		key, value, ok := strings.Cut(w, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("invalid key=value pair %q", w)
+		}
+		labels[key] = value
+	}
+	cfg.Labels = labels
+	return nil
+}
+
+func applyExpose(cfg *v1.Config, args string) error {
+	ports := make(map[string]struct{}, len(cfg.ExposedPorts))
+	for p := range cfg.ExposedPorts {
+		ports[p] = struct{}{}
+	}
+	for _, p := range strings.Fields(args) {
+		if !strings.Contains(p, "/") {
+			p += "/tcp"
+		}
+		port, proto, _ := strings.Cut(p, "/")
+		if port == "" || strings.Trim(port, "0123456789-") != "" {
+			return fmt.Errorf("invalid port %q", p)
+		}
+		ports[port+"/"+strings.ToLower(proto)] = struct{}{}
+	}
+	cfg.ExposedPorts = ports
+	return nil
+}
+
+// parseCommandForm parses the arguments of CMD or ENTRYPOINT, which are
+// either a JSON array (exec form) or a shell command (shell form).
+func parseCommandForm(args string) []string {
+	var exec []string
+	if strings.HasPrefix(args, "[") && json.Unmarshal([]byte(args), &exec) == nil {
+		return exec
+	}
+	return []string{"/bin/sh", "-c", args}
+}
+
+// splitWords splits s into words on whitespace, honoring single quotes,
+// double quotes and backslash escapes.
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var cur strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, cur.String())
+	}
+	return words, nil
+}
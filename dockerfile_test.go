@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestParseDockerfileFragment(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want []dockerfileInstruction
+		err  string
+	}{
+		{
+			name: "comments and blank lines",
+			in:   "# syntax is not a directive here\n\nENV A=1\n  # indented comment\nuser app\n",
+			want: []dockerfileInstruction{{"ENV", "A=1", 3}, {"USER", "app", 5}},
+		},
+		{
+			name: "continuation",
+			in:   "LABEL a=1 \\\n  b=2 \\\n  c=3\nEXPOSE 80\n",
+			want: []dockerfileInstruction{{"LABEL", "a=1  b=2  c=3", 1}, {"EXPOSE", "80", 4}},
+		},
+		{
+			name: "blank lines and comments within a continuation",
+			in:   "ENV A=1 \\\n\n  # B is set too\n  B=2\n\nCMD [\"run\"]\n",
+			want: []dockerfileInstruction{{"ENV", "A=1  B=2", 1}, {"CMD", `["run"]`, 6}},
+		},
+		{
+			name: "exec form continuation",
+			in:   "ENTRYPOINT [\"/bin/app\", \\\n  \"--serve\"]\n",
+			want: []dockerfileInstruction{{"ENTRYPOINT", `["/bin/app",  "--serve"]`, 1}},
+		},
+		{name: "unterminated continuation", in: "ENV A=1 \\\n\n", err: "line 1: unterminated line continuation"},
+		{name: "unsupported instruction", in: "ENV A=1\nRUN make\n", err: `line 2: unsupported instruction "RUN"`},
+		{name: "missing argument", in: "WORKDIR\n", err: "line 1: WORKDIR requires at least one argument"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseDockerfileFragment(strings.NewReader(tc.in))
+			if tc.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+					t.Fatalf("got %v, want an error starting with %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyDockerfile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		base v1.Config
+		in   string
+		want v1.Config
+	}{
+		{
+			name: "exec and shell forms",
+			base: v1.Config{Cmd: []string{"bash"}},
+			in:   "ENTRYPOINT [\"/bin/app\", \"--serve\"]\nCMD --port 80 && true\n",
+			want: v1.Config{Entrypoint: []string{"/bin/app", "--serve"}, Cmd: []string{"/bin/sh", "-c", "--port 80 && true"}},
+		},
+		{
+			name: "invalid JSON is the shell form",
+			in:   "CMD [\"unterminated\"\n",
+			want: v1.Config{Cmd: []string{"/bin/sh", "-c", `["unterminated"`}},
+		},
+		{
+			name: "ENTRYPOINT resets an inherited CMD",
+			base: v1.Config{Cmd: []string{"bash"}},
+			in:   "ENTRYPOINT /bin/app\n",
+			want: v1.Config{Entrypoint: []string{"/bin/sh", "-c", "/bin/app"}},
+		},
+		{
+			name: "relative WORKDIR",
+			base: v1.Config{WorkingDir: "/srv"},
+			in:   "WORKDIR app\nWORKDIR ./data/../logs\n",
+			want: v1.Config{WorkingDir: "/srv/app/logs"},
+		},
+		{
+			name: "relative WORKDIR without a base",
+			in:   "WORKDIR app\n",
+			want: v1.Config{WorkingDir: "/app"},
+		},
+		{
+			name: "absolute WORKDIR",
+			base: v1.Config{WorkingDir: "/srv"},
+			in:   "WORKDIR /opt//app/\n",
+			want: v1.Config{WorkingDir: "/opt/app"},
+		},
+		{
+			name: "ENV forms and LABEL continuation",
+			base: v1.Config{Env: []string{"PATH=/bin", "A=0"}},
+			in:   "ENV A=1 B=\"two words\"\nENV C three words\nLABEL x=1 \\\n  y=2\n",
+			want: v1.Config{Env: []string{"PATH=/bin", "A=1", "B=two words", "C=three words"}, Labels: map[string]string{"x": "1", "y": "2"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			instrs, err := parseDockerfileFragment(strings.NewReader(tc.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := tc.base
+			if err := applyDockerfile(&cfg, instrs); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg, tc.want) {
+				t.Errorf("got %+v, want %+v", cfg, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// command is a form of the docker-squash command line, as listed in the
+// --help usage lines and the generated docs.
+type command struct {
+	// Name is the subcommand, like "bench" or "cache prune", or "" for
+	// squashing.
+	Name string
+	// Args are the arguments that follow the name.
+	Args string
+	// Summary is a one-line description, for the docs.
+	Summary string
+	// Main runs the command with the arguments that follow its name, or is
+	// nil if it squashes, with the squash options.
+	Main func(args []string) error
+	// Flags returns a new FlagSet of the command's own flags, or is nil if
+	// it has none.
+	Flags func() *flag.FlagSet
+	// Hidden commands aren't listed.
+	Hidden bool
+}
+
+// commands are the forms of the command line, in the order they're listed.
+// They're set in init, since their handlers list them.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"", "[ OPTIONS ...] SOURCE DEST", "Squash SOURCE into a single layer and write it to DEST", nil, nil, false},
+		{"", "[ OPTIONS ...] -source PLATFORM=SOURCE ... DEST", "Squash an image for each platform and write them to DEST as one multi-platform index", nil, nil, false},
+		{"promote", "[ OPTIONS ...] SOURCE docker://DEST ...", "Squash SOURCE and push it to every DEST, setting the tags only once every push has succeeded", nil, nil, false},
+		{"relayer", "-layer-map FILE [ OPTIONS ...] SOURCE DEST", "Split SOURCE back into the layers of a layer map", nil, nil, false},
+		{"run", "[-print] PIPELINE.yaml", "Run a pipeline file", runMain, flagSet(runFlags), false},
+		{"cache prune", "[-cache-dir DIR] [-max-size SIZE]", "Evict least recently used entries from the cache", cachePruneMain, flagSet(cachePruneFlags), false},
+		{"bench", "[-levels LEVELS] SOURCE", "Measure the throughput of each phase of squashing SOURCE", benchMain, flagSet(benchFlags), false},
+		{"selftest", "[-v]", "Check this build of the tool on this platform and filesystem", selftestMain, flagSet(selftestFlags), false},
+		{"inspect", "[-decryption-key KEY] SOURCE", "Report how well each layer of SOURCE compresses", inspectMain, inspectFlags, false},
+		{"digest", "DEST.tar", "Print the manifest digest, image ID and layer diffIDs of a local output", digestMain, nil, false},
+		{"tags", "docker://REPO", "List the tags in a repository", tagsMain, nil, false},
+		{"exists", "docker://IMAGE", "Print the digest of an image, or exit with the source-not-found status", existsMain, nil, false},
+		{"bundle create", "[-file PATH ...] SOURCE BUNDLE", "Package an image and its signatures and attachments for an air-gapped network", bundleCreateMain, flagSet(bundleCreateFlags), false},
+		{"bundle apply", "[-files-dir DIR] BUNDLE docker://DEST", "Verify a bundle and push its contents", bundleApplyMain, flagSet(bundleApplyFlags), false},
+		{"completion", "bash|zsh|fish|powershell", "Print a shell completion script", completionMain, nil, false},
+		{"__complete", "CWORD ARG...", "Print the completion candidates of a word, for the completion scripts", completeMain, nil, true},
+		{"docs", "man|markdown", "Print this documentation as a man page or Markdown", docsMain, nil, false},
+		{"version", "[-json]", "Print the version, commit and supported features", versionMain, flagSet(versionFlags), false},
+		{"self-update", "[-version TAG] [-key KEY] [-check]", "Replace this executable with a release binary, once its checksum and signature are verified", selfUpdateMain, flagSet(selfUpdateFlags), false},
+	}
+}
+
+// flagSet adapts a function returning a command's FlagSet and the values
+// its flags are parsed into to a command's Flags.
+func flagSet[T any](flags func() (*flag.FlagSet, T)) func() *flag.FlagSet {
+	return func() *flag.FlagSet {
+		fs, _ := flags()
+		return fs
+	}
+}
+
+// listedCommands returns the commands that aren't hidden.
+func listedCommands() []command {
+	return slices.DeleteFunc(slices.Clone(commands), func(c command) bool { return c.Hidden })
+}
+
+// findCommand returns the subcommand args start with, or nil if they
+// don't, and are squash arguments. Naming a subcommand with subcommands
+// but none of them, like "bundle" alone, is a usage error.
+func findCommand(args []string) (*command, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	var forms []string
+	for i, c := range commands {
+		words := strings.Fields(c.Name)
+		if len(words) == 0 || words[0] != args[0] {
+			continue
+		}
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			return &commands[i], nil
+		}
+		forms = append(forms, c.line(os.Args[0]))
+	}
+	if forms != nil {
+		return nil, withExitCode(exitUsage, fmt.Errorf("usage: %s", strings.Join(forms, "\n       ")))
+	}
+	return nil, nil
+}
+
+// line returns the command line of c, run as prog.
+func (c command) line(prog string) string {
+	if c.Name == "" {
+		return prog + " " + c.Args
+	}
+	return prog + " " + c.Name + " " + c.Args
+}
+
+// usageLines returns the usage lines of --help, run as prog.
+func usageLines(prog string) string {
+	var b strings.Builder
+	for i, c := range listedCommands() {
+		if i == 0 {
+			b.WriteString("Usage: ")
+		} else {
+			b.WriteString("\n       ")
+		}
+		b.WriteString(c.line(prog))
+	}
+	return b.String()
+}
+
+// commandNames returns the names of the subcommands, sorted.
+func commandNames() []string {
+	var names []string
+	for _, c := range listedCommands() {
+		if c.Name != "" {
+			names = append(names, strings.Fields(c.Name)[0])
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// docsMain implements the docs subcommand, which prints the documentation
+// of the command line, generated from the commands, the --help text, the
+// flags and the exit codes, as a man page or Markdown.
+func docsMain(args []string) error {
+	if len(args) != 1 || (args[0] != "man" && args[0] != "markdown") {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s docs man|markdown", os.Args[0]))
+	}
+	if args[0] == "man" {
+		return writeManPage(os.Stdout)
+	}
+	return writeMarkdown(os.Stdout)
+}
+
+// docFlag is a flag as documented.
+type docFlag struct {
+	name, arg, usage string
+	// def is the default, if it's worth showing.
+	def string
+}
+
+// docFlags returns the flags of fs, sorted by name, as flag.PrintDefaults
+// describes them.
+func docFlags(fs *flag.FlagSet) []docFlag {
+	var flags []docFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		arg, usage := flag.UnquoteUsage(f)
+		d := docFlag{name: f.Name, arg: arg, usage: usage}
+		switch f.DefValue {
+		case "", "false", "0", "0s", "[]":
+		default:
+			d.def = f.DefValue
+		}
+		flags = append(flags, d)
+	})
+	return flags
+}
+
+// docsDescription returns the --help text for the docs.
+func docsDescription() string {
+	return fmt.Sprintf(helpText, "docker-squash", optimizerHelp())
+}
+
+// writeManPage writes the docs as a man page, dated $SOURCE_DATE_EPOCH if
+// it's set, for reproducible packages.
+func writeManPage(w io.Writer) error {
+	date := time.Now()
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		var err error
+		if date, err = parseCreated(epoch); err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH: %w", err)
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, ".TH DOCKER-SQUASH 1 %q %q\n", date.UTC().Format("2006-01-02"), "docker-squash "+currentBuildInfo().Version)
+	b.WriteString(".SH NAME\ndocker-squash \\- squash container images into a single layer\n")
+	b.WriteString(".SH SYNOPSIS\n.nf\n")
+	for _, c := range listedCommands() {
+		b.WriteString(roffEscape(c.line("docker-squash")) + "\n")
+	}
+	b.WriteString(".fi\n.SH COMMANDS\n")
+	for _, c := range listedCommands() {
+		fmt.Fprintf(&b, ".TP\n.B %s\n%s\n", roffEscape(c.line("docker-squash")), roffEscape(c.Summary))
+	}
+	b.WriteString(".SH DESCRIPTION\n.nf\n")
+	for _, l := range strings.Split(strings.TrimRight(docsDescription(), "\n"), "\n") {
+		b.WriteString(roffEscape(l) + "\n")
+	}
+	b.WriteString(".fi\n.SH OPTIONS\n")
+	writeManFlags(&b, flag.CommandLine)
+	b.WriteString(".SH SUBCOMMAND OPTIONS\n")
+	for _, c := range listedCommands() {
+		if c.Flags != nil {
+			fmt.Fprintf(&b, ".SS %s\n", roffEscape("docker-squash "+c.Name))
+			writeManFlags(&b, c.Flags())
+		}
+	}
+	b.WriteString(".SH EXIT STATUS\n")
+	for _, c := range exitCodes {
+		fmt.Fprintf(&b, ".TP\n.B %d\n%s: %s\n", c.Code, roffEscape(c.Name), roffEscape(c.Description))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeManFlags writes the flags of fs to a man page.
+func writeManFlags(b *strings.Builder, fs *flag.FlagSet) {
+	for _, f := range docFlags(fs) {
+		fmt.Fprintf(b, ".TP\n.B \\-%s", roffEscape(f.name))
+		if f.arg != "" {
+			fmt.Fprintf(b, " \\fI%s\\fR", roffEscape(f.arg))
+		}
+		b.WriteString("\n" + roffEscape(f.usage))
+		if f.def != "" {
+			fmt.Fprintf(b, " (default %s)", roffEscape(f.def))
+		}
+		b.WriteString("\n")
+	}
+}
+
+// roffEscape escapes s for a man page line.
+func roffEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\e`)
+	s = strings.ReplaceAll(s, "-", `\-`)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+// writeMarkdown writes the docs as Markdown.
+func writeMarkdown(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("# docker-squash\n\n## Commands\n\n| Command | Description |\n| --- | --- |\n")
+	for _, c := range listedCommands() {
+		fmt.Fprintf(&b, "| `%s` | %s |\n", markdownCell(c.line("docker-squash")), c.Summary)
+	}
+	b.WriteString("\n## Description\n\n```\n" + strings.TrimRight(docsDescription(), "\n") + "\n```\n\n## Options\n\n")
+	writeMarkdownFlags(&b, flag.CommandLine)
+	b.WriteString("\n## Subcommand options\n")
+	for _, c := range listedCommands() {
+		if c.Flags != nil {
+			fmt.Fprintf(&b, "\n### `docker-squash %s`\n\n", c.Name)
+			writeMarkdownFlags(&b, c.Flags())
+		}
+	}
+	b.WriteString("\n## Exit status\n\n| Code | Name | Description |\n| --- | --- | --- |\n")
+	for _, c := range exitCodes {
+		fmt.Fprintf(&b, "| %d | `%s` | %s |\n", c.Code, c.Name, c.Description)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeMarkdownFlags writes the flags of fs as a Markdown list.
+func writeMarkdownFlags(b *strings.Builder, fs *flag.FlagSet) {
+	for _, f := range docFlags(fs) {
+		fmt.Fprintf(b, "- `-%s", f.name)
+		if f.arg != "" {
+			fmt.Fprintf(b, " %s", f.arg)
+		}
+		fmt.Fprintf(b, "`: %s", f.usage)
+		if f.def != "" {
+			fmt.Fprintf(b, " (default `%s`)", f.def)
+		}
+		b.WriteString("\n")
+	}
+}
+
+// markdownCell escapes the "|" in s for a Markdown table cell.
+func markdownCell(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
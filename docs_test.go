@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFindCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+		err  bool
+	}{
+		{args: nil},
+		{args: []string{"docker://example:foo", "out.tar"}},
+		{args: []string{"-quiet", "docker://example:foo", "out.tar"}},
+		{args: []string{"promote", "docker://example:foo", "docker://example:bar"}, want: "promote"},
+		{args: []string{"cache", "prune", "-max-size", "1GB"}, want: "cache prune"},
+		{args: []string{"bundle", "apply", "b.tar", "docker://example:foo"}, want: "bundle apply"},
+		{args: []string{"bundle"}, err: true},
+		{args: []string{"cache", "purge"}, err: true},
+	} {
+		c, err := findCommand(tc.args)
+		var exit *codedError
+		if tc.err {
+			if !errors.As(err, &exit) || exit.code != exitUsage {
+				t.Errorf("findCommand(%q) = %v, want a usage error", tc.args, err)
+			}
+			continue
+		}
+		got := ""
+		if c != nil {
+			got = c.Name
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("findCommand(%q) = %q, %v, want %q", tc.args, got, err, tc.want)
+		}
+	}
+}
+
+func TestDocsSubcommandFlags(t *testing.T) {
+	var b strings.Builder
+	if err := writeMarkdown(&b); err != nil {
+		t.Fatal(err)
+	}
+	_, sub, _ := strings.Cut(b.String(), "## Subcommand options")
+	for _, want := range []string{
+		"### `docker-squash self-update`", "`-releases string`", "`-force`", "`-skip-signature`", "`-version string`", "`-key string`", "`-check`",
+		"### `docker-squash bundle create`", "`-file value`",
+		"### `docker-squash bundle apply`", "`-files-dir string`",
+		"### `docker-squash bench`", "`-levels string`",
+		"### `docker-squash cache prune`", "`-max-size string`", "`-cache-dir string`",
+		"### `docker-squash run`", "`-print`",
+		"### `docker-squash version`", "`-json`",
+		"### `docker-squash inspect`", "`-decryption-key value`",
+		"### `docker-squash selftest`", "`-v`",
+	} {
+		if !strings.Contains(sub, want) {
+			t.Errorf("markdown subcommand options lack %s", want)
+		}
+	}
+	if strings.Contains(b.String(), "__complete") {
+		t.Error("markdown lists the hidden __complete command")
+	}
+}
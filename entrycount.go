@@ -0,0 +1,69 @@
+package main
+
+import (
+	"archive/tar"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// manyEntries is the number of entries in the squashed layers above which
+// overlayfs mounts and layer extraction get noticeably slow.
+const manyEntries = 1_000_000
+
+// entryCounts counts the entries of the squashed layers by type.
+type entryCounts struct {
+	files, dirs, symlinks, hardlinks, other int
+}
+
+func (c *entryCounts) WantsContent(hdr *tar.Header) bool { return false }
+
+func (c *entryCounts) Visit(hdr *tar.Header, content []byte) error {
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		c.files++
+	case tar.TypeDir:
+		c.dirs++
+	case tar.TypeSymlink:
+		c.symlinks++
+	case tar.TypeLink:
+		c.hardlinks++
+	default:
+		c.other++
+	}
+	return nil
+}
+
+func (c *entryCounts) total() int {
+	return c.files + c.dirs + c.symlinks + c.hardlinks + c.other
+}
+
+// report logs the counts, and warns if there are so many entries that the
+// image will be slow to extract and mount.
+func (c *entryCounts) report() {
+	parts := []string{
+		plural(c.files, "file"),
+		plural(c.dirs, "directory"),
+		plural(c.symlinks, "symlink"),
+		plural(c.hardlinks, "hardlink"),
+	}
+	if c.other > 0 {
+		parts = append(parts, plural(c.other, "other entry"))
+	}
+	logf("Squashed layer entries: %s", strings.Join(parts, ", "))
+	if c.total() > manyEntries {
+		logf("Warning: the squashed image has %s entries, which makes registry extraction and overlayfs mounts slow; consider deleting caches and build leftovers with -run (like 'pip cache purge' or 'rm -rf /var/cache/*'), or splitting the image with -layer-map", humanize.Comma(int64(c.total())))
+	}
+}
+
+// plural formats n with the singular noun, pluralized if n isn't 1.
+func plural(n int, noun string) string {
+	s := humanize.Comma(int64(n)) + " "
+	if n == 1 {
+		return s + noun
+	}
+	if strings.HasSuffix(noun, "y") {
+		return s + strings.TrimSuffix(noun, "y") + "ies"
+	}
+	return s + noun + "s"
+}
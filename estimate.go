@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// estimateProbeSize is how much of the largest layer is downloaded to
+// measure bandwidth and compression ratio.
+const estimateProbeSize = 4 * 1024 * 1024
+
+type squashEstimate struct {
+	// CompressedSize is the total compressed size of the source layers.
+	CompressedSize int64
+	// ScratchSize is the expected size of the uncompressed flattened tarball
+	// written to the temp directory.
+	ScratchSize int64
+	// Bandwidth is the measured read throughput of the source, in bytes per
+	// second.
+	Bandwidth float64
+	// CompressRate is the measured local gzip throughput, in uncompressed
+	// bytes per second.
+	CompressRate float64
+}
+
+// Duration returns a rough estimate of how long the squash will take.
+func (e *squashEstimate) Duration() time.Duration {
+	var secs float64
+	if e.Bandwidth > 0 {
+		secs += float64(e.CompressedSize) / e.Bandwidth
+	}
+	if e.CompressRate > 0 {
+		// The squashed layer is compressed once to compute its digest and
+		// once more when writing the output.
+		secs += 2 * float64(e.ScratchSize) / e.CompressRate
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+// estimateSquash computes sizes from the image manifest and probes the
+// beginning of the largest layer to estimate bandwidth, compression ratio
+// and local compression throughput.
+func estimateSquash(img v1.Image) (*squashEstimate, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %w", err)
+	}
+	e := &squashEstimate{}
+	var largest v1.Hash
+	var largestSize int64 = -1
+	for _, desc := range m.Layers {
+		e.CompressedSize += desc.Size
+		if desc.Size > largestSize {
+			largest, largestSize = desc.Digest, desc.Size
+		}
+	}
+	if largestSize <= 0 {
+		return e, nil
+	}
+	layer, err := img.LayerByDigest(largest)
+	if err != nil {
+		return nil, fmt.Errorf("get layer %s: %w", largest, err)
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, fmt.Errorf("read layer %s: %w", largest, err)
+	}
+	defer rc.Close()
+	// Don't count the latency before the first byte (auth handshakes,
+	// redirects) towards bandwidth.
+	var probe bytes.Buffer
+	if _, err := io.CopyN(&probe, rc, 1); err != nil {
+		return nil, fmt.Errorf("read layer %s: %w", largest, err)
+	}
+	start := time.Now()
+	n, err := io.Copy(&probe, io.LimitReader(rc, estimateProbeSize-1))
+	if err != nil {
+		return nil, fmt.Errorf("read layer %s: %w", largest, err)
+	}
+	if elapsed := time.Since(start); n > 0 && elapsed > 0 {
+		e.Bandwidth = float64(n) / elapsed.Seconds()
+	}
+
+	// Decompress whatever we got to estimate the compression ratio. The
+	// probe is usually truncated mid-stream, so a read error is expected.
+	ratio := 1.0
+	var raw bytes.Buffer
+	if zr, err := decompressProbe(probe.Bytes()); err == nil {
+		_, _ = io.Copy(&raw, zr)
+		if raw.Len() > 0 {
+			ratio = float64(raw.Len()) / float64(probe.Len())
+		}
+	} else {
+		raw = probe
+	}
+	e.ScratchSize = int64(float64(e.CompressedSize) * ratio)
+
+	start = time.Now()
+	zw := gzip.NewWriter(io.Discard)
+	if _, err := zw.Write(raw.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if elapsed := time.Since(start); elapsed > 0 {
+		e.CompressRate = float64(raw.Len()) / elapsed.Seconds()
+	}
+	return e, nil
+}
+
+func printEstimate(e *squashEstimate, remoteSource bool) {
+	if remoteSource {
+		fmt.Printf("Download size:       %s\n", humanize.Bytes(uint64(e.CompressedSize)))
+		fmt.Printf("Measured bandwidth:  %s/s\n", humanize.Bytes(uint64(e.Bandwidth)))
+	} else {
+		fmt.Printf("Source layers size:  %s\n", humanize.Bytes(uint64(e.CompressedSize)))
+	}
+	fmt.Printf("Scratch disk usage:  ~%s\n", humanize.Bytes(uint64(e.ScratchSize)))
+	fmt.Printf("Estimated duration:  ~%s\n", e.Duration().Round(time.Second))
+}
+
+// decompressProbe returns a reader of the decompressed contents of the
+// start of a gzip or zstd layer blob.
+func decompressProbe(b []byte) (io.Reader, error) {
+	if bytes.HasPrefix(b, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		// Decode synchronously, so that a truncated stream still yields
+		// the blocks before the cut.
+		return zstd.NewReader(bytes.NewReader(b), zstd.WithDecoderConcurrency(1))
+	}
+	return gzip.NewReader(bytes.NewReader(b))
+}
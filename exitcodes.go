@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/bduffany/docker-squash/pkg/squash"
+)
+
+// Exit codes. These are a stable interface for wrapper scripts; don't
+// renumber them.
+const (
+	exitOK             = 0
+	exitError          = 1
+	exitUsage          = 2
+	exitSourceNotFound = 3
+	exitAuth           = 4
+	exitNetwork        = 5
+	exitDiskSpace      = 6
+	exitVerification   = 7
+)
+
+type exitCodeInfo struct {
+	Code        int    `json:"code"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+var exitCodes = []exitCodeInfo{
+	{exitOK, "ok", "Success"},
+	{exitError, "error", "Any failure not covered by a more specific code"},
+	{exitUsage, "usage", "Invalid command line arguments or flags"},
+	{exitSourceNotFound, "source-not-found", "SOURCE (or the -previous image) does not exist"},
+	{exitAuth, "auth", "A registry rejected the credentials, or they don't allow the operation"},
+	{exitNetwork, "network", "A registry could not be reached"},
+	{exitDiskSpace, "disk-space", "Ran out of disk space or quota"},
+	{exitVerification, "verification", "The squashed image failed a check, like a -scan severity threshold or a -profile limit, or SOURCE failed the -trust-policy"},
+	{128 + 2, "interrupted", "Interrupted by SIGINT (128 + the signal number, in general)"},
+}
+
+// printExitCodes writes the exit code listing as JSON.
+func printExitCodes() error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(exitCodes)
+}
+
+// codedError associates an exit code with an error.
+type codedError struct {
+	code int
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// withExitCode returns err annotated with the process exit code to use if
+// it causes the program to fail.
+func withExitCode(code int, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// exitCodeFor returns the process exit code for err, from an explicit
+// withExitCode annotation if there is one, and otherwise by inspecting the
+// error chain.
+func exitCodeFor(err error) int {
+	var ee *codedError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	switch squash.Kind(err) {
+	case squash.ErrAuth:
+		return exitAuth
+	case squash.ErrDiskSpace:
+		return exitDiskSpace
+	case squash.ErrNetwork:
+		return exitNetwork
+	}
+	return exitError
+}
+
+// isNotFound returns whether err means a registry has no such image.
+func isNotFound(err error) bool {
+	return squash.Kind(err) == squash.ErrNotFound
+}
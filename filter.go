@@ -0,0 +1,357 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/dustin/go-humanize"
+)
+
+// filterRule is a -filter statement, like `chown 0:0 path ~ "/etc/**"`:
+// an action applied to each entry of the squashed rootfs that meets all of
+// its conditions.
+type filterRule struct {
+	// action is "drop", "chown" or "mode".
+	action   string
+	uid, gid int
+	mode     int64
+	conds    []filterCond
+}
+
+// filterCond is a condition of a filter statement, like `path ~ "*.conf"`
+// or `type == dir`.
+type filterCond struct {
+	field, op, value string
+}
+
+// filterTypes are the values a type condition can compare against.
+var filterTypes = []string{"file", "dir", "symlink", "hardlink", "other"}
+
+// parseFilters parses -filter values, each holding statements separated
+// by ";".
+func parseFilters(values []string) ([]*filterRule, error) {
+	var rules []*filterRule
+	for _, v := range values {
+		tokens, err := tokenizeFilter(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", v, err)
+		}
+		for len(tokens) > 0 {
+			n := 0
+			for n < len(tokens) && tokens[n] != ";" {
+				n++
+			}
+			stmt := tokens[:n]
+			tokens = tokens[min(n+1, len(tokens)):]
+			if len(stmt) == 0 {
+				continue
+			}
+			r, err := parseFilterStatement(stmt)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %w", strings.Join(stmt, " "), err)
+			}
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// tokenizeFilter splits a -filter value into words, quoted strings (kept
+// with their quotes), ";" and the operators "~", "!~", "==" and "!=".
+func tokenizeFilter(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == ';' || c == '~':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case strings.HasPrefix(s[i:], "!~") || strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!="):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune(";~\"!=", rune(s[j])) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected %q", s[i:i+1])
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func parseFilterStatement(stmt []string) (*filterRule, error) {
+	r := &filterRule{action: stmt[0]}
+	rest := stmt[1:]
+	switch r.action {
+	case "drop":
+	case "chown", "mode":
+		if len(rest) == 0 {
+			return nil, fmt.Errorf("%s needs a value", r.action)
+		}
+		var err error
+		if r.action == "chown" {
+			r.uid, r.gid, err = parseOwner(rest[0])
+		} else if r.mode, err = strconv.ParseInt(rest[0], 8, 64); err != nil || r.mode > 0o7777 || r.mode < 0 {
+			err = fmt.Errorf("invalid mode %q (expected octal permissions, like 0644)", rest[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+		rest = rest[1:]
+	default:
+		return nil, fmt.Errorf("unknown action %q (expected drop, chown or mode)", r.action)
+	}
+	for len(rest) > 0 {
+		if len(r.conds) > 0 {
+			if rest[0] != "and" {
+				return nil, fmt.Errorf("expected \"and\" before %q", rest[0])
+			}
+			rest = rest[1:]
+		}
+		if len(rest) < 3 {
+			return nil, fmt.Errorf("incomplete condition %q", strings.Join(rest, " "))
+		}
+		c := filterCond{field: rest[0], op: rest[1], value: rest[2]}
+		if strings.HasPrefix(c.value, `"`) {
+			v, err := strconv.Unquote(c.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s: %w", c.value, err)
+			}
+			c.value = v
+		}
+		switch {
+		case c.field == "path" && (c.op == "~" || c.op == "!~"):
+			if _, err := path.Match(strings.ReplaceAll(c.value, "**", "*"), ""); err != nil {
+				return nil, fmt.Errorf("invalid glob %q: %w", c.value, err)
+			}
+		case c.field == "path" && (c.op == "==" || c.op == "!="):
+			c.value = cleanTarPath(c.value)
+		case c.field == "type" && (c.op == "==" || c.op == "!="):
+			if !slices.Contains(filterTypes, c.value) {
+				return nil, fmt.Errorf("unknown type %q (expected %s)", c.value, strings.Join(filterTypes, ", "))
+			}
+		case c.field == "path" || c.field == "type":
+			return nil, fmt.Errorf("invalid operator %q for %s", c.op, c.field)
+		default:
+			return nil, fmt.Errorf("unknown field %q (expected path or type)", c.field)
+		}
+		r.conds = append(r.conds, c)
+		rest = rest[3:]
+	}
+	return r, nil
+}
+
+// matchFilterGlob returns whether the rootfs path name matches glob, in
+// which "**" matches any number of directories and other wildcards are as
+// for path.Match. A glob without a "/", like "*.conf", matches the base
+// name of paths in any directory.
+func matchFilterGlob(glob, name string) bool {
+	if !strings.Contains(glob, "/") {
+		ok, _ := path.Match(glob, path.Base(name))
+		return ok
+	}
+	return matchGlobParts(strings.Split(strings.Trim(glob, "/"), "/"), strings.Split(name, "/"))
+}
+
+func matchGlobParts(glob, parts []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchGlobParts(glob[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], parts[0]); !ok {
+			return false
+		}
+		glob, parts = glob[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// filterType returns the type name of hdr for type conditions.
+func filterType(hdr *tar.Header) string {
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	}
+	return "other"
+}
+
+// matches returns whether the entry name of type typ meets all of the
+// rule's conditions.
+func (r *filterRule) matches(name, typ string) bool {
+	for _, c := range r.conds {
+		if !c.holds(name, typ) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesDir returns whether the rule's positive conditions, of which it
+// must have one, all hold for the directory dir, so that a drop rule drops
+// everything below it. Negated conditions only apply to entries themselves:
+// otherwise, with `drop path !~ "/app/bin/*"`, /app/bin/x would go with
+// its parent, which doesn't match the glob.
+func (r *filterRule) matchesDir(dir string) bool {
+	positive := false
+	for _, c := range r.conds {
+		if c.negated() {
+			continue
+		}
+		if !c.holds(dir, "dir") {
+			return false
+		}
+		positive = true
+	}
+	return positive
+}
+
+func (c filterCond) negated() bool {
+	return strings.HasPrefix(c.op, "!")
+}
+
+// holds returns whether the entry name of type typ meets the condition.
+func (c filterCond) holds(name, typ string) bool {
+	var ok bool
+	switch c.field {
+	case "path":
+		if c.op == "~" || c.op == "!~" {
+			ok = matchFilterGlob(c.value, name)
+		} else {
+			ok = c.value == name
+		}
+	case "type":
+		ok = c.value == typ
+	}
+	return ok != c.negated()
+}
+
+// dropped returns whether a drop rule removes the entry name of type typ:
+// the entry matches one, or is below a directory that its positive
+// conditions match.
+func dropped(rules []*filterRule, name, typ string) bool {
+	for _, r := range rules {
+		if r.action != "drop" {
+			continue
+		}
+		if r.matches(name, typ) {
+			return true
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if r.matchesDir(dir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterEntries applies the -filter rules to each entry of the tar stream
+// rc as it's read.
+func filterEntries(rc io.ReadCloser, rules []*filterRule) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer rc.Close()
+		pw.CloseWithError(copyFiltered(pw, rc, rules))
+	}()
+	return pr
+}
+
+func copyFiltered(w io.Writer, r io.Reader, rules []*filterRule) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	var droppedCount, droppedLinks, chowned, chmodded int
+	var droppedSize int64
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, typ := cleanTarPath(hdr.Name), filterType(hdr)
+		if dropped(rules, name, typ) {
+			droppedCount++
+			droppedSize += hdr.Size
+			continue
+		}
+		if typ == "hardlink" && dropped(rules, cleanTarPath(hdr.Linkname), "file") {
+			// The file it links to is gone, so the link can't be kept.
+			logf("-filter: dropping /%s, a hard link to dropped /%s", name, cleanTarPath(hdr.Linkname))
+			droppedLinks++
+			continue
+		}
+		for _, rule := range rules {
+			if !rule.matches(name, typ) {
+				continue
+			}
+			switch rule.action {
+			case "chown":
+				if hdr.Uid != rule.uid || hdr.Gid != rule.gid {
+					chowned++
+				}
+				hdr.Uid, hdr.Gid = rule.uid, rule.gid
+				hdr.Uname, hdr.Gname = "", ""
+				delete(hdr.PAXRecords, "uname")
+				delete(hdr.PAXRecords, "gname")
+			case "mode":
+				if hdr.Mode&0o7777 != rule.mode {
+					chmodded++
+				}
+				hdr.Mode = hdr.Mode&^0o7777 | rule.mode
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	logf("-filter: dropped %s (%s of files), changed the owner of %s and the mode of %s", plural(droppedCount+droppedLinks, "entry"), humanize.Bytes(uint64(droppedSize)), plural(chowned, "entry"), plural(chmodded, "entry"))
+	return nil
+}
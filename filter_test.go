@@ -0,0 +1,142 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeFilter(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+		err  string
+	}{
+		{in: `drop path ~ "/usr/share/doc/**"`, want: []string{"drop", "path", "~", `"/usr/share/doc/**"`}},
+		{in: `drop path!~"*.md";mode 0644 type==file`, want: []string{"drop", "path", "!~", `"*.md"`, ";", "mode", "0644", "type", "==", "file"}},
+		{in: `chown 0:0 path != "/a \"b\""`, want: []string{"chown", "0:0", "path", "!=", `"/a \"b\""`}},
+		{in: "  ;\t; ", want: []string{";", ";"}},
+		{in: "", want: nil},
+		{in: `drop path ~ "/etc`, err: "unterminated string"},
+		{in: `drop path = "/etc"`, err: `unexpected "="`},
+		{in: `drop !path`, err: `unexpected "!"`},
+	} {
+		got, err := tokenizeFilter(tc.in)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("tokenizeFilter(%q) = %q, %v, want error %q", tc.in, got, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("tokenizeFilter(%q) = %q, %v, want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	for _, tc := range []struct {
+		in   []string
+		want []*filterRule
+		err  string
+	}{
+		{
+			in: []string{`drop path ~ "/usr/share/doc/**"; chown 1000:100 path == "/home/app/"`, `mode 0644 path ~ "*.conf" and type == file;`},
+			want: []*filterRule{
+				{action: "drop", conds: []filterCond{{"path", "~", "/usr/share/doc/**"}}},
+				{action: "chown", uid: 1000, gid: 100, conds: []filterCond{{"path", "==", "home/app"}}},
+				{action: "mode", mode: 0o644, conds: []filterCond{{"path", "~", "*.conf"}, {"type", "==", "file"}}},
+			},
+		},
+		{
+			in: []string{`drop path !~ "/app/bin/*" and type != dir`, "drop"},
+			want: []*filterRule{
+				{action: "drop", conds: []filterCond{{"path", "!~", "/app/bin/*"}, {"type", "!=", "dir"}}},
+				{action: "drop"},
+			},
+		},
+		{in: []string{";;"}, want: nil},
+		{in: []string{"delete path == /etc"}, err: "unknown action"},
+		{in: []string{"chown"}, err: "chown needs a value"},
+		{in: []string{"mode 0999"}, err: "invalid mode"},
+		{in: []string{"mode 10000"}, err: "invalid mode"},
+		{in: []string{`drop path ~ "/etc" type == dir`}, err: `expected "and"`},
+		{in: []string{"drop path ~"}, err: "incomplete condition"},
+		{in: []string{`drop path ~ "[/etc"`}, err: "invalid glob"},
+		{in: []string{"drop type == socket"}, err: "unknown type"},
+		{in: []string{"drop type ~ dir"}, err: `invalid operator "~" for type`},
+		{in: []string{"drop size == 0"}, err: "unknown field"},
+	} {
+		got, err := parseFilters(tc.in)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("parseFilters(%q) = %v, want an error containing %q", tc.in, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseFilters(%q) = %+v, %v, want %+v", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestMatchFilterGlob(t *testing.T) {
+	for _, tc := range []struct {
+		glob, name string
+		want       bool
+	}{
+		{"/usr/share/doc/**", "usr/share/doc", true},
+		{"/usr/share/doc/**", "usr/share/doc/bash/README", true},
+		{"/usr/share/doc/**", "usr/share/docs", false},
+		{"/**/*.pyc", "app.pyc", true},
+		{"/**/*.pyc", "usr/lib/python3/x/y.pyc", true},
+		{"/**/*.pyc", "usr/lib/python3/x/y.py", false},
+		{"/usr/**/bin/*", "usr/bin/ls", true},
+		{"/usr/**/bin/*", "usr/local/x/bin/ls", true},
+		{"/usr/**/bin/*", "usr/local/bin", false},
+		{"/etc/*", "etc/passwd", true},
+		{"/etc/*", "etc/ssl/certs", false},
+		{"*.conf", "etc/nginx/nginx.conf", true},
+		{"*.conf", "etc/nginx/conf.d", false},
+	} {
+		if got := matchFilterGlob(tc.glob, tc.name); got != tc.want {
+			t.Errorf("matchFilterGlob(%q, %q) = %v, want %v", tc.glob, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDropped(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		name   string
+		typ    string
+		want   bool
+	}{
+		{`drop path ~ "/usr/share/doc/**"`, "usr/share/doc", "dir", true},
+		{`drop path ~ "/usr/share/doc/**"`, "usr/share/doc/bash/README", "file", true},
+		{`drop path ~ "/usr/share/doc/**"`, "usr/share/man/man1/ls.1", "file", false},
+		{`drop path == "/var/cache"`, "var/cache/apt/pkgcache.bin", "file", true},
+		{`drop path == "/var/cache"`, "var/cache.conf", "file", false},
+		{`drop type == dir and path == "/tmp"`, "tmp/x", "file", true},
+		{`drop type == file and path ~ "/opt/**"`, "opt/app/run", "symlink", false},
+		// Negated conditions only apply to the entry itself, not to
+		// the directories above it.
+		{`drop path !~ "/app/bin/*"`, "app/bin/x", "file", false},
+		{`drop path !~ "/app/bin/*"`, "app/lib/x", "file", true},
+		{`drop path != "/app"`, "app/x", "file", true},
+		{`drop path != "/app"`, "app", "dir", false},
+		{`drop type != dir`, "etc/passwd", "file", true},
+		{`drop type != dir`, "etc/ssl", "dir", false},
+		{`drop path ~ "/app/**" and path !~ "/app/keep/**"`, "app/keep/x", "file", true},
+		{`drop path ~ "/app/**" and path !~ "/app/keep/**"`, "etc/x", "file", false},
+		{`chown 0:0 path ~ "/app/**"`, "app/x", "file", false},
+	} {
+		rules, err := parseFilters([]string{tc.filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := dropped(rules, tc.name, tc.typ); got != tc.want {
+			t.Errorf("%s: dropped(%q, %s) = %v, want %v", tc.filter, tc.name, tc.typ, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "strings"
+
+// stringsFlag is a flag.Value that can be passed multiple times, collecting
+// each value.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
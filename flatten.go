@@ -0,0 +1,327 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	// opaqueWhiteout in a directory hides everything that lower layers put
+	// in that directory.
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// extractImage returns the flattened filesystem of img as a tar stream. It
+// works like mutate.Extract, which this is adapted from, but also honors
+// opaque whiteouts, which mutate.Extract passes through as regular files
+// while leaving the hidden lower-layer entries in place.
+func extractImage(img v1.Image) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(extractImageTo(img, pw, nil))
+	}()
+	return pr
+}
+
+// extractSquashedRootfs is extractImage for the rootfs being squashed,
+// which also reports paths whose type conflicts across layers, failing
+// with -fail-on-conflicts.
+func extractSquashedRootfs(img v1.Image) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(extractImageTo(img, pw, newPathConflicts()))
+	}()
+	return pr
+}
+
+// extractImageTo writes the flattened filesystem of img to w as a tar
+// stream. If conflicts isn't nil, they're reported before the end of the
+// stream, so that a failure isn't mistaken for the end.
+func extractImageTo(img v1.Image, w io.Writer, conflicts *pathConflicts) error {
+	tw := tar.NewWriter(w)
+	err := walkImage(img, conflicts, func(_ int, hdr *tar.Header, r io.Reader) error {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Size > 0 {
+			if _, err := io.CopyN(tw, r, hdr.Size); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && conflicts != nil {
+		err = conflicts.report()
+	}
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// walkImage calls emit for each entry of the flattened filesystem of img,
+// with the index of the layer it's from and a reader of its content. If
+// conflicts isn't nil, it records the paths whose type conflicts across
+// layers.
+func walkImage(img v1.Image, conflicts *pathConflicts, emit func(layer int, hdr *tar.Header, r io.Reader) error) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("retrieving image layers: %w", err)
+	}
+	w := &imageWalker{
+		seen:      map[string]bool{},
+		opaque:    map[string]bool{},
+		pending:   map[string][]hardlink{},
+		reread:    map[int]map[string][]hardlink{},
+		conflicts: conflicts,
+		emit:      emit,
+	}
+	// Walk the layers top-down, so that each path is written (or whited
+	// out) by the first layer that has it.
+	for i := len(layers) - 1; i >= 0; i-- {
+		rc, err := layers[i].Uncompressed()
+		if err != nil {
+			return fmt.Errorf("reading layer contents: %w", err)
+		}
+		rc = timeReadCloser(rc, phaseExtract, phasePull)
+		err = w.walkLayer(tar.NewReader(rc), i)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return w.finish(layers)
+}
+
+// hardlink is a hardlink entry of a layer.
+type hardlink struct {
+	hdr   *tar.Header
+	layer int
+}
+
+// imageWalker is the state of walkImage.
+type imageWalker struct {
+	// Paths seen so far, mapped to whether they hide everything below them
+	// (whiteouts and non-directories).
+	seen map[string]bool
+	// Directories made opaque by the layers above the current one.
+	opaque map[string]bool
+	// pending are the hardlinks, by target, whose targets are in lower
+	// layers. They're written once their target has been, so that it comes
+	// first, or, if it's hidden, the first is written as a copy of it.
+	pending map[string][]hardlink
+	// reread are the hardlinks, by layer and target, whose targets come
+	// earlier in the same layer but are hidden, so that layer is read again
+	// for their contents.
+	reread    map[int]map[string][]hardlink
+	conflicts *pathConflicts
+	emit      func(layer int, hdr *tar.Header, r io.Reader) error
+}
+
+func (w *imageWalker) walkLayer(tr *tar.Reader, layer int) error {
+	layerOpaque := map[string]bool{}
+	// The paths of this layer so far, mapped to whether they were written,
+	// and its hardlinks, mapped to the file they link to.
+	written := map[string]bool{}
+	linkTargets := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+		// Some tools prefix names with "./", which would otherwise result
+		// in duplicate entries.
+		hdr.Name = path.Clean(hdr.Name)
+		// Use PAX to lift the USTAR name length limits.
+		hdr.Format = tar.FormatPAX
+
+		dir, base := path.Split(hdr.Name)
+		dir = path.Clean(dir)
+		if base == opaqueWhiteout {
+			if !hiddenByAncestor(dir, w.seen, w.opaque) {
+				layerOpaque[dir] = true
+			}
+			continue
+		}
+		tombstone := strings.HasPrefix(base, whiteoutPrefix)
+		name := hdr.Name
+		if tombstone {
+			name = path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			w.conflicts.whiteout(name, layer)
+		}
+		hidden := false
+		if hides, ok := w.seen[name]; ok {
+			if tombstone {
+				if _, same := written[name]; !hides && !same {
+					// A directory re-created above a whiteout doesn't
+					// bring back what was below the whiteout.
+					w.seen[name] = true
+				}
+				continue
+			}
+			hidden = true
+			w.conflicts.hidden(name, layer, hdr)
+		} else if hiddenByAncestor(name, w.seen, w.opaque) {
+			if tombstone {
+				continue
+			}
+			hidden = true
+		} else {
+			// A non-directory implicitly hides anything below it.
+			w.seen[name] = tombstone || hdr.Typeflag != tar.TypeDir
+			if tombstone {
+				continue
+			}
+			w.conflicts.provided(name, layer, hdr)
+		}
+		if _, ok := written[name]; !ok {
+			written[name] = !hidden
+		}
+
+		// The hardlinks to this path in higher layers are to this entry.
+		links := w.pending[name]
+		delete(w.pending, name)
+		if hdr.Typeflag == tar.TypeLink {
+			if !hidden {
+				links = append([]hardlink{{hdr, layer}}, links...)
+			}
+			target := path.Clean(hdr.Linkname)
+			for linkTargets[target] != "" {
+				target = linkTargets[target]
+			}
+			if target != name {
+				// Later hardlinks to this one are to the same file.
+				linkTargets[name] = target
+			}
+			targetWritten, inLayer := written[target]
+			switch {
+			case targetWritten:
+				err = w.writeLinks(target, links)
+			case len(links) == 0:
+			case inLayer:
+				if w.reread[layer] == nil {
+					w.reread[layer] = map[string][]hardlink{}
+				}
+				w.reread[layer][target] = append(w.reread[layer][target], links...)
+			default:
+				w.pending[target] = append(w.pending[target], links...)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !hidden {
+			if err := w.emit(layer, hdr, tr); err != nil {
+				return err
+			}
+			err = w.writeLinks(name, links)
+		} else {
+			err = w.writeCopy(hdr, tr, links)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Opaque whiteouts only hide entries from lower layers.
+	for dir := range layerOpaque {
+		w.opaque[dir] = true
+	}
+	return nil
+}
+
+// writeLinks writes links as hardlinks to target, which has been written.
+func (w *imageWalker) writeLinks(target string, links []hardlink) error {
+	for _, l := range links {
+		hdr := *l.hdr
+		hdr.Linkname = target
+		if err := w.emit(l.layer, &hdr, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCopy writes the first of links as a copy of their target, which is
+// hidden, and the rest as hardlinks to it.
+func (w *imageWalker) writeCopy(target *tar.Header, r io.Reader, links []hardlink) error {
+	if len(links) == 0 {
+		return nil
+	}
+	hdr := *target
+	hdr.Name = links[0].hdr.Name
+	if err := w.emit(links[0].layer, &hdr, r); err != nil {
+		return err
+	}
+	return w.writeLinks(hdr.Name, links[1:])
+}
+
+// finish writes the hardlinks still waiting for their targets: those whose
+// targets were hidden earlier in their own layer, once that layer is read
+// again, and the dangling ones as they are. Layers and targets are taken in
+// sorted order, so that the squashed tarball is the same on every run.
+func (w *imageWalker) finish(layers []v1.Layer) error {
+	for _, i := range slices.Sorted(maps.Keys(w.reread)) {
+		targets := w.reread[i]
+		rc, err := layers[i].Uncompressed()
+		if err != nil {
+			return fmt.Errorf("reading layer contents: %w", err)
+		}
+		tr := tar.NewReader(rc)
+		for len(targets) > 0 {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				rc.Close()
+				return fmt.Errorf("reading tar: %w", err)
+			}
+			name := path.Clean(hdr.Name)
+			if links, ok := targets[name]; ok {
+				delete(targets, name)
+				if err := w.writeCopy(hdr, tr, links); err != nil {
+					rc.Close()
+					return err
+				}
+			}
+		}
+		rc.Close()
+		for _, target := range slices.Sorted(maps.Keys(targets)) {
+			w.pending[target] = append(w.pending[target], targets[target]...)
+		}
+	}
+	for _, target := range slices.Sorted(maps.Keys(w.pending)) {
+		for _, l := range w.pending[target] {
+			if err := w.emit(l.layer, l.hdr, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hiddenByAncestor returns whether name is inside a directory that a higher
+// layer whited out, replaced with a non-directory, or made opaque.
+func hiddenByAncestor(name string, seen, opaque map[string]bool) bool {
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if seen[dir] || opaque[dir] {
+			return true
+		}
+		if dir == "." || dir == "/" {
+			return false
+		}
+	}
+}
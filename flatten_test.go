@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/bduffany/docker-squash/pkg/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// runAsMainEnv is set for the test binary to run as docker-squash, so that
+// tests squash with the same command line, flag parsing and exit codes as
+// the real binary.
+const runAsMainEnv = "DOCKER_SQUASH_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runAsMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// squashTestLayers pushes an image with a layer for each set of files to an
+// in-process registry, squashes it, and returns the squashed image after
+// checking that it has the filesystem the layers describe.
+func squashTestLayers(t *testing.T, layers ...[]testutil.File) v1.Image {
+	t.Helper()
+	reg, err := testutil.StartRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(reg.Close)
+	img, err := testutil.Image(layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := reg.Push("test:source", img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runSquash(t, "docker://"+src.String(), "docker://"+reg.Host+"/test:squashed"); err != nil {
+		t.Fatalf("squash: %v\n%s", err, out)
+	}
+	squashed, err := reg.Pull("test:squashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkOneLayer(squashed); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckSquashed(squashed, testutil.Flatten(layers...)); err != nil {
+		t.Error(err)
+	}
+	return squashed
+}
+
+// runSquash runs docker-squash with args, without a cache and with
+// -reproducible, and returns its output.
+func runSquash(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-cache-dir=", "-reproducible"}, args...)...)
+	cmd.Env = append(os.Environ(), runAsMainEnv+"=1", "TMPDIR="+t.TempDir())
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	return out.String(), err
+}
+
+func TestSquashOpaqueWhiteout(t *testing.T) {
+	squashTestLayers(t,
+		[]testutil.File{
+			testutil.Dir("opt", 0755),
+			testutil.Dir("opt/app", 0755),
+			testutil.Reg("opt/app/old", "old", 0644),
+			testutil.Dir("opt/app/lib", 0755),
+			testutil.Reg("opt/app/lib/libold.so", "libold", 0755),
+			testutil.Reg("opt/other", "other", 0644),
+		},
+		[]testutil.File{
+			testutil.Reg("opt/app/kept", "added below the opaque layer", 0644),
+		},
+		[]testutil.File{
+			// Hides everything the layers below put in opt/app, but not
+			// opt/app itself, its siblings, or what this layer adds.
+			testutil.Dir("opt/app", 0750),
+			testutil.OpaqueWhiteout("opt/app"),
+			testutil.Reg("opt/app/new", "new", 0644),
+		},
+	)
+}
+
+func TestSquashWhiteoutThenRecreate(t *testing.T) {
+	squashTestLayers(t,
+		[]testutil.File{
+			testutil.Dir("etc", 0755),
+			testutil.Reg("etc/app.conf", "v1", 0644),
+			testutil.Dir("var", 0755),
+			testutil.Dir("var/cache", 0755),
+			testutil.Reg("var/cache/stale", "stale", 0644),
+			testutil.Reg("var/run", "a file, later a directory", 0644),
+		},
+		[]testutil.File{
+			testutil.Whiteout("etc/app.conf"),
+			testutil.Whiteout("var/cache"),
+			testutil.Whiteout("var/run"),
+		},
+		[]testutil.File{
+			// Re-created with different contents, modes and types: nothing
+			// of what the whiteouts deleted may come back.
+			testutil.Reg("etc/app.conf", "v3", 0600),
+			testutil.Dir("var/cache", 0700),
+			testutil.Reg("var/cache/fresh", "fresh", 0644),
+			testutil.Dir("var/run", 0755),
+			testutil.Reg("var/run/app.pid", "1", 0644),
+		},
+	)
+}
+
+func TestSquashHardlinksAcrossLayers(t *testing.T) {
+	img := squashTestLayers(t,
+		[]testutil.File{
+			testutil.Dir("usr", 0755),
+			testutil.Dir("usr/bin", 0755),
+			testutil.Reg("usr/bin/python3.12", "python", 0755),
+			testutil.Reg("usr/bin/perl5.38", "perl", 0755),
+			testutil.Reg("usr/bin/ruby3.3", "ruby", 0755),
+			testutil.Dir("usr/lib", 0755),
+			testutil.Reg("usr/lib/libssl.so.3", "libssl", 0644),
+			testutil.Hardlink("usr/lib/libssl.so", "usr/lib/libssl.so.3"),
+		},
+		[]testutil.File{
+			// Links to files in the layer below.
+			testutil.Hardlink("usr/bin/python3", "usr/bin/python3.12"),
+			testutil.Hardlink("usr/bin/perl", "usr/bin/perl5.38"),
+			testutil.Hardlink("usr/bin/ruby", "usr/bin/ruby3.3"),
+		},
+		[]testutil.File{
+			// The link outlives its deleted target, and keeps the content
+			// of a target that is replaced.
+			testutil.Whiteout("usr/bin/perl5.38"),
+			testutil.Reg("usr/bin/ruby3.3", "ruby, patched", 0755),
+			testutil.Reg("usr/lib/libssl.so.3", "libssl, patched", 0644),
+		},
+	)
+	if err := checkHardlinks(img, "usr/bin/python3", "usr/bin/python3.12"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSquashHardlinksReproducible(t *testing.T) {
+	// Links whose targets are replaced later in their own layer are written
+	// once the layer is read again, and links to targets that don't exist
+	// are written last: both in the same order on every run.
+	var layers [][]testutil.File
+	for _, dir := range []string{"a", "b", "c"} {
+		files := []testutil.File{testutil.Dir(dir, 0755)}
+		var patches []testutil.File
+		for _, n := range []string{"1", "2", "3", "4"} {
+			files = append(files,
+				testutil.Reg(dir+"/lib"+n, "lib"+n, 0644),
+				testutil.Hardlink(dir+"/link"+n, dir+"/lib"+n),
+				testutil.Hardlink(dir+"/dangling"+n, dir+"/missing"+n),
+			)
+			patches = append(patches, testutil.Reg(dir+"/lib"+n, "lib"+n+", patched", 0644))
+		}
+		layers = append(layers, files, patches)
+	}
+	reg, err := testutil.StartRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(reg.Close)
+	img, err := testutil.Image(layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := reg.Push("test:source", img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digests []v1.Hash
+	for i := range 4 {
+		dst := "test:squashed" + string(rune('0'+i))
+		if out, err := runSquash(t, "docker://"+src.String(), "docker://"+reg.Host+"/"+dst); err != nil {
+			t.Fatalf("squash: %v\n%s", err, out)
+		}
+		squashed, err := reg.Pull(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := squashed.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, d)
+	}
+	for _, d := range digests[1:] {
+		if d != digests[0] {
+			t.Fatalf("squashing the same image gave digests %v", digests)
+		}
+	}
+}
+
+func TestSourceLayersLabel(t *testing.T) {
+	reg, err := testutil.StartRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(reg.Close)
+	base := []testutil.File{testutil.Dir("etc", 0755), testutil.Reg("etc/os-release", "ID=test", 0644)}
+	app := []testutil.File{testutil.Dir("app", 0755), testutil.Reg("app/run", "run", 0755)}
+	for repo, layers := range map[string][][]testutil.File{"test:base": {base}, "test:source": {base, app}} {
+		img, err := testutil.Image(layers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reg.Push(repo, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src, err := reg.Pull("test:source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := src.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With -previous, the base layer is carried over rather than squashed.
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, m.Layers[0].Digest.String() + "," + m.Layers[1].Digest.String()},
+		{[]string{"-previous", "docker://" + reg.Host + "/test:base"}, m.Layers[1].Digest.String()},
+	} {
+		args := append(tc.args, "docker://"+reg.Host+"/test:source", "docker://"+reg.Host+"/test:squashed")
+		if out, err := runSquash(t, args...); err != nil {
+			t.Fatalf("squash %q: %v\n%s", args, err, out)
+		}
+		squashed, err := reg.Pull("test:squashed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := squashed.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cfg.Config.Labels[sourceLayersLabel]; got != tc.want {
+			t.Errorf("squash %q: got %s %q, want %q", args, sourceLayersLabel, got, tc.want)
+		}
+	}
+}
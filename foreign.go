@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// foreignBase returns, for -keep-foreign-layers, an image of just the
+// foreign (non-distributable) layers at the bottom of img, like Windows base
+// layers, with their original descriptors so that the output manifest
+// points at the same URLs. It returns nil if img has no foreign layers.
+func foreignBase(img v1.Image) (*source, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %w", err)
+	}
+	n := 0
+	for n < len(m.Layers) && !m.Layers[n].MediaType.IsDistributable() {
+		n++
+	}
+	for _, desc := range m.Layers[n:] {
+		if !desc.MediaType.IsDistributable() {
+			return nil, fmt.Errorf("foreign layer %s is above distributable layers; -keep-foreign-layers only keeps foreign layers at the bottom of the image", desc.Digest)
+		}
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("get image layers: %w", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("get config file: %w", err)
+	}
+	// The history entries of the kept layers, skipping those of
+	// instructions that created no layer.
+	var history []v1.History
+	for _, h := range cfg.History {
+		if !h.EmptyLayer {
+			history = append(history, h)
+		}
+	}
+	var adds []mutate.Addendum
+	for i, desc := range m.Layers[:n] {
+		add := mutate.Addendum{Layer: layers[i], MediaType: desc.MediaType, URLs: desc.URLs, Annotations: desc.Annotations}
+		if i < len(history) {
+			add.History = history[i]
+		}
+		adds = append(adds, add)
+	}
+	base, err := mutate.Append(empty.Image, adds...)
+	if err != nil {
+		return nil, fmt.Errorf("append foreign layers: %w", err)
+	}
+	logf("Keeping %s by reference", plural(n, "foreign base layer"))
+	return &source{Image: base}, nil
+}
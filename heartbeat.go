@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+// heartbeatInterval is how often a long phase logs its progress when
+// stderr isn't a terminal, as in CI, where it'd otherwise look hung.
+const heartbeatInterval = 30 * time.Second
+
+// startHeartbeat reports status, given the time since it started, until
+// the returned stop is called: in place every second on a terminal, like
+// progressWriter, and otherwise as a log line every heartbeatInterval.
+// Nothing is reported for phases that end before the first report.
+func startHeartbeat(status func(elapsed time.Duration) string) (stop func()) {
+	if *quiet {
+		return func() {}
+	}
+	tty := isatty.IsTerminal(os.Stderr.Fd())
+	interval := heartbeatInterval
+	if tty {
+		interval = time.Second
+	}
+	start := time.Now()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		printed := false
+		for {
+			select {
+			case <-done:
+				if printed {
+					// Leave the final status on the terminal.
+					fmt.Fprintf(os.Stderr, "\033[1A\033[K\r%s\n", status(time.Since(start)))
+				}
+				return
+			case <-ticker.C:
+				if !tty {
+					logf("%s", status(time.Since(start)))
+					continue
+				}
+				if printed {
+					fmt.Fprintf(os.Stderr, "\033[1A\033[K\r")
+				}
+				fmt.Fprintf(os.Stderr, "%s\n", status(time.Since(start)))
+				printed = true
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// byteCounter is a writer that counts what's written to it, safely read
+// by a heartbeat while it's written.
+type byteCounter struct {
+	atomic.Int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.Add(int64(len(p)))
+	return len(p), nil
+}
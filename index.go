@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// platformString formats p like "linux/arm64/v8".
+func platformString(p *v1.Platform) string {
+	if p == nil {
+		return "unknown platform"
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// squashIndex squashes each platform's image in src's index, returning a
+// new index of the squashed images. Attestation manifests and nested
+// indexes are skipped, since they don't describe a platform's filesystem.
+func squashIndex(sq *squasher, src *source) (v1.ImageIndex, error) {
+	im, err := src.Index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("get source index manifest: %w", err)
+	}
+	if len(src.Refs) > 0 && isDockerHub(src.Refs[0].Context().RegistryStr()) {
+		n := 0
+		for _, desc := range im.Manifests {
+			if desc.MediaType.IsImage() && desc.Platform != nil && desc.Platform.OS != "unknown" {
+				n++
+			}
+		}
+		checkHubQuota(n, "-all-platforms")
+	}
+	var adds []mutate.IndexAddendum
+	for _, desc := range im.Manifests {
+		if !desc.MediaType.IsImage() {
+			logf("Skipping %s: %s is not an image", desc.Digest, desc.MediaType)
+			continue
+		}
+		if desc.Platform == nil || desc.Platform.OS == "unknown" {
+			logf("Skipping %s: not a platform image (likely an attestation manifest)", desc.Digest)
+			continue
+		}
+		img, err := src.Index.Image(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("get %s image: %w", platformString(desc.Platform), err)
+		}
+		if err := checkManifestLimits(img); err != nil {
+			return nil, fmt.Errorf("%s image: %w", platformString(desc.Platform), err)
+		}
+		if img, err = decryptImage(img); err != nil {
+			return nil, fmt.Errorf("%s image: %w", platformString(desc.Platform), err)
+		}
+		if err := checkForeignLayers(img); err != nil {
+			return nil, err
+		}
+		logf("Squashing %s image %s", platformString(desc.Platform), desc.Digest)
+		flat, err := sq.squash(img, nil, src.Registry)
+		if err != nil {
+			return nil, fmt.Errorf("squash %s image: %w", platformString(desc.Platform), err)
+		}
+		annotations, err := filterAnnotations(desc.Annotations)
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, mutate.IndexAddendum{
+			Add: flat,
+			Descriptor: v1.Descriptor{
+				Platform:    desc.Platform,
+				Annotations: annotations,
+			},
+		})
+	}
+	if len(adds) == 0 {
+		return nil, fmt.Errorf("source index has no platform images")
+	}
+	mt, err := outputIndexMediaType(im.MediaType, nil)
+	if err != nil {
+		return nil, err
+	}
+	idx := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, mt), adds...)
+	annotations, err := filterAnnotations(im.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	if len(annotations) > 0 {
+		idx = mutate.Annotations(idx, annotations).(v1.ImageIndex)
+	}
+	return idx, nil
+}
+
+// writeIndex writes idx to outputPath: pushed as-is for registry DESTs, or
+// as an oci-archive for local ones.
+func writeIndex(outputPath string, outRefs []name.Reference, idx v1.ImageIndex, prov *provenance) error {
+	if isRegistryDest(outputPath) {
+		return pushIndex(outRefs[0], idx)
+	}
+	logf("Writing %q as an oci-archive (a tarball of an OCI image layout), since docker-archive tarballs can't hold a multi-platform image", outputPath)
+	return writeOCIArchive(outputPath, outRefs, idx, prov)
+}
+
+func pushIndex(ref name.Reference, idx v1.ImageIndex) error {
+	logf("Pushing image index to %q", ref)
+	_, err := pushWithFallback(ref.Context().RegistryStr(), idx, func(t remote.Taggable) error {
+		return writeWithProgress(func(opts ...remote.Option) error {
+			return remote.WriteIndex(ref, t.(v1.ImageIndex), opts...)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("push image index to %q: %w", ref, err)
+	}
+	return nil
+}
+
+// writeOCIArchive writes the image or index t to outputPath as a tarball of
+// an OCI image layout, with an index.json entry for each of outRefs and
+// prov alongside.
+func writeOCIArchive(outputPath string, outRefs []name.Reference, t remote.Taggable, prov *provenance) error {
+	parent := ""
+	if tempKey != nil {
+		// The layout holds the image's blobs as they'll be in outputPath,
+		// so with -encrypt-tmp it's staged beside it instead, which a pipe
+		// or device doesn't have.
+		if isStreamDest(outputPath) {
+			return fmt.Errorf("write oci-archive to %q: with -encrypt-tmp, oci-archives are staged beside DEST, so they can't be written to a pipe or device", outputPath)
+		}
+		parent = filepath.Dir(outputPath)
+	}
+	dir, err := mkdirTempIn(parent, "docker-squash-layout-*")
+	if err != nil {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+	if err := writeLayout(dir, outRefs, t, prov); err != nil {
+		return err
+	}
+	if err := tarDir(dir, outputPath); err != nil {
+		return fmt.Errorf("write oci-archive to %q: %w", outputPath, err)
+	}
+	return nil
+}
+
+// writeOCILayout writes the image or index t to outputPath as an OCI image
+// layout directory, like the ones Bazel's rules_oci oci_image writes and
+// oci_load reads.
+func writeOCILayout(outputPath string, outRefs []name.Reference, t remote.Taggable, prov *provenance) error {
+	if err := checkLayoutDest(outputPath); err != nil {
+		return err
+	}
+	logf("Writing %q as an OCI image layout directory", outputPath)
+	return writeLayout(outputPath, outRefs, t, prov)
+}
+
+// checkLayoutDest checks that the OCI layout directory output path doesn't
+// exist yet, or is an empty directory, like the ones Bazel creates for an
+// action's declared directory outputs.
+func checkLayoutDest(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q exists and isn't a directory, so it can't be written as an OCI layout", path)
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%q isn't empty; OCI layouts are only written to new or empty directories", path)
+	}
+	return nil
+}
+
+// writeLayout writes the image or index t to the OCI image layout directory
+// dir, with an index.json entry for each of outRefs and prov alongside.
+func writeLayout(dir string, outRefs []name.Reference, t remote.Taggable, prov *provenance) error {
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return fmt.Errorf("write OCI layout: %w", err)
+	}
+	for _, ref := range outRefs {
+		ann := layout.WithAnnotations(map[string]string{
+			// The ref name convention used by buildx and containerd.
+			"io.containerd.image.name":          ref.Name(),
+			"org.opencontainers.image.ref.name": ref.Identifier(),
+		})
+		if idx, ok := t.(v1.ImageIndex); ok {
+			err = lp.AppendIndex(idx, ann)
+		} else {
+			err = lp.AppendImage(t.(v1.Image), ann)
+		}
+		if err != nil {
+			return fmt.Errorf("write OCI layout: %w", err)
+		}
+	}
+
+	data, err := prov.marshal(t)
+	if err != nil {
+		return fmt.Errorf("describe output: %w", err)
+	}
+	return os.WriteFile(filepath.Join(dir, provenanceFile), data, 0644)
+}
+
+// tarDir writes the contents of dir to a tarball at outputPath.
+func tarDir(dir, outputPath string) error {
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output file: %w", err)
+	}
+	defer out.Close()
+	progress := &progressWriter{}
+	tw := tar.NewWriter(io.MultiWriter(out, progress))
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		outputArchive.apply(hdr)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		return err
+	}
+	progress.Print()
+	return nil
+}
+
+// platformSource is a parsed -source flag value.
+type platformSource struct {
+	Platform *v1.Platform
+	Path     string
+}
+
+// parsePlatformSources parses -source values like "linux/arm64=SOURCE".
+func parsePlatformSources(values []string) ([]platformSource, error) {
+	var pss []platformSource
+	seen := map[string]bool{}
+	for _, v := range values {
+		p, path, ok := strings.Cut(v, "=")
+		if !ok || p == "" || path == "" {
+			return nil, fmt.Errorf("%q: expected PLATFORM=SOURCE", v)
+		}
+		platform, err := v1.ParsePlatform(p)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", v, err)
+		}
+		if platform.OS == "" || platform.Architecture == "" {
+			return nil, fmt.Errorf("%q: platform must be OS/ARCH[/VARIANT]", v)
+		}
+		if seen[platformString(platform)] {
+			return nil, fmt.Errorf("platform %s given more than once", platformString(platform))
+		}
+		seen[platformString(platform)] = true
+		pss = append(pss, platformSource{Platform: platform, Path: path})
+	}
+	return pss, nil
+}
+
+// openPlatformSource opens ps.Path. If it's a multi-platform index, the
+// image for ps.Platform is selected from it instead of the default.
+func openPlatformSource(ps platformSource) (*source, error) {
+	src, err := openSource(ps.Path)
+	if err != nil {
+		return nil, err
+	}
+	if src.Index == nil {
+		return src, nil
+	}
+	im, err := src.Index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("get source index manifest: %w", err)
+	}
+	for _, desc := range im.Manifests {
+		if desc.MediaType.IsImage() && desc.Platform != nil && desc.Platform.Satisfies(*ps.Platform) {
+			img, err := src.Index.Image(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("get %s image: %w", platformString(ps.Platform), err)
+			}
+			src.Image = img
+			return src, nil
+		}
+	}
+	return nil, withExitCode(exitSourceNotFound, fmt.Errorf("%q has no %s image", ps.Path, platformString(ps.Platform)))
+}
+
+// squashPlatformSources squashes the image of each of pss, returning an
+// index of the squashed images. first is the already-opened source of
+// pss[0].
+func squashPlatformSources(sq *squasher, pss []platformSource, first *source) (v1.ImageIndex, error) {
+	hubPulls := 0
+	for _, ps := range pss[1:] {
+		if !isRegistrySource(ps.Path) {
+			continue
+		}
+		if ref, err := parseDockerRef(strings.TrimPrefix(ps.Path, "docker://")); err == nil && isDockerHub(ref.Context().RegistryStr()) {
+			hubPulls++
+		}
+	}
+	checkHubQuota(hubPulls, "-source")
+	var adds []mutate.IndexAddendum
+	for i, ps := range pss {
+		src := first
+		if i > 0 {
+			var err error
+			if src, err = openPlatformSource(ps); err != nil {
+				return nil, err
+			}
+			if err := checkManifestLimits(src.Image); err != nil {
+				return nil, fmt.Errorf("%s image: %w", platformString(ps.Platform), err)
+			}
+			if err := checkForeignLayers(src.Image); err != nil {
+				return nil, err
+			}
+		}
+		img, err := decryptImage(src.Image)
+		if err != nil {
+			return nil, fmt.Errorf("%s image: %w", platformString(ps.Platform), err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("get %s image config: %w", platformString(ps.Platform), err)
+		}
+		if got := (v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant}); !got.Satisfies(*ps.Platform) {
+			logf("Warning: %q is configured as a %s image, but is given as %s", ps.Path, platformString(&got), platformString(ps.Platform))
+		}
+		logf("Squashing %s image %q", platformString(ps.Platform), ps.Path)
+		flat, err := sq.squash(img, nil, src.Registry)
+		if err != nil {
+			return nil, fmt.Errorf("squash %s image: %w", platformString(ps.Platform), err)
+		}
+		adds = append(adds, mutate.IndexAddendum{
+			Add:        flat,
+			Descriptor: v1.Descriptor{Platform: ps.Platform},
+		})
+	}
+	var imgs []v1.Image
+	for _, add := range adds {
+		imgs = append(imgs, add.Add.(v1.Image))
+	}
+	mt, err := outputIndexMediaType("", imgs)
+	if err != nil {
+		return nil, err
+	}
+	return mutate.AppendManifests(mutate.IndexMediaType(empty.Index, mt), adds...), nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// precompressedExts are extensions of files whose contents are already
+// compressed, so gzipping them again costs CPU and saves next to nothing.
+var precompressedExts = map[string]bool{
+	// Archives and packages.
+	".7z": true, ".apk": true, ".bz2": true, ".deb": true, ".ear": true, ".egg": true, ".gz": true,
+	".jar": true, ".lz4": true, ".rpm": true, ".tgz": true, ".war": true, ".whl": true, ".xz": true,
+	".zip": true, ".zst": true,
+	// Media and fonts.
+	".avif": true, ".flac": true, ".gif": true, ".jpeg": true, ".jpg": true, ".m4a": true, ".mkv": true,
+	".mov": true, ".mp3": true, ".mp4": true, ".ogg": true, ".png": true, ".webm": true, ".webp": true,
+	".woff": true, ".woff2": true,
+	// Models and other packed data.
+	".onnx": true, ".pdf": true, ".pt": true, ".safetensors": true,
+}
+
+// inspectRatioBuckets are the upper bounds of the compression ratio
+// histogram buckets.
+var inspectRatioBuckets = []float64{1.1, 1.5, 2, 3, 5}
+
+// layerStats describes the compression of one layer.
+type layerStats struct {
+	Digest       v1.Hash
+	Compressed   int64
+	Uncompressed int64
+	// FileBytes is the size of the regular files in the layer, and
+	// PrecompressedBytes the part of it in already-compressed formats.
+	FileBytes, PrecompressedBytes int64
+}
+
+func (s *layerStats) ratio() float64 {
+	if s.Compressed == 0 {
+		return 1
+	}
+	return float64(s.Uncompressed) / float64(s.Compressed)
+}
+
+// mostlyPrecompressed returns whether gzipping the layer is mostly wasted
+// effort: most of its content is already compressed, and gzip saved little.
+func (s *layerStats) mostlyPrecompressed() bool {
+	return s.FileBytes > 0 && s.PrecompressedBytes*2 >= s.FileBytes && s.ratio() < 1.5
+}
+
+// inspectFlags returns the flags of the inspect subcommand, whose
+// -decryption-key values are those of squashing's.
+func inspectFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	flags.Var(&decryptionKeys, "decryption-key", "Private key file to decrypt the encrypted layers of SOURCE with, as for squashing. Can be repeated")
+	return flags
+}
+
+// inspectMain implements the inspect subcommand, which reports how well
+// each layer of an image compresses.
+func inspectMain(args []string) error {
+	flags := inspectFlags()
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 1 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s inspect [-decryption-key KEY] SOURCE", os.Args[0]))
+	}
+	if err := readLayerKeys(); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	defer removeTemps()
+	src, err := openSource(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := checkManifestLimits(src.Image); err != nil {
+		return err
+	}
+	img, err := decryptImage(src.Image)
+	if err != nil {
+		return err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("get layers: %w", err)
+	}
+	var stats []*layerStats
+	for i, layer := range layers {
+		logf("Reading layer %d of %d", i+1, len(layers))
+		s, err := inspectLayer(layer, src.Uncompressed)
+		if err != nil {
+			return fmt.Errorf("read layer %d: %w", i+1, err)
+		}
+		stats = append(stats, s)
+	}
+	printLayerStats(stats, src.Uncompressed)
+	return nil
+}
+
+// inspectLayer reads layer to measure its compression. Layers stored
+// uncompressed are gzipped as squashing would, to measure what that gains.
+func inspectLayer(layer v1.Layer, uncompressed bool) (*layerStats, error) {
+	s := &layerStats{}
+	var err error
+	if s.Digest, err = layer.Digest(); err != nil {
+		return nil, err
+	}
+	if !uncompressed {
+		if s.Compressed, err = layer.Size(); err != nil {
+			return nil, err
+		}
+	}
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	cr := &countingReader{r: rc}
+	var r io.Reader = cr
+	var zw *gzip.Writer
+	cw := &countingWriter{w: io.Discard}
+	if uncompressed {
+		zw, _ = gzip.NewWriterLevel(cw, gzip.BestSpeed)
+		r = io.TeeReader(cr, zw)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		s.FileBytes += hdr.Size
+		if precompressedExts[strings.ToLower(path.Ext(hdr.Name))] {
+			s.PrecompressedBytes += hdr.Size
+		}
+	}
+	// Count the tar padding after the last entry too.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	}
+	s.Uncompressed = cr.n
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		s.Compressed = cw.n
+	}
+	return s, nil
+}
+
+func printLayerStats(stats []*layerStats, uncompressed bool) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	compressedHeader := "COMPRESSED"
+	if uncompressed {
+		compressedHeader = "GZIPPED"
+	}
+	fmt.Fprintf(tw, "LAYER\tUNCOMPRESSED\t%s\tRATIO\tPRECOMPRESSED\t\n", compressedHeader)
+	flagged := 0
+	var total, flaggedBytes layerStats
+	for i, s := range stats {
+		pre, mark := "-", ""
+		if s.FileBytes > 0 {
+			pre = fmt.Sprintf("%.0f%%", 100*float64(s.PrecompressedBytes)/float64(s.FileBytes))
+		}
+		if s.mostlyPrecompressed() {
+			mark = "*"
+			flagged++
+			flaggedBytes.Uncompressed += s.Uncompressed
+			flaggedBytes.Compressed += s.Compressed
+		}
+		total.Uncompressed += s.Uncompressed
+		total.Compressed += s.Compressed
+		fmt.Fprintf(tw, "%d %s\t%s\t%s\t%.2f\t%s\t%s\n", i+1, s.Digest.Hex[:12], humanize.Bytes(uint64(s.Uncompressed)), humanize.Bytes(uint64(s.Compressed)), s.ratio(), pre, mark)
+	}
+	fmt.Fprintf(tw, "total\t%s\t%s\t%.2f\t\t\n", humanize.Bytes(uint64(total.Uncompressed)), humanize.Bytes(uint64(total.Compressed)), total.ratio())
+	tw.Flush()
+
+	// A histogram of the uncompressed bytes by compression ratio.
+	fmt.Println()
+	fmt.Println("Uncompressed bytes by compression ratio:")
+	sums := make([]int64, len(inspectRatioBuckets)+1)
+	for _, s := range stats {
+		b := len(inspectRatioBuckets)
+		for i, limit := range inspectRatioBuckets {
+			if s.ratio() < limit {
+				b = i
+				break
+			}
+		}
+		sums[b] += s.Uncompressed
+	}
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for i, sum := range sums {
+		label := fmt.Sprintf("%.1f+", inspectRatioBuckets[len(inspectRatioBuckets)-1])
+		if i < len(inspectRatioBuckets) {
+			lower := 1.0
+			if i > 0 {
+				lower = inspectRatioBuckets[i-1]
+			}
+			label = fmt.Sprintf("%.1f-%.1f", lower, inspectRatioBuckets[i])
+		}
+		bar := ""
+		if total.Uncompressed > 0 {
+			bar = strings.Repeat("#", int(40*sum/total.Uncompressed))
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", label, humanize.Bytes(uint64(sum)), bar)
+	}
+	tw.Flush()
+
+	if flagged > 0 {
+		saved := 100 * (1 - float64(flaggedBytes.Compressed)/float64(max(flaggedBytes.Uncompressed, 1)))
+		what := fmt.Sprintf("%d layers (marked *) mostly hold", flagged)
+		if flagged == 1 {
+			what = "1 layer (marked *) mostly holds"
+		}
+		fmt.Printf("\n%s already-compressed files, like jars, wheels or media: gzip only shrinks that by %.0f%%, so squashing spends CPU on compression for little gain.\n", what, saved)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+)
+
+// Encrypted layers wrap their symmetric keys in JWEs (RFC 7516), in the
+// JSON serialization, as ocicrypt and go-jose write them: the content is
+// encrypted with A256GCM, under a key wrapped for each recipient with
+// RSA-OAEP for RSA keys, or with ECDH-ES+A256KW for EC keys. Only what
+// ocicrypt and go-jose use is implemented, which the standard library
+// covers.
+
+// jweObject is a JWE in the JSON serialization: general, with recipients,
+// or flattened, with a single header and encrypted key.
+type jweObject struct {
+	Protected    string         `json:"protected,omitempty"`
+	Unprotected  *jweHeader     `json:"unprotected,omitempty"`
+	Header       *jweHeader     `json:"header,omitempty"`
+	EncryptedKey string         `json:"encrypted_key,omitempty"`
+	Recipients   []jweRecipient `json:"recipients,omitempty"`
+	AAD          string         `json:"aad,omitempty"`
+	IV           string         `json:"iv"`
+	Ciphertext   string         `json:"ciphertext"`
+	Tag          string         `json:"tag"`
+}
+
+type jweRecipient struct {
+	Header       *jweHeader `json:"header,omitempty"`
+	EncryptedKey string     `json:"encrypted_key,omitempty"`
+}
+
+// jweHeader holds the JWE header parameters that are used.
+type jweHeader struct {
+	Alg string  `json:"alg,omitempty"`
+	Enc string  `json:"enc,omitempty"`
+	Zip string  `json:"zip,omitempty"`
+	EPK *jwkKey `json:"epk,omitempty"`
+	APU string  `json:"apu,omitempty"`
+	APV string  `json:"apv,omitempty"`
+}
+
+// jwkKey is an EC public key as a JWK, for the ephemeral keys of ECDH-ES.
+type jwkKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// merge returns h with the parameters set in o added.
+func (h jweHeader) merge(o *jweHeader) jweHeader {
+	if o == nil {
+		return h
+	}
+	for _, p := range []struct{ dst, src *string }{{&h.Alg, &o.Alg}, {&h.Enc, &o.Enc}, {&h.Zip, &o.Zip}, {&h.APU, &o.APU}, {&h.APV, &o.APV}} {
+		if *p.src != "" {
+			*p.dst = *p.src
+		}
+	}
+	if o.EPK != nil {
+		h.EPK = o.EPK
+	}
+	return h
+}
+
+var b64url = base64.RawURLEncoding
+
+// jweContentKeySize is the size of the A256GCM content encryption key.
+const jweContentKeySize = 32
+
+// encryptJWE returns plaintext encrypted for each of the recipients, which
+// are *rsa.PublicKey or *ecdsa.PublicKey, as a JWE in the general JSON
+// serialization.
+func encryptJWE(plaintext []byte, recipients []crypto.PublicKey) ([]byte, error) {
+	cek := make([]byte, jweContentKeySize)
+	// crypto/rand.Read doesn't fail.
+	rand.Read(cek)
+	protected, err := json.Marshal(jweHeader{Enc: "A256GCM"})
+	if err != nil {
+		return nil, err
+	}
+	obj := jweObject{Protected: b64url.EncodeToString(protected)}
+	for _, pub := range recipients {
+		r, err := wrapJWEKey(cek, pub)
+		if err != nil {
+			return nil, err
+		}
+		obj.Recipients = append(obj.Recipients, r)
+	}
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	rand.Read(iv)
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(obj.Protected))
+	ct, tag := sealed[:len(plaintext)], sealed[len(plaintext):]
+	obj.IV = b64url.EncodeToString(iv)
+	obj.Ciphertext = b64url.EncodeToString(ct)
+	obj.Tag = b64url.EncodeToString(tag)
+	return json.Marshal(obj)
+}
+
+// wrapJWEKey returns the recipient of a JWE holding cek wrapped for pub.
+func wrapJWEKey(cek []byte, pub crypto.PublicKey) (jweRecipient, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		// go-jose's RSA-OAEP is OAEP with SHA-1, as in RFC 7518.
+		ek, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, cek, nil)
+		if err != nil {
+			return jweRecipient{}, fmt.Errorf("wrap key with RSA-OAEP: %w", err)
+		}
+		return jweRecipient{Header: &jweHeader{Alg: "RSA-OAEP"}, EncryptedKey: b64url.EncodeToString(ek)}, nil
+	case *ecdsa.PublicKey:
+		epub, err := pub.ECDH()
+		if err != nil {
+			return jweRecipient{}, fmt.Errorf("wrap key with ECDH-ES: %w", err)
+		}
+		eph, err := epub.Curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return jweRecipient{}, fmt.Errorf("generate ephemeral key: %w", err)
+		}
+		z, err := eph.ECDH(epub)
+		if err != nil {
+			return jweRecipient{}, fmt.Errorf("wrap key with ECDH-ES: %w", err)
+		}
+		const alg = "ECDH-ES+A256KW"
+		ek, err := aesKeyWrap(concatKDF(z, alg, nil, nil, 32), cek)
+		if err != nil {
+			return jweRecipient{}, err
+		}
+		epk, err := ecJWK(pub.Curve.Params().Name, eph.PublicKey().Bytes())
+		if err != nil {
+			return jweRecipient{}, err
+		}
+		return jweRecipient{Header: &jweHeader{Alg: alg, EPK: epk}, EncryptedKey: b64url.EncodeToString(ek)}, nil
+	}
+	return jweRecipient{}, fmt.Errorf("unsupported public key type %T (expected RSA or EC)", pub)
+}
+
+// decryptJWE returns the plaintext of the JWE data, decrypted with the
+// first of keys, which are *rsa.PrivateKey or *ecdsa.PrivateKey, that it's
+// encrypted for.
+func decryptJWE(data []byte, keys []crypto.PrivateKey) ([]byte, error) {
+	var obj jweObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("parse JWE: %w", err)
+	}
+	var protected jweHeader
+	if obj.Protected != "" {
+		b, err := b64url.DecodeString(obj.Protected)
+		if err != nil {
+			return nil, fmt.Errorf("parse JWE protected header: %w", err)
+		}
+		if err := json.Unmarshal(b, &protected); err != nil {
+			return nil, fmt.Errorf("parse JWE protected header: %w", err)
+		}
+	}
+	recipients := obj.Recipients
+	if recipients == nil {
+		recipients = []jweRecipient{{Header: obj.Header, EncryptedKey: obj.EncryptedKey}}
+	}
+	iv, err := b64url.DecodeString(obj.IV)
+	if err != nil {
+		return nil, fmt.Errorf("parse JWE IV: %w", err)
+	}
+	ct, err := b64url.DecodeString(obj.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("parse JWE ciphertext: %w", err)
+	}
+	tag, err := b64url.DecodeString(obj.Tag)
+	if err != nil {
+		return nil, fmt.Errorf("parse JWE tag: %w", err)
+	}
+	sealed := append(ct, tag...)
+	aad := obj.Protected
+	if obj.AAD != "" {
+		aad += "." + obj.AAD
+	}
+	var algs []string
+	for _, r := range recipients {
+		h := protected.merge(obj.Unprotected).merge(r.Header)
+		if h.Enc != "A256GCM" && h.Enc != "A192GCM" && h.Enc != "A128GCM" {
+			return nil, fmt.Errorf("unsupported JWE content encryption %q (expected A256GCM)", h.Enc)
+		}
+		if h.Zip != "" {
+			return nil, fmt.Errorf("unsupported JWE compression %q", h.Zip)
+		}
+		algs = append(algs, h.Alg)
+		for _, key := range keys {
+			cek, err := unwrapJWEKey(h, r.EncryptedKey, key)
+			if err != nil {
+				// Not for this key.
+				continue
+			}
+			gcm, err := newGCM(cek)
+			if err != nil || len(iv) != gcm.NonceSize() {
+				continue
+			}
+			if plaintext, err := gcm.Open(nil, iv, sealed, []byte(aad)); err == nil {
+				return plaintext, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("none of the %d decryption keys can decrypt it, which is encrypted for %d recipients (%s)", len(keys), len(recipients), strings.Join(algs, ", "))
+}
+
+// unwrapJWEKey returns the content encryption key wrapped in ek for key,
+// with the algorithm of the recipient header h.
+func unwrapJWEKey(h jweHeader, ek string, key crypto.PrivateKey) ([]byte, error) {
+	wrapped, err := b64url.DecodeString(ek)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var oaepHash hash.Hash
+		switch h.Alg {
+		case "RSA-OAEP":
+			oaepHash = sha1.New()
+		case "RSA-OAEP-256":
+			oaepHash = sha256.New()
+		default:
+			return nil, fmt.Errorf("unsupported JWE algorithm %q for an RSA key", h.Alg)
+		}
+		return rsa.DecryptOAEP(oaepHash, nil, key, wrapped, nil)
+	case *ecdsa.PrivateKey:
+		var size int
+		switch h.Alg {
+		case "ECDH-ES+A128KW":
+			size = 16
+		case "ECDH-ES+A192KW":
+			size = 24
+		case "ECDH-ES+A256KW":
+			size = 32
+		default:
+			return nil, fmt.Errorf("unsupported JWE algorithm %q for an EC key", h.Alg)
+		}
+		if h.EPK == nil {
+			return nil, errors.New("JWE has no ephemeral public key")
+		}
+		priv, err := key.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		epk, err := h.EPK.publicKey(priv.Curve())
+		if err != nil {
+			return nil, err
+		}
+		z, err := priv.ECDH(epk)
+		if err != nil {
+			return nil, err
+		}
+		apu, err := b64url.DecodeString(h.APU)
+		if err != nil {
+			return nil, err
+		}
+		apv, err := b64url.DecodeString(h.APV)
+		if err != nil {
+			return nil, err
+		}
+		return aesKeyUnwrap(concatKDF(z, h.Alg, apu, apv, size), wrapped)
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ecCurves maps the JWK names of the supported curves, which are also their
+// crypto/elliptic names, to their crypto/ecdh curves.
+var ecCurves = map[string]ecdh.Curve{
+	"P-256": ecdh.P256(),
+	"P-384": ecdh.P384(),
+	"P-521": ecdh.P521(),
+}
+
+// ecJWK returns the JWK of the uncompressed point pub on the curve named
+// name.
+func ecJWK(name string, pub []byte) (*jwkKey, error) {
+	if _, ok := ecCurves[name]; !ok || len(pub) == 0 || pub[0] != 4 {
+		return nil, fmt.Errorf("unsupported EC key on curve %s", name)
+	}
+	n := (len(pub) - 1) / 2
+	return &jwkKey{Kty: "EC", Crv: name, X: b64url.EncodeToString(pub[1 : 1+n]), Y: b64url.EncodeToString(pub[1+n:])}, nil
+}
+
+// publicKey returns the ECDH public key of k, which must be on curve.
+func (k *jwkKey) publicKey(curve ecdh.Curve) (*ecdh.PublicKey, error) {
+	if c, ok := ecCurves[k.Crv]; k.Kty != "EC" || !ok || c != curve {
+		return nil, fmt.Errorf("ephemeral key isn't on the private key's curve")
+	}
+	x, err := b64url.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := b64url.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	// Coordinates are fixed-size, but some encoders trim leading zeros.
+	n := max(len(x), len(y))
+	point := make([]byte, 1+2*n)
+	point[0] = 4
+	copy(point[1+n-len(x):], x)
+	copy(point[1+2*n-len(y):], y)
+	return curve.NewPublicKey(point)
+}
+
+// concatKDF derives a size-byte key from the ECDH shared secret z for the
+// algorithm alg, with the Concat KDF of NIST SP 800-56A and SHA-256, as
+// RFC 7518 section 4.6.2 specifies for ECDH-ES.
+func concatKDF(z []byte, alg string, apu, apv []byte, size int) []byte {
+	var info bytes.Buffer
+	for _, b := range [][]byte{[]byte(alg), apu, apv} {
+		binary.Write(&info, binary.BigEndian, uint32(len(b)))
+		info.Write(b)
+	}
+	binary.Write(&info, binary.BigEndian, uint32(size*8))
+	var out []byte
+	for counter := uint32(1); len(out) < size; counter++ {
+		h := sha256.New()
+		binary.Write(h, binary.BigEndian, counter)
+		h.Write(z)
+		h.Write(info.Bytes())
+		out = h.Sum(out)
+	}
+	return out[:size]
+}
+
+// aesKeyWrapIV is the initial value of RFC 3394's key wrap.
+var aesKeyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// aesKeyWrap wraps key with kek, with the AES key wrap of RFC 3394.
+func aesKeyWrap(kek, key []byte) ([]byte, error) {
+	if len(key)%8 != 0 || len(key) < 16 {
+		return nil, fmt.Errorf("can't wrap a %d-byte key", len(key))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(key) / 8
+	out := make([]byte, 8+len(key))
+	copy(out, aesKeyWrapIV)
+	copy(out[8:], key)
+	b := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, out[:8])
+			copy(b[8:], out[8*i:8*i+8])
+			block.Encrypt(b, b)
+			binary.BigEndian.PutUint64(out, binary.BigEndian.Uint64(b)^uint64(n*j+i))
+			copy(out[8*i:], b[8:])
+		}
+	}
+	return out, nil
+}
+
+// aesKeyUnwrap unwraps the key wrapped with kek by aesKeyWrap.
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, fmt.Errorf("invalid %d-byte wrapped key", len(wrapped))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(wrapped)/8 - 1
+	out := bytes.Clone(wrapped)
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			binary.BigEndian.PutUint64(b, binary.BigEndian.Uint64(out)^uint64(n*j+i))
+			copy(b[8:], out[8*i:8*i+8])
+			block.Decrypt(b, b)
+			copy(out, b[:8])
+			copy(out[8*i:], b[8:])
+		}
+	}
+	if !bytes.Equal(out[:8], aesKeyWrapIV) {
+		return nil, errors.New("key unwrap failed: wrong key or corrupt wrapped key")
+	}
+	return out[8:], nil
+}
+
+// readPrivateKey reads the RSA or EC private key in the PEM (PKCS #1,
+// PKCS #8 or SEC 1) or DER file at path.
+func readPrivateKey(path string) (crypto.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if _, ok := block.Headers["DEK-Info"]; ok {
+			return nil, fmt.Errorf("%s is encrypted with a passphrase, which is not supported; decrypt it first, e.g. with 'openssl pkey'", path)
+		}
+		data = block.Bytes
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(data); err == nil {
+		return checkKeyType(path, key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(data); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(data); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s isn't a PEM or DER private key", path)
+}
+
+// readPublicKey reads the RSA or EC public key in the PEM or DER file at
+// path, which may also be a certificate or a private key.
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+		return checkKeyType(path, key)
+	}
+	if key, err := x509.ParsePKCS1PublicKey(data); err == nil {
+		return key, nil
+	}
+	if cert, err := x509.ParseCertificate(data); err == nil {
+		return checkKeyType(path, cert.PublicKey)
+	}
+	if key, err := readPrivateKey(path); err == nil {
+		return key.(crypto.Signer).Public(), nil
+	}
+	return nil, fmt.Errorf("%s isn't a PEM or DER public key or certificate", path)
+}
+
+// checkKeyType returns key if it's an RSA or EC key, the only types JWE
+// key wrapping is implemented for.
+func checkKeyType[K any](path string, key K) (K, error) {
+	switch any(key).(type) {
+	case *rsa.PublicKey, *rsa.PrivateKey, *ecdsa.PublicKey, *ecdsa.PrivateKey:
+		return key, nil
+	}
+	var zero K
+	return zero, fmt.Errorf("%s has a %T key, which is not supported (expected RSA or EC)", path, key)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// keychain resolves registry credentials.
+var keychain authn.Keychain = authn.DefaultKeychain
+
+// newKeychain returns the keychain selected by the flags: the -cred-helper,
+// if any, then the -docker-config files or else the default Docker config,
+// then $DOCKERHUB_TOKEN for Docker Hub and $GITHUB_TOKEN for ghcr.io.
+func newKeychain() (authn.Keychain, error) {
+	var chain []authn.Keychain
+	if *credHelper != "" {
+		chain = append(chain, credHelperKeychain{name: *credHelper})
+	}
+	for _, path := range dockerConfigs {
+		cf, err := loadDockerConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, dockerConfigKeychain{cf})
+	}
+	if len(dockerConfigs) == 0 {
+		chain = append(chain, authn.DefaultKeychain)
+	}
+	chain = append(chain, dockerHubTokenKeychain{})
+	if !*noGitHubToken {
+		chain = append(chain, gitHubTokenKeychain{})
+	}
+	return authn.NewMultiKeychain(chain...), nil
+}
+
+// loadDockerConfig loads the Docker config file at path, or the
+// config.json in it if it's a directory.
+func loadDockerConfig(path string) (*configfile.ConfigFile, error) {
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		path = filepath.Join(path, config.ConfigFileName)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cf, err := config.LoadFromReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cf.Filename = path
+	return cf, nil
+}
+
+// dockerConfigKeychain gets credentials from a -docker-config file, like
+// authn.DefaultKeychain does from the default one.
+type dockerConfigKeychain struct {
+	cf *configfile.ConfigFile
+}
+
+func (k dockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	// Credentials can be stored for a repository or its whole registry.
+	for _, key := range []string{target.String(), target.RegistryStr()} {
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+		cfg, err := k.cf.GetAuthConfig(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k.cf.Filename, err)
+		}
+		if cfg.Username == "" && cfg.Password == "" && cfg.Auth == "" && cfg.IdentityToken == "" && cfg.RegistryToken == "" {
+			continue
+		}
+		return authn.FromConfig(authn.AuthConfig{
+			Username:      cfg.Username,
+			Password:      cfg.Password,
+			Auth:          cfg.Auth,
+			IdentityToken: cfg.IdentityToken,
+			RegistryToken: cfg.RegistryToken,
+		}), nil
+	}
+	return authn.Anonymous, nil
+}
+
+// credHelperKeychain gets credentials for every registry from the docker
+// credential helper docker-credential-NAME, whatever config.json says.
+type credHelperKeychain struct {
+	name string
+}
+
+func (k credHelperKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	serverURL := target.RegistryStr()
+	if serverURL == name.DefaultRegistry {
+		// The key Docker uses for Docker Hub credentials.
+		serverURL = authn.DefaultAuthKey
+	}
+	creds, err := client.Get(client.NewShellProgramFunc("docker-credential-"+k.name), serverURL)
+	if credentials.IsErrCredentialsNotFound(err) {
+		return authn.Anonymous, nil
+	}
+	if err != nil {
+		// Helpers like ecr-login fail for registries they don't handle,
+		// which then get the Docker config's credentials instead.
+		logf("Warning: docker-credential-%s has no credentials for %s: %v", k.name, serverURL, err)
+		return authn.Anonymous, nil
+	}
+	if creds.Username == "<token>" {
+		return authn.FromConfig(authn.AuthConfig{IdentityToken: creds.Secret}), nil
+	}
+	return authn.FromConfig(authn.AuthConfig{Username: creds.Username, Password: creds.Secret}), nil
+}
+
+// gitHubTokenKeychain authenticates to ghcr.io with $GITHUB_TOKEN or
+// $GH_TOKEN, as set in GitHub Actions workflows, so that they don't need a
+// docker login step.
+type gitHubTokenKeychain struct{}
+
+func (gitHubTokenKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if target.RegistryStr() != "ghcr.io" {
+		return authn.Anonymous, nil
+	}
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		token = os.Getenv("GH_TOKEN")
+	}
+	if token == "" {
+		return authn.Anonymous, nil
+	}
+	// ghcr.io accepts any username with a token.
+	user := os.Getenv("GITHUB_ACTOR")
+	if user == "" {
+		user = "github"
+	}
+	return authn.FromConfig(authn.AuthConfig{Username: user, Password: token}), nil
+}
+
+// dockerHubTokenKeychain authenticates to Docker Hub with
+// $DOCKERHUB_USERNAME and $DOCKERHUB_TOKEN (a personal or organization
+// access token), for CI providers where writing a Docker config is awkward.
+type dockerHubTokenKeychain struct{}
+
+func (dockerHubTokenKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if !isDockerHub(target.RegistryStr()) {
+		return authn.Anonymous, nil
+	}
+	user, token := os.Getenv("DOCKERHUB_USERNAME"), os.Getenv("DOCKERHUB_TOKEN")
+	if user == "" || token == "" {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{Username: user, Password: token}), nil
+}
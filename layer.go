@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bduffany/docker-squash/pkg/squash"
+	"github.com/dustin/go-humanize"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// digestedLayer is a layer whose compressed blob, digest and DiffID were
+// all computed up front in a single pass over the uncompressed tarball.
+type digestedLayer struct {
+	uncompressed   func() (io.ReadCloser, error)
+	compressedPath string
+	digest         v1.Hash
+	diffID         v1.Hash
+	size           int64
+	mediaType      types.MediaType
+}
+
+var _ v1.Layer = (*digestedLayer)(nil)
+
+func (l *digestedLayer) Digest() (v1.Hash, error)             { return l.digest, nil }
+func (l *digestedLayer) DiffID() (v1.Hash, error)             { return l.diffID, nil }
+func (l *digestedLayer) Size() (int64, error)                 { return l.size, nil }
+func (l *digestedLayer) MediaType() (types.MediaType, error)  { return l.mediaType, nil }
+func (l *digestedLayer) Compressed() (io.ReadCloser, error)   { return openTemp(l.compressedPath) }
+func (l *digestedLayer) Uncompressed() (io.ReadCloser, error) { return l.uncompressed() }
+
+// layerCompressor compresses squashed layers, as selected by -compressor.
+var layerCompressor squash.Compressor = squash.Gzip{}
+
+// layerFromTarball compresses the uncompressed layer tarball at path into
+// a temp file with layerCompressor. The DiffID, the compression, and the
+// digest and size of the compressed blob are each computed in their own
+// goroutine while the tarball is read once, rather than re-reading (and
+// re-compressing) it for each. The default gzip level matches
+// tarball.LayerFromFile, so digests are the same as they would be if the
+// layer were created that way.
+//
+// crypto/sha256 uses the SHA-NI and ARMv8 SHA2 instructions when the CPU
+// supports them.
+func layerFromTarball(path string) (v1.Layer, error) {
+	return digestLayer(func() (io.ReadCloser, error) { return openTemp(path) })
+}
+
+// digestLayer is like layerFromTarball, but reads the uncompressed layer
+// from open.
+func digestLayer(open func() (io.ReadCloser, error)) (v1.Layer, error) {
+	dst, err := createTemp("docker-squash-*.tar.gz")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	defer dst.Close()
+	l, err := compressLayer(open, dst, tempWriter(dst))
+	if err != nil {
+		return nil, err
+	}
+	if err := dst.Close(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// compressLayer is like digestLayer, but writes the compressed blob to dst
+// through w, leaving it open.
+func compressLayer(open func() (io.ReadCloser, error), dst *os.File, w io.Writer) (*digestedLayer, error) {
+	src, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	diffIDHash := sha256.New()
+	digestHash := sha256.New()
+	var size int64
+	// Compressing a big layer can take minutes.
+	var hashed, compressed byteCounter
+	stop := startHeartbeat(func(elapsed time.Duration) string {
+		n := hashed.Load()
+		return fmt.Sprintf("Hashed %s, compressed to %s (%s/s)", humanize.Bytes(uint64(n)), humanize.Bytes(uint64(compressed.Load())), humanize.Bytes(uint64(float64(n)/elapsed.Seconds())))
+	})
+	defer stop()
+	err = teeParallel(src,
+		func(r io.Reader) error {
+			_, err := copyBuffered(&timedWriter{w: io.MultiWriter(diffIDHash, &hashed), phase: phaseHash}, r)
+			return err
+		},
+		func(r io.Reader) error {
+			pr, pw := io.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				// Batch the compressor's small writes, so the goroutines
+				// below aren't woken up for each one.
+				bw := bufio.NewWriterSize(&timedWriter{w: pw, phase: phaseCompressWait}, teeBufferSize)
+				zw, err := layerCompressor.Compress(bw)
+				if err == nil {
+					_, err = copyBuffered(&timedWriter{w: zw, phase: phaseCompress, nested: []string{phaseCompressWait}}, r)
+					if cerr := zw.Close(); err == nil {
+						// Closed even on errors, so that a -compressor
+						// exec: command exits.
+						err = cerr
+					}
+				}
+				if err == nil {
+					err = bw.Flush()
+				}
+				pw.CloseWithError(err)
+			}()
+			err := teeParallel(pr,
+				func(r io.Reader) error {
+					_, err := copyBuffered(&timedWriter{w: w, phase: phaseWrite}, r)
+					return err
+				},
+				func(r io.Reader) error {
+					n, err := copyBuffered(&timedWriter{w: io.MultiWriter(digestHash, &compressed), phase: phaseHash}, r)
+					size = n
+					return err
+				},
+			)
+			// Unblock the compressor if we stopped reading early, and wait
+			// for it to stop reading r, which teeParallel drains once we
+			// return.
+			pr.CloseWithError(err)
+			<-done
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &digestedLayer{
+		uncompressed:   open,
+		compressedPath: dst.Name(),
+		digest:         v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", digestHash.Sum(nil))},
+		diffID:         v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", diffIDHash.Sum(nil))},
+		size:           size,
+		mediaType:      dockerLayerType(layerCompressor.MediaType()),
+	}, nil
+}
+
+// teeBufferSize is the size of the chunks handed to each teeParallel
+// consumer, and teeDepth is how many chunks each consumer may lag behind
+// the reader, so that consumers overlap instead of taking turns.
+// -low-priority lowers teeDepth to fit a cgroup memory limit.
+const teeBufferSize = 1024 * 1024
+
+var teeDepth = 4
+
+func copyBuffered(w io.Writer, r io.Reader) (int64, error) {
+	return io.CopyBuffer(w, r, make([]byte, teeBufferSize))
+}
+
+// teeChunk is a chunk of the teeParallel input, shared by all consumers and
+// recycled once they've all read it.
+type teeChunk struct {
+	b    []byte
+	refs atomic.Int32
+}
+
+var teeChunkPool = sync.Pool{New: func() any { return &teeChunk{b: make([]byte, teeBufferSize)} }}
+
+func (c *teeChunk) release() {
+	if c.refs.Add(-1) == 0 {
+		teeChunkPool.Put(c)
+	}
+}
+
+// teeReader reads the chunks sent to one teeParallel consumer.
+type teeReader struct {
+	ch  <-chan *teeChunk
+	cur *teeChunk
+	off int
+}
+
+func (r *teeReader) Read(p []byte) (int, error) {
+	for r.cur == nil || r.off == len(r.cur.b) {
+		if r.cur != nil {
+			r.cur.release()
+			r.cur = nil
+		}
+		c, ok := <-r.ch
+		if !ok {
+			return 0, io.EOF
+		}
+		r.cur, r.off = c, 0
+	}
+	n := copy(p, r.cur.b[r.off:])
+	r.off += n
+	return n, nil
+}
+
+// drain releases all remaining chunks, so the sender never blocks on a
+// consumer that has stopped reading.
+func (r *teeReader) drain() {
+	if r.cur != nil {
+		r.cur.release()
+		r.cur = nil
+	}
+	for c := range r.ch {
+		c.release()
+	}
+}
+
+// teeParallel copies r to each consumer, which run concurrently. It returns
+// the first error from reading r or from any consumer.
+func teeParallel(r io.Reader, consumers ...func(io.Reader) error) error {
+	chans := make([]chan *teeChunk, len(consumers))
+	errs := make([]error, len(consumers))
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for i, consume := range consumers {
+		chans[i] = make(chan *teeChunk, teeDepth)
+		tr := &teeReader{ch: chans[i]}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = consume(tr); errs[i] != nil {
+				failed.Store(true)
+			}
+			tr.drain()
+		}()
+	}
+	var err error
+	for !failed.Load() {
+		c := teeChunkPool.Get().(*teeChunk)
+		c.b = c.b[:cap(c.b)]
+		n, rerr := io.ReadFull(r, c.b)
+		if n > 0 {
+			c.b = c.b[:n]
+			c.refs.Store(int32(len(chans)))
+			for _, ch := range chans {
+				ch <- c
+			}
+		} else {
+			teeChunkPool.Put(c)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			err = rerr
+			break
+		}
+	}
+	for _, ch := range chans {
+		close(ch)
+	}
+	wg.Wait()
+	for _, e := range errs {
+		if e != nil {
+			return e
+		}
+	}
+	return err
+}
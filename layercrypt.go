@@ -0,0 +1,437 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Layers are encrypted as ocicrypt encrypts them, so that images can be
+// exchanged with containerd, skopeo and buildah: each layer blob is
+// encrypted with AES-256 in CTR mode under its own random key, with an
+// HMAC-SHA256 of the ciphertext. The key, the nonce and the digest of the
+// plaintext blob are wrapped for the recipients in a JWE annotation, and the
+// cipher and HMAC are in another. The encrypted layer's media type is the
+// plaintext one with "+encrypted" appended.
+//
+// Squashing reads the plaintext of encrypted source layers through
+// -decryption-key, and -encryption-key encrypts the squashed layers for
+// recipients.
+
+const (
+	encryptedSuffix = "+encrypted"
+	// encAnnotationPrefix prefixes the layer annotations of ocicrypt.
+	encAnnotationPrefix = "org.opencontainers.image.enc."
+	// jweKeysAnnotation holds the comma-separated, base64 JWEs of the
+	// privateLayerOptions, and encKeysAnnotationPrefix prefixes this and
+	// the annotations of the schemes other than JWE (pgp, pkcs7, pkcs11).
+	jweKeysAnnotation       = encKeysAnnotationPrefix + "jwe"
+	encKeysAnnotationPrefix = encAnnotationPrefix + "keys."
+	// pubOptsAnnotation holds the base64 publicLayerOptions.
+	pubOptsAnnotation = encAnnotationPrefix + "pubopts"
+	layerCipher       = "AES_256_CTR_HMAC_SHA256"
+)
+
+// publicLayerOptions are the encryption parameters of a layer that needn't
+// be secret.
+type publicLayerOptions struct {
+	Cipher        string            `json:"cipher"`
+	HMAC          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// privateLayerOptions are the encryption parameters of a layer that are
+// wrapped for the recipients. Digest is that of the plaintext blob.
+type privateLayerOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        string            `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+var (
+	// layerDecryptionKeys are the private keys of -decryption-key.
+	layerDecryptionKeys []crypto.PrivateKey
+	// layerRecipients are the public keys of -encryption-key.
+	layerRecipients []crypto.PublicKey
+)
+
+// readLayerKeys reads the keys of -decryption-key and -encryption-key.
+func readLayerKeys() error {
+	for _, path := range decryptionKeys {
+		key, err := readPrivateKey(path)
+		if err != nil {
+			return fmt.Errorf("invalid -decryption-key: %w", err)
+		}
+		layerDecryptionKeys = append(layerDecryptionKeys, key)
+	}
+	for _, r := range encryptionKeys {
+		scheme, path, ok := strings.Cut(r, ":")
+		if !ok || len(scheme) == 1 {
+			// No scheme, or a Windows drive letter.
+			scheme, path = "jwe", r
+		}
+		if scheme != "jwe" {
+			return fmt.Errorf("invalid -encryption-key %q: unsupported scheme %q (only jwe is supported)", r, scheme)
+		}
+		key, err := readPublicKey(path)
+		if err != nil {
+			return fmt.Errorf("invalid -encryption-key: %w", err)
+		}
+		layerRecipients = append(layerRecipients, key)
+	}
+	return nil
+}
+
+// isEncryptedLayer returns whether the layer media type mt is that of an
+// encrypted layer.
+func isEncryptedLayer(mt types.MediaType) bool {
+	return strings.HasSuffix(string(mt), encryptedSuffix)
+}
+
+// decryptedImage is an image whose layers were decrypted from those of the
+// encrypted image.
+type decryptedImage struct {
+	v1.Image
+	encrypted v1.Image
+}
+
+// encryptedSource returns the image img was decrypted from, or img itself,
+// so that the source labels name the blobs that were actually pulled.
+func encryptedSource(img v1.Image) v1.Image {
+	if d, ok := img.(*decryptedImage); ok {
+		return d.encrypted
+	}
+	return img
+}
+
+// decryptImage returns img with its encrypted layers decrypted with the
+// -decryption-key keys, or img itself if none are. Copies with -no-squash
+// keep the layers encrypted.
+func decryptImage(img v1.Image) (v1.Image, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %w", err)
+	}
+	enc := slices.IndexFunc(m.Layers, func(desc v1.Descriptor) bool { return isEncryptedLayer(desc.MediaType) })
+	if enc < 0 || *noSquash {
+		return img, nil
+	}
+	if len(layerDecryptionKeys) == 0 {
+		return nil, withExitCode(exitUsage, fmt.Errorf("layer %s is encrypted (%s); pass -decryption-key with a private key it's encrypted for", m.Layers[enc].Digest, m.Layers[enc].MediaType))
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("get layers: %w", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("get config file: %w", err)
+	}
+	if len(cfg.RootFS.DiffIDs) != len(m.Layers) {
+		return nil, fmt.Errorf("image has %d layers, but %d diffIDs", len(m.Layers), len(cfg.RootFS.DiffIDs))
+	}
+	var adds []mutate.Addendum
+	for i, desc := range m.Layers {
+		add := mutate.Addendum{Layer: layers[i], MediaType: desc.MediaType, Annotations: desc.Annotations, URLs: desc.URLs}
+		if isEncryptedLayer(desc.MediaType) {
+			l, err := newDecryptedLayer(layers[i], desc, cfg.RootFS.DiffIDs[i])
+			if err != nil {
+				return nil, fmt.Errorf("decrypt layer %s: %w", desc.Digest, err)
+			}
+			// The uncompressed layer is what decompressing the decrypted
+			// blob gives.
+			if add.Layer, err = partial.CompressedToLayer(l); err != nil {
+				return nil, err
+			}
+			add.MediaType = l.mediaType
+			add.Annotations = maps.Clone(desc.Annotations)
+			maps.DeleteFunc(add.Annotations, func(k, _ string) bool { return strings.HasPrefix(k, encAnnotationPrefix) })
+		}
+		adds = append(adds, add)
+	}
+	base := mutate.ConfigMediaType(mutate.MediaType(empty.Image, m.MediaType), m.Config.MediaType)
+	out, err := mutate.Append(base, adds...)
+	if err != nil {
+		return nil, err
+	}
+	if out, err = mutate.ConfigFile(out, cfg); err != nil {
+		return nil, err
+	}
+	if len(m.Annotations) > 0 {
+		out = mutate.Annotations(out, m.Annotations).(v1.Image)
+	}
+	return &decryptedImage{Image: out, encrypted: img}, nil
+}
+
+// decryptedLayer is the plaintext of an encrypted layer, decrypted as it's
+// read, and checked against its HMAC and digest once it's read in full.
+type decryptedLayer struct {
+	encrypted v1.Layer
+	digest    v1.Hash
+	diffID    v1.Hash
+	size      int64
+	mediaType types.MediaType
+	key       []byte
+	nonce     []byte
+	hmac      []byte
+}
+
+func (l *decryptedLayer) Digest() (v1.Hash, error)            { return l.digest, nil }
+func (l *decryptedLayer) DiffID() (v1.Hash, error)            { return l.diffID, nil }
+func (l *decryptedLayer) Size() (int64, error)                { return l.size, nil }
+func (l *decryptedLayer) MediaType() (types.MediaType, error) { return l.mediaType, nil }
+
+func (l *decryptedLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.encrypted.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(l.key)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &layerDecrypter{
+		ReadCloser: rc,
+		layer:      l,
+		stream:     cipher.NewCTR(block, l.nonce),
+		mac:        hmac.New(sha256.New, l.key),
+		plain:      sha256.New(),
+	}, nil
+}
+
+// newDecryptedLayer returns the decrypted layer of the encrypted layer
+// described by desc, whose DiffID is diffID, unwrapping its key with the
+// -decryption-key keys.
+func newDecryptedLayer(layer v1.Layer, desc v1.Descriptor, diffID v1.Hash) (*decryptedLayer, error) {
+	jwes, ok := desc.Annotations[jweKeysAnnotation]
+	if !ok {
+		var schemes []string
+		for k := range desc.Annotations {
+			if strings.HasPrefix(k, encKeysAnnotationPrefix) {
+				schemes = append(schemes, strings.TrimPrefix(k, encKeysAnnotationPrefix))
+			}
+		}
+		slices.Sort(schemes)
+		return nil, fmt.Errorf("its keys are wrapped with %s, which is not supported (only jwe is)", strings.Join(schemes, ", "))
+	}
+	var priv privateLayerOptions
+	var jweErr error
+	for _, s := range strings.Split(jwes, ",") {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", jweKeysAnnotation, err)
+		}
+		plaintext, err := decryptJWE(b, layerDecryptionKeys)
+		if err != nil {
+			jweErr = err
+			continue
+		}
+		if err := json.Unmarshal(plaintext, &priv); err != nil {
+			return nil, fmt.Errorf("parse private options: %w", err)
+		}
+		jweErr = nil
+		break
+	}
+	if jweErr != nil {
+		return nil, withExitCode(exitUsage, jweErr)
+	}
+	b, err := base64.StdEncoding.DecodeString(desc.Annotations[pubOptsAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", pubOptsAnnotation, err)
+	}
+	var pub publicLayerOptions
+	if err := json.Unmarshal(b, &pub); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", pubOptsAnnotation, err)
+	}
+	if pub.Cipher != layerCipher {
+		return nil, fmt.Errorf("unsupported cipher %q (expected %s)", pub.Cipher, layerCipher)
+	}
+	digest, err := v1.NewHash(priv.Digest)
+	if err != nil || digest.Algorithm != "sha256" {
+		return nil, fmt.Errorf("invalid plaintext digest %q", priv.Digest)
+	}
+	if len(priv.SymmetricKey) != 32 || len(priv.CipherOptions["nonce"]) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid %s key or nonce", layerCipher)
+	}
+	return &decryptedLayer{
+		encrypted: layer,
+		digest:    digest,
+		diffID:    diffID,
+		size:      desc.Size,
+		mediaType: types.MediaType(strings.TrimSuffix(string(desc.MediaType), encryptedSuffix)),
+		key:       priv.SymmetricKey,
+		nonce:     priv.CipherOptions["nonce"],
+		hmac:      pub.HMAC,
+	}, nil
+}
+
+// layerDecrypter decrypts an encrypted layer blob as it's read, and fails
+// at its end if the ciphertext doesn't match the HMAC, or the plaintext
+// the digest.
+type layerDecrypter struct {
+	io.ReadCloser
+	layer  *decryptedLayer
+	stream cipher.Stream
+	mac    hash.Hash
+	plain  hash.Hash
+}
+
+func (r *layerDecrypter) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.mac.Write(p[:n])
+	r.stream.XORKeyStream(p[:n], p[:n])
+	r.plain.Write(p[:n])
+	if err == io.EOF {
+		if !hmac.Equal(r.mac.Sum(nil), r.layer.hmac) {
+			return n, withExitCode(exitVerification, fmt.Errorf("layer %s fails its HMAC check: it was modified, or encrypted with another key", r.layer.digest))
+		}
+		if got := fmt.Sprintf("%x", r.plain.Sum(nil)); got != r.layer.digest.Hex {
+			return n, withExitCode(exitVerification, fmt.Errorf("decrypted layer has digest sha256:%s, not %s", got, r.layer.digest))
+		}
+	}
+	return n, err
+}
+
+// encryptImage returns img with its layers encrypted for the -encryption-key
+// recipients, or img itself if there are none. The image gets OCI media
+// types, since Docker has no encrypted layer types. Foreign layers, which
+// aren't stored with the image, are left alone.
+func encryptImage(img v1.Image) (v1.Image, error) {
+	if len(layerRecipients) == 0 {
+		return img, nil
+	}
+	if oci, err := isOCIImage(img); err != nil {
+		return nil, err
+	} else if !oci {
+		if img, err = toOCIImage(img); err != nil {
+			return nil, err
+		}
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %w", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("get layers: %w", err)
+	}
+	var adds []mutate.Addendum
+	for i, desc := range m.Layers {
+		add := mutate.Addendum{Layer: layers[i], MediaType: desc.MediaType, Annotations: desc.Annotations, URLs: desc.URLs}
+		if desc.MediaType.IsDistributable() && !isEncryptedLayer(desc.MediaType) {
+			logf("Encrypting layer %d of %d", i+1, len(m.Layers))
+			l, annotations, err := encryptLayer(layers[i], desc.MediaType)
+			if err != nil {
+				return nil, fmt.Errorf("encrypt layer %s: %w", desc.Digest, err)
+			}
+			add.Layer, add.MediaType = l, l.mediaType
+			add.Annotations = maps.Clone(desc.Annotations)
+			if add.Annotations == nil {
+				add.Annotations = map[string]string{}
+			}
+			maps.Copy(add.Annotations, annotations)
+		}
+		adds = append(adds, add)
+	}
+	base := mutate.ConfigMediaType(mutate.MediaType(empty.Image, m.MediaType), m.Config.MediaType)
+	out, err := mutate.Append(base, adds...)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if out, err = mutate.ConfigFile(out, cfg); err != nil {
+		return nil, err
+	}
+	if len(m.Annotations) > 0 {
+		out = mutate.Annotations(out, m.Annotations).(v1.Image)
+	}
+	return out, nil
+}
+
+// encryptLayer encrypts the blob of layer, whose manifest gives it the
+// media type mt, into a temp file, and returns the encrypted layer with the
+// annotations that describe its encryption.
+func encryptLayer(layer v1.Layer, mt types.MediaType) (*digestedLayer, map[string]string, error) {
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return nil, nil, err
+	}
+	key := make([]byte, 32)
+	nonce := make([]byte, aes.BlockSize)
+	// crypto/rand.Read doesn't fail.
+	rand.Read(key)
+	rand.Read(nonce)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+	dst, err := createTemp("docker-squash-*.tar.gz.enc")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create temp file: %w", err)
+	}
+	defer dst.Close()
+	mac, plain, digest := hmac.New(sha256.New, key), sha256.New(), sha256.New()
+	size, err := copyBuffered(cipher.StreamWriter{S: cipher.NewCTR(block, nonce), W: io.MultiWriter(tempWriter(dst), mac, digest)}, io.TeeReader(rc, plain))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := dst.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	priv, err := json.Marshal(privateLayerOptions{
+		SymmetricKey:  key,
+		Digest:        fmt.Sprintf("sha256:%x", plain.Sum(nil)),
+		CipherOptions: map[string][]byte{"nonce": nonce},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	jwe, err := encryptJWE(priv, layerRecipients)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := json.Marshal(publicLayerOptions{Cipher: layerCipher, HMAC: mac.Sum(nil), CipherOptions: map[string][]byte{}})
+	if err != nil {
+		return nil, nil, err
+	}
+	l := &digestedLayer{
+		uncompressed:   layer.Uncompressed,
+		compressedPath: dst.Name(),
+		digest:         v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", digest.Sum(nil))},
+		diffID:         diffID,
+		size:           size,
+		mediaType:      mt + encryptedSuffix,
+	}
+	return l, map[string]string{
+		jweKeysAnnotation: base64.StdEncoding.EncodeToString(jwe),
+		pubOptsAnnotation: base64.StdEncoding.EncodeToString(pub),
+	}, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/bduffany/docker-squash/pkg/testutil"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// writeTestKeys writes an RSA and an EC key pair to dir, and returns the
+// paths of their private and public key files.
+func writeTestKeys(t *testing.T, dir string) (privs, pubs []string) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []struct {
+		name string
+		priv *pem.Block
+		pub  any
+	}{
+		{"rsa", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, &rsaKey.PublicKey},
+		{"ec", &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}, &ecKey.PublicKey},
+	} {
+		pubDER, err := x509.MarshalPKIXPublicKey(k.pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, pub := filepath.Join(dir, k.name+".pem"), filepath.Join(dir, k.name+".pub.pem")
+		if err := os.WriteFile(priv, pem.EncodeToMemory(k.priv), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(pub, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644); err != nil {
+			t.Fatal(err)
+		}
+		privs, pubs = append(privs, priv), append(pubs, pub)
+	}
+	return privs, pubs
+}
+
+func TestSquashEncryptedLayers(t *testing.T) {
+	reg, err := testutil.StartRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(reg.Close)
+	layers := [][]testutil.File{
+		{
+			testutil.Dir("etc", 0755),
+			testutil.Reg("etc/secret.conf", "password=hunter2", 0600),
+			testutil.Reg("etc/stale", "stale", 0644),
+		},
+		{
+			testutil.Whiteout("etc/stale"),
+			testutil.Reg("etc/app.conf", "v2", 0644),
+		},
+	}
+	img, err := testutil.Image(layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := reg.Push("test:source", img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privs, pubs := writeTestKeys(t, t.TempDir())
+
+	// Squash and encrypt for both keys, then squash that again with either
+	// key to get the plaintext back.
+	encrypted := "docker://" + reg.Host + "/test:encrypted"
+	if out, err := runSquash(t, "-encryption-key", "jwe:"+pubs[0], "-encrypt-recipient", pubs[1], "docker://"+src.String(), encrypted); err != nil {
+		t.Fatalf("squash and encrypt: %v\n%s", err, out)
+	}
+	enc, err := reg.Pull("test:encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := enc.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Layers) != 1 || m.Layers[0].MediaType != types.OCILayer+encryptedSuffix || m.Layers[0].Annotations[jweKeysAnnotation] == "" || m.Layers[0].Annotations[pubOptsAnnotation] == "" {
+		t.Fatalf("got layers %+v, want one encrypted layer", m.Layers)
+	}
+
+	for i, priv := range privs {
+		dst := "test:decrypted" + string(rune('0'+i))
+		if out, err := runSquash(t, "-decryption-key", priv, encrypted, "docker://"+reg.Host+"/"+dst); err != nil {
+			t.Fatalf("decrypt with %s: %v\n%s", filepath.Base(priv), err, out)
+		}
+		squashed, err := reg.Pull(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkOneLayer(squashed); err != nil {
+			t.Error(err)
+		}
+		if err := testutil.CheckSquashed(squashed, testutil.Flatten(layers...)); err != nil {
+			t.Errorf("decrypted with %s: %v", filepath.Base(priv), err)
+		}
+	}
+
+	// Without a key it's encrypted for, it's a usage error.
+	otherPrivs, _ := writeTestKeys(t, t.TempDir())
+	for _, args := range [][]string{
+		{encrypted, "docker://" + reg.Host + "/test:nokey"},
+		{"-decryption-key", otherPrivs[0], "-decryption-key", otherPrivs[1], encrypted, "docker://" + reg.Host + "/test:wrongkey"},
+	} {
+		out, err := runSquash(t, args...)
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) || exit.ExitCode() != exitUsage {
+			t.Errorf("squash %q: got %v, want exit status %d\n%s", args, err, exitUsage, out)
+		}
+	}
+}
+
+// TestOcicryptInterop checks interoperability with ocicrypt both ways,
+// against testdata/ocicrypt: a layout of images encrypted as 'skopeo copy
+// --encryption-key' encrypts them, and ocicrypt.py, which decrypts them as
+// ocicrypt does, both written with OpenSSL rather than Go's crypto (see
+// ocicrypt.py).
+func TestOcicryptInterop(t *testing.T) {
+	reg, err := testutil.StartRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(reg.Close)
+	fixture, err := filepath.Abs(filepath.Join("testdata", "ocicrypt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(name string) string { return filepath.Join(fixture, name) }
+	src := filepath.Join(fixture, "layout")
+	want := testutil.Flatten(
+		[]testutil.File{
+			testutil.Dir("etc", 0755),
+			testutil.Reg("etc/secret.conf", "password=hunter2", 0600),
+			testutil.Reg("etc/stale", "stale", 0644),
+		},
+		[]testutil.File{
+			testutil.Whiteout("etc/stale"),
+			testutil.Reg("etc/app.conf", "v2", 0644),
+		},
+	)
+
+	// The "rsa" image's JWE is flattened, with the recipient's header
+	// merged into the protected one, and "multi" has a recipient per key.
+	for _, tc := range []struct{ ref, key string }{
+		{"rsa", "rsa.pem"},
+		{"multi", "rsa.pem"},
+		{"multi", "ec.pem"},
+	} {
+		dst := "test:" + tc.ref + "-" + filepath.Base(tc.key)
+		if out, err := runSquash(t, "-layout-ref", tc.ref, "-decryption-key", key(tc.key), src, "docker://"+reg.Host+"/"+dst); err != nil {
+			t.Fatalf("decrypt %s with %s: %v\n%s", tc.ref, tc.key, err, out)
+		}
+		squashed, err := reg.Pull(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckSquashed(squashed, want); err != nil {
+			t.Errorf("decrypted %s with %s: %v", tc.ref, tc.key, err)
+		}
+	}
+	out, err := runSquash(t, "-layout-ref", "rsa", "-decryption-key", key("ec.pem"), src, "docker://"+reg.Host+"/test:wrongkey")
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != exitUsage {
+		t.Errorf("decrypt rsa with ec.pem: got %v, want exit status %d\n%s", err, exitUsage, out)
+	}
+
+	// The other way: squash, encrypt for both keys, and decrypt with
+	// ocicrypt.py.
+	for _, tool := range []string{"python3", "openssl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("decrypting as ocicrypt needs %s: %v", tool, err)
+		}
+	}
+	encrypted := filepath.Join(t.TempDir(), "encrypted")
+	if out, err := runSquash(t, "-format=oci", "-layout-ref", "multi", "-decryption-key", key("ec.pem"), "-encryption-key", "jwe:"+key("rsa.pub.pem"), "-encrypt-recipient", key("ec.pub.pem"), src, encrypted); err != nil {
+		t.Fatalf("squash and encrypt: %v\n%s", err, out)
+	}
+	for _, priv := range []string{"rsa.pem", "ec.pem"} {
+		dir := t.TempDir()
+		cmd := exec.Command("python3", key("ocicrypt.py"), "decrypt", encrypted, key(priv), dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("ocicrypt.py decrypt with %s: %v\n%s", priv, err, out)
+		}
+		l, err := tarball.LayerFromFile(filepath.Join(dir, "0.tar.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := mutate.AppendLayers(empty.Image, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckSquashed(img, want); err != nil {
+			t.Errorf("decrypted with ocicrypt.py and %s: %v", priv, err)
+		}
+	}
+}
+
+func TestAESKeyWrap(t *testing.T) {
+	// RFC 3394, section 4.1.
+	kek := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+	key := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	want := []byte{0x1f, 0xa6, 0x8b, 0x0a, 0x81, 0x12, 0xb4, 0x47, 0xae, 0xf3, 0x4b, 0xd8, 0xfb, 0x5a, 0x7b, 0x82, 0x9d, 0x3e, 0x86, 0x23, 0x71, 0xd2, 0xcf, 0xe5}
+	wrapped, err := aesKeyWrap(kek, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(wrapped) != string(want) {
+		t.Fatalf("aesKeyWrap = %x, want %x", wrapped, want)
+	}
+	unwrapped, err := aesKeyUnwrap(kek, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(unwrapped) != string(key) {
+		t.Fatalf("aesKeyUnwrap = %x, want %x", unwrapped, key)
+	}
+	wrapped[3] ^= 1
+	if _, err := aesKeyUnwrap(kek, wrapped); err == nil {
+		t.Fatal("aesKeyUnwrap of a corrupt key succeeded")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// parseLayerMap parses a -layer-map file into a layer plan. Each non-empty
+// line that isn't a "#" comment names a layer and the rootfs path prefixes
+// that go into it, like "deps /opt/venv /usr/lib/python3", with layers
+// listed from the bottom up. Paths matching no prefix go to the layer
+// listed with just "/", or else to the first layer.
+func parseLayerMap(path string) (layerPlan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var plan layerPlan
+	names := map[string]bool{}
+	owners := map[string]string{}
+	catchAll := ""
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("%s:%d: layer %q has no path prefixes", path, n, fields[0])
+		}
+		spec := layerSpec{Name: fields[0]}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("%s:%d: duplicate layer %q", path, n, spec.Name)
+		}
+		names[spec.Name] = true
+		for _, p := range fields[1:] {
+			prefix := cleanTarPath(p)
+			if prefix == "." || prefix == "" {
+				if len(fields) > 2 {
+					return nil, fmt.Errorf("%s:%d: layer %q lists / along with other prefixes", path, n, spec.Name)
+				}
+				if catchAll != "" {
+					return nil, fmt.Errorf("%s:%d: layers %q and %q both list /", path, n, catchAll, spec.Name)
+				}
+				catchAll = spec.Name
+				continue
+			}
+			if owner, ok := owners[prefix]; ok {
+				return nil, fmt.Errorf("%s:%d: /%s is already mapped to layer %q", path, n, prefix, owner)
+			}
+			owners[prefix] = spec.Name
+			spec.Prefixes = append(spec.Prefixes, prefix)
+		}
+		plan = append(plan, spec)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(plan) == 0 {
+		return nil, fmt.Errorf("%s: no layers", path)
+	}
+	return plan, nil
+}
+
+// outputLayerPlan returns the plan for splitting the squashed rootfs into
+// layers, from -layer-map or -profile. A nil plan means a single layer.
+func outputLayerPlan() (layerPlan, error) {
+	if *layerMapFile != "" {
+		return parseLayerMap(*layerMapFile)
+	}
+	return profileLayerPlan(*profile)
+}
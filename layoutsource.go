@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+)
+
+const (
+	// refNameAnnotation is the OCI index annotation naming an entry of an
+	// image layout, often just a tag like "latest".
+	refNameAnnotation = "org.opencontainers.image.ref.name"
+	// containerdNameAnnotation is the annotation containerd and 'docker
+	// save' use for an entry's full image name.
+	containerdNameAnnotation = "io.containerd.image.name"
+)
+
+// sourcePlatform is the parsed -platform value, if set.
+var sourcePlatform *v1.Platform
+
+// isLayoutSource returns whether path is an OCI image layout directory.
+func isLayoutSource(path string) bool {
+	_, err := os.Stat(filepath.Join(path, "oci-layout"))
+	return err == nil
+}
+
+// openLayoutSource opens the image in the OCI image layout at dir selected
+// by -layout-ref and -platform. Selecting an entry is only required when
+// the layout has several; an ambiguous selection is an error listing them.
+func openLayoutSource(dir string) (*source, error) {
+	what := fmt.Sprintf("OCI layout %q", dir)
+	// ggcr reads index.json whole.
+	if info, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+		if err := checkMetadataSize(what+" index.json", info.Size()); err != nil {
+			return nil, err
+		}
+	}
+	lp, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", what, err)
+	}
+	idx, err := lp.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", what, err)
+	}
+	return selectLayoutEntry(idx, what)
+}
+
+// selectLayoutEntry returns the source selected by -layout-ref and
+// -platform from the index.json idx of the layout described by what, which
+// is a directory or an oci-archive.
+func selectLayoutEntry(idx v1.ImageIndex, what string) (*source, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", what, err)
+	}
+	if len(im.Manifests) == 0 {
+		return nil, withExitCode(exitSourceNotFound, fmt.Errorf("%s is empty", what))
+	}
+	descs := im.Manifests
+	if *layoutRef != "" {
+		descs = nil
+		for _, desc := range im.Manifests {
+			if matchesLayoutRef(desc, *layoutRef) {
+				descs = append(descs, desc)
+			}
+		}
+		if len(descs) == 0 {
+			return nil, withExitCode(exitSourceNotFound, fmt.Errorf("%s has no entry %q; it has:\n%s", what, *layoutRef, listLayoutEntries(im.Manifests)))
+		}
+	}
+	if len(descs) > 1 && sourcePlatform != nil {
+		var matching []v1.Descriptor
+		for _, desc := range descs {
+			if desc.MediaType.IsImage() && desc.Platform != nil && desc.Platform.Satisfies(*sourcePlatform) {
+				matching = append(matching, desc)
+			}
+		}
+		if len(matching) > 0 {
+			descs = matching
+		}
+	}
+	if len(descs) > 1 {
+		return nil, fmt.Errorf("%s has %d matching entries; choose one with -layout-ref:\n%s", what, len(descs), listLayoutEntries(descs))
+	}
+	desc := descs[0]
+	if err := checkMetadataSize(fmt.Sprintf("%s entry %s", what, desc.Digest), desc.Size); err != nil {
+		return nil, err
+	}
+
+	src := &source{}
+	for _, key := range []string{containerdNameAnnotation, refNameAnnotation} {
+		// A bare tag isn't enough for a reference.
+		if v := desc.Annotations[key]; strings.ContainsAny(v, "/:") {
+			if ref, err := name.ParseReference(v); err == nil {
+				src.Refs = append(src.Refs, ref)
+				break
+			}
+		}
+	}
+	if !desc.MediaType.IsIndex() {
+		if src.Image, err = idx.Image(desc.Digest); err != nil {
+			return nil, fmt.Errorf("read %s: %w", what, err)
+		}
+		return src, nil
+	}
+	if src.Index, err = idx.ImageIndex(desc.Digest); err != nil {
+		return nil, fmt.Errorf("read %s: %w", what, err)
+	}
+	child, err := src.Index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", what, err)
+	}
+	src.IndexAnnotations = child.Annotations
+	platformDesc, err := selectPlatform(child.Manifests)
+	if err != nil {
+		return nil, fmt.Errorf("%s entry %s: %w", what, desc.Digest, err)
+	}
+	if err := checkMetadataSize(fmt.Sprintf("%s entry %s", what, platformDesc.Digest), platformDesc.Size); err != nil {
+		return nil, err
+	}
+	if src.Image, err = src.Index.Image(platformDesc.Digest); err != nil {
+		return nil, fmt.Errorf("read %s: %w", what, err)
+	}
+	return src, nil
+}
+
+// matchesLayoutRef returns whether the layout entry desc is the one named
+// by a -layout-ref value: a digest, or its name or tag, optionally with a
+// digest as in "name@sha256:...".
+func matchesLayoutRef(desc v1.Descriptor, ref string) bool {
+	refName, digest, ok := strings.Cut(ref, "@")
+	if !ok && strings.HasPrefix(ref, "sha256:") {
+		refName, digest = "", ref
+	}
+	if digest != "" && desc.Digest.String() != digest {
+		return false
+	}
+	if refName == "" {
+		return true
+	}
+	for _, key := range []string{containerdNameAnnotation, refNameAnnotation} {
+		v := desc.Annotations[key]
+		if v == refName || strings.HasSuffix(v, ":"+refName) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectPlatform returns the image among the entries of an index for
+// -platform, or else for linux/amd64 (like pulling from a registry), or the
+// only platform's image if there's just one.
+func selectPlatform(descs []v1.Descriptor) (v1.Descriptor, error) {
+	want := sourcePlatform
+	if want == nil {
+		want = &v1.Platform{OS: "linux", Architecture: "amd64"}
+	}
+	var images []v1.Descriptor
+	for _, desc := range descs {
+		// Skip attestation manifests, which have an "unknown" platform.
+		if desc.MediaType.IsImage() && (desc.Platform == nil || desc.Platform.OS != "unknown") {
+			images = append(images, desc)
+		}
+	}
+	for _, desc := range images {
+		if desc.Platform != nil && desc.Platform.Satisfies(*want) {
+			return desc, nil
+		}
+	}
+	if sourcePlatform == nil && len(images) == 1 {
+		return images[0], nil
+	}
+	var platforms []string
+	for _, desc := range images {
+		platforms = append(platforms, platformString(desc.Platform))
+	}
+	return v1.Descriptor{}, withExitCode(exitSourceNotFound, fmt.Errorf("no %s image (available: %s); choose one with -platform", platformString(want), strings.Join(platforms, ", ")))
+}
+
+// listLayoutEntries formats the entries of a layout's index.json, one per
+// line, for error messages.
+func listLayoutEntries(descs []v1.Descriptor) string {
+	var lines []string
+	for _, desc := range descs {
+		kind := "image"
+		if desc.MediaType.IsIndex() {
+			kind = "index"
+		}
+		line := fmt.Sprintf("  %s (%s", desc.Digest, kind)
+		if desc.Platform != nil {
+			line += ", " + platformString(desc.Platform)
+		}
+		line += ")"
+		for _, key := range []string{containerdNameAnnotation, refNameAnnotation} {
+			if v := desc.Annotations[key]; v != "" {
+				line += " " + v
+				break
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxLicenseFileSize is the largest license file that's read, for its text
+// and hash in the inventory. Larger files are listed with only their size.
+const maxLicenseFileSize = 1024 * 1024
+
+// licenseFile is a license or notice file found in the squashed rootfs.
+type licenseFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Package is the name of the package the file belongs to, if known.
+	Package string `json:"package,omitempty"`
+	Text    string `json:"text,omitempty"`
+}
+
+// packageLicense is license metadata declared by an installed package.
+type packageLicense struct {
+	Ecosystem string `json:"ecosystem"`
+	Name      string `json:"name"`
+	Version   string `json:"version,omitempty"`
+	License   string `json:"license,omitempty"`
+	// Source is the path of the metadata file the license was read from.
+	Source string `json:"source"`
+}
+
+// licenseInventory collects license files and package license metadata
+// from the squashed rootfs.
+type licenseInventory struct {
+	Files    []licenseFile    `json:"files"`
+	Packages []packageLicense `json:"packages"`
+}
+
+var _ rootfsVisitor = (*licenseInventory)(nil)
+
+// isLicenseFile returns whether name (a rootfs path) looks like a license
+// or notice file.
+func isLicenseFile(name string) bool {
+	base := strings.ToUpper(path.Base(name))
+	for _, prefix := range []string{"LICENSE", "LICENCE", "COPYING", "NOTICE", "COPYRIGHT", "UNLICENSE"} {
+		if strings.HasPrefix(base, prefix) {
+			return true
+		}
+	}
+	// Debian packages ship their licenses as /usr/share/doc/$PKG/copyright.
+	return strings.HasPrefix(name, "usr/share/doc/") && path.Base(name) == "copyright"
+}
+
+// packageMetadataEcosystem returns the package ecosystem of a package
+// metadata file, or "" if name isn't one.
+func packageMetadataEcosystem(name string) string {
+	switch {
+	case name == "lib/apk/db/installed":
+		return "apk"
+	case strings.HasSuffix(name, ".dist-info/METADATA") || strings.HasSuffix(name, ".egg-info/PKG-INFO"):
+		return "python"
+	case path.Base(name) == "package.json" && path.Base(path.Dir(path.Dir(name))) == "node_modules",
+		path.Base(name) == "package.json" && path.Base(path.Dir(path.Dir(path.Dir(name)))) == "node_modules":
+		return "npm"
+	}
+	return ""
+}
+
+func (l *licenseInventory) WantsContent(hdr *tar.Header) bool {
+	name := cleanTarPath(hdr.Name)
+	return (isLicenseFile(name) && hdr.Size <= maxLicenseFileSize) || packageMetadataEcosystem(name) != ""
+}
+
+func (l *licenseInventory) Visit(hdr *tar.Header, content []byte) error {
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	name := cleanTarPath(hdr.Name)
+	if isLicenseFile(name) {
+		f := licenseFile{Path: "/" + name, Size: hdr.Size}
+		// Another visitor may have read a larger file, but the inventory
+		// doesn't depend on which run.
+		if content != nil && hdr.Size <= maxLicenseFileSize {
+			sum := sha256.Sum256(content)
+			f.SHA256 = hex.EncodeToString(sum[:])
+			f.Text = string(content)
+		}
+		if pkg, ok := strings.CutPrefix(path.Dir(name), "usr/share/doc/"); ok && !strings.Contains(pkg, "/") {
+			f.Package = pkg
+		}
+		l.Files = append(l.Files, f)
+	}
+	switch packageMetadataEcosystem(name) {
+	case "apk":
+		l.Packages = append(l.Packages, parseAPKInstalled(content, "/"+name)...)
+	case "python":
+		if p, ok := parsePythonMetadata(content, "/"+name); ok {
+			l.Packages = append(l.Packages, p)
+		}
+	case "npm":
+		if p, ok := parsePackageJSON(content, "/"+name); ok {
+			l.Packages = append(l.Packages, p)
+		}
+	}
+	return nil
+}
+
+// parseAPKInstalled parses an Alpine apk database, which has a block of
+// "K:value" lines per package.
+func parseAPKInstalled(b []byte, source string) []packageLicense {
+	var pkgs []packageLicense
+	cur := packageLicense{Ecosystem: "apk", Source: source}
+	flush := func() {
+		if cur.Name != "" {
+			pkgs = append(pkgs, cur)
+		}
+		cur = packageLicense{Ecosystem: "apk", Source: source}
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "P":
+			cur.Name = value
+		case "V":
+			cur.Version = value
+		case "L":
+			cur.License = value
+		}
+	}
+	flush()
+	return pkgs
+}
+
+// parsePythonMetadata parses the email-header-style metadata of an
+// installed Python distribution.
+func parsePythonMetadata(b []byte, source string) (packageLicense, bool) {
+	p := packageLicense{Ecosystem: "python", Source: source}
+	var classifiers []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			// End of headers; the rest is the description.
+			break
+		}
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Name":
+			p.Name = value
+		case "Version":
+			p.Version = value
+		case "License-Expression":
+			p.License = value
+		case "License":
+			if p.License == "" {
+				p.License = value
+			}
+		case "Classifier":
+			if c, ok := strings.CutPrefix(value, "License :: "); ok {
+				classifiers = append(classifiers, c)
+			}
+		}
+	}
+	if p.License == "" || p.License == "UNKNOWN" {
+		p.License = strings.Join(classifiers, "; ")
+	}
+	return p, p.Name != ""
+}
+
+// parsePackageJSON parses the license of an installed npm package.
+func parsePackageJSON(b []byte, source string) (packageLicense, bool) {
+	var pkg struct {
+		Name    string          `json:"name"`
+		Version string          `json:"version"`
+		License json.RawMessage `json:"license"`
+	}
+	if err := json.Unmarshal(b, &pkg); err != nil || pkg.Name == "" {
+		return packageLicense{}, false
+	}
+	p := packageLicense{Ecosystem: "npm", Name: pkg.Name, Version: pkg.Version, Source: source}
+	// "license" is usually an SPDX string, but old packages use
+	// {"type": "MIT", "url": "..."}.
+	var license string
+	var legacy struct{ Type string }
+	if json.Unmarshal(pkg.License, &license) == nil {
+		p.License = license
+	} else if json.Unmarshal(pkg.License, &legacy) == nil {
+		p.License = legacy.Type
+	}
+	return p, true
+}
+
+// Write writes the inventory as JSON to path.
+func (l *licenseInventory) Write(path string) error {
+	sort.Slice(l.Files, func(i, j int) bool { return l.Files[i].Path < l.Files[j].Path })
+	sort.Slice(l.Packages, func(i, j int) bool {
+		a, b := l.Packages[i], l.Packages[j]
+		if a.Ecosystem != b.Ecosystem {
+			return a.Ecosystem < b.Ecosystem
+		}
+		return a.Name < b.Name
+	})
+	if l.Files == nil {
+		l.Files = []licenseFile{}
+	}
+	if l.Packages == nil {
+		l.Packages = []packageLicense{}
+	}
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLicenseInventoryLargeFiles(t *testing.T) {
+	large := strings.Repeat("x", maxLicenseFileSize+1)
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, f := range []struct{ name, body string }{
+		{"usr/share/doc/bash/copyright", "GPL-3+"},
+		{"opt/app/LICENSE.txt", large},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &licenseInventory{}
+	if l.WantsContent(&tar.Header{Name: "opt/app/LICENSE.txt", Typeflag: tar.TypeReg, Size: int64(len(large))}) {
+		t.Error("WantsContent of a license file larger than maxLicenseFileSize")
+	}
+	if err := visitTar(&b, []rootfsVisitor{l}); err != nil {
+		t.Fatal(err)
+	}
+	want := []licenseFile{
+		{Path: "/usr/share/doc/bash/copyright", Size: 6, SHA256: "ecec93aec3c96cf64450126d94bae114d5af4a525a893ca000a9ba616ac236b2", Package: "bash", Text: "GPL-3+"},
+		{Path: "/opt/app/LICENSE.txt", Size: int64(len(large))},
+	}
+	if !reflect.DeepEqual(l.Files, want) {
+		t.Errorf("got files %+v, want %+v", l.Files, want)
+	}
+}
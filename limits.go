@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dustin/go-humanize"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// metadataLimit returns the -max-metadata-size in bytes, or 0 if manifests
+// and configs may be any size.
+func metadataLimit() int64 {
+	// Already validated.
+	n, _ := humanize.ParseBytes(*maxMetadataSize)
+	return int64(n)
+}
+
+// errMetadataTooLarge is wrapped by the errors for manifests, indexes and
+// configs over -max-metadata-size.
+var errMetadataTooLarge = errors.New("larger than -max-metadata-size")
+
+// checkMetadataSize returns an error if the manifest, index or config
+// described by what is larger than -max-metadata-size, before it's read.
+func checkMetadataSize(what string, size int64) error {
+	if limit := metadataLimit(); limit > 0 && size > limit {
+		return fmt.Errorf("%s is %s, %w (%s); raise the limit if the image is legitimate", what, humanize.Bytes(uint64(size)), errMetadataTooLarge, humanize.Bytes(uint64(limit)))
+	}
+	return nil
+}
+
+// readMetadata reads the manifest, index or config described by what from
+// r, stopping with an error once it's over -max-metadata-size instead of
+// reading the rest into memory.
+func readMetadata(r io.Reader, what string) ([]byte, error) {
+	limit := metadataLimit()
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("%s is %w (%s); raise the limit if the image is legitimate", what, errMetadataTooLarge, humanize.Bytes(uint64(limit)))
+	}
+	return b, nil
+}
+
+// checkManifestLimits checks img's manifest against -max-metadata-size and
+// -max-layers, and the size its config is declared with against
+// -max-metadata-size, so that a pathological source fails here instead of
+// when its config is read or its layers are planned.
+func checkManifestLimits(img v1.Image) error {
+	raw, err := img.RawManifest()
+	if err != nil {
+		return fmt.Errorf("get manifest: %w", err)
+	}
+	if err := checkMetadataSize("manifest", int64(len(raw))); err != nil {
+		return err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return fmt.Errorf("get manifest: %w", err)
+	}
+	if *maxLayers > 0 && len(m.Layers) > *maxLayers {
+		return fmt.Errorf("manifest has %d layers, more than -max-layers (%d)", len(m.Layers), *maxLayers)
+	}
+	return checkMetadataSize(fmt.Sprintf("config %s", m.Config.Digest), m.Config.Size)
+}
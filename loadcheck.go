@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// loadCheck loads each of dests, as just written, into the -load-check
+// runtime to make sure that it accepts them, and then removes the loaded
+// images again unless -keep-loaded is set. OCI layout directories are
+// skipped, since neither runtime loads them, and so are pipes and devices.
+func loadCheck(dests []string) error {
+	for _, dest := range dests {
+		if !isRegistryDest(dest) && isLayoutSource(dest) {
+			logf("-load-check: skipping %s, an OCI layout directory, which %s can't load", dest, *loadCheckRuntime)
+			continue
+		}
+		if !isRegistryDest(dest) && isStreamDest(dest) {
+			logf("-load-check: skipping %s, a pipe or device, which can't be read back", dest)
+			continue
+		}
+		var loaded []string
+		var err error
+		switch *loadCheckRuntime {
+		case "docker":
+			loaded, err = dockerLoad(dest)
+		case "containerd":
+			loaded, err = containerdLoad(dest)
+		}
+		if err != nil {
+			return withExitCode(exitVerification, fmt.Errorf("-load-check: %s rejected %s: %w", *loadCheckRuntime, dest, err))
+		}
+		if len(loaded) == 0 {
+			// Already there, so leave it alone.
+			logf("Loaded %s into %s", dest, *loadCheckRuntime)
+			continue
+		}
+		logf("Loaded %s into %s as %s", dest, *loadCheckRuntime, strings.Join(loaded, ", "))
+		if *keepLoaded {
+			continue
+		}
+		if err := removeLoaded(loaded); err != nil {
+			logf("Warning: -load-check: remove loaded images: %v", err)
+		}
+	}
+	return nil
+}
+
+// dockerLoad loads dest with 'docker load', or 'docker pull' for registry
+// DESTs, returning the names or IDs of the loaded images.
+func dockerLoad(dest string) ([]string, error) {
+	if isRegistryDest(dest) {
+		ref := strings.TrimPrefix(dest, "docker://")
+		if _, err := runtimeOutput("docker", "pull", ref); err != nil {
+			return nil, err
+		}
+		return []string{ref}, nil
+	}
+	out, err := runtimeOutput("docker", "load", "-i", dest)
+	if err != nil {
+		return nil, err
+	}
+	// Like "Loaded image: example:tag" or "Loaded image ID: sha256:...".
+	var loaded []string
+	for _, line := range strings.Split(out, "\n") {
+		for _, prefix := range []string{"Loaded image: ", "Loaded image ID: "} {
+			if ref, ok := strings.CutPrefix(strings.TrimSpace(line), prefix); ok {
+				loaded = append(loaded, ref)
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// containerdLoad loads dest with 'ctr images import', or 'ctr images pull'
+// for registry DESTs, into the namespace given by $CONTAINERD_NAMESPACE
+// (default "default"). It returns the names of the images it added.
+func containerdLoad(dest string) ([]string, error) {
+	before, err := containerdImages()
+	if err != nil {
+		return nil, err
+	}
+	if isRegistryDest(dest) {
+		ref, err := parseRegistryDest(dest)
+		if err != nil {
+			return nil, err
+		}
+		args := []string{"images", "pull"}
+		if ref.Context().Registry.Scheme() == "http" {
+			args = append(args, "--plain-http")
+		}
+		_, err = runtimeOutput("ctr", append(args, ref.Name())...)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err := runtimeOutput("ctr", "images", "import", dest); err != nil {
+		return nil, err
+	}
+	after, err := containerdImages()
+	if err != nil {
+		return nil, err
+	}
+	var added []string
+	for _, img := range after {
+		if !slices.Contains(before, img) {
+			added = append(added, img)
+		}
+	}
+	return added, nil
+}
+
+// containerdImages returns the names of the images in containerd.
+func containerdImages() ([]string, error) {
+	out, err := runtimeOutput("ctr", "images", "ls", "-q")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// removeLoaded removes the images loaded by loadCheck.
+func removeLoaded(images []string) error {
+	if *loadCheckRuntime == "containerd" {
+		_, err := runtimeOutput("ctr", append([]string{"images", "rm"}, images...)...)
+		return err
+	}
+	_, err := runtimeOutput("docker", append([]string{"rmi"}, images...)...)
+	return err
+}
+
+// runtimeOutput runs a docker or ctr command, returning its stdout. Its
+// stderr is included in the error if it fails.
+func runtimeOutput(bin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s %s: %w: %s", bin, args[0], err, msg)
+		}
+		return "", fmt.Errorf("%s %s: %w", bin, args[0], err)
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// errLocked is returned by tryLockFile if the lock is held by another
+// process.
+var errLocked = errors.New("locked by another process")
+
+// fileLock is an exclusive advisory lock held on a lock file, used to
+// coordinate concurrent docker-squash processes sharing a cache directory.
+// Locks are released automatically if the process exits.
+type fileLock struct {
+	f *os.File
+}
+
+func openLockFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+}
+
+// acquireLock takes the lock at path, blocking until it's available.
+// onWait is called if the lock is currently held by another process.
+func acquireLock(path string, onWait func()) (*fileLock, error) {
+	waited := false
+	for {
+		f, err := openLockFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = tryLockFile(f)
+		if err == errLocked {
+			if !waited {
+				onWait()
+				waited = true
+			}
+			err = lockFile(f)
+		}
+		if err == nil {
+			var removed bool
+			if removed, err = lockFileRemoved(f, path); err == nil && removed {
+				// The holder removed it: lock the new one.
+				f.Close()
+				continue
+			}
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &fileLock{f: f}, nil
+	}
+}
+
+// tryAcquireLock takes the lock at path if it's available, otherwise it
+// returns errLocked.
+func tryAcquireLock(path string) (*fileLock, error) {
+	for {
+		f, err := openLockFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = tryLockFile(f)
+		if err == nil {
+			var removed bool
+			if removed, err = lockFileRemoved(f, path); err == nil && removed {
+				f.Close()
+				continue
+			}
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &fileLock{f: f}, nil
+	}
+}
+
+// lockFileRemoved returns whether the lock file f, just locked, is no
+// longer the one at path, because the process that held it removed it.
+func lockFileRemoved(f *os.File, path string) (bool, error) {
+	locked, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	current, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(locked, current), nil
+}
+
+// Unlock releases the lock.
+func (l *fileLock) Unlock() error {
+	// Closing the file releases the lock.
+	return l.f.Close()
+}
+
+// Remove removes the lock file and releases the lock. The file is removed
+// while it's still locked, so that processes waiting for it can tell that
+// it was removed and lock a new one; Windows doesn't remove open files, so
+// there it's removed once released, unless another process has opened it
+// since.
+func (l *fileLock) Remove() error {
+	err := os.Remove(l.f.Name())
+	if cerr := l.f.Close(); err == nil {
+		return cerr
+	}
+	if runtime.GOOS == "windows" {
+		os.Remove(l.f.Name())
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"runtime/debug"
+
+	"github.com/dustin/go-humanize"
+)
+
+// setLowPriority implements -low-priority: it lowers the CPU and I/O
+// priority of the process and, in a memory-limited cgroup, keeps the
+// process's memory use well under the limit.
+func setLowPriority() error {
+	if err := lowerPriority(); err != nil {
+		return err
+	}
+	limit, ok := cgroupMemoryLimit()
+	if !ok {
+		logf("Running with low CPU and I/O priority")
+		return nil
+	}
+	// The layer pipeline has about four consumers buffering teeDepth
+	// chunks each. Spend at most 1/16 of the limit on them.
+	teeDepth = min(teeDepth, max(1, int(limit/16/(4*teeBufferSize))))
+	// Have the garbage collector work harder, rather than let the kernel
+	// OOM-kill us, as the heap approaches the limit. GOMEMLIMIT overrides
+	// this.
+	if os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(limit * 3 / 4)
+	}
+	logf("Running with low CPU and I/O priority, within the cgroup memory limit of %s", humanize.IBytes(uint64(limit)))
+	return nil
+}
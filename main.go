@@ -1,86 +1,925 @@
 package main
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path"
+	"runtime"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/bduffany/docker-squash/pkg/squash"
 	"github.com/dustin/go-humanize"
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/mattn/go-isatty"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	tarball "github.com/google/go-containerregistry/pkg/v1/tarball"
 )
 
 var (
-	tag   = flag.String("tag", "", `Tag to apply to the image (default "docker-squash-$TIMESTAMP_UNIX_NANOS")`)
-	quiet = flag.Bool("quiet", false, "Don't show progress")
+	tag            = flag.String("tag", "", "Tag to apply to the image, as a Go template. Available variables: {{.Repo}}, {{.Registry}}, {{.Repository}}, {{.Tag}}, {{.Digest}}, {{.ShortDigest}}, {{.Timestamp}} (default \""+defaultTagTemplate+"\" if the source reference is known, otherwise \""+fallbackTagTemplate+"\")")
+	quiet          = flag.Bool("quiet", false, "Don't show progress")
+	keepSourceTags = flag.Bool("keep-source-tags", false, "Tag the output with the same RepoTags as the source tarball, instead of using -tag")
+	estimate       = flag.Bool("estimate", false, "Print estimated download size, scratch disk usage and duration, then exit without squashing")
+	layerMapFile   = flag.String("layer-map", "", "File mapping rootfs path prefixes to output layers, one layer per line from the bottom up, like \"deps /opt/venv /usr/lib/python3\", to split the squashed image into those layers (see 'relayer')")
+	profile        = flag.String("profile", "", `Re-split the squashed image into layers optimized for a platform. Supported profiles: "lambda" (AWS Lambda / serverless)`)
+	format         = flag.String("format", "docker", `Output format of a local DEST: "docker" (docker-archive tarball), "oci" (OCI image layout directory, like Bazel's oci_image writes, for oci_load) or "wsl" (rootfs tarball for 'wsl --import')`)
+	buildxCompat   = flag.Bool("buildx-compat", false, "Write docker-archive outputs byte for byte the way 'docker buildx build --output type=docker' does, for tools that parse those strictly: an OCI layout with blobs under blobs/sha256 and a manifest.json, RepoTags like \"app:1.0\", and no "+provenanceFile+" member")
+
+	applyFile          = flag.String("apply", "", "Path to a Dockerfile fragment with ENV, LABEL, ENTRYPOINT, CMD, USER, WORKDIR or EXPOSE instructions to apply to the squashed image's config")
+	overrideOS         = flag.String("override-os", "", "Set the OS in the output image config, instead of copying it from the source, dropping the source's OS version and features if it differs")
+	overrideArch       = flag.String("override-arch", "", `Set the architecture (and optionally variant, like "arm/v7") in the output image config, instead of copying it from the source, as for a mislabeled source. Only the label changes, with a warning; the files aren't converted`)
+	previous           = flag.String("previous", "", "Previously squashed image (tarball path or docker:// ref). If set, the output is the previous image's layers plus a single delta layer with the files that changed")
+	scanner            = flag.String("scan", "", `Scan the squashed rootfs for vulnerabilities before writing DEST, using "trivy" or "grype" (which must be installed). Cached results are scanned again`)
+	scanReport         = flag.String("scan-report", "", `Where to write the scanner's JSON report (default "$DEST.scan.json" for local DESTs)`)
+	severityThreshold  = flag.String("severity-threshold", "HIGH", "With -scan: fail if any vulnerability has at least this severity (UNKNOWN, NEGLIGIBLE, LOW, MEDIUM, HIGH or CRITICAL)")
+	reportPackages     = flag.Bool("report-packages", false, "Report how much of the squashed rootfs each installed dpkg or apk package takes up, largest first, to show which packages are worth removing upstream")
+	targetSize         = flag.String("target-size", "", `Fail unless the files of the squashed rootfs total at most this size, like "10GB", suggesting the largest files and directories to exclude`)
+	autoExcludeLargest = flag.Bool("auto-exclude-largest", false, "With -target-size: exclude the largest files and directories (those matching -exclude-rules, if given) until the target is met. Without -exclude-rules, each exclusion is confirmed on the terminal, unless -yes is set")
+	excludeRules       = flag.String("exclude-rules", "", `With -auto-exclude-largest: file of globs, one per line like "/opt/models/*.bin", of the paths that may be excluded, largest first`)
+	licensesOutput     = flag.String("licenses-output", "", "Write an inventory of license files and package license metadata found in the squashed rootfs to this JSON file")
+	failOnConflicts    = flag.Bool("fail-on-conflicts", false, "Fail if layers give the same path different types (file, directory or symlink), which is otherwise a warning")
+	provenanceMapFile  = flag.String("provenance-map", "", "Write a JSON map of every path in the squashed image to the source layer digest and history entry (build step) it came from to this file")
+	recompress         = flag.Bool("recompress", false, "When the source image has a single layer and is reused as-is, recompress the layer with gzip (or -compressor) instead of copying its blob")
+	resume             = flag.Bool("resume", false, "Save the progress of the squash in -cache-dir, so that rerunning the same command after a crash or interruption picks up where it stopped: source layer blobs already downloaded, the squashed rootfs and its compressed layer are reused once complete")
+	compressorFlag     = flag.String("compressor", "gzip", `Compression of the squashed layers: "gzip", "pgzip" (gzip on all CPUs, with different digests), "zstd" (OCI media types only), "none", or "exec:CMD" to pipe each layer through the shell command CMD, like "exec:igzip -c -1", which must write gzip`)
+	printExitCodesFlag = flag.Bool("print-exit-codes", false, "Print the exit codes used by this program as JSON, and exit")
+	versionFlag        = flag.Bool("version", false, "Print the version, commit and supported features, and exit (see the version subcommand for JSON)")
+	sizeBudget         = flag.String("size-budget", "", `Total file size budget for the size-over-budget policy condition, like "500MB"`)
+	platformFlag       = flag.String("platform", "", `Platform ("OS/ARCH[/VARIANT]") of the image to squash when SOURCE is a multi-platform index, instead of linux/amd64`)
+	layoutRef          = flag.String("layout-ref", "", `When SOURCE is an OCI layout directory or oci-archive with several entries, the one to squash: its digest, its name or tag ("org.opencontainers.image.ref.name" or "io.containerd.image.name" annotation), or "NAME@DIGEST"`)
+	allPlatforms       = flag.Bool("all-platforms", false, "If SOURCE is a multi-platform image index, squash the image for every platform and write a new index. Local DESTs are written as an oci-archive, since docker-archive tarballs can't hold one")
+	cacheDir           = flag.String("cache-dir", os.Getenv("DOCKER_SQUASH_CACHE_DIR"), "Directory in which to cache squash results, keyed by source digest and options. Caching is disabled if empty")
+	metadataTTL        = flag.Duration("metadata-ttl", 5*time.Minute, "With -cache-dir: how long to reuse source manifests fetched by tag from the cache, instead of asking the registry again. Manifests and config blobs fetched by digest are always reused. 0 disables reuse of tag lookups")
+	maxMetadataSize    = flag.String("max-metadata-size", "64MB", `Fail on source manifests, indexes and configs larger than this, like "256MB", instead of reading them into memory. 0 disables the limit`)
+	maxLayers          = flag.Int("max-layers", 1000, "Fail on source images with more layers than this. 0 disables the limit")
+	trustPolicyFile    = flag.String("trust-policy", "", "Trust policy file in the containers-policy.json(5) format, deciding which sources may be squashed: which registries, repositories and local paths are accepted, rejected, or must be signed (checked with 'cosign verify' for sigstoreSigned keys)")
+	credHelper         = flag.String("cred-helper", "", `Get registry credentials from this docker credential helper, like "ecr-login" (docker-credential-ecr-login) or "gcloud", whatever the Docker config's credHelpers say. Registries it has no credentials for fall back to the Docker config`)
+	noGitHubToken      = flag.Bool("no-github-token", false, "Don't use $GITHUB_TOKEN or $GH_TOKEN as the ghcr.io credentials when the Docker config has none")
+	cacheMaxSize       = flag.String("cache-max-size", "", `Maximum total size of the -cache-dir, like "20GB". Least recently used results are evicted when exceeded`)
+	fixOwner           = flag.Bool("fix-owner", false, "With -enforce-owner: change the owner of mismatched paths instead of failing")
+	auditSymlinks      = flag.Bool("audit-symlinks", false, "Report symlinks in the squashed rootfs that point outside the image root or into volatile paths like /tmp or /run. Use -fail-on unsafe-symlinks to fail on them")
+	auditPermissions   = flag.Bool("audit-permissions", false, "Report world-writable files and directories, file capabilities on files that can't be executed, and files the image's USER can't read in the squashed rootfs. Use -fail-on unsafe-permissions to fail on them")
+	cosignKey          = flag.String("cosign-key", "", "With promote: sign the pushed image with 'cosign sign --key' using this key before tagging it")
+	createdFlag        = flag.String("created", "", "Creation time of the squashed image, as RFC 3339 or Unix seconds (default now). Sets the config's Created, the history entries and the "+createdAnnotation+" annotation (and label, if the source has one)")
+	archiveMtime       = flag.String("archive-mtime", "", "Modification time of the members of local output archives themselves (like manifest.json and the blobs, not the files in the image), as RFC 3339 or Unix seconds. With -reproducible, defaults to the creation time")
+	archiveOwner       = flag.String("archive-owner", "0:0", `Owner of the members of local output archives themselves, as "UID:GID" or "UID:GID:USER:GROUP"`)
+	reproducible       = flag.Bool("reproducible", false, "Make the output depend only on the source and flags: use -created, $SOURCE_DATE_EPOCH or else the Unix epoch as the creation time, and clamp file modification times to it")
+	optimizeFlag       = flag.String("optimize", "", `Shrink the squashed rootfs with these heuristics: "all", or a comma-separated list of names, where "-NAME" disables one (like "all,-tzdata"). See --help for the list`)
+	canonicalTar       = flag.Bool("canonical-tar", false, "Rewrite the squashed layer with entries sorted by path, user and group names removed, mtimes truncated to seconds and PAX records other than xattrs dropped, so that external tar diffs between squashed images are stable")
+	numericOwner       = flag.Bool("numeric-owner", false, "Drop user and group names from the squashed layer, leaving only numeric UIDs and GIDs, so that extraction doesn't map them through a host's conflicting passwd and group entries")
+	canonicalOwner     = flag.String("canonical-owner", "", `With -canonical-tar: set the owner of every entry to this "UID:GID"`)
+	cpuLimit           = flag.Int("cpu-limit", 0, "Maximum number of CPU cores to use for decompression, compression and hashing (default all of them). Doesn't limit -run commands")
+	tmpPrefix          = flag.String("tmp-prefix", defaultTempPrefix, `Prefix of the names of temp files and directories, like "ci-job-1234", to tell which pipeline owns which scratch files`)
+	preallocateFlag    = flag.Bool("preallocate", false, "Linux only: preallocate the temp file of the squashed rootfs (with fallocate) to the estimated uncompressed size of the source layers, to avoid fragmentation on some filesystems. Estimating reads the start of the largest layer")
+	encryptTmp         = flag.Bool("encrypt-tmp", false, "Encrypt the temp files holding image contents, like the squashed rootfs tarball, with a key generated for the run and kept only in memory, for when writing plaintext image contents to a shared temp dir isn't allowed. Can't be used with -run, -scan or -resume, which need plaintext on disk")
+	lowPriority        = flag.Bool("low-priority", false, "Linux only: run with low CPU (nice) and I/O (ionice) priority, so that background squashes don't starve interactive workloads, and keep memory use well under the cgroup memory limit, if any")
+	notifyCmd          = flag.String("notify-cmd", "", "Shell command to run when squashing starts, succeeds and fails, with a JSON description of the event on stdin and its name (start, success or failure) in $DOCKER_SQUASH_EVENT")
+	notifyWebhook      = flag.String("notify-webhook", "", "URL to POST the -notify-cmd JSON payload to for each event. The payload's \"text\" field makes it usable as a Slack incoming webhook")
+	jsonResult         = flag.Bool("json", false, "Print the result on stdout once done, as JSON like the -notify-cmd success or failure payload, which includes the Docker Hub pull quota left if the sources were pulled from Docker Hub")
+	dnsServer          = flag.String("dns", "", `DNS server ("IP" or "IP:PORT") to look up registry hosts with, instead of the system resolver`)
+	mediaTypes         = flag.String("media-types", "auto", `Media types of the output manifest, config and layers: "auto" (OCI if the source image is OCI, otherwise Docker), "docker" or "oci". With "oci", pushes aren't retried with Docker media types if the registry rejects OCI ones`)
+	noSquash           = flag.Bool("no-squash", false, "Copy SOURCE to DEST unchanged instead of squashing it, keeping its digest. A multi-platform image index is copied whole, and local DESTs are tagged with the source's tags unless -tag is given")
+	noSourceLabels     = flag.Bool("no-source-labels", false, "Don't record the source manifest digest and the digests of the squashed source layers in the "+sourceDigestLabel+" and "+sourceLayersLabel+" labels")
+	loadCheckRuntime   = flag.String("load-check", "", `After writing DEST, load it into this local runtime, "docker" or "containerd" (with ctr), and fail if it's rejected. The loaded image is removed again unless -keep-loaded is set`)
+	outputMode         = flag.String("output-mode", "", `Permissions of local output files, in octal, like "0644", whatever the umask and the existing file's mode. OCI layout directories get the execute bit for each read bit, like 0755. By default, outputs are created as the umask says`)
+	outputOwner        = flag.String("output-owner", "", `Owner of local output files and directories, as "UID:GID", like the CI user collecting outputs written by root in a container (default the current user)`)
+	verifyOutputFlag   = flag.Bool("verify-output", false, "After writing each local output, read it back and check every blob against its digest and size, and its manifests against the image written, exiting with the verification status on a torn write, as on flaky network filesystems")
+	keepLoaded         = flag.Bool("keep-loaded", false, "With -load-check: keep the loaded image in the runtime")
+	keepForeignLayers  = flag.Bool("keep-foreign-layers", false, "Keep the foreign (non-distributable) layers at the bottom of the source image, like Windows base layers, by reference, with their media types and URLs, and squash the layers above them into one delta layer on top")
+	assumeYes          = flag.Bool("yes", false, "Answer yes to confirmation prompts, like those before overwriting an existing local DEST or pushing over an existing tag")
+	forcePush          = flag.Bool("force-push", false, "Push over existing tags in the DEST registry without asking for confirmation")
+	runRuntime         = flag.String("run-runtime", "chroot", `Runtime used to execute -run commands: "chroot", or an OCI runtime binary such as "runc" or "crun"`)
+
+	wslDefaultUser = flag.String("wsl-default-user", "", "With -format=wsl: default login user to set in /etc/wsl.conf")
+	wslHostname    = flag.String("wsl-hostname", "", "With -format=wsl: hostname to set in /etc/wsl.conf")
+	wslSystemd     = flag.Bool("wsl-systemd", false, "With -format=wsl: enable systemd in /etc/wsl.conf")
+)
+
+var (
+	// runCmds holds the -run flag values.
+	runCmds stringsFlag
+	// dropAnnotations holds the -drop-annotation flag values.
+	dropAnnotations stringsFlag
+	// dropLabels and preserveLabels hold the -drop-labels and
+	// -preserve-labels flag values.
+	dropLabels, preserveLabels stringsFlag
+	// enforceOwnerFlags holds the -enforce-owner flag values.
+	enforceOwnerFlags stringsFlag
+	// addLabels and addAnnotations hold the -label and -annotation flag
+	// values.
+	addLabels, addAnnotations stringsFlag
+	// platformSourceFlags holds the -source flag values.
+	platformSourceFlags stringsFlag
+	// resolveFlags holds the -resolve flag values.
+	resolveFlags stringsFlag
+	// dockerConfigs holds the -docker-config flag values.
+	dockerConfigs stringsFlag
+	// alsoOutputFlags holds the -also-output flag values.
+	alsoOutputFlags stringsFlag
+	// filterFlags holds the -filter flag values.
+	filterFlags stringsFlag
+	// decryptionKeys and encryptionKeys hold the -decryption-key and
+	// -encryption-key flag values.
+	decryptionKeys, encryptionKeys stringsFlag
 )
 
+func init() {
+	flag.Var(&dropAnnotations, "drop-annotation", `Glob pattern of source manifest annotations not to copy to the output, like "moby.buildkit.*". Can be repeated`)
+	flag.Var(&dropLabels, "drop-labels", `Glob pattern of source config labels not to copy to the output, like "com.example.build.*". Can be repeated`)
+	flag.Var(&preserveLabels, "preserve-labels", `Glob pattern of source config labels to keep, like "org.opencontainers.image.*". If given, other labels are dropped. Takes precedence over -drop-labels. Can be repeated`)
+	flag.Var(&enforceOwnerFlags, "enforce-owner", `USER:GROUP[:GLOB], like "app:app:/app": fail unless every path matching GLOB (and everything below it) is owned by USER:GROUP, which may be names from the image's /etc/passwd and /etc/group or numeric IDs. If several match a path, the last one applies. Can be repeated`)
+	flag.Var(&failOn, "fail-on", "Fail if the squashed image meets this policy condition: "+strings.Join(policyConditionNames(), ", ")+". Can be repeated")
+	flag.Var(&warnOn, "warn-on", "Warn if the squashed image meets this policy condition (see -fail-on). Can be repeated")
+	flag.Var(&platformSourceFlags, "source", `PLATFORM=SOURCE, like "linux/arm64=docker://example:arm64": squash SOURCE as the image for PLATFORM. Can be repeated to assemble a multi-platform index from single-platform images, in which case only DEST is given`)
+	flag.Var(&addLabels, "label", `KEY=VALUE label to set on the squashed image, like "environment=production". VALUE is a Go template (see below), like 'build.date={{now | date "2006-01-02"}}'. Can be repeated`)
+	flag.Var(&addAnnotations, "annotation", `KEY=VALUE manifest annotation to set on the squashed image, like 'org.opencontainers.image.revision={{env "GIT_SHA"}}'. VALUE is a Go template, as for -label. Can be repeated`)
+	flag.Var(&dockerConfigs, "docker-config", `Docker config file, or directory containing a config.json, to read registry credentials from instead of $DOCKER_CONFIG or ~/.docker, like a mounted secret. Can be repeated, in which case the first file with credentials for a registry is used`)
+	flag.Var(&resolveFlags, "resolve", `HOST:ADDR or HOST:PORT:ADDR, like "registry.example:10.0.0.5": connect to ADDR (an IP address, in brackets for IPv6) for registry HOST, for all ports or only PORT, like curl's --resolve. Can be repeated`)
+	flag.Var(&alsoOutputFlags, "also-output", `PATH[:FORMAT], like "/tmp/image.oci.tar:oci-archive": also write the output to the local path PATH, as a "docker-archive", "oci-archive" or "oci" (OCI image layout directory) (default: as a local DEST would be), from the same squash. Can be repeated`)
+	flag.Var(&filterFlags, "filter", `Statements to apply to each entry of the squashed rootfs, separated by ";", like 'drop path ~ "/usr/share/doc/**"; chown 0:0 path ~ "/etc/**"; mode 0644 path ~ "*.conf" and type == file' (see below). Can be repeated`)
+	flag.Var(&decryptionKeys, "decryption-key", `Private key file (PEM or DER, RSA or EC) to decrypt the ocicrypt-encrypted layers of SOURCE with, like those of 'skopeo copy --encryption-key jwe:pubkey.pem'. Can be repeated, in which case each layer is decrypted with the first key it's encrypted for`)
+	flag.Var(&encryptionKeys, "encryption-key", `[jwe:]PUBKEY, like "jwe:pubkey.pem": encrypt the squashed layers with ocicrypt's scheme for the public key (PEM or DER, RSA or EC, or a certificate) in the file PUBKEY, so that only its private key can decrypt them. Implies OCI media types. Can be repeated to encrypt for several recipients`)
+	flag.Var(&encryptionKeys, "encrypt-recipient", `Same as -encryption-key, by the name nerdctl and ctr-enc give it`)
+	flag.Var(&runCmds, "run", "Shell command to run inside the unpacked squashed rootfs before re-packing it, e.g. 'pip cache purge'. Can be repeated")
+}
+
 func printBasicUsage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s [ OPTIONS ... ] SOURCE DEST\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [ OPTIONS ... ] -source PLATFORM=SOURCE ... DEST\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "Try '%s --help' for more information.\n", os.Args[0])
 }
 
-func printHelp() {
-	fmt.Fprintf(os.Stdout, `
-Usage: %s [ OPTIONS ...] SOURCE DEST
+// helpText is the --help text between the usage lines and the options,
+// with the program name as %[1]s and the -optimize heuristics as %[2]s. It's
+// also the description of the generated docs (see docsMain).
+const helpText = `SOURCE can be either:
+- A local tarball archive path, like "/path/to/image.tar": either a
+  docker-archive ('docker save') or an oci-archive ('podman save --format
+  oci-archive'), which is detected automatically.
+- A local OCI image layout directory, like "/path/to/layout" or the output
+  of a Bazel rules_oci oci_image or oci_image_index target. If it, or an
+  oci-archive, holds several images or indexes, -layout-ref selects one;
+  the available entries are listed otherwise.
+- A remote image ref prefixed with "docker://", like "docker://example:foo".
+  IPv6 registry addresses go in brackets, like
+  "docker://[2001:db8::1]:5000/repo:tag", and registries listening on a
+  unix socket are given as "docker://unix:///run/registry.sock/repo:tag".
+
+DEST can be either:
+- An output tarball archive path, like "/path/to/squashed.tar". Next to the
+  image, the archive holds a docker-squash.json file recording the sources
+  and their digests, the options used and the output digests. With
+  -format=oci, it's an OCI image layout directory, which must be new or
+  empty, as for a Bazel rule's declared directory that oci_load reads. It
+  can also be a named pipe or device, like a FIFO that 'pv' or 'ssh' reads:
+  tarballs are written in order, in one pass.
+- A remote image ref prefixed with "docker://", like "docker://example:squashed".
+  Push permission is checked before the source image is pulled, and layers
+  that already exist in the repository aren't uploaded again. If the
+  registry rejects OCI media types, the push is retried with Docker ones
+  (unless -media-types=oci).
+
+-trust-policy takes a policy.json like containers/image's, with
+"insecureAcceptAnything", "reject" and "sigstoreSigned" (keyPath, keyPaths
+or keyData) requirements under the "docker" transport's registry scopes,
+or the "docker-archive", "oci-archive" and "oci" transports' path scopes.
+Rejected registry sources fail before any network access; signatures are
+verified on the pulled digest with 'cosign verify'.
+
+With -resume and -cache-dir, a squash saves its progress as it goes: the
+source layer blobs pulled from a registry and, when squashing into a single
+layer, the squashed rootfs and its compressed layer, each once complete.
+Rerunning the same command after a crash or interruption reuses them,
+rather than starting over. The saved state is removed once the result is
+cached; '%[1]s cache prune' removes that of squashes that never finish.
+
+-also-output writes the same output to more local paths, like a
+docker-archive for 'docker load' next to an oci-archive, without squashing
+or compressing again.
+
+When stdin is a terminal, overwriting an existing DEST file or pushing over
+an existing tag asks for confirmation first (-yes, or -force-push for tags,
+skips the question). Otherwise nothing is asked and DEST is replaced, as in
+CI; pushing over a tag is logged with the digest it replaced.
+
+The output keeps the format of the source: OCI sources produce OCI
+manifests, configs and layers, and Docker sources Docker ones, unless
+-media-types says otherwise. Source layers can be gzip- or zstd-compressed;
+squashed layers are gzipped (or compressed with -compressor), and a reused
+zstd layer is kept as is unless Docker media types are asked for, which
+have no zstd layer type. Squashing a Docker source with -compressor zstd
+produces OCI media types. Programs embedding docker-squash can plug in
+their own compression through the squash.Compressor interface.
+
+Foreign (non-distributable) layers, like Windows base layers, are fetched
+from their URLs and squashed like any other, which puts their contents in
+the squashed layer. With -keep-foreign-layers they stay in the output by
+reference instead, and only the layers above them are squashed.
+
+Layers encrypted with ocicrypt for "jwe:" recipients, as by 'skopeo copy
+--encryption-key', are decrypted as they're read with the -decryption-key
+private keys, and checked against their HMAC and digest. -encryption-key
+encrypts the squashed layers the same way for each public key given, so
+that only the holders of the private keys can pull and run the image. The
+plaintext still goes through the temp dir and the result cache; pass
+-encrypt-tmp and -cache-dir "" to keep it off the disk.
+
+With -source, each SOURCE is squashed and the results are assembled into
+one multi-platform image index at DEST, like with -all-platforms.
+
+'bundle create' packages an image (typically a squashed one) with its cosign
+signatures, attestations and SBOMs and any -file attachments into a single
+tarball for transfer to an air-gapped network. 'bundle apply' verifies the
+bundle's digests and pushes its contents to a registry there.
+
+'promote' squashes SOURCE and publishes it to every DEST as one step: push
+permission for every DEST (and cosign, with -cosign-key) is checked first,
+the image is pushed to each repository by digest and signed, and only then
+are the tags set, so a failure never leaves a tag on a partial promotion.
+
+'relayer' splits SOURCE, typically an image squashed into a single layer,
+back into the layers of a -layer-map file, so that they can be pulled in
+parallel and cached separately. Each line of the file names a layer and the
+path prefixes that go into it, from the bottom layer up; paths matching no
+prefix go to the layer listed with just "/", or else to the first layer:
+
+    base  /
+    deps  /opt/venv /usr/local/lib/python3.12
+    app   /app
+
+'run' runs a pipeline file: YAML with a "source" (or "sources", as for
+-source), "filters", "mutations", "verification", "signing", "options" and
+"destinations". The middle sections map flag names, without the "-", to
+values, or lists of values for repeatable flags. The first registry
+destination, or else the first local one without a ":FORMAT", is the DEST,
+and other local ones are -also-output; signing or several registry
+destinations make it a promote. -print prints the equivalent command line
+instead of running it.
+
+'selftest' checks this build of the tool on this platform and filesystem:
+it squashes a synthesized image with whiteouts, hardlinks, sparse files,
+xattrs and non-ASCII names from an in-process registry, to the registry and
+to a tarball in the temp directory, and checks that the squashed
+filesystems match the source's layers and that the outputs are
+reproducible. It prints a line for each check, and exits with the
+verification status if any fail.
+
+'inspect' reports each layer's compression ratio, with a histogram, and
+flags layers that mostly hold already-compressed files like jars, wheels or
+media, for which gzip spends CPU for little gain.
 
-SOURCE can be either:
-- A local tarball archive path, like "/path/to/image.tar"
-- A remote image ref prefixed with "docker://", like "docker://example:foo"
+'digest' prints the manifest digest, image ID and layer diffIDs of a local
+output, like a DEST tarball, as "manifest", "image-id" and "diff-id" lines.
 
-DEST is the output tarball archive path.
+'tags' prints the tags in a repository, one per line. 'exists' prints the
+digest of an image if it exists, and otherwise exits with the
+source-not-found status.
 
-Options:
-`, os.Args[0])
+With -format=wsl, DEST is a rootfs tarball suitable for 'wsl --import'
+(gzipped if it ends in ".gz").
+
+-filter statements run on each entry of the squashed rootfs as it streams
+by, in order, each as ACTION [CONDITION [and CONDITION ...]]:
+
+    drop                 remove the entry, and everything below a directory
+    chown UID:GID        set the numeric owner (and drop owner names)
+    mode OCTAL           set the permission bits, like 0644
+
+Conditions are path ~ "GLOB" (or !~), path == "/PATH" (or !=), and
+type == file, dir, symlink, hardlink or other (or !=). In globs, "**"
+matches any number of directories, and a glob without "/", like "*.conf",
+matches base names anywhere. A drop also removes everything below a
+directory meeting its ~ and == conditions; !~ and != only apply to the
+entry itself, so 'drop path !~ "/app/bin/*"' keeps /app/bin's contents.
+Hard links to dropped files are dropped too.
+
+-label and -annotation values are Go templates, with {{.SourceDigest}} (the
+source manifest digest), {{.Platform}} (like "linux/arm64") and {{.Created}}
+(the creation time), and the functions now (the creation time, which is the
+current time unless -created or -reproducible says otherwise), date LAYOUT
+(formats a time in UTC with a Go time layout, like {{now | date
+"2006-01-02"}}) and env NAME (an environment variable).
+
+-optimize heuristics, each reported with what it changed:
+%[2]s
+
+When squashing succeeds, the time spent pulling, extracting, filtering
+(-run, -optimize and the like), compressing, hashing and writing or pushing
+is logged, and included in the -notify-cmd payload as "phaseSeconds", to
+tell whether a squash is network-, CPU- or disk-bound. The phases stream
+into each other, so they overlap.
+
+While the squashed layer is compressed and hashed, the bytes hashed and
+compressed so far are shown every second on a terminal, and otherwise
+logged every 30 seconds, to tell a slow squash from a hung one.
+
+Failures exit with a status describing the cause (usage error, source not
+found, auth, network, disk space or verification failure); run with
+-print-exit-codes for the list.
+`
+
+func printHelp() {
+	fmt.Fprintf(os.Stdout, "\n%s\n\n", usageLines(os.Args[0]))
+	fmt.Fprintf(os.Stdout, helpText, os.Args[0], optimizerHelp())
+	fmt.Fprintf(os.Stdout, "\nOptions:\n")
 	flag.CommandLine.SetOutput(os.Stdout)
 	flag.PrintDefaults()
 }
 
 func main() {
+	c, err := findCommand(os.Args[1:])
+	if err == nil {
+		if c == nil || c.Main == nil {
+			squashMain()
+			return
+		}
+		err = c.Main(os.Args[1+len(strings.Fields(c.Name)):])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitCodeFor(err))
+	}
+}
+
+// squashMain squashes as os.Args says, including for the promote and
+// relayer subcommands, which take the squash options.
+func squashMain() {
+
+	args := os.Args[1:]
+	relayerMode := false
+	if len(args) > 0 && args[0] == "promote" {
+		promoteMode = true
+		args = args[1:]
+	} else if len(args) > 0 && args[0] == "relayer" {
+		relayerMode = true
+		args = args[1:]
+	}
 	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
 	flag.CommandLine.SetOutput(io.Discard)
-	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+	if err := flag.CommandLine.Parse(args); err != nil {
 		if err == flag.ErrHelp {
 			printHelp()
 			return
 		}
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		printBasicUsage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
-	if flag.NArg() != 2 {
+	if *printExitCodesFlag {
+		if err := printExitCodes(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitError)
+		}
+		return
+	}
+	if *versionFlag {
+		if err := printVersion(false); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitError)
+		}
+		return
+	}
+
+	// The number of positional arguments before the DESTs.
+	nSources := 1
+	if len(platformSourceFlags) > 0 {
+		nSources = 0
+		if flag.NArg() != 1 && !promoteMode {
+			fmt.Fprintf(os.Stderr, "Error: with -source, only DEST is given\n")
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+		if _, err := parsePlatformSources(platformSourceFlags); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -source: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	} else if flag.NArg() != 2 && !promoteMode {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
+	}
+	if promoteMode {
+		if flag.NArg() < nSources+1 {
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+		promoteDests = flag.Args()[nSources:]
+		for _, dest := range promoteDests {
+			if !isRegistryDest(dest) {
+				fmt.Fprintf(os.Stderr, "Error: promote DESTs must be registry refs prefixed with \"docker://\", not %q\n", dest)
+				printBasicUsage()
+				os.Exit(exitUsage)
+			}
+		}
+		if *estimate {
+			fmt.Fprintf(os.Stderr, "Error: -estimate is not supported with promote\n")
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	} else if *cosignKey != "" {
+		fmt.Fprintf(os.Stderr, "Error: -cosign-key is only supported with promote\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *createdFlag != "" {
+		if _, err := parseCreated(*createdFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -created: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	for _, f := range []struct {
+		name   string
+		values []string
+	}{{"label", addLabels}, {"annotation", addAnnotations}} {
+		if err := checkMetadataFlags(f.name, f.values); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+
+	if *cpuLimit < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid -cpu-limit %d\n", *cpuLimit)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	} else if *cpuLimit > 0 {
+		// The layer pipeline runs its decompression, compression and hashing
+		// stages in separate goroutines, so bounding the threads running Go
+		// code bounds the cores they can use.
+		runtime.GOMAXPROCS(*cpuLimit)
+	}
+	if overrides, err := parseResolveOverrides(resolveFlags); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -resolve: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	} else {
+		resolveOverrides = overrides
+	}
+	if *credHelper != "" {
+		if _, err := exec.LookPath("docker-credential-" + *credHelper); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -cred-helper: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	if kc, err := newKeychain(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -docker-config: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	} else {
+		keychain = kc
+	}
+	if *dnsServer != "" {
+		r, err := newDNSResolver(*dnsServer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -dns: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+		resolver = r
+	}
+	if *tmpPrefix == "" || strings.ContainsAny(*tmpPrefix, `/\*`) {
+		fmt.Fprintf(os.Stderr, "Error: invalid -tmp-prefix %q (must be non-empty and hold no path separators or \"*\")\n", *tmpPrefix)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *lowPriority {
+		if err := setLowPriority(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+
+	if *mediaTypes != "auto" && *mediaTypes != "docker" && *mediaTypes != "oci" {
+		fmt.Fprintf(os.Stderr, "Error: invalid -media-types %q\n", *mediaTypes)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if c, err := squash.ParseCompressor(*compressorFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -compressor: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	} else if c.MediaType() == types.OCILayerZStd && *mediaTypes == "docker" {
+		fmt.Fprintf(os.Stderr, "Error: -compressor zstd requires OCI media types, but -media-types is docker\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	} else {
+		layerCompressor = c
+	}
+	if o, err := parseArchiveOptions(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	} else {
+		outputArchive = o
+	}
+	if p, err := parseOutputPermissions(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	} else {
+		outputPerms = p
+	}
+	if err := readLayerKeys(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if len(encryptionKeys) > 0 && (*mediaTypes == "docker" || *format == "wsl") {
+		fmt.Fprintf(os.Stderr, "Error: -encryption-key requires OCI media types, which -media-types=docker and -format=wsl don't have\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *format != "docker" && *format != "wsl" && *format != "oci" {
+		fmt.Fprintf(os.Stderr, "Error: invalid -format %q\n", *format)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+
+	if *overrideArch != "" {
+		if _, _, err := parseArch(*overrideArch); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -override-arch: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+
+	for _, p := range dropAnnotations {
+		if _, err := path.Match(p, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -drop-annotation %q: %v\n", p, err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	for _, p := range append(append([]string(nil), dropLabels...), preserveLabels...) {
+		if _, err := path.Match(p, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid label pattern %q: %v\n", p, err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	if *scanner != "" && *scanner != "trivy" && *scanner != "grype" {
+		fmt.Fprintf(os.Stderr, "Error: invalid -scan %q\n", *scanner)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if severityRank(*severityThreshold) < 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid -severity-threshold %q\n", *severityThreshold)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if err := checkPolicyFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *noSquash {
+		if err := checkNoSquashFlags(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	if *allPlatforms && len(platformSourceFlags) > 0 {
+		fmt.Fprintf(os.Stderr, "Error: -all-platforms and -source are mutually exclusive\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	multi := ""
+	if *allPlatforms {
+		multi = "-all-platforms"
+	} else if len(platformSourceFlags) > 0 {
+		multi = "-source"
+	}
+	if multi != "" {
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{
+			{"-previous", *previous != ""},
+			{"-format=wsl", *format == "wsl"},
+			{"-estimate", *estimate},
+			{"-scan", *scanner != ""},
+			{"-licenses-output", *licensesOutput != ""},
+			{"-provenance-map", *provenanceMapFile != ""},
+			{"-override-os", *overrideOS != ""},
+			{"-override-arch", *overrideArch != ""},
+		} {
+			if f.set {
+				fmt.Fprintf(os.Stderr, "Error: %s is not supported with %s\n", f.name, multi)
+				printBasicUsage()
+				os.Exit(exitUsage)
+			}
+		}
+	}
+	if *platformFlag != "" {
+		p, err := v1.ParsePlatform(*platformFlag)
+		if err == nil && (p.OS == "" || p.Architecture == "") {
+			err = fmt.Errorf("%q: platform must be OS/ARCH[/VARIANT]", *platformFlag)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -platform: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+		if *allPlatforms || len(platformSourceFlags) > 0 {
+			fmt.Fprintf(os.Stderr, "Error: -platform can't be used with -all-platforms or -source\n")
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+		sourcePlatform = p
+	}
+	if *previous != "" && *profile != "" {
+		fmt.Fprintf(os.Stderr, "Error: -previous and -profile are mutually exclusive\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if _, err := profileLayerPlan(*profile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -profile: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if relayerMode && *layerMapFile == "" {
+		fmt.Fprintf(os.Stderr, "Error: relayer requires -layer-map\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if _, err := humanize.ParseBytes(*maxMetadataSize); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -max-metadata-size: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *cacheMaxSize != "" {
+		if _, err := humanize.ParseBytes(*cacheMaxSize); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -cache-max-size: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	if *maxLayers < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-layers must not be negative\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *targetSize != "" {
+		if _, err := humanize.ParseBytes(*targetSize); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -target-size: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	} else if *autoExcludeLargest || *excludeRules != "" {
+		fmt.Fprintf(os.Stderr, "Error: -auto-exclude-largest and -exclude-rules require -target-size\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *excludeRules != "" {
+		if !*autoExcludeLargest {
+			fmt.Fprintf(os.Stderr, "Error: -exclude-rules requires -auto-exclude-largest\n")
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+		if _, err := parseExcludeRules(*excludeRules); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -exclude-rules: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	if *keepForeignLayers && (*previous != "" || *profile != "" || *layerMapFile != "" || *format == "wsl") {
+		fmt.Fprintf(os.Stderr, "Error: -keep-foreign-layers can't be used with -previous, -profile, -layer-map or -format=wsl\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *layerMapFile != "" {
+		if *previous != "" || *profile != "" {
+			fmt.Fprintf(os.Stderr, "Error: -layer-map can't be used with -previous or -profile\n")
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+		if _, err := parseLayerMap(*layerMapFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -layer-map: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
 	}
 
 	infile := flag.Arg(0)
 	outfile := flag.Arg(1)
-	outRef, err := name.ParseReference(*tag)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if len(platformSourceFlags) > 0 {
+		infile, outfile = "", flag.Arg(0)
+	}
+	if *trustPolicyFile != "" {
+		p, err := loadTrustPolicy(*trustPolicyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -trust-policy: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+		trust = p
+		// Rejected registry sources fail here, before any network access.
+		// Local sources and signatures are checked as they're opened.
+		sources := []string{infile, *previous}
+		if len(platformSourceFlags) > 0 {
+			// Already validated.
+			pss, _ := parsePlatformSources(platformSourceFlags)
+			for _, ps := range pss {
+				sources = append(sources, ps.Path)
+			}
+		}
+		for _, src := range sources {
+			if !isRegistrySource(src) {
+				continue
+			}
+			ref, err := parseDockerRef(strings.TrimPrefix(src, "docker://"))
+			if err != nil {
+				// Reported when it's opened.
+				continue
+			}
+			if _, err := checkRegistryTrust(ref); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(exitCodeFor(err))
+			}
+		}
+	}
+	if *buildxCompat && *format != "docker" {
+		fmt.Fprintf(os.Stderr, "Error: -buildx-compat can't be used with -format=%s\n", *format)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if isRegistryDest(outfile) && *format != "docker" {
+		fmt.Fprintf(os.Stderr, "Error: -format=%s requires DEST to be a local path\n", *format)
+		os.Exit(exitUsage)
+	}
+	if _, err := parseFilters(filterFlags); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -filter: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if _, err := parseOwnerRules(enforceOwnerFlags); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -enforce-owner: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *encryptTmp {
+		var problem string
+		switch {
+		case len(runCmds) > 0:
+			problem = "-encrypt-tmp can't be used with -run, which unpacks the squashed rootfs into a plaintext temp directory"
+		case *scanner != "":
+			problem = "-encrypt-tmp can't be used with -scan, which unpacks the squashed rootfs into a plaintext temp directory"
+		case *resume:
+			problem = "-encrypt-tmp can't be used with -resume, which saves the squashed rootfs in -cache-dir"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", problem)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+		if err := initTempEncryption(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitError)
+		}
+	}
+	if *resume {
+		var problem string
+		switch {
+		case *cacheDir == "":
+			problem = "-resume requires -cache-dir"
+		case confirmsExclusions():
+			problem = "-resume can't be used when -auto-exclude-largest confirms exclusions on the terminal (pass -exclude-rules or -yes)"
+		case *format == "wsl":
+			problem = "-resume can't be used with -format=wsl"
+		}
+		if problem != "" {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", problem)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	if *fixOwner && len(enforceOwnerFlags) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: -fix-owner requires -enforce-owner\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *canonicalOwner != "" {
+		if !*canonicalTar {
+			fmt.Fprintf(os.Stderr, "Error: -canonical-owner requires -canonical-tar\n")
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+		if _, _, err := parseOwner(*canonicalOwner); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -canonical-owner: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	switch *loadCheckRuntime {
+	case "", "docker", "containerd":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid -load-check %q (expected \"docker\" or \"containerd\")\n", *loadCheckRuntime)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *loadCheckRuntime != "" && (*estimate || *format == "wsl") {
+		fmt.Fprintf(os.Stderr, "Error: -load-check can't be used with -estimate or -format=wsl\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if *optimizeFlag != "" {
+		if _, err := parseOptimize(*optimizeFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -optimize: %v\n", err)
+			printBasicUsage()
+			os.Exit(exitUsage)
+		}
+	}
+	if outputs, err := parseAlsoOutputs(alsoOutputFlags); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -also-output: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
+	} else {
+		alsoOutputs = outputs
+	}
+	if len(alsoOutputs) > 0 && (promoteMode || *estimate || *format == "wsl") {
+		fmt.Fprintf(os.Stderr, "Error: -also-output can't be used with promote, -estimate or -format=wsl\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	// Fail before squashing, rather than when writing.
+	if *format == "oci" && !*estimate {
+		if err := checkLayoutDest(outfile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -format=oci: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+	for _, o := range alsoOutputs {
+		if cmp.Or(o.format, *format) == "oci" {
+			if err := checkLayoutDest(o.path); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: -also-output: %v\n", err)
+				os.Exit(exitUsage)
+			}
+		}
 	}
-	if *tag == "" {
-		*tag = "docker-squash-" + fmt.Sprintf("%d", time.Now().UnixNano())
+	if *keepSourceTags && *tag != "" {
+		fmt.Fprintf(os.Stderr, "Error: -keep-source-tags and -tag are mutually exclusive\n")
+		printBasicUsage()
+		os.Exit(exitUsage)
+	}
+	if _, err := parseTagTemplate(*tag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -tag: %v\n", err)
+		printBasicUsage()
+		os.Exit(exitUsage)
 	}
 
-	if err := run(infile, outfile, outRef); err != nil {
+	event := &notifyEvent{Event: "start", Sources: []string{infile}, Dests: []string{outfile}}
+	if len(platformSourceFlags) > 0 {
+		event.Sources = platformSourceFlags
+	}
+	if promoteMode {
+		event.Dests = promoteDests
+	}
+	for _, o := range alsoOutputs {
+		event.Dests = append(event.Dests, o.path)
+	}
+	notify(event)
+	start := time.Now()
+	err := run(infile, outfile)
+	if err == nil {
+		event.PhaseSeconds = reportPhaseTimes(time.Since(start))
+	}
+	if err == nil && *loadCheckRuntime != "" {
+		err = loadCheck(event.Dests)
+	}
+	event.Event, event.DurationSeconds = "success", time.Since(start).Seconds()
+	if err != nil {
+		event.Event, event.Error, event.ExitCode = "failure", err.Error(), exitCodeFor(err)
+	}
+	event.HubPullQuota = currentHubQuota()
+	notify(event)
+	if *jsonResult {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if jerr := enc.Encode(event); jerr != nil && err == nil {
+			err = fmt.Errorf("write -json result: %w", jerr)
+		}
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitCodeFor(err))
 	}
 }
 
@@ -91,34 +930,154 @@ func logf(format string, args ...any) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
 }
 
-func run(inputPath, outputPath string, outRef name.Reference) error {
-	var img v1.Image
-	var err error
-	if strings.HasPrefix(inputPath, "docker://") {
-		ref, err := name.ParseReference(strings.TrimPrefix(inputPath, "docker://"))
+func run(inputPath, outputPath string) error {
+	var dockerfile []dockerfileInstruction
+	if *applyFile != "" {
+		instrs, err := readDockerfileFragment(*applyFile)
 		if err != nil {
-			return fmt.Errorf("parse input reference: %w", err)
+			return fmt.Errorf("read -apply file: %w", err)
 		}
-		img, err = remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		dockerfile = instrs
+	}
+
+	var outRefs []name.Reference
+	if isRegistryDest(outputPath) {
+		ref, err := parseRegistryDest(outputPath)
 		if err != nil {
-			return fmt.Errorf("pull image %q: %w", ref, err)
+			return err
+		}
+		outRefs = []name.Reference{ref}
+		if !*estimate {
+			if err := checkPushPermission(ref); err != nil {
+				return err
+			}
+			if err := confirmOverwrite(outputPath, ref); err != nil {
+				return err
+			}
+		}
+	} else if !*estimate {
+		if err := confirmOverwrite(outputPath, nil); err != nil {
+			return err
+		}
+	}
+	written := map[string]bool{outputPath: true}
+	for _, o := range alsoOutputs {
+		if written[o.path] {
+			return fmt.Errorf("-also-output %s is written more than once", o.path)
+		}
+		written[o.path] = true
+		if err := confirmOverwrite(o.path, nil); err != nil {
+			return err
 		}
+	}
+	var promoteRefs []name.Reference
+	if promoteMode {
+		// Check everything that could fail before anything is pushed.
+		for _, dest := range promoteDests {
+			ref, err := parseRegistryDest(dest)
+			if err != nil {
+				return err
+			}
+			if dest != outputPath {
+				if err := checkPushPermission(ref); err != nil {
+					return err
+				}
+				if err := confirmOverwrite(dest, ref); err != nil {
+					return err
+				}
+			}
+			promoteRefs = append(promoteRefs, ref)
+		}
+		if err := checkCosign(); err != nil {
+			return err
+		}
+	}
+
+	var platformSources []platformSource
+	var src *source
+	var err error
+	if len(platformSourceFlags) > 0 {
+		// Already validated.
+		platformSources, _ = parsePlatformSources(platformSourceFlags)
+		inputPath = platformSources[0].Path
+		src, err = openPlatformSource(platformSources[0])
 	} else {
-		img, err = tarball.ImageFromPath(inputPath, nil)
+		src, err = openSource(inputPath)
+	}
+	if err != nil {
+		return err
+	}
+	img, srcRefs := src.Image, src.Refs
+	if err := checkManifestLimits(img); err != nil {
+		return err
+	}
+	if img, err = decryptImage(img); err != nil {
+		return err
+	}
+	if err := checkForeignLayers(img); err != nil {
+		return err
+	}
+
+	var prev *source
+	if *previous != "" {
+		prev, err = openSource(*previous)
 		if err != nil {
-			return fmt.Errorf("read image tarball from %q: %w", inputPath, err)
+			return fmt.Errorf("open -previous image: %w", err)
+		}
+		if err := checkManifestLimits(prev.Image); err != nil {
+			return fmt.Errorf("-previous image: %w", err)
+		}
+		if prev.Image, err = decryptImage(prev.Image); err != nil {
+			return fmt.Errorf("-previous image: %w", err)
 		}
 	}
 
-	// TODO: handle multi-arch images
-	// For now assume single-arch.
+	if *allPlatforms && src.Index == nil {
+		logf("Source is not a multi-platform image index; squashing its only image")
+	}
 
-	f, err := os.CreateTemp("", "docker-squash-*.tar")
-	if err != nil {
-		return fmt.Errorf("create temp file: %w", err)
+	if *estimate {
+		logf("Probing source image")
+		e, err := estimateSquash(img)
+		if err != nil {
+			return fmt.Errorf("estimate: %w", err)
+		}
+		printEstimate(e, isRegistrySource(inputPath))
+		return nil
 	}
 
-	// Make sure we clean up the temp file, either when exiting normally,
+	if outRefs == nil && *noSquash && *tag == "" {
+		// A copy keeps the source's tags, rather than getting "-squashed"
+		// ones.
+		for _, ref := range srcRefs {
+			if _, ok := ref.(name.Tag); ok {
+				outRefs = append(outRefs, ref)
+			}
+		}
+	}
+	if outRefs == nil && *keepSourceTags {
+		for _, ref := range srcRefs {
+			if _, ok := ref.(name.Tag); ok {
+				outRefs = append(outRefs, ref)
+			}
+		}
+		if len(outRefs) == 0 {
+			return fmt.Errorf("-keep-source-tags: source image %q has no tags", inputPath)
+		}
+	}
+	if outRefs == nil {
+		var srcRef name.Reference
+		if len(srcRefs) > 0 {
+			srcRef = srcRefs[0]
+		}
+		ref, err := resolveTag(*tag, srcRef, img)
+		if err != nil {
+			return err
+		}
+		outRefs = []name.Reference{ref}
+	}
+
+	// Make sure we clean up temp files, either when exiting normally,
 	// or if Ctrl+C is pressed.
 	sigs := make(chan os.Signal, 1)
 	var wg sync.WaitGroup
@@ -130,9 +1089,7 @@ func run(inputPath, outputPath string, outRef name.Reference) error {
 		if signaled {
 			fmt.Fprintf(os.Stderr, "\n")
 		}
-		fmt.Fprintf(os.Stderr, "Removing %q\n", f.Name())
-		_ = f.Close()
-		_ = os.Remove(f.Name())
+		removeTemps()
 		if signaled {
 			os.Exit(128 + int(sig.(syscall.Signal)))
 		}
@@ -141,60 +1098,448 @@ func run(inputPath, outputPath string, outRef name.Reference) error {
 	defer close(sigs)
 	defer signal.Reset()
 
-	logf("Extracting squashed image to %q", f.Name())
-	progress := &progressWriter{}
-	if err := writeSquashedTarball(io.MultiWriter(f, progress), img); err != nil {
-		return fmt.Errorf("extract squashed image to %q: %w", f.Name(), err)
+	if *format == "wsl" {
+		// WSL imports a plain rootfs tarball, so there's no image to build.
+		if err := writeWSLTarball(outputPath, img); err != nil {
+			return err
+		}
+		return outputPerms.apply(outputPath)
 	}
-	progress.Print()
 
-	// Build a new image from scratch
-	flat := empty.Image
-	logf("Computing layer digest")
-	layer, err := tarball.LayerFromFile(f.Name())
-	if err != nil {
-		return fmt.Errorf("read squashed layer: %w", err)
+	var prov *provenance
+	if !isRegistryDest(outputPath) || len(alsoOutputs) > 0 {
+		if prov, err = newProvenance(inputPath, src); err != nil {
+			return err
+		}
+	}
+	sq := &squasher{dockerfile: dockerfile, prev: prev, outputPath: outputPath}
+	defer sq.close()
+	if *noSquash && src.Index != nil && platformSources == nil {
+		logf("Copying image index without squashing")
+		if promoteMode {
+			return promote(promoteRefs, src.Index)
+		}
+		return writeOutput(outputPath, outRefs, src.Index, prov)
+	}
+	if platformSources != nil {
+		idx, err := squashPlatformSources(sq, platformSources, src)
+		if err != nil {
+			return err
+		}
+		if promoteMode {
+			return promote(promoteRefs, idx)
+		}
+		return writeOutput(outputPath, outRefs, idx, prov)
+	}
+	if *allPlatforms && src.Index != nil {
+		idx, err := squashIndex(sq, src)
+		if err != nil {
+			return err
+		}
+		if promoteMode {
+			return promote(promoteRefs, idx)
+		}
+		return writeOutput(outputPath, outRefs, idx, prov)
 	}
-	flat, err = mutate.AppendLayers(flat, layer)
+	flat, err := sq.squash(img, src.IndexAnnotations, src.Registry)
 	if err != nil {
-		return fmt.Errorf("append squashed layer to empty image: %w", err)
+		return err
 	}
-	diffID, err := layer.DiffID()
+	if promoteMode {
+		return promote(promoteRefs, flat)
+	}
+	return writeOutput(outputPath, outRefs, flat, prov)
+}
+
+// squasher squashes images with the options given on the command line.
+type squasher struct {
+	dockerfile []dockerfileInstruction
+	prev       *source
+	outputPath string
+	// locks are the cache entry locks held until the output is written.
+	locks []*fileLock
+}
+
+// close releases the squasher's cache entry locks.
+func (s *squasher) close() {
+	for _, l := range s.locks {
+		l.Unlock()
+	}
+}
+
+// squash returns the squashed version of img. indexAnnotations are the
+// annotations of the index img was selected from, to be merged into its
+// manifest annotations. fromRegistry is whether img is pulled from a
+// registry, in which case -resume saves its layer blobs as they download.
+func (s *squasher) squash(img v1.Image, indexAnnotations map[string]string, fromRegistry bool) (v1.Image, error) {
+	if *noSquash {
+		return img, nil
+	}
+	var cache *resultCache
+	var cacheKey string
+	if *cacheDir != "" && !confirmsExclusions() {
+		srcDigest, err := img.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("get source image digest: %w", err)
+		}
+		var extra []string
+		if s.prev != nil {
+			prevDigest, err := s.prev.Image.Digest()
+			if err != nil {
+				return nil, fmt.Errorf("get previous image digest: %w", err)
+			}
+			extra = append(extra, prevDigest.String())
+		}
+		cacheKey, err = resultCacheKey(srcDigest, extra...)
+		if err != nil {
+			return nil, fmt.Errorf("compute cache key: %w", err)
+		}
+		cache = &resultCache{dir: *cacheDir}
+		lock, err := cache.Lock(cacheKey)
+		if err != nil {
+			return nil, fmt.Errorf("lock cache entry: %w", err)
+		}
+		s.locks = append(s.locks, lock)
+		cached, err := cache.Get(cacheKey)
+		if err != nil {
+			return nil, fmt.Errorf("read cached result: %w", err)
+		}
+		if cached != nil {
+			logf("Using cached squash result %s", cacheKey)
+			if err := inspectImageRootfs(cached); err != nil {
+				return nil, err
+			}
+			if *scanner != "" {
+				if err := scanImage(cached, s.outputPath); err != nil {
+					return nil, err
+				}
+			}
+			if *provenanceMapFile != "" {
+				if err := writeProvenanceMap(*provenanceMapFile, img, cached); err != nil {
+					return nil, err
+				}
+			}
+			return encryptImage(cached)
+		}
+	}
+	// The source as pulled, rather than as decrypted.
+	src := encryptedSource(img)
+	var run *runState
+	if *resume {
+		var err error
+		if run, err = cache.openRun(cacheKey); err != nil {
+			return nil, fmt.Errorf("read -resume state: %w", err)
+		}
+		if fromRegistry {
+			img = run.wrapImage(img)
+		}
+	}
+
+	createdTime, err := outputCreated()
 	if err != nil {
-		return fmt.Errorf("get layer digest: %w", err)
+		return nil, err
+	}
+	created := v1.Time{Time: createdTime}
+	var flat v1.Image
+	var diffIDs []v1.Hash
+	var history []v1.History
+	prev, prevWhat := s.prev, "previous image"
+	if *keepForeignLayers {
+		base, err := foreignBase(img)
+		if err != nil {
+			return nil, err
+		}
+		if base != nil {
+			prev, prevWhat = base, "foreign base image"
+		}
 	}
 	cfg, err := img.ConfigFile()
 	if err != nil {
-		return fmt.Errorf("get config file: %w", err)
+		return nil, fmt.Errorf("get config file: %w", err)
+	}
+	if layer, ok := reusableLayer(img); ok {
+		logf("Source image has a single layer; reusing it instead of re-extracting")
+		if flat, diffIDs, err = reuseLayer(layer); err != nil {
+			return nil, err
+		}
+	} else {
+		flat, diffIDs, history, err = squashLayers(img, prev, prevWhat, s.outputPath, outputUser(cfg.Config.User, s.dockerfile), created, run)
+		if err != nil {
+			return nil, err
+		}
 	}
+	srcCfg := cfg
 	cfg = shallowCopy(cfg)
-	cfg.RootFS.DiffIDs = []v1.Hash{diffID}
-	cfg.History = nil
-	cfg.Created = v1.Time{Time: time.Now()}
+	if err := setPlatform(cfg, srcCfg); err != nil {
+		return nil, err
+	}
+	cfg.RootFS.DiffIDs = diffIDs
+	cfg.History = history
+	cfg.Created = created
+	if cfg.Config.Labels, err = outputLabels(cfg.Config.Labels); err != nil {
+		return nil, err
+	}
+	srcDigest, err := src.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("get source image digest: %w", err)
+	}
+	vars := metadataVars{
+		SourceDigest: srcDigest.String(),
+		Platform:     v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant}.String(),
+		Created:      created.Time,
+	}
+	if cfg.Config.Labels, err = renderMetadata(cfg.Config.Labels, "label", addLabels, vars); err != nil {
+		return nil, err
+	}
+	if !*noSourceLabels {
+		if cfg.Config.Labels, err = withSourceLabels(cfg.Config.Labels, src, prev); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyDockerfile(&cfg.Config, s.dockerfile); err != nil {
+		return nil, fmt.Errorf("apply %s: %w", *applyFile, err)
+	}
+	// A creation time carried over from the source would contradict
+	// cfg.Created.
+	if _, ok := cfg.Config.Labels[createdAnnotation]; ok {
+		cfg.Config.Labels[createdAnnotation] = created.UTC().Format(time.RFC3339)
+	}
 	flat, err = mutate.ConfigFile(flat, cfg)
 	if err != nil {
-		return fmt.Errorf("set config file: %w", err)
+		return nil, fmt.Errorf("set config file: %w", err)
+	}
+
+	annotations, err := outputAnnotations(indexAnnotations, img)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := annotations[createdAnnotation]; ok || *createdFlag != "" || *reproducible {
+		annotations[createdAnnotation] = created.UTC().Format(time.RFC3339)
+	}
+	if annotations, err = renderMetadata(annotations, "annotation", addAnnotations, vars); err != nil {
+		return nil, err
+	}
+	if flat, err = matchMediaTypes(flat, img); err != nil {
+		return nil, fmt.Errorf("set media types: %w", err)
+	}
+	if len(annotations) > 0 {
+		flat = mutate.Annotations(flat, annotations).(v1.Image)
+	}
+
+	if cache != nil {
+		logf("Saving squash result to cache")
+		flat, err = cache.Put(cacheKey, flat)
+		if err != nil {
+			return nil, fmt.Errorf("write cached result: %w", err)
+		}
+		if run != nil {
+			// Reruns use the cached result from now on.
+			if err := run.remove(); err != nil {
+				logf("Warning: remove -resume state: %v", err)
+			}
+		}
+		if *cacheMaxSize != "" {
+			// Validated in main.
+			max, _ := humanize.ParseBytes(*cacheMaxSize)
+			if _, err := cache.Prune(int64(max), cacheKey); err != nil {
+				return nil, fmt.Errorf("prune cache: %w", err)
+			}
+		}
+	}
+	if *provenanceMapFile != "" {
+		if err := writeProvenanceMap(*provenanceMapFile, img, flat); err != nil {
+			return nil, err
+		}
+	}
+
+	// Encrypted after caching, so that a cached result is reused for any
+	// recipients.
+	return encryptImage(flat)
+}
+
+// squashLayers extracts the squashed rootfs of img into new layers (split
+// according to -layer-map or -profile, or as a delta against prev, which
+// messages call prevWhat), returning an image with just those layers along
+// with their DiffIDs and history.
+func squashLayers(img v1.Image, prev *source, prevWhat, outputPath, user string, created v1.Time, run *runState) (flat v1.Image, diffIDs []v1.Hash, history []v1.History, err error) {
+	plan, err := outputLayerPlan()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if plan == nil {
+		plan = layerPlan{{Name: "squashed"}}
+	}
+
+	layerPaths, layerSizes, err := extractLayers(img, plan, run)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	counts := &entryCounts{}
+	err = inspectRootfs(user, func(visitors []rootfsVisitor) error {
+		return visitLayers(layerPaths, visitors)
+	}, counts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	counts.report()
+	if *scanner != "" {
+		if err := scanLayers(layerPaths, outputPath); err != nil {
+			return nil, nil, nil, err
+		}
 	}
 
-	// Write image to output file
-	logf("Writing image to %q", outputPath)
-	out, err := os.Create(outputPath)
+	cfg, err := img.ConfigFile()
 	if err != nil {
-		return fmt.Errorf("create output file: %w", err)
+		return nil, nil, nil, fmt.Errorf("get config file: %w", err)
+	}
+	if err := checkProfile(*profile, cfg, layerSizes); err != nil {
+		return nil, nil, nil, err
 	}
-	defer out.Close()
-	progress = &progressWriter{}
-	if err := tarball.Write(outRef, flat, io.MultiWriter(out, progress)); err != nil {
-		return fmt.Errorf("write image to %q: %w", outputPath, err)
+
+	// Build a new image from scratch, or on top of the previous image's
+	// layers if we're producing a delta.
+	flat = empty.Image
+	layerNames := make([]string, len(plan))
+	for i := range plan {
+		layerNames[i] = plan[i].Name
+	}
+	if prev != nil {
+		flat, diffIDs, history, err = previousLayers(prev, prevWhat)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		delta, err := createTemp("docker-squash-delta-*.tar")
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("create temp file: %w", err)
+		}
+		stats, err := writeDelta(tempWriter(delta), layerPaths[0], prev.Image, prevWhat)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("compute delta against %s: %w", prevWhat, err)
+		}
+		logf("Delta against %s: %d added, %d changed, %d removed, %d unchanged", prevWhat, stats.Added, stats.Changed, stats.Removed, stats.Unchanged)
+		layerPaths = []string{delta.Name()}
+		layerNames = []string{"delta"}
+	}
+	logf("Computing layer digest")
+	for i, p := range layerPaths {
+		var layer v1.Layer
+		if run != nil && len(plan) == 1 && prev == nil {
+			layer, err = run.squashedLayer()
+		} else {
+			layer, err = layerFromTarball(p)
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("read squashed layer: %w", err)
+		}
+		flat, err = mutate.AppendLayers(flat, layer)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("append squashed layer to empty image: %w", err)
+		}
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("get layer digest: %w", err)
+		}
+		diffIDs = append(diffIDs, diffID)
+		if len(plan) > 1 || prev != nil {
+			history = append(history, v1.History{
+				Created:   created,
+				CreatedBy: "docker-squash",
+				Comment:   layerNames[i],
+			})
+		}
+	}
+	return flat, diffIDs, history, nil
+}
+
+// extractLayers extracts the squashed rootfs of img into a tarball for each
+// layer of plan, returning their paths and sizes. With -resume (run), a
+// single layer's tarball is kept in the run state, and reused if an
+// earlier run finished it.
+func extractLayers(img v1.Image, plan layerPlan, run *runState) ([]string, []int64, error) {
+	saveRootfs := run != nil && len(plan) == 1
+	if saveRootfs && run.Rootfs != nil {
+		logf("Reusing the squashed rootfs saved by an earlier run (%s)", humanize.Bytes(uint64(run.Rootfs.Size)))
+		return []string{run.rootfsPath()}, []int64{run.Rootfs.Size}, nil
+	}
+	rootfsHash := sha256.New()
+	tmpFiles := make([]*os.File, len(plan))
+	writers := make([]io.Writer, len(plan))
+	for i := range plan {
+		var f *os.File
+		var err error
+		if saveRootfs {
+			// Kept in the run state, rather than removed with the temp
+			// files.
+			f, err = os.Create(run.rootfsPath() + ".partial")
+		} else {
+			f, err = createTemp("docker-squash-*.tar")
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("create temp file: %w", err)
+		}
+		tmpFiles[i] = f
+		writers[i] = &timedWriter{w: tempWriter(f), phase: phaseWrite}
+	}
+
+	progress := &progressWriter{}
+	var layerSizes []int64
+	if len(plan) == 1 {
+		if *preallocateFlag {
+			e, err := estimateSquash(img)
+			if err != nil {
+				return nil, nil, fmt.Errorf("estimate size to preallocate: %w", err)
+			}
+			preallocateTemp(tmpFiles[0], e.ScratchSize)
+		}
+		logf("Extracting squashed image to %q", tmpFiles[0].Name())
+		w := io.MultiWriter(writers[0], progress)
+		if saveRootfs {
+			w = io.MultiWriter(w, &timedWriter{w: rootfsHash, phase: phaseHash})
+		}
+		if err := writeSquashedTarball(w, img); err != nil {
+			return nil, nil, fmt.Errorf("extract squashed image to %q: %w", tmpFiles[0].Name(), err)
+		}
+		if *preallocateFlag {
+			if err := tmpFiles[0].Truncate(progress.written); err != nil {
+				return nil, nil, fmt.Errorf("truncate %q: %w", tmpFiles[0].Name(), err)
+			}
+		}
+		layerSizes = []int64{progress.written}
+	} else {
+		logf("Extracting squashed image into %d layers", len(plan))
+		rc, err := squashedRootfs(img)
+		if err != nil {
+			return nil, nil, fmt.Errorf("extract squashed image layers: %w", err)
+		}
+		defer rc.Close()
+		layerSizes, err = splitLayers(io.TeeReader(rc, progress), plan, writers)
+		if err != nil {
+			return nil, nil, fmt.Errorf("extract squashed image layers: %w", err)
+		}
 	}
 	progress.Print()
-	return nil
+
+	if saveRootfs {
+		digest := v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", rootfsHash.Sum(nil))}
+		if err := run.complete(tmpFiles[0], run.rootfsPath(), func() { run.Rootfs = &runFile{Size: layerSizes[0], Digest: digest} }); err != nil {
+			return nil, nil, fmt.Errorf("save squashed rootfs for -resume: %w", err)
+		}
+		return []string{run.rootfsPath()}, layerSizes, nil
+	}
+	var layerPaths []string
+	for _, f := range tmpFiles {
+		layerPaths = append(layerPaths, f.Name())
+	}
+	return layerPaths, layerSizes, nil
 }
 
 func writeSquashedTarball(w io.Writer, img v1.Image) error {
-	rc := mutate.Extract(img)
+	rc, err := squashedRootfs(img)
+	if err != nil {
+		return err
+	}
 	defer rc.Close()
-	_, err := io.Copy(w, rc)
+	_, err = io.Copy(w, rc)
 	return err
 }
 
@@ -212,11 +1557,16 @@ type progressWriter struct {
 
 func (w *progressWriter) Write(p []byte) (int, error) {
 	w.written += int64(len(p))
-	if !*quiet && isatty.IsTerminal(os.Stderr.Fd()) && time.Since(w.lastPrinted) > 100*time.Millisecond {
+	w.maybePrint()
+	return len(p), nil
+}
 
+// maybePrint prints the current progress if printing to a terminal and
+// progress hasn't been printed recently.
+func (w *progressWriter) maybePrint() {
+	if !*quiet && isatty.IsTerminal(os.Stderr.Fd()) && time.Since(w.lastPrinted) > 100*time.Millisecond {
 		w.print()
 	}
-	return len(p), nil
 }
 
 func (w *progressWriter) Print() {
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// dockerLayerTypes maps OCI layer media types to their Docker equivalents.
+var dockerLayerTypes = map[types.MediaType]types.MediaType{
+	types.OCILayer:                       types.DockerLayer,
+	types.OCIUncompressedLayer:           types.DockerUncompressedLayer,
+	types.OCIRestrictedLayer:             types.DockerForeignLayer,
+	types.OCIUncompressedRestrictedLayer: types.DockerForeignLayer,
+	types.DockerLayer:                    types.DockerLayer,
+	types.DockerUncompressedLayer:        types.DockerUncompressedLayer,
+	types.DockerForeignLayer:             types.DockerForeignLayer,
+}
+
+// dockerLayerType returns the Docker equivalent of the OCI layer media type
+// mt, or mt itself if there's none, as for zstd.
+func dockerLayerType(mt types.MediaType) types.MediaType {
+	if d, ok := dockerLayerTypes[mt]; ok {
+		return d
+	}
+	return mt
+}
+
+// isMediaTypeRejection returns whether err from pushing a manifest could
+// mean that the registry doesn't accept OCI media types, as with some
+// older Artifactory and Nexus versions.
+func isMediaTypeRejection(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusUnsupportedMediaType {
+		return true
+	}
+	if terr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	for _, d := range terr.Errors {
+		if d.Code == transport.ManifestInvalidErrorCode || d.Code == transport.UnsupportedErrorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// imageHasOCIMediaTypes returns whether img's manifest, config or layers
+// use OCI media types.
+func imageHasOCIMediaTypes(img v1.Image) (bool, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return false, err
+	}
+	if !isDockerMediaType(m.MediaType) || !isDockerMediaType(m.Config.MediaType) {
+		return true, nil
+	}
+	for _, l := range m.Layers {
+		if !isDockerMediaType(l.MediaType) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// indexHasOCIMediaTypes is like imageHasOCIMediaTypes, for idx and its
+// images.
+func indexHasOCIMediaTypes(idx v1.ImageIndex) (bool, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return false, err
+	}
+	if !isDockerMediaType(im.MediaType) {
+		return true, nil
+	}
+	for _, desc := range im.Manifests {
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return false, err
+		}
+		if oci, err := imageHasOCIMediaTypes(img); err != nil || oci {
+			return oci, err
+		}
+	}
+	return false, nil
+}
+
+// isDockerMediaType returns whether mt is one of Docker's media types,
+// which are understood by every registry. An empty media type, as in
+// manifests that predate the mediaType field, counts as Docker.
+func isDockerMediaType(mt types.MediaType) bool {
+	switch mt {
+	case "", types.DockerManifestSchema2, types.DockerManifestList, types.DockerConfigJSON,
+		types.DockerLayer, types.DockerUncompressedLayer, types.DockerForeignLayer:
+		return true
+	}
+	return false
+}
+
+// ociLayerTypes maps Docker layer media types to their OCI equivalents.
+var ociLayerTypes = map[types.MediaType]types.MediaType{
+	types.DockerLayer:                    types.OCILayer,
+	types.DockerUncompressedLayer:        types.OCIUncompressedLayer,
+	types.DockerForeignLayer:             types.OCIRestrictedLayer,
+	types.OCILayer:                       types.OCILayer,
+	types.OCIUncompressedLayer:           types.OCIUncompressedLayer,
+	types.OCIRestrictedLayer:             types.OCIRestrictedLayer,
+	types.OCILayerZStd:                   types.OCILayerZStd,
+	types.OCIUncompressedRestrictedLayer: types.OCIUncompressedRestrictedLayer,
+}
+
+// toDockerImage returns img with Docker media types. The layer blobs are
+// unchanged, but annotations are dropped, since Docker manifests don't
+// define them.
+func toDockerImage(img v1.Image) (v1.Image, error) {
+	return convertMediaTypes(img, types.DockerManifestSchema2, types.DockerConfigJSON, dockerLayerTypes, false)
+}
+
+// toOCIImage returns img with OCI media types. The layer blobs and
+// annotations are unchanged.
+func toOCIImage(img v1.Image) (v1.Image, error) {
+	return convertMediaTypes(img, types.OCIManifestSchema1, types.OCIConfigJSON, ociLayerTypes, true)
+}
+
+func convertMediaTypes(img v1.Image, manifestType, configType types.MediaType, layerTypes map[types.MediaType]types.MediaType, keepAnnotations bool) (v1.Image, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	var adds []mutate.Addendum
+	for i, layer := range layers {
+		mt, ok := layerTypes[m.Layers[i].MediaType]
+		if !ok {
+			return nil, fmt.Errorf("layer %s has media type %s, which has no %s equivalent", m.Layers[i].Digest, m.Layers[i].MediaType, manifestType)
+		}
+		adds = append(adds, mutate.Addendum{Layer: layer, MediaType: mt, URLs: m.Layers[i].URLs})
+	}
+	base := mutate.ConfigMediaType(mutate.MediaType(empty.Image, manifestType), configType)
+	converted, err := mutate.Append(base, adds...)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if converted, err = mutate.ConfigFile(converted, cfg); err != nil {
+		return nil, err
+	}
+	if keepAnnotations && len(m.Annotations) > 0 {
+		converted = mutate.Annotations(converted, m.Annotations).(v1.Image)
+	}
+	return converted, nil
+}
+
+// isOCIImage returns whether img's manifest is an OCI one.
+func isOCIImage(img v1.Image) (bool, error) {
+	mt, err := img.MediaType()
+	if err != nil {
+		return false, err
+	}
+	return mt == types.OCIManifestSchema1, nil
+}
+
+// matchMediaTypes returns out with the media types selected by
+// -media-types: those of the format of src (OCI or Docker) by default.
+func matchMediaTypes(out, src v1.Image) (v1.Image, error) {
+	oci := *mediaTypes == "oci"
+	if *mediaTypes == "auto" {
+		var err error
+		if oci, err = isOCIImage(src); err != nil {
+			return nil, err
+		}
+		if !oci {
+			// Zstd layers, from -compressor zstd, have no Docker media type.
+			if oci, err = hasZstdLayers(out); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if oci {
+		if isOCI, err := isOCIImage(out); err != nil || isOCI {
+			return out, err
+		}
+		return toOCIImage(out)
+	}
+	if hasOCI, err := imageHasOCIMediaTypes(out); err != nil || !hasOCI {
+		return out, err
+	}
+	return toDockerImage(out)
+}
+
+// hasZstdLayers returns whether any of img's layers are zstd-compressed.
+func hasZstdLayers(img v1.Image) (bool, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return false, err
+	}
+	for _, l := range m.Layers {
+		if l.MediaType == types.OCILayerZStd {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// outputIndexMediaType returns the media type for an index of imgs: that
+// of the source index, if there is one (src), and otherwise an OCI index
+// if any of imgs is an OCI image. -media-types overrides both.
+func outputIndexMediaType(src types.MediaType, imgs []v1.Image) (types.MediaType, error) {
+	switch *mediaTypes {
+	case "oci":
+		return types.OCIImageIndex, nil
+	case "docker":
+		return types.DockerManifestList, nil
+	}
+	if src != "" {
+		return src, nil
+	}
+	for _, img := range imgs {
+		if oci, err := isOCIImage(img); err != nil || oci {
+			return types.OCIImageIndex, err
+		}
+	}
+	return types.DockerManifestList, nil
+}
+
+// toDockerIndex returns idx as a Docker manifest list of Docker images.
+func toDockerIndex(idx v1.ImageIndex) (v1.ImageIndex, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var adds []mutate.IndexAddendum
+	for _, desc := range im.Manifests {
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		docker, err := toDockerImage(img)
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, mutate.IndexAddendum{Add: docker, Descriptor: v1.Descriptor{Platform: desc.Platform}})
+	}
+	return mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.DockerManifestList), adds...), nil
+}
+
+// dockerFallback returns t (an image or index) converted to Docker media
+// types, or nil if it has no OCI media types to convert.
+func dockerFallback(t remote.Taggable) (remote.Taggable, error) {
+	switch t := t.(type) {
+	case v1.ImageIndex:
+		if oci, err := indexHasOCIMediaTypes(t); err != nil || !oci {
+			return nil, err
+		}
+		return toDockerIndex(t)
+	case v1.Image:
+		if oci, err := imageHasOCIMediaTypes(t); err != nil || !oci {
+			return nil, err
+		}
+		return toDockerImage(t)
+	}
+	return nil, nil
+}
+
+// pushWithFallback calls push with t and, if the registry rejects it and
+// it uses OCI media types, again with Docker media types, unless
+// -media-types=oci asked for OCI. It returns what was pushed.
+func pushWithFallback(registry string, t remote.Taggable, push func(remote.Taggable) error) (remote.Taggable, error) {
+	err := push(t)
+	if err == nil || !isMediaTypeRejection(err) || *mediaTypes == "oci" {
+		return t, err
+	}
+	docker, cerr := dockerFallback(t)
+	if cerr != nil || docker == nil {
+		return t, err
+	}
+	logf("%s rejected the manifest (%v); retrying with Docker media types instead of OCI ones", registry, err)
+	return docker, push(docker)
+}
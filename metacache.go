@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCachedBlobSize is the largest blob kept in the metadata cache. Config
+// blobs are well under it; layer blobs almost always over it.
+const maxCachedBlobSize = 1 << 20
+
+// registryPathPattern matches the registry API paths of manifests and
+// blobs.
+var registryPathPattern = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs)/([^/]+)$`)
+
+// metadataEntry is a registry response stored in the metadata cache.
+type metadataEntry struct {
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	// Ref is the reference a manifest was fetched by, like
+	// "registry.example.com/repo:tag", for completing SOURCE.
+	Ref string `json:"ref,omitempty"`
+}
+
+// metadataCacheTransport serves repeated manifest and config blob requests
+// from the metadata cache in -cache-dir, so that repeated runs don't spend
+// registry requests (and Docker Hub pull quota) on metadata they already
+// have. Responses for digests are immutable and reused for as long as
+// they're cached; manifests fetched by tag are reused for -metadata-ttl.
+type metadataCacheTransport struct {
+	inner http.RoundTripper
+}
+
+func (t *metadataCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if *cacheDir == "" || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return t.inner.RoundTrip(req)
+	}
+	m := registryPathPattern.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		return t.inner.RoundTrip(req)
+	}
+	kind, ref := m[2], m[3]
+	byDigest := strings.HasPrefix(ref, "sha256:")
+	if (kind == "blobs" && !byDigest) || (!byDigest && *metadataTTL <= 0) {
+		return t.inner.RoundTrip(req)
+	}
+	key := req.URL.Host + req.URL.Path
+	if kind == "manifests" {
+		// The registry picks the manifest format by the Accept header.
+		key += "\n" + req.Header.Get("Accept")
+	}
+	sum := sha256.Sum256([]byte(key))
+	path := filepath.Join(*cacheDir, "metadata", hex.EncodeToString(sum[:])+".json")
+
+	if e, ok := readMetadataEntry(path, byDigest); ok {
+		return e.response(req), nil
+	}
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	if kind == "blobs" && (resp.ContentLength < 0 || resp.ContentLength > maxCachedBlobSize) {
+		return resp, nil
+	}
+	body, err := readMetadata(resp.Body, req.URL.Path)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if byDigest {
+		if got := sha256.Sum256(body); "sha256:"+hex.EncodeToString(got[:]) != ref {
+			// Let go-containerregistry report the mismatch.
+			return resp, nil
+		}
+	}
+	e := &metadataEntry{Header: http.Header{}, Body: body}
+	if kind == "manifests" {
+		sep := ":"
+		if byDigest {
+			sep = "@"
+		}
+		e.Ref = req.URL.Host + "/" + m[1] + sep + ref
+	}
+	for _, h := range []string{"Content-Type", "Docker-Content-Digest"} {
+		if v := resp.Header.Get(h); v != "" {
+			e.Header.Set(h, v)
+		}
+	}
+	if err := writeMetadataEntry(path, e); err != nil {
+		logf("Warning: write metadata cache: %v", err)
+	}
+	return resp, nil
+}
+
+// readMetadataEntry returns the cache entry at path, if there is one that
+// hasn't expired.
+func readMetadataEntry(path string, immutable bool) (*metadataEntry, bool) {
+	info, err := os.Stat(path)
+	if err != nil || (!immutable && time.Since(info.ModTime()) > *metadataTTL) {
+		return nil, false
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var e metadataEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, false
+	}
+	return &e, true
+}
+
+func writeMetadataEntry(path string, e *metadataEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Write atomically, since the cache may be shared by concurrent
+	// processes.
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// response returns a response to req built from the cache entry.
+func (e *metadataEntry) response(req *http.Request) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	body := e.Body
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", http.StatusOK, http.StatusText(http.StatusOK)),
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// metadataVars are the variables available to the templates in -label and
+// -annotation values.
+type metadataVars struct {
+	// SourceDigest is the source image's manifest digest, like
+	// "sha256:abc...".
+	SourceDigest string
+	// Platform is the squashed image's platform, like "linux/arm64".
+	Platform string
+	// Created is the squashed image's creation time (see -created).
+	Created time.Time
+}
+
+// metadataFuncs are the functions available to -label and -annotation
+// templates, given the squashed image's creation time:
+//
+//	now                 the creation time, which is the current time unless
+//	                    -created or -reproducible says otherwise
+//	date LAYOUT TIME    TIME in UTC, formatted with a Go time layout, like
+//	                    {{now | date "2006-01-02"}}
+//	env NAME            the environment variable NAME, or "" if it's unset
+func metadataFuncs(created time.Time) template.FuncMap {
+	return template.FuncMap{
+		"now":  func() time.Time { return created },
+		"date": func(layout string, t time.Time) string { return t.UTC().Format(layout) },
+		"env":  os.Getenv,
+	}
+}
+
+// parseMetadataTemplate parses the value of a -label or -annotation flag
+// (named by what) as a template.
+func parseMetadataTemplate(what, value string, created time.Time) (*template.Template, error) {
+	return template.New(what).Funcs(metadataFuncs(created)).Option("missingkey=error").Parse(value)
+}
+
+// checkMetadataFlags validates the KEY=VALUE values of the -label or
+// -annotation flag (named by what), including their templates.
+func checkMetadataFlags(what string, values []string) error {
+	for _, kv := range values {
+		if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+			return fmt.Errorf("invalid -%s %q (expected KEY=VALUE)", what, kv)
+		}
+	}
+	_, err := renderMetadata(nil, what, values, metadataVars{})
+	return err
+}
+
+// renderMetadata renders the KEY=VALUE values of the -label or -annotation
+// flag (named by what) into m, allocating it if needed.
+func renderMetadata(m map[string]string, what string, values []string, vars metadataVars) (map[string]string, error) {
+	for _, kv := range values {
+		k, v, _ := strings.Cut(kv, "=")
+		tmpl, err := parseMetadataTemplate(what, v, vars.Created)
+		if err != nil {
+			return nil, fmt.Errorf("parse -%s %q: %w", what, kv, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, vars); err != nil {
+			return nil, fmt.Errorf("render -%s %q: %w", what, kv, err)
+		}
+		if m == nil {
+			m = map[string]string{}
+		}
+		m[k] = buf.String()
+	}
+	return m, nil
+}
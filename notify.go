@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// notifyEvent is the JSON payload sent to -notify-cmd and -notify-webhook.
+type notifyEvent struct {
+	// Event is "start", "success" or "failure".
+	Event   string   `json:"event"`
+	Sources []string `json:"sources"`
+	Dests   []string `json:"dests"`
+	// Error and ExitCode are set for failures.
+	Error    string `json:"error,omitempty"`
+	ExitCode int    `json:"exitCode"`
+	// DurationSeconds is set once the squash has finished.
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	// PhaseSeconds is the time spent in each phase of a successful
+	// squash, like "pull" or "compress". Phases overlap.
+	PhaseSeconds map[string]float64 `json:"phaseSeconds,omitempty"`
+	// HubPullQuota is the Docker Hub pull quota left once the squash has
+	// finished, if it pulled from Docker Hub.
+	HubPullQuota *hubPullQuota `json:"hubPullQuota,omitempty"`
+	// Text is a one-line summary, which is also what Slack incoming
+	// webhooks display.
+	Text string `json:"text"`
+}
+
+// notifyTimeout bounds each notification, so that a hanging hook can't
+// hold up the squash.
+const notifyTimeout = 30 * time.Second
+
+// notify sends e to -notify-cmd and -notify-webhook, if set. Failures are
+// logged, but don't fail the squash. It sets e.Text, for the -json result
+// too.
+func notify(e *notifyEvent) {
+	what := fmt.Sprintf("squashing %s to %s", strings.Join(e.Sources, ", "), strings.Join(e.Dests, ", "))
+	switch e.Event {
+	case "start":
+		e.Text = "docker-squash: started " + what
+	case "success":
+		e.Text = fmt.Sprintf("docker-squash: finished %s in %s", what, time.Duration(e.DurationSeconds*float64(time.Second)).Round(time.Second))
+	case "failure":
+		e.Text = fmt.Sprintf("docker-squash: %s failed: %s", what, e.Error)
+	}
+	if *notifyCmd == "" && *notifyWebhook == "" {
+		return
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		logf("Warning: encode notification: %v", err)
+		return
+	}
+	if *notifyCmd != "" {
+		if err := runNotifyCmd(e.Event, payload); err != nil {
+			logf("Warning: -notify-cmd failed: %v", err)
+		}
+	}
+	if *notifyWebhook != "" {
+		if err := postNotifyWebhook(payload); err != nil {
+			logf("Warning: -notify-webhook failed: %v", err)
+		}
+	}
+}
+
+// runNotifyCmd runs -notify-cmd in the shell with the payload on stdin and
+// the event name in $DOCKER_SQUASH_EVENT.
+func runNotifyCmd(event string, payload []byte) error {
+	cmd := shellCommand(*notifyCmd)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "DOCKER_SQUASH_EVENT="+event)
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(notifyTimeout, func() { cmd.Process.Kill() })
+	defer timer.Stop()
+	return cmd.Wait()
+}
+
+func postNotifyWebhook(payload []byte) error {
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(*notifyWebhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// isOCIArchive returns whether the tar archive indexed by x is an
+// oci-archive, a tarred OCI image layout like 'podman save --format
+// oci-archive' writes, rather than a docker-save tarball.
+func isOCIArchive(x *tarIndex) bool {
+	_, ok := x.entries[x.member("oci-layout")]
+	return ok
+}
+
+// openOCIArchive opens the image in the oci-archive at path selected by
+// -layout-ref and -platform, as for an OCI layout directory. Blobs are read
+// in place from the archive.
+func openOCIArchive(path string, x *tarIndex) (*source, error) {
+	what := fmt.Sprintf("OCI archive %q", path)
+	raw, err := x.readAll(x.member("index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", what, err)
+	}
+	return selectLayoutEntry(&archiveIndex{archive: x, mediaType: types.OCIImageIndex, raw: raw}, what)
+}
+
+// blobName returns the name of the member holding the layout blob h.
+func (x *tarIndex) blobName(h v1.Hash) string {
+	return x.member("blobs/" + h.Algorithm + "/" + h.Hex)
+}
+
+// archiveIndex is an index of an oci-archive: its index.json, or an index
+// blob it refers to. It's like ggcr's layout index, reading from a tarIndex.
+type archiveIndex struct {
+	archive   *tarIndex
+	mediaType types.MediaType
+	raw       []byte
+}
+
+var _ v1.ImageIndex = (*archiveIndex)(nil)
+
+func (i *archiveIndex) MediaType() (types.MediaType, error) { return i.mediaType, nil }
+func (i *archiveIndex) Digest() (v1.Hash, error)            { return partial.Digest(i) }
+func (i *archiveIndex) Size() (int64, error)                { return partial.Size(i) }
+func (i *archiveIndex) RawManifest() ([]byte, error)        { return i.raw, nil }
+
+func (i *archiveIndex) IndexManifest() (*v1.IndexManifest, error) {
+	var im v1.IndexManifest
+	if err := json.Unmarshal(i.raw, &im); err != nil {
+		return nil, err
+	}
+	return &im, nil
+}
+
+// findDescriptor returns i's entry for h, checking that it's an image or an
+// index as wanted.
+func (i *archiveIndex) findDescriptor(h v1.Hash, index bool) (v1.Descriptor, error) {
+	im, err := i.IndexManifest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	for _, desc := range im.Manifests {
+		if desc.Digest != h {
+			continue
+		}
+		if index && !desc.MediaType.IsIndex() || !index && !desc.MediaType.IsImage() {
+			return v1.Descriptor{}, fmt.Errorf("unexpected media type for %v: %s", h, desc.MediaType)
+		}
+		return desc, nil
+	}
+	return v1.Descriptor{}, fmt.Errorf("could not find descriptor in index: %s", h)
+}
+
+func (i *archiveIndex) Image(h v1.Hash) (v1.Image, error) {
+	desc, err := i.findDescriptor(h, false)
+	if err != nil {
+		return nil, err
+	}
+	return partial.CompressedToImage(&archiveImage{archive: i.archive, desc: desc})
+}
+
+func (i *archiveIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	desc, err := i.findDescriptor(h, true)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := i.archive.readAll(i.archive.blobName(h))
+	if err != nil {
+		return nil, err
+	}
+	return &archiveIndex{archive: i.archive, mediaType: desc.MediaType, raw: raw}, nil
+}
+
+// archiveImage is an image in an oci-archive, described by desc.
+type archiveImage struct {
+	archive *tarIndex
+	desc    v1.Descriptor
+
+	manifestOnce sync.Once
+	raw          []byte
+	manifest     *v1.Manifest
+	manifestErr  error
+}
+
+func (i *archiveImage) MediaType() (types.MediaType, error) { return i.desc.MediaType, nil }
+
+func (i *archiveImage) Manifest() (*v1.Manifest, error) {
+	i.manifestOnce.Do(func() {
+		if i.raw, i.manifestErr = i.archive.readAll(i.archive.blobName(i.desc.Digest)); i.manifestErr != nil {
+			return
+		}
+		i.manifest, i.manifestErr = v1.ParseManifest(bytes.NewReader(i.raw))
+	})
+	return i.manifest, i.manifestErr
+}
+
+func (i *archiveImage) RawManifest() ([]byte, error) {
+	if _, err := i.Manifest(); err != nil {
+		return nil, err
+	}
+	return i.raw, nil
+}
+
+func (i *archiveImage) RawConfigFile() ([]byte, error) {
+	m, err := i.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	return i.archive.readAll(i.archive.blobName(m.Config.Digest))
+}
+
+func (i *archiveImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	m, err := i.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	if h == m.Config.Digest {
+		return &archiveBlob{archive: i.archive, desc: m.Config}, nil
+	}
+	for _, desc := range m.Layers {
+		if desc.Digest == h {
+			return &archiveBlob{archive: i.archive, desc: desc}, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find layer in image: %s", h)
+}
+
+// archiveBlob is a layer or config blob in an oci-archive.
+type archiveBlob struct {
+	archive *tarIndex
+	desc    v1.Descriptor
+}
+
+func (b *archiveBlob) Digest() (v1.Hash, error) { return b.desc.Digest, nil }
+func (b *archiveBlob) Compressed() (io.ReadCloser, error) {
+	return b.archive.open(b.archive.blobName(b.desc.Digest))
+}
+func (b *archiveBlob) Size() (int64, error)                { return b.desc.Size, nil }
+func (b *archiveBlob) MediaType() (types.MediaType, error) { return b.desc.MediaType, nil }
+func (b *archiveBlob) Descriptor() (*v1.Descriptor, error) { return &b.desc, nil }
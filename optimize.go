@@ -0,0 +1,429 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// optimizer is an -optimize heuristic for shrinking the squashed rootfs.
+type optimizer struct {
+	Name        string
+	Description string
+	// edit returns the entries of fs to change: each maps to the entry to
+	// replace it with a hardlink to, or to "" to remove it.
+	edit func(fs *rootfsListing) map[string]string
+	// hashes is set if edit needs the content hashes of shared libraries.
+	hashes bool
+}
+
+// optimizers are the -optimize heuristics, in the order they're applied.
+var optimizers = []*optimizer{
+	{
+		Name:        "pycache",
+		Description: "remove Python bytecode caches (__pycache__ directories), which Python regenerates or does without",
+		edit:        removePycache,
+	},
+	{
+		Name:        "stale-pyc",
+		Description: "remove Python bytecode compiled for Python versions that aren't installed",
+		edit:        removeStalePyc,
+	},
+	{
+		Name:        "tzdata",
+		Description: "remove the duplicate posix/ and right/ copies of the timezone database in /usr/share/zoneinfo",
+		edit:        removeDuplicateTzdata,
+	},
+	{
+		Name:        "package-caches",
+		Description: "empty apt, apk, yum, dnf, pip and npm download caches and package lists",
+		edit:        removePackageCaches,
+	},
+	{
+		Name:        "package-metadata",
+		Description: "remove dpkg, apk and rpm databases when the package manager itself isn't installed (vulnerability scanners read them, so this hides packages from scans)",
+		edit:        removeOrphanedPackageMetadata,
+	},
+	{
+		Name:        "dedupe-libs",
+		Description: "replace identical copies of shared libraries (.so files) with hardlinks to one of them",
+		edit:        dedupeLibs,
+		hashes:      true,
+	},
+}
+
+// parseOptimize parses an -optimize value: "all", or a comma-separated list
+// of heuristic names, where "-NAME" disables one (as in "all,-tzdata").
+func parseOptimize(value string) ([]*optimizer, error) {
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		on := true
+		if n, ok := strings.CutPrefix(name, "-"); ok {
+			name, on = n, false
+		}
+		if name == "all" {
+			for _, o := range optimizers {
+				enabled[o.Name] = on
+			}
+			continue
+		}
+		if !slices.ContainsFunc(optimizers, func(o *optimizer) bool { return o.Name == name }) {
+			return nil, fmt.Errorf("unknown heuristic %q (expected \"all\" or one of: %s)", name, strings.Join(optimizerNames(), ", "))
+		}
+		enabled[name] = on
+	}
+	var out []*optimizer
+	for _, o := range optimizers {
+		if enabled[o.Name] {
+			out = append(out, o)
+		}
+	}
+	return out, nil
+}
+
+// optimizerHelp lists the heuristics for --help, wrapped like the rest of
+// the help text.
+func optimizerHelp() string {
+	var lines []string
+	for _, o := range optimizers {
+		line := "-"
+		for _, word := range strings.Fields(o.Name + ": " + o.Description) {
+			if len(line)+1+len(word) > 76 {
+				lines = append(lines, line)
+				line = " "
+			}
+			line += " " + word
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func optimizerNames() []string {
+	var names []string
+	for _, o := range optimizers {
+		names = append(names, o.Name)
+	}
+	return names
+}
+
+// rootfsListing lists the entries of a squashed rootfs, for -optimize
+// heuristics to choose from.
+type rootfsListing struct {
+	// names are the cleaned entry names, in stream order.
+	names   []string
+	headers map[string]*tar.Header
+	// sums are the content hashes of shared libraries, if requested.
+	sums map[string][sha256.Size]byte
+}
+
+func (fs *rootfsListing) has(name string) bool {
+	_, ok := fs.headers[name]
+	return ok
+}
+
+func (fs *rootfsListing) isDir(name string) bool {
+	hdr, ok := fs.headers[name]
+	return ok && hdr.Typeflag == tar.TypeDir
+}
+
+// tree returns dir and everything below it.
+func (fs *rootfsListing) tree(dir string) []string {
+	if !fs.has(dir) {
+		return nil
+	}
+	return append([]string{dir}, fs.below(dir)...)
+}
+
+// below returns everything below dir.
+func (fs *rootfsListing) below(dir string) []string {
+	var out []string
+	for _, name := range fs.names {
+		if strings.HasPrefix(name, dir+"/") {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// removeAll returns edits removing names.
+func removeAll(names []string) map[string]string {
+	edits := map[string]string{}
+	for _, name := range names {
+		edits[name] = ""
+	}
+	return edits
+}
+
+func removePycache(fs *rootfsListing) map[string]string {
+	var names []string
+	for _, name := range fs.names {
+		if name == "__pycache__" || strings.HasPrefix(name, "__pycache__/") || strings.Contains(name, "/__pycache__/") || strings.HasSuffix(name, "/__pycache__") {
+			names = append(names, name)
+		}
+	}
+	return removeAll(names)
+}
+
+var (
+	// pycTag matches the interpreter tag of a cached bytecode file, like
+	// "__pycache__/foo.cpython-311.pyc".
+	pycTag = regexp.MustCompile(`(?:^|/)__pycache__/[^/]+\.(cpython-3\d+)(?:\.opt-\d)?\.pyc$`)
+	// pythonBinary matches an installed CPython 3 interpreter.
+	pythonBinary = regexp.MustCompile(`^(?:usr/(?:local/)?)?bin/python3\.(\d+)$`)
+)
+
+func removeStalePyc(fs *rootfsListing) map[string]string {
+	installed := map[string]bool{}
+	for _, name := range fs.names {
+		if m := pythonBinary.FindStringSubmatch(name); m != nil {
+			installed["cpython-3"+m[1]] = true
+		}
+	}
+	var names []string
+	for _, name := range fs.names {
+		if m := pycTag.FindStringSubmatch(name); m != nil && !installed[m[1]] {
+			names = append(names, name)
+		}
+	}
+	return removeAll(names)
+}
+
+func removeDuplicateTzdata(fs *rootfsListing) map[string]string {
+	const zoneinfo = "usr/share/zoneinfo"
+	if !fs.has(zoneinfo+"/UTC") && !fs.has(zoneinfo+"/Etc/UTC") {
+		return nil
+	}
+	var names []string
+	for _, dup := range []string{"posix", "right"} {
+		// Debian makes these symlinks, which cost nothing.
+		if fs.isDir(zoneinfo + "/" + dup) {
+			names = append(names, fs.tree(zoneinfo+"/"+dup)...)
+		}
+	}
+	return removeAll(names)
+}
+
+// packageCacheDirs are directories whose contents package managers
+// re-download when needed.
+var packageCacheDirs = []string{
+	"var/cache/apt",
+	"var/lib/apt/lists",
+	"var/cache/apk",
+	"etc/apk/cache",
+	"var/cache/yum",
+	"var/cache/dnf",
+	"root/.cache/pip",
+	"root/.npm/_cacache",
+}
+
+func removePackageCaches(fs *rootfsListing) map[string]string {
+	var names []string
+	for _, dir := range packageCacheDirs {
+		if fs.isDir(dir) {
+			names = append(names, fs.below(dir)...)
+		}
+	}
+	return removeAll(names)
+}
+
+// packageDatabases lists, for each package manager, its binaries and the
+// directories holding its database of installed packages.
+var packageDatabases = []struct {
+	binaries, dirs []string
+}{
+	{
+		binaries: []string{"usr/bin/dpkg", "bin/dpkg"},
+		dirs:     []string{"var/lib/dpkg", "var/lib/apt", "var/cache/apt", "var/cache/debconf", "var/log/apt"},
+	},
+	{
+		binaries: []string{"sbin/apk", "usr/sbin/apk", "bin/apk"},
+		dirs:     []string{"lib/apk", "var/cache/apk"},
+	},
+	{
+		binaries: []string{"usr/bin/rpm", "bin/rpm"},
+		dirs:     []string{"var/lib/rpm", "usr/lib/sysimage/rpm", "var/lib/dnf", "var/lib/yum", "var/cache/dnf", "var/cache/yum"},
+	},
+}
+
+func removeOrphanedPackageMetadata(fs *rootfsListing) map[string]string {
+	var names []string
+	for _, db := range packageDatabases {
+		if slices.ContainsFunc(db.binaries, fs.has) {
+			continue
+		}
+		for _, dir := range db.dirs {
+			if fs.isDir(dir) {
+				names = append(names, fs.tree(dir)...)
+			}
+		}
+	}
+	return removeAll(names)
+}
+
+// sharedLibrary matches shared library file names, like "libz.so.1.3".
+var sharedLibrary = regexp.MustCompile(`\.so(?:\.[0-9.]+)?$`)
+
+func dedupeLibs(fs *rootfsListing) map[string]string {
+	type key struct {
+		sum          [sha256.Size]byte
+		mode         int64
+		uid, gid     int
+		uname, gname string
+	}
+	first := map[key]string{}
+	edits := map[string]string{}
+	for _, name := range fs.names {
+		sum, ok := fs.sums[name]
+		if !ok {
+			continue
+		}
+		// Hardlinks share their metadata, so only link identical files.
+		hdr := fs.headers[name]
+		k := key{sum, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname}
+		if target, ok := first[k]; ok {
+			edits[name] = target
+		} else {
+			first[k] = name
+		}
+	}
+	return edits
+}
+
+// optimizeRootfs applies the heuristics to the tar stream r, logging what
+// each changed. r is spooled to a temp file first, since the heuristics look
+// at the whole rootfs.
+func optimizeRootfs(r io.Reader, heuristics []*optimizer) (io.ReadCloser, error) {
+	spool, err := createTemp("docker-squash-optimize-*.tar")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	if _, err := io.Copy(tempWriter(spool), r); err != nil {
+		return nil, fmt.Errorf("spool squashed rootfs: %w", err)
+	}
+	hashes := slices.ContainsFunc(heuristics, func(o *optimizer) bool { return o.hashes })
+	fs, err := listRootfs(spool, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("read squashed rootfs: %w", err)
+	}
+
+	edits := map[string]string{}
+	by := map[string]*optimizer{}
+	for _, o := range heuristics {
+		for name, target := range o.edit(fs) {
+			if _, ok := edits[name]; !ok {
+				edits[name], by[name] = target, o
+			}
+		}
+	}
+	keepLinkTargets(fs, edits)
+	for _, o := range heuristics {
+		var n int
+		var saved int64
+		for name := range edits {
+			if by[name] == o {
+				n++
+				saved += fs.headers[name].Size
+			}
+		}
+		verb := "removed"
+		if o.hashes {
+			verb = "hardlinked"
+		}
+		logf("-optimize %s: %s %s (%s)", o.Name, verb, plural(n, "entry"), humanize.Bytes(uint64(saved)))
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeOptimized(pw, spool, fs, edits))
+	}()
+	return pr, nil
+}
+
+// listRootfs lists the entries of the tar file f, hashing shared libraries
+// if hashes is set.
+func listRootfs(f *os.File, hashes bool) (*rootfsListing, error) {
+	fs := &rootfsListing{headers: map[string]*tar.Header{}, sums: map[string][sha256.Size]byte{}}
+	tr := tar.NewReader(tempReader(f))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return fs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := cleanTarPath(hdr.Name)
+		if name == "" {
+			continue
+		}
+		fs.names = append(fs.names, name)
+		fs.headers[name] = hdr
+		if hashes && hdr.Typeflag == tar.TypeReg && hdr.Size > 0 && sharedLibrary.MatchString(name) {
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, err
+			}
+			fs.sums[name] = [sha256.Size]byte(h.Sum(nil))
+		}
+	}
+}
+
+// keepLinkTargets drops the removal of entries (and their parent
+// directories) that remaining hardlinks point to.
+func keepLinkTargets(fs *rootfsListing, edits map[string]string) {
+	for _, name := range fs.names {
+		if target, ok := edits[name]; ok && target == "" {
+			continue
+		}
+		linkname := edits[name]
+		if hdr := fs.headers[name]; linkname == "" && hdr.Typeflag == tar.TypeLink {
+			linkname = cleanTarPath(hdr.Linkname)
+		}
+		for p := linkname; p != "" && p != "."; p = path.Dir(p) {
+			if target, ok := edits[p]; ok && target == "" {
+				delete(edits, p)
+			}
+		}
+	}
+}
+
+func writeOptimized(w io.Writer, spool *os.File, fs *rootfsListing, edits map[string]string) error {
+	tr := tar.NewReader(tempReader(spool))
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target, ok := edits[cleanTarPath(hdr.Name)]
+		if ok && target == "" {
+			continue
+		}
+		if ok {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, fs.headers[target].Name, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Size > 0 {
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+// outputPermissions are the permissions and owner of local outputs, as set
+// by the -output-mode and -output-owner flags, so that outputs written by
+// root in a container can be read by the CI user collecting them.
+type outputPermissions struct {
+	// mode is the permission bits of output files, and of directories with
+	// the execute bits of each read bit added. If zero, outputs are created
+	// as the umask says, including the files of OCI layout directories,
+	// which go-containerregistry would otherwise write with its own modes.
+	mode fs.FileMode
+	// uid and gid own every output file and directory, or -1 to keep the
+	// current user's.
+	uid, gid int
+	// umask is the process umask, read once at startup since reading it
+	// means setting it.
+	umask fs.FileMode
+}
+
+// outputPerms are the parsed -output-mode and -output-owner flags.
+var outputPerms = outputPermissions{uid: -1, gid: -1}
+
+// parseOutputPermissions returns the outputPermissions set by flags.
+func parseOutputPermissions() (outputPermissions, error) {
+	p := outputPermissions{uid: -1, gid: -1, umask: umask()}
+	if *outputMode != "" {
+		m, err := strconv.ParseUint(*outputMode, 8, 32)
+		if err != nil || m == 0 || m > 0777 {
+			return p, fmt.Errorf("invalid -output-mode %q (expected octal permissions, like 0644)", *outputMode)
+		}
+		p.mode = fs.FileMode(m)
+	}
+	if *outputOwner != "" {
+		if runtime.GOOS == "windows" {
+			return p, fmt.Errorf("-output-owner is not supported on Windows")
+		}
+		var err error
+		if p.uid, p.gid, err = parseOwner(*outputOwner); err != nil {
+			return p, fmt.Errorf("invalid -output-owner: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// apply sets the permissions and owner of the local output at path, and of
+// everything in it if it's an OCI layout directory. Pipes and devices are
+// left alone.
+func (p outputPermissions) apply(path string) error {
+	if isRegistryDest(path) || isStreamDest(path) {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return p.set(path, false, p.mode != 0)
+	}
+	return filepath.WalkDir(path, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// The directory itself may be one DEST was given as, like Bazel's,
+		// whose mode isn't ours to reset unless asked.
+		return p.set(name, d.IsDir(), p.mode != 0 || name != path)
+	})
+}
+
+// set sets the owner of the output file or directory name, and its mode if
+// chmod is set.
+func (p outputPermissions) set(name string, dir, chmod bool) error {
+	if chmod {
+		mode := p.mode
+		if mode == 0 {
+			mode = 0666 &^ p.umask
+			if dir {
+				mode = 0777 &^ p.umask
+			}
+		} else if dir {
+			mode |= (mode & 0444) >> 2
+		}
+		if err := os.Chmod(name, mode); err != nil {
+			return fmt.Errorf("set output permissions: %w", err)
+		}
+	}
+	if p.uid >= 0 {
+		if err := os.Lchown(name, p.uid, p.gid); err != nil {
+			return fmt.Errorf("set output owner: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ownerRule is a parsed -enforce-owner value.
+type ownerRule struct {
+	User, Group string
+	// Glob matches the paths the rule applies to, along with everything
+	// below them. Empty means the whole rootfs.
+	Glob string
+
+	uid, gid int
+}
+
+// parseOwnerRules parses -enforce-owner values like "1000:1000:/app".
+func parseOwnerRules(values []string) ([]*ownerRule, error) {
+	var rules []*ownerRule
+	for _, v := range values {
+		parts := strings.SplitN(v, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q: expected USER:GROUP[:GLOB]", v)
+		}
+		r := &ownerRule{User: parts[0], Group: parts[1]}
+		if len(parts) == 3 {
+			r.Glob = cleanTarPath(parts[2])
+			if _, err := path.Match(r.Glob, ""); err != nil {
+				return nil, fmt.Errorf("%q: %w", v, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// matches returns whether name, or one of its parent directories, matches
+// the rule's glob.
+func (r *ownerRule) matches(name string) bool {
+	if r.Glob == "" {
+		return true
+	}
+	for p := name; p != "." && p != ""; p = path.Dir(p) {
+		if ok, _ := path.Match(r.Glob, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ownerRule) String() string {
+	s := r.User + ":" + r.Group
+	if r.Glob != "" {
+		s += " under /" + r.Glob
+	}
+	return s
+}
+
+// resolveOwnerRules sets the numeric IDs of each rule, looking up user and
+// group names in img's /etc/passwd and /etc/group.
+func resolveOwnerRules(rules []*ownerRule, img v1.Image) error {
+	var users, groups map[string]int
+	for _, r := range rules {
+		uid, uerr := strconv.Atoi(r.User)
+		gid, gerr := strconv.Atoi(r.Group)
+		if (uerr != nil || gerr != nil) && users == nil {
+			var err error
+			if users, groups, err = readAccounts(img); err != nil {
+				return fmt.Errorf("read users and groups from image: %w", err)
+			}
+		}
+		if uerr != nil {
+			id, ok := users[r.User]
+			if !ok {
+				return fmt.Errorf("-enforce-owner: no user %q in the image's /etc/passwd", r.User)
+			}
+			uid = id
+		}
+		if gerr != nil {
+			id, ok := groups[r.Group]
+			if !ok {
+				return fmt.Errorf("-enforce-owner: no group %q in the image's /etc/group", r.Group)
+			}
+			gid = id
+		}
+		r.uid, r.gid = uid, gid
+	}
+	return nil
+}
+
+// readAccounts returns the user and group IDs by name from the flattened
+// rootfs of img.
+func readAccounts(img v1.Image) (users, groups map[string]int, err error) {
+	users, groups = map[string]int{}, map[string]int{}
+	rc := extractImage(img)
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	found := 0
+	for found < 2 {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var ids map[string]int
+		switch cleanTarPath(hdr.Name) {
+		case "etc/passwd":
+			ids = users
+		case "etc/group":
+			ids = groups
+		default:
+			continue
+		}
+		found++
+		sc := bufio.NewScanner(tr)
+		for sc.Scan() {
+			// name:password:ID:...
+			fields := strings.Split(sc.Text(), ":")
+			if len(fields) < 3 {
+				continue
+			}
+			if id, err := strconv.Atoi(fields[2]); err == nil {
+				ids[fields[0]] = id
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return users, groups, nil
+}
+
+// maxOwnerViolations is how many mismatched paths are listed in errors.
+const maxOwnerViolations = 10
+
+// enforceOwners returns a copy of the tar stream rc in which every entry
+// matched by one of rules (the last matching rule wins) is checked to have
+// the rule's owner. With -fix-owner, mismatched entries are changed to the
+// rule's owner; otherwise, reading fails at the end of the stream. rc is
+// closed once it has been copied.
+func enforceOwners(rc io.ReadCloser, rules []*ownerRule) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer rc.Close()
+		pw.CloseWithError(copyEnforcingOwners(pw, rc, rules))
+	}()
+	return pr
+}
+
+func copyEnforcingOwners(w io.Writer, r io.Reader, rules []*ownerRule) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	var violations []string
+	count := 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanTarPath(hdr.Name)
+		var rule *ownerRule
+		for _, r := range rules {
+			if r.matches(name) {
+				rule = r
+			}
+		}
+		if rule != nil && (hdr.Uid != rule.uid || hdr.Gid != rule.gid) {
+			count++
+			if *fixOwner {
+				hdr.Uid, hdr.Gid = rule.uid, rule.gid
+				hdr.Uname, hdr.Gname = "", ""
+			} else if len(violations) < maxOwnerViolations {
+				violations = append(violations, fmt.Sprintf("  /%s is owned by %d:%d, expected %s", name, hdr.Uid, hdr.Gid, rule))
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if *fixOwner {
+		if count > 0 {
+			logf("Changed the owner of %d entries to match -enforce-owner", count)
+		}
+		return nil
+	}
+	if count > 0 {
+		if count > len(violations) {
+			violations = append(violations, fmt.Sprintf("  ... and %d more", count-len(violations)))
+		}
+		return withExitCode(exitVerification, fmt.Errorf("%d entries don't have the owner required by -enforce-owner (use -fix-owner to change them):\n%s", count, strings.Join(violations, "\n")))
+	}
+	return nil
+}
+
+// numericOwners returns a copy of the tar stream rc without user and group
+// names, for -numeric-owner, so that extraction uses the numeric IDs
+// instead of looking the names up in the host's passwd and group files.
+// rc is closed once it has been copied.
+func numericOwners(rc io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer rc.Close()
+		pw.CloseWithError(copyNumericOwners(pw, rc))
+	}()
+	return pr
+}
+
+func copyNumericOwners(w io.Writer, r io.Reader) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		// PAX records would otherwise bring the names back.
+		delete(hdr.PAXRecords, "uname")
+		delete(hdr.PAXRecords, "gname")
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// topPackages is how many of the largest packages -report-packages lists.
+const topPackages = 20
+
+// packageUsage attributes the size of the files in the squashed rootfs to
+// the dpkg and apk packages that installed them, for -report-packages.
+type packageUsage struct {
+	// sizes are the sizes of regular files, by rootfs path.
+	sizes map[string]int64
+	// owners maps the paths that packages installed to the package names.
+	owners map[string]string
+	// dirLinks are the top-level symlinks to directories, like bin ->
+	// usr/bin on merged-/usr systems, where package file lists still use
+	// the old paths.
+	dirLinks map[string]string
+	// managers are the package databases found.
+	managers map[string]bool
+}
+
+var _ rootfsVisitor = (*packageUsage)(nil)
+
+func newPackageUsage() *packageUsage {
+	return &packageUsage{sizes: map[string]int64{}, owners: map[string]string{}, dirLinks: map[string]string{}, managers: map[string]bool{}}
+}
+
+// isDpkgFileList returns whether name is a dpkg package's file list, like
+// var/lib/dpkg/info/curl.list or var/lib/dpkg/info/libc6:amd64.list.
+func isDpkgFileList(name string) bool {
+	return path.Dir(name) == "var/lib/dpkg/info" && strings.HasSuffix(name, ".list")
+}
+
+func (u *packageUsage) WantsContent(hdr *tar.Header) bool {
+	name := cleanTarPath(hdr.Name)
+	return isDpkgFileList(name) || name == "lib/apk/db/installed"
+}
+
+func (u *packageUsage) Visit(hdr *tar.Header, content []byte) error {
+	name := cleanTarPath(hdr.Name)
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		u.sizes[name] = hdr.Size
+	case tar.TypeSymlink:
+		if !strings.Contains(name, "/") {
+			u.dirLinks[name] = cleanTarPath(path.Join(path.Dir(name), hdr.Linkname))
+		}
+	}
+	switch {
+	case isDpkgFileList(name):
+		u.managers["dpkg"] = true
+		pkg, _, _ := strings.Cut(strings.TrimSuffix(path.Base(name), ".list"), ":")
+		sc := bufio.NewScanner(bytes.NewReader(content))
+		for sc.Scan() {
+			if line := sc.Text(); line != "" {
+				u.owners[cleanTarPath(line)] = pkg
+			}
+		}
+	case name == "lib/apk/db/installed":
+		u.managers["apk"] = true
+		u.parseAPKFiles(content)
+	case strings.HasPrefix(name, "var/lib/rpm/") || strings.HasPrefix(name, "usr/lib/sysimage/rpm/"):
+		u.managers["rpm"] = true
+	}
+	return nil
+}
+
+// parseAPKFiles records the files of each package in an apk database,
+// whose blocks list a package's directories as "F:" lines, each followed by
+// that directory's files as "R:" lines.
+func (u *packageUsage) parseAPKFiles(b []byte) {
+	var pkg, dir string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		key, value, _ := strings.Cut(sc.Text(), ":")
+		switch key {
+		case "":
+			pkg, dir = "", ""
+		case "P":
+			pkg = value
+		case "F":
+			dir = value
+		case "R":
+			if pkg != "" {
+				u.owners[cleanTarPath(path.Join(dir, value))] = pkg
+			}
+		}
+	}
+}
+
+// resolve returns the rootfs path of a file a package list names, which
+// may be behind a top-level directory symlink.
+func (u *packageUsage) resolve(name string) string {
+	if _, ok := u.sizes[name]; ok {
+		return name
+	}
+	if first, rest, ok := strings.Cut(name, "/"); ok {
+		if target, ok := u.dirLinks[first]; ok {
+			return target + "/" + rest
+		}
+	}
+	return name
+}
+
+// report logs the total size of each package's files, largest first, and
+// the size of the files no package owns.
+func (u *packageUsage) report() {
+	if !u.managers["dpkg"] && !u.managers["apk"] {
+		if u.managers["rpm"] {
+			logf("-report-packages: found an rpm database, which isn't supported; only dpkg and apk packages can be reported")
+		} else {
+			logf("-report-packages: no dpkg or apk package database in the squashed rootfs")
+		}
+		return
+	}
+	usage := map[string]int64{}
+	owned := map[string]bool{}
+	for name, pkg := range u.owners {
+		name = u.resolve(name)
+		if size, ok := u.sizes[name]; ok && !owned[name] {
+			owned[name] = true
+			usage[pkg] += size
+		}
+	}
+	var total, unowned int64
+	for name, size := range u.sizes {
+		total += size
+		if !owned[name] {
+			unowned += size
+		}
+	}
+	pkgs := make([]string, 0, len(usage))
+	for pkg := range usage {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		if usage[pkgs[i]] != usage[pkgs[j]] {
+			return usage[pkgs[i]] > usage[pkgs[j]]
+		}
+		return pkgs[i] < pkgs[j]
+	})
+
+	var managers []string
+	for _, m := range []string{"apk", "dpkg"} {
+		if u.managers[m] {
+			managers = append(managers, m)
+		}
+	}
+	logf("Squashed rootfs usage by package (%s, %s in total):", strings.Join(managers, ", "), humanize.Bytes(uint64(total)))
+	for _, pkg := range pkgs[:min(len(pkgs), topPackages)] {
+		logf("  %10s  %s", humanize.Bytes(uint64(usage[pkg])), pkg)
+	}
+	if rest := pkgs[min(len(pkgs), topPackages):]; len(rest) > 0 {
+		var size int64
+		for _, pkg := range rest {
+			size += usage[pkg]
+		}
+		logf("  %10s  (%s more)", humanize.Bytes(uint64(size)), plural(len(rest), "package"))
+	}
+	logf("  %10s  (not installed by a package)", humanize.Bytes(uint64(unowned)))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// privatePaths are files and directories that are meant to be readable
+// only by root or a service account, so they aren't reported as unreadable
+// by the image's USER.
+var privatePaths = []string{
+	"etc/shadow", "etc/shadow-", "etc/gshadow", "etc/gshadow-",
+	"etc/sudoers", "etc/sudoers.d", "etc/security/opasswd", "etc/ssl/private",
+	"root",
+	"var/cache/apt/archives/partial", "var/lib/apt/lists/partial",
+	"var/cache/debconf/passwords.dat", "var/cache/ldconfig", "var/log/btmp",
+}
+
+// auditsPermissions returns whether the squashed rootfs's permissions are
+// checked, for -audit-permissions or the unsafe-permissions condition.
+func auditsPermissions() bool {
+	return *auditPermissions || policyEnabled("unsafe-permissions")
+}
+
+// permEntry is the owner and mode of a rootfs entry.
+type permEntry struct {
+	name     string
+	dir      bool
+	uid, gid int
+	mode     int64
+}
+
+// permissionAudit checks the squashed rootfs for world-writable files and
+// directories, file capabilities on files that can't be executed, and files
+// that the image's USER can't read.
+type permissionAudit struct {
+	// user is the image's USER, as "USER[:GROUP]".
+	user string
+
+	worldWritable, danglingCaps []string
+	// restricted are the entries that not everyone can read, checked
+	// against user's IDs once /etc/passwd and /etc/group have been read.
+	restricted    []permEntry
+	passwd, group []byte
+}
+
+var _ rootfsVisitor = (*permissionAudit)(nil)
+
+// newPermissionAudit returns a permission audit for an image whose USER is
+// user, or nil if none was requested.
+func newPermissionAudit(user string) *permissionAudit {
+	if !auditsPermissions() {
+		return nil
+	}
+	return &permissionAudit{user: user}
+}
+
+func (a *permissionAudit) WantsContent(hdr *tar.Header) bool {
+	name := cleanTarPath(hdr.Name)
+	return name == "etc/passwd" || name == "etc/group"
+}
+
+func (a *permissionAudit) Visit(hdr *tar.Header, content []byte) error {
+	name := cleanTarPath(hdr.Name)
+	switch name {
+	case "etc/passwd":
+		a.passwd = content
+	case "etc/group":
+		a.group = content
+	}
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+		return nil
+	}
+	dir := hdr.Typeflag == tar.TypeDir
+	perm := hdr.Mode & 07777
+	// Sticky directories like /tmp are meant to be shared.
+	if perm&0o002 != 0 && !(dir && perm&01000 != 0) {
+		a.worldWritable = append(a.worldWritable, fmt.Sprintf("/%s (mode %04o)", name, perm))
+	}
+	if _, ok := hdr.PAXRecords["SCHILY.xattr.security.capability"]; ok && (dir || perm&0o111 == 0) {
+		a.danglingCaps = append(a.danglingCaps, fmt.Sprintf("/%s (mode %04o)", name, perm))
+	}
+	need := int64(0o444)
+	if dir {
+		need = 0o555
+	}
+	if perm&need != need {
+		a.restricted = append(a.restricted, permEntry{name, dir, hdr.Uid, hdr.Gid, perm})
+	}
+	return nil
+}
+
+// unreadable returns the restricted entries that a's user can't read (or,
+// for directories, list and enter), leaving out those below one already
+// listed. It's empty if the user is root, and an error explains why the
+// check was skipped if the user can't be resolved.
+func (a *permissionAudit) unreadable() ([]string, error) {
+	uid, gids, err := resolveUser(a.user, a.passwd, a.group)
+	if err != nil || uid == 0 {
+		return nil, err
+	}
+	slices.SortFunc(a.restricted, func(x, y permEntry) int { return strings.Compare(x.name, y.name) })
+	var found []string
+	var blocked []string
+	for _, e := range a.restricted {
+		if slices.ContainsFunc(privatePaths, func(p string) bool { return e.name == p || strings.HasPrefix(e.name, p+"/") }) {
+			continue
+		}
+		if slices.ContainsFunc(blocked, func(p string) bool { return strings.HasPrefix(e.name, p+"/") }) {
+			continue
+		}
+		bits := e.mode & 0o7
+		switch {
+		case e.uid == uid:
+			bits = e.mode >> 6 & 0o7
+		case slices.Contains(gids, e.gid):
+			bits = e.mode >> 3 & 0o7
+		}
+		need := int64(0o4)
+		if e.dir {
+			need = 0o5
+		}
+		if bits&need == need {
+			continue
+		}
+		if e.dir {
+			blocked = append(blocked, e.name)
+		}
+		found = append(found, fmt.Sprintf("/%s (mode %04o, owner %d:%d)", e.name, e.mode, e.uid, e.gid))
+	}
+	return found, nil
+}
+
+// resolveUser returns the UID and the primary and supplementary GIDs that
+// a container runs with for the USER spec "USER[:GROUP]", given the
+// image's /etc/passwd and /etc/group. As with docker and runc, an empty
+// spec is root, and a numeric UID without a passwd entry gets GID 0.
+func resolveUser(spec string, passwd, group []byte) (uid int, gids []int, err error) {
+	if spec == "" {
+		return 0, nil, nil
+	}
+	userSpec, groupSpec, hasGroup := strings.Cut(spec, ":")
+	name := ""
+	uid, numeric := -1, false
+	gid := 0
+	if n, err := strconv.Atoi(userSpec); err == nil {
+		uid, numeric = n, true
+	}
+	for _, fields := range accountLines(passwd) {
+		// name:password:UID:GID:...
+		if len(fields) < 4 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil || !(fields[0] == userSpec || numeric && id == uid) {
+			continue
+		}
+		name, uid = fields[0], id
+		gid, _ = strconv.Atoi(fields[3])
+		break
+	}
+	if uid < 0 {
+		return 0, nil, fmt.Errorf("user %q isn't in /etc/passwd", userSpec)
+	}
+	groups := accountLines(group)
+	if hasGroup {
+		gid = -1
+		n, err := strconv.Atoi(groupSpec)
+		for _, fields := range groups {
+			// name:password:GID:members
+			if len(fields) >= 3 && (fields[0] == groupSpec || err == nil && fields[2] == groupSpec) {
+				gid, _ = strconv.Atoi(fields[2])
+				break
+			}
+		}
+		if gid < 0 && err == nil {
+			gid = n
+		}
+		if gid < 0 {
+			return 0, nil, fmt.Errorf("group %q isn't in /etc/group", groupSpec)
+		}
+	}
+	gids = []int{gid}
+	for _, fields := range groups {
+		if name == "" || len(fields) < 4 || !slices.Contains(strings.Split(fields[3], ","), name) {
+			continue
+		}
+		if id, err := strconv.Atoi(fields[2]); err == nil {
+			gids = append(gids, id)
+		}
+	}
+	return uid, gids, nil
+}
+
+// accountLines splits the lines of an /etc/passwd or /etc/group file into
+// their colon-separated fields.
+func accountLines(b []byte) [][]string {
+	var lines [][]string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		if line := sc.Text(); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, strings.Split(line, ":"))
+		}
+	}
+	return lines
+}
+
+// report prints the -audit-permissions report and returns the findings for
+// the unsafe-permissions condition.
+func (a *permissionAudit) report() []policyFinding {
+	unreadable, err := a.unreadable()
+	if *auditPermissions {
+		var lines []string
+		for _, d := range a.worldWritable {
+			lines = append(lines, "\n  world-writable: "+d)
+		}
+		for _, d := range a.danglingCaps {
+			lines = append(lines, "\n  capabilities on a non-executable file: "+d)
+		}
+		for _, d := range unreadable {
+			lines = append(lines, "\n  unreadable by USER: "+d)
+		}
+		user := a.user
+		if user == "" {
+			user = "root"
+		}
+		logf("Permission audit: %d world-writable, %d with dangling file capabilities, %d unreadable by USER %s%s", len(a.worldWritable), len(a.danglingCaps), len(unreadable), user, strings.Join(lines, ""))
+		if err != nil {
+			logf("Permission audit: not checking what USER %s can read: %v", user, err)
+		}
+	}
+	var findings []policyFinding
+	for _, d := range a.worldWritable {
+		findings = append(findings, policyFinding{"unsafe-permissions", d + " is world-writable"})
+	}
+	for _, d := range a.danglingCaps {
+		findings = append(findings, policyFinding{"unsafe-permissions", d + " has file capabilities but isn't executable"})
+	}
+	for _, d := range unreadable {
+		findings = append(findings, policyFinding{"unsafe-permissions", d + " isn't readable by USER " + a.user})
+	}
+	return findings
+}
+
+// outputUser returns the USER of the squashed image: the source's, unless
+// the -apply fragment sets another.
+func outputUser(source string, instrs []dockerfileInstruction) string {
+	for _, instr := range instrs {
+		if instr.Cmd == "USER" {
+			source = instr.Args
+		}
+	}
+	return source
+}
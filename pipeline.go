@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pipelineFile is a pipeline file for the run subcommand: a squash written
+// as reviewable config rather than a command line. It's run as the
+// equivalent command line, so every section but the source, filters and
+// destinations is a map from flag names (without the "-") to values, and
+// they only differ in what they're for.
+type pipelineFile struct {
+	// Source is the SOURCE, or Sources the -source PLATFORM=SOURCE values.
+	Source  string   `yaml:"source"`
+	Sources []string `yaml:"sources"`
+	// Filters are -filter statements.
+	Filters []string `yaml:"filters"`
+	// Mutations are flags that change the squashed image, like label, run,
+	// apply or optimize.
+	Mutations map[string]any `yaml:"mutations"`
+	// Verification are flags that check it, like scan, fail-on, profile or
+	// load-check.
+	Verification map[string]any `yaml:"verification"`
+	// Signing are the signing flags, like cosign-key, which make the
+	// pipeline a promote.
+	Signing map[string]any `yaml:"signing"`
+	// Options are any other flags, like cache-dir or media-types.
+	Options map[string]any `yaml:"options"`
+	// Destinations are registry refs and local paths to write the squashed
+	// image to; local paths can have a ":FORMAT" as for -also-output.
+	Destinations []string `yaml:"destinations"`
+}
+
+// pipelineFlags are the flags set by their own pipeline fields, or that
+// don't make sense in a pipeline file.
+var pipelineFlags = map[string]string{
+	"source":           "sources",
+	"filter":           "filters",
+	"also-output":      "destinations",
+	"print-exit-codes": "",
+}
+
+// runFlags returns the flags of the run subcommand, and its -print.
+func runFlags() (*flag.FlagSet, *bool) {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	return flags, flags.Bool("print", false, "Print the equivalent command line instead of running it")
+}
+
+// runMain implements the run subcommand, which squashes as the command
+// line the pipeline file runs as. With -print, the command line is printed
+// instead.
+func runMain(args []string) error {
+	flags, printOnly := runFlags()
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 1 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s run [-print] PIPELINE.yaml", os.Args[0]))
+	}
+	b, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	cmdline, err := pipelineArgs(b)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("%s: %w", flags.Arg(0), err))
+	}
+	if *printOnly {
+		fmt.Println(shellJoin(append([]string{os.Args[0]}, cmdline...)))
+		return nil
+	}
+	logf("Running pipeline %s as: %s", flags.Arg(0), shellJoin(cmdline))
+	os.Args = append([]string{os.Args[0]}, cmdline...)
+	squashMain()
+	return nil
+}
+
+// pipelineArgs parses the pipeline file b into the command line it runs as.
+func pipelineArgs(b []byte) ([]string, error) {
+	var p pipelineFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if (p.Source == "") == (len(p.Sources) == 0) {
+		return nil, errors.New("needs either source or sources")
+	}
+	if len(p.Destinations) == 0 {
+		return nil, errors.New("needs at least one destination")
+	}
+
+	var args []string
+	// A promote pushes to every registry destination, signing first.
+	promote := len(p.Signing) > 0 || len(registryDests(p.Destinations)) > 1
+	if promote {
+		args = append(args, "promote")
+	}
+	for _, s := range p.Sources {
+		args = append(args, "-source="+s)
+	}
+	for _, f := range p.Filters {
+		args = append(args, "-filter="+f)
+	}
+	for _, section := range []struct {
+		name  string
+		flags map[string]any
+	}{
+		{"mutations", p.Mutations},
+		{"verification", p.Verification},
+		{"signing", p.Signing},
+		{"options", p.Options},
+	} {
+		names := make([]string, 0, len(section.flags))
+		for name := range section.flags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			flagArgs, err := pipelineFlagArgs(name, section.flags[name])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", section.name, err)
+			}
+			args = append(args, flagArgs...)
+		}
+	}
+
+	dests, err := pipelineDests(p.Destinations, promote)
+	if err != nil {
+		return nil, err
+	}
+	if !promote {
+		for _, o := range dests[1:] {
+			args = append(args, "-also-output="+o)
+		}
+		dests = dests[:1]
+	}
+	if p.Source != "" {
+		args = append(args, p.Source)
+	}
+	return append(args, dests...), nil
+}
+
+// pipelineFlagArgs returns the command line arguments setting the flag name
+// to v: a scalar, or a list for a flag that can be repeated.
+func pipelineFlagArgs(name string, v any) ([]string, error) {
+	if field, ok := pipelineFlags[name]; ok {
+		if field == "" {
+			return nil, fmt.Errorf("-%s can't be set in a pipeline file", name)
+		}
+		return nil, fmt.Errorf("-%s is set with the %s field", name, field)
+	}
+	f := flag.Lookup(name)
+	if f == nil {
+		return nil, fmt.Errorf("unknown flag -%s", name)
+	}
+	values, ok := v.([]any)
+	if !ok {
+		values = []any{v}
+	}
+	if len(values) > 1 {
+		if _, repeatable := f.Value.(*stringsFlag); !repeatable {
+			return nil, fmt.Errorf("-%s can't be repeated", name)
+		}
+	}
+	var args []string
+	for _, v := range values {
+		switch v := v.(type) {
+		case map[string]any, []any, nil:
+			return nil, fmt.Errorf("-%s: expected a string, number or boolean", name)
+		case bool:
+			args = append(args, fmt.Sprintf("-%s=%t", name, v))
+		default:
+			args = append(args, fmt.Sprintf("-%s=%v", name, v))
+		}
+	}
+	return args, nil
+}
+
+func registryDests(dests []string) []string {
+	var registry []string
+	for _, d := range dests {
+		if isRegistryDest(d) {
+			registry = append(registry, d)
+		}
+	}
+	return registry
+}
+
+// pipelineDests orders dests for the command line: the DEST first, which is
+// the first registry destination, or else the first local one without a
+// format. For a promote, only registry destinations are allowed.
+func pipelineDests(dests []string, promote bool) ([]string, error) {
+	registry := registryDests(dests)
+	if promote {
+		if len(registry) != len(dests) {
+			return nil, errors.New("with signing or several registry destinations, the pipeline is a promote, which can only push to registry destinations")
+		}
+		return dests, nil
+	}
+	if len(registry) > 0 {
+		i := slices.Index(dests, registry[0])
+		return append([]string{registry[0]}, slices.Delete(slices.Clone(dests), i, i+1)...), nil
+	}
+	for i, d := range dests {
+		o, err := parseAlsoOutputs([]string{d})
+		if err != nil {
+			return nil, fmt.Errorf("destination %w", err)
+		}
+		if o[0].format == "" {
+			return append([]string{d}, slices.Delete(slices.Clone(dests), i, i+1)...), nil
+		}
+	}
+	return nil, errors.New("needs a registry destination or a local one without a :FORMAT, to be the DEST")
+}
+
+// shellJoin quotes args for a POSIX shell, for display.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && strings.Trim(a, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=./:@,+") == "" {
+			quoted[i] = a
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
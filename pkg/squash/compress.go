@@ -0,0 +1,169 @@
+package squash
+
+import (
+	"cmp"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// A Compressor compresses squashed layers.
+type Compressor interface {
+	// Compress returns a writer that compresses what's written to it into
+	// w. Closing it finishes the compressed stream, but doesn't close w.
+	Compress(w io.Writer) (io.WriteCloser, error)
+	// MediaType returns the OCI media type of the layers it compresses,
+	// like types.OCILayer for gzip.
+	MediaType() types.MediaType
+}
+
+// Gzip compresses layers with compress/gzip.
+type Gzip struct {
+	// Level is the compression level; 0 means gzip.BestSpeed, which is
+	// what docker-squash and go-containerregistry use by default.
+	Level int
+}
+
+func (c Gzip) Compress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, cmp.Or(c.Level, gzip.BestSpeed))
+}
+
+func (c Gzip) MediaType() types.MediaType { return types.OCILayer }
+
+// PGzip compresses layers with gzip, compressing blocks of each layer on
+// all CPUs. Its output differs from Gzip's, so the layer digests do too.
+type PGzip struct {
+	// Level is the compression level; 0 means gzip.BestSpeed.
+	Level int
+	// BlockSize and Blocks are the size of the blocks compressed in
+	// parallel and how many are in flight at once; 0 keeps pgzip's
+	// defaults.
+	BlockSize, Blocks int
+}
+
+func (c PGzip) Compress(w io.Writer) (io.WriteCloser, error) {
+	zw, err := pgzip.NewWriterLevel(w, cmp.Or(c.Level, gzip.BestSpeed))
+	if err != nil {
+		return nil, err
+	}
+	if c.BlockSize != 0 || c.Blocks != 0 {
+		if err := zw.SetConcurrency(cmp.Or(c.BlockSize, 1<<20), cmp.Or(c.Blocks, runtime.GOMAXPROCS(0))); err != nil {
+			return nil, err
+		}
+	}
+	return zw, nil
+}
+
+func (c PGzip) MediaType() types.MediaType { return types.OCILayer }
+
+// Zstd compresses layers with zstd. Zstd layers only have an OCI media
+// type, so images with them can't use Docker media types.
+type Zstd struct {
+	// Level is the encoder level; 0 means zstd.SpeedDefault.
+	Level zstd.EncoderLevel
+}
+
+func (c Zstd) Compress(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(cmp.Or(c.Level, zstd.SpeedDefault)))
+}
+
+func (c Zstd) MediaType() types.MediaType { return types.OCILayerZStd }
+
+// None stores layers uncompressed, for registries and runtimes on fast
+// networks where compressing costs more than it saves.
+type None struct{}
+
+func (None) Compress(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }
+func (None) MediaType() types.MediaType                   { return types.OCIUncompressedLayer }
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Exec compresses layers with an external command, like igzip or a
+// hardware offload tool, which reads the uncompressed layer on its stdin
+// and writes the compressed one to its stdout. Its stderr is passed
+// through.
+type Exec struct {
+	// Path and Args are as for exec.Command.
+	Path string
+	Args []string
+	// Type is the media type of what the command writes; empty means
+	// gzip (types.OCILayer).
+	Type types.MediaType
+}
+
+// ShellCommand returns an Exec compressor that runs cmd with /bin/sh (or
+// cmd.exe on Windows).
+func ShellCommand(cmd string) Exec {
+	if runtime.GOOS == "windows" {
+		return Exec{Path: "cmd.exe", Args: []string{"/C", cmd}}
+	}
+	return Exec{Path: "/bin/sh", Args: []string{"-c", cmd}}
+}
+
+func (c Exec) Compress(w io.Writer) (io.WriteCloser, error) {
+	cmd := exec.Command(c.Path, c.Args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start compressor: %w", err)
+	}
+	return &execWriter{stdin, cmd}, nil
+}
+
+func (c Exec) MediaType() types.MediaType { return cmp.Or(c.Type, types.OCILayer) }
+
+// execWriter writes to an Exec compressor's stdin. Closing it waits for
+// the command to write the rest of its output and exit.
+type execWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (w *execWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if werr := w.cmd.Wait(); werr != nil {
+		return fmt.Errorf("compressor %s: %w", strings.Join(w.cmd.Args, " "), werr)
+	}
+	return err
+}
+
+// CompressorNames are the compressors ParseCompressor accepts by name,
+// besides "exec:CMD".
+var CompressorNames = []string{"gzip", "pgzip", "zstd", "none"}
+
+// ParseCompressor returns the compressor called name, at its default
+// level: "gzip", "pgzip", "zstd", "none", or "exec:CMD" to pipe layers
+// through the shell command CMD, which must write gzip.
+func ParseCompressor(name string) (Compressor, error) {
+	switch name {
+	case "gzip":
+		return Gzip{}, nil
+	case "pgzip":
+		return PGzip{}, nil
+	case "zstd":
+		return Zstd{}, nil
+	case "none":
+		return None{}, nil
+	}
+	if cmd, ok := strings.CutPrefix(name, "exec:"); ok {
+		if strings.TrimSpace(cmd) == "" {
+			return nil, fmt.Errorf("exec: needs a command")
+		}
+		return ShellCommand(cmd), nil
+	}
+	return nil, fmt.Errorf("unknown compressor %q (expected %s or exec:CMD)", name, strings.Join(CompressorNames, ", "))
+}
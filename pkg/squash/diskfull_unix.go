@@ -0,0 +1,14 @@
+//go:build unix
+
+package squash
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isDiskFull returns whether err means a filesystem is out of space or
+// quota.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
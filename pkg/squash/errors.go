@@ -0,0 +1,123 @@
+// Package squash holds the parts of docker-squash that programs embedding
+// it can use directly: the Compressor interface for layer compression
+// backends, and its error taxonomy. Classify tags an error with one of the
+// Err* kinds below, so that callers can decide whether to retry, fall back
+// or give up with errors.Is, rather than by matching error strings:
+//
+//	err = squash.Classify(err)
+//	switch {
+//	case errors.Is(err, squash.ErrNetwork), errors.Is(err, squash.ErrCorruptLayer):
+//		// Worth retrying.
+//	case errors.Is(err, squash.ErrAuth):
+//		// Refresh credentials and retry.
+//	}
+package squash
+
+import (
+	"archive/tar"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// Error kinds. Errors returned by Classify wrap one of these, as well as
+// the original error.
+var (
+	// ErrAuth means a registry rejected the credentials, or they don't
+	// allow the operation.
+	ErrAuth = errors.New("authentication failed")
+	// ErrNotFound means a registry has no such repository or image.
+	ErrNotFound = errors.New("not found")
+	// ErrNetwork means a registry could not be reached.
+	ErrNetwork = errors.New("network error")
+	// ErrDiskSpace means a filesystem is out of space or quota.
+	ErrDiskSpace = errors.New("out of disk space")
+	// ErrCorruptLayer means a layer blob couldn't be decompressed or
+	// unpacked, or didn't match its digest.
+	ErrCorruptLayer = errors.New("corrupt layer")
+	// ErrCancelled means the operation was cancelled, or timed out.
+	ErrCancelled = errors.New("cancelled")
+)
+
+// kindError is an error tagged with its kind.
+type kindError struct {
+	kind, err error
+}
+
+func (e *kindError) Error() string   { return e.err.Error() }
+func (e *kindError) Unwrap() []error { return []error{e.err, e.kind} }
+
+// Classify returns err wrapped with its kind, which can be tested for with
+// errors.Is. Its message is unchanged. If err is nil, already classified,
+// or of no known kind, it's returned as-is.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	if k := Kind(err); k != nil && !errors.Is(err, k) {
+		return &kindError{kind: k, err: err}
+	}
+	return err
+}
+
+// Kind returns the kind of err (one of the Err* values), or nil if it's of
+// no known kind.
+func Kind(err error) error {
+	for _, k := range []error{ErrAuth, ErrNotFound, ErrNetwork, ErrDiskSpace, ErrCorruptLayer, ErrCancelled} {
+		if errors.Is(err, k) {
+			return k
+		}
+	}
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		switch terr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return ErrAuth
+		case http.StatusNotFound:
+			return ErrNotFound
+		}
+		for _, d := range terr.Errors {
+			switch d.Code {
+			case transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode, transport.BlobUnknownErrorCode:
+				return ErrNotFound
+			case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+				return ErrAuth
+			}
+		}
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrCancelled
+	}
+	if isDiskFull(err) {
+		return ErrDiskSpace
+	}
+	if isCorrupt(err) {
+		return ErrCorruptLayer
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return ErrNetwork
+	}
+	return nil
+}
+
+func isCorrupt(err error) bool {
+	var ferr flate.CorruptInputError
+	if errors.As(err, &ferr) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, tar.ErrHeader) {
+		return true
+	}
+	// go-containerregistry's digest verification error is internal, so
+	// can only be recognized by its message.
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if strings.HasPrefix(e.Error(), "error verifying ") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,439 @@
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// File is an entry in a layer.
+type File struct {
+	// Name is the path, without a leading "/" or trailing "/" for
+	// directories.
+	Name string
+	// Type is a tar type flag; the zero value means a regular file.
+	Type byte
+	Mode int64
+	Body string
+	// Link is the target of a symlink or hardlink.
+	Link   string
+	Xattrs map[string]string
+	// Sparse stores a regular file's runs of zero bytes as holes, in a GNU
+	// sparse (PAX format 1.0) entry. Xattrs aren't stored for sparse files.
+	Sparse bool
+}
+
+// Dir returns a directory entry.
+func Dir(name string, mode int64) File {
+	return File{Name: name, Type: tar.TypeDir, Mode: mode}
+}
+
+// Reg returns a regular file entry.
+func Reg(name, body string, mode int64) File {
+	return File{Name: name, Type: tar.TypeReg, Body: body, Mode: mode}
+}
+
+// Symlink returns a symlink entry.
+func Symlink(name, target string) File {
+	return File{Name: name, Type: tar.TypeSymlink, Link: target, Mode: 0777}
+}
+
+// Hardlink returns a hardlink entry pointing at target, another path in the
+// same layer or a lower one.
+func Hardlink(name, target string) File {
+	return File{Name: name, Type: tar.TypeLink, Link: target, Mode: 0644}
+}
+
+// SparseReg returns a sparse regular file entry of size bytes, which are
+// zero except for data at each of its offsets.
+func SparseReg(name string, size int64, data map[int64]string, mode int64) File {
+	body := make([]byte, size)
+	for off, d := range data {
+		copy(body[off:], d)
+	}
+	return File{Name: name, Type: tar.TypeReg, Body: string(body), Mode: mode, Sparse: true}
+}
+
+// Whiteout returns an entry deleting name from lower layers.
+func Whiteout(name string) File {
+	dir, base := path.Split(name)
+	return File{Name: dir + whiteoutPrefix + base, Type: tar.TypeReg, Mode: 0644}
+}
+
+// OpaqueWhiteout returns an entry hiding everything in dir from lower
+// layers.
+func OpaqueWhiteout(dir string) File {
+	return File{Name: path.Join(dir, opaqueWhiteout), Type: tar.TypeReg, Mode: 0644}
+}
+
+func (f File) typeflag() byte {
+	if f.Type == 0 {
+		return tar.TypeReg
+	}
+	return f.Type
+}
+
+// Layer returns a layer containing files, in order.
+func Layer(files ...File) (v1.Layer, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		if f.Sparse {
+			// archive/tar can read sparse files but not write them.
+			if err := tw.Flush(); err != nil {
+				return nil, err
+			}
+			writeSparse(&buf, f)
+			continue
+		}
+		hdr := &tar.Header{
+			Name:     f.Name,
+			Typeflag: f.typeflag(),
+			Mode:     f.Mode,
+			Linkname: f.Link,
+			Format:   tar.FormatPAX,
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(f.Body))
+		}
+		for k, v := range f.Xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords["SCHILY.xattr."+k] = v
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(tw, f.Body); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	})
+}
+
+// writeSparse writes the regular file f to buf as a GNU sparse entry: a PAX
+// header naming it, then a regular file holding the sparse map and the
+// data fragments, which are f's runs of non-zero bytes.
+func writeSparse(buf *bytes.Buffer, f File) {
+	var offsets, lengths []int
+	for i := 0; i < len(f.Body); {
+		if f.Body[i] == 0 {
+			i++
+			continue
+		}
+		j := i
+		for j < len(f.Body) && f.Body[j] != 0 {
+			j++
+		}
+		offsets, lengths = append(offsets, i), append(lengths, j-i)
+		i = j
+	}
+	sparseMap := strconv.Itoa(len(offsets)) + "\n"
+	var data strings.Builder
+	for i, off := range offsets {
+		sparseMap += fmt.Sprintf("%d\n%d\n", off, lengths[i])
+		data.WriteString(f.Body[off : off+lengths[i]])
+	}
+	content := pad(sparseMap) + data.String()
+
+	var records string
+	for _, kv := range [][2]string{
+		{"GNU.sparse.major", "1"},
+		{"GNU.sparse.minor", "0"},
+		{"GNU.sparse.name", f.Name},
+		{"GNU.sparse.realsize", strconv.Itoa(len(f.Body))},
+	} {
+		records += paxRecord(kv[0], kv[1])
+	}
+	dir, base := path.Split(f.Name)
+	buf.Write(ustarHeader(path.Join(dir, "PaxHeaders.0", base), tar.TypeXHeader, 0644, len(records)))
+	buf.WriteString(pad(records))
+	buf.Write(ustarHeader(path.Join(dir, "GNUSparseFile.0", base), tar.TypeReg, f.Mode, len(content)))
+	buf.WriteString(pad(content))
+}
+
+// paxRecord formats a PAX record, whose length includes its own digits.
+func paxRecord(k, v string) string {
+	size := len(k) + len(v) + 3
+	size += len(strconv.Itoa(size))
+	record := fmt.Sprintf("%d %s=%s\n", size, k, v)
+	if len(record) != size {
+		// Adding the length's digits added a digit.
+		record = fmt.Sprintf("%d %s=%s\n", len(record), k, v)
+	}
+	return record
+}
+
+// ustarHeader returns a USTAR header block. name must fit in 100 bytes.
+func ustarHeader(name string, typeflag byte, mode int64, size int) []byte {
+	b := make([]byte, 512)
+	copy(b[0:], name)
+	copy(b[100:], fmt.Sprintf("%07o", mode))
+	copy(b[108:], "0000000")
+	copy(b[116:], "0000000")
+	copy(b[124:], fmt.Sprintf("%011o", size))
+	copy(b[136:], "00000000000")
+	b[156] = typeflag
+	copy(b[257:], "ustar\x0000")
+	copy(b[148:], "        ")
+	sum := 0
+	for _, c := range b {
+		sum += int(c)
+	}
+	copy(b[148:], fmt.Sprintf("%06o\x00 ", sum))
+	return b
+}
+
+// pad pads s with zeros to a whole number of tar blocks.
+func pad(s string) string {
+	return s + strings.Repeat("\x00", (512-len(s)%512)%512)
+}
+
+// Image returns a linux/amd64 image with a layer for each set of files.
+func Image(layers ...[]File) (v1.Image, error) {
+	img := empty.Image
+	for _, files := range layers {
+		l, err := Layer(files...)
+		if err != nil {
+			return nil, err
+		}
+		if img, err = mutate.AppendLayers(img, l); err != nil {
+			return nil, err
+		}
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+	cfg.OS, cfg.Architecture = "linux", "amd64"
+	cfg.Config.Cmd = []string{"/bin/sh"}
+	return mutate.ConfigFile(img, cfg)
+}
+
+// SampleLayers returns layers exercising the cases squashing has to get
+// right: whiteouts of files and directories, opaque directories, files
+// replaced by directories, hardlinks, symlinks, xattrs, unusual modes,
+// sparse files and non-ASCII names.
+func SampleLayers() [][]File {
+	return [][]File{
+		{
+			Dir("etc", 0755),
+			Reg("etc/passwd", "root:x:0:0:root:/root:/bin/sh\n", 0644),
+			Reg("etc/shadow", "root:*:19000::::::\n", 0600),
+			Dir("tmp", 01777),
+			Reg("tmp/junk", "junk", 0644),
+			Dir("opt", 0755),
+			Dir("opt/old", 0755),
+			Reg("opt/old/a", "a", 0644),
+			Reg("opt/old/b", "b", 0644),
+			Dir("bin", 0755),
+			{Name: "bin/ping", Type: tar.TypeReg, Body: "ping", Mode: 0755, Xattrs: map[string]string{"security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00"}},
+			Reg("bin/su", "su", 04755),
+			Dir("cache", 0755),
+			Reg("cache/x", "x", 0644),
+			Reg("replaced", "file", 0644),
+		},
+		{
+			Whiteout("tmp/junk"),
+			Whiteout("cache"),
+			OpaqueWhiteout("opt/old"),
+			Reg("opt/old/c", "c", 0644),
+			Dir("app", 0755),
+			Reg("app/main.py", "print('hi')\n", 0644),
+			Hardlink("app/hard", "app/main.py"),
+			Symlink("app/passwd", "/etc/passwd"),
+			Dir("replaced", 0755),
+			Reg("replaced/inner", "inner", 0644),
+			SparseReg("app/sparse.img", 1<<20, map[int64]string{0: "head", 300000: "middle", 1<<20 - 4: "tail"}, 0644),
+			Dir("app/données", 0755),
+			Reg("app/données/naïve café.txt", "café\n", 0644),
+			Reg("app/données/日本語.txt", "こんにちは\n", 0644),
+			Reg("app/données/🐳", "whale", 0644),
+			Hardlink("app/données/链接", "app/données/naïve café.txt"),
+		},
+		{
+			Reg("etc/passwd", "root:x:0:0:root:/root:/bin/bash\n", 0644),
+			Whiteout("app/passwd"),
+			Whiteout("app/données/🐳"),
+			{Name: "app/data.txt", Type: tar.TypeReg, Body: "data", Mode: 0640, Xattrs: map[string]string{"user.origin": "layer3"}},
+		},
+	}
+}
+
+// Flatten returns the filesystem that results from applying layers in
+// order, keyed by path. Hardlinks are returned as copies of their target as
+// it was when they were created, since which of a set of linked paths is
+// stored as the file is up to the writer.
+func Flatten(layers ...[]File) map[string]File {
+	fs := map[string]File{}
+	removeTree := func(name string) {
+		for p := range fs {
+			if p == name || strings.HasPrefix(p, name+"/") {
+				delete(fs, p)
+			}
+		}
+	}
+	for _, files := range layers {
+		layerPaths := map[string]bool{}
+		for _, f := range files {
+			name := strings.Trim(path.Clean("/"+f.Name), "/")
+			dir, base := path.Split(name)
+			dir = strings.TrimSuffix(dir, "/")
+			switch {
+			case base == opaqueWhiteout:
+				for p := range fs {
+					if strings.HasPrefix(p, dir+"/") && !layerPaths[p] {
+						delete(fs, p)
+					}
+				}
+				continue
+			case strings.HasPrefix(base, whiteoutPrefix):
+				removeTree(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+				continue
+			}
+			if old, ok := fs[name]; ok && old.typeflag() == tar.TypeDir && f.typeflag() != tar.TypeDir {
+				removeTree(name)
+			}
+			f.Name = name
+			if f.typeflag() == tar.TypeLink {
+				// A hardlink is its target's inode, mode, xattrs and all.
+				target := fs[strings.Trim(path.Clean("/"+f.Link), "/")]
+				target.Name = name
+				f = target
+			}
+			if f.typeflag() != tar.TypeDir {
+				// A non-directory replaces anything below it too.
+				removeTree(name)
+			}
+			fs[name] = f
+			layerPaths[name] = true
+		}
+	}
+	return fs
+}
+
+// ReadLayer returns the entries of a layer.
+func ReadLayer(l v1.Layer) ([]File, error) {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var files []File
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		f := File{
+			Name: strings.Trim(path.Clean("/"+hdr.Name), "/"),
+			Type: hdr.Typeflag,
+			Mode: hdr.Mode & 07777,
+			Body: string(body),
+			Link: hdr.Linkname,
+		}
+		if f.Type == tar.TypeRegA {
+			f.Type = tar.TypeReg
+		}
+		for k, v := range hdr.PAXRecords {
+			if x, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+				if f.Xattrs == nil {
+					f.Xattrs = map[string]string{}
+				}
+				f.Xattrs[x] = v
+			}
+		}
+		if f.Name != "" {
+			files = append(files, f)
+		}
+	}
+}
+
+// CheckSquashed returns an error describing each difference between the
+// flattened filesystem of img and want, as returned by Flatten.
+func CheckSquashed(img v1.Image, want map[string]File) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	var contents [][]File
+	for _, l := range layers {
+		files, err := ReadLayer(l)
+		if err != nil {
+			return err
+		}
+		contents = append(contents, files)
+	}
+	got := Flatten(contents...)
+	var diffs []string
+	for name, w := range want {
+		g, ok := got[name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("missing /%s", name))
+			continue
+		}
+		if d := diffFile(g, w); d != "" {
+			diffs = append(diffs, fmt.Sprintf("/%s: %s", name, d))
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected /%s", name))
+		}
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	sort.Strings(diffs)
+	return fmt.Errorf("squashed filesystem differs:\n  %s", strings.Join(diffs, "\n  "))
+}
+
+func diffFile(got, want File) string {
+	switch {
+	case got.typeflag() != want.typeflag():
+		return fmt.Sprintf("type %q, want %q", got.typeflag(), want.typeflag())
+	case got.Mode&07777 != want.Mode&07777:
+		return fmt.Sprintf("mode %o, want %o", got.Mode&07777, want.Mode&07777)
+	case got.Body != want.Body:
+		return fmt.Sprintf("content %q, want %q", got.Body, want.Body)
+	case got.Link != want.Link:
+		return fmt.Sprintf("link target %q, want %q", got.Link, want.Link)
+	case fmt.Sprint(got.Xattrs) != fmt.Sprint(want.Xattrs):
+		return fmt.Sprintf("xattrs %v, want %v", got.Xattrs, want.Xattrs)
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+// Package testutil helps test docker-squash and programs that embed it. It
+// runs an in-process registry, synthesizes multi-layer images with
+// whiteouts, hardlinks, xattrs and sparse files, and checks that a squashed
+// image has the filesystem those layers describe.
+//
+// A typical test pushes SampleLayers to a Registry, squashes it, and checks
+// the result:
+//
+//	reg, err := testutil.StartRegistry()
+//	...
+//	defer reg.Close()
+//	layers := testutil.SampleLayers()
+//	img, err := testutil.Image(layers...)
+//	...
+//	src, err := reg.Push("sample:latest", img)
+//	...
+//	// Squash docker://<src> to docker://<dst>, then:
+//	err = testutil.CheckSquashed(squashed, testutil.Flatten(layers...))
+package testutil
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Registry is an in-memory registry served over HTTP on localhost.
+type Registry struct {
+	server *httptest.Server
+	// Host is the registry's "host:port", for use in image refs.
+	Host string
+}
+
+// StartRegistry starts an in-memory registry. Call Close to stop it.
+func StartRegistry() (*Registry, error) {
+	s := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	return &Registry{server: s, Host: strings.TrimPrefix(s.URL, "http://")}, nil
+}
+
+// Close stops the registry, discarding its contents.
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// Ref returns a reference to repo (like "foo:latest") in the registry.
+func (r *Registry) Ref(repo string) (name.Reference, error) {
+	return name.ParseReference(r.Host+"/"+repo, name.Insecure)
+}
+
+// Push pushes img to repo (like "foo:latest") in the registry and returns
+// its reference.
+func (r *Registry) Push(repo string, img v1.Image) (name.Reference, error) {
+	ref, err := r.Ref(repo)
+	if err != nil {
+		return nil, err
+	}
+	if err := remote.Write(ref, img); err != nil {
+		return nil, fmt.Errorf("push %s: %w", ref, err)
+	}
+	return ref, nil
+}
+
+// Pull pulls repo (like "foo:squashed") from the registry.
+func (r *Registry) Pull(repo string) (v1.Image, error) {
+	ref, err := r.Ref(repo)
+	if err != nil {
+		return nil, err
+	}
+	img, err := remote.Image(ref)
+	if err != nil {
+		return nil, fmt.Errorf("pull %s: %w", ref, err)
+	}
+	return img, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// setPlatform explicitly copies the platform fields of the source config
+// into the output config, then applies any -override-os / -override-arch
+// values, warning when they change it. Some pipelines match on exact
+// platform strings (e.g. the arm variant, or the Windows OS version), so
+// these must never be dropped.
+func setPlatform(dst, src *v1.ConfigFile) error {
+	dst.OS = src.OS
+	dst.Architecture = src.Architecture
+	dst.Variant = src.Variant
+	dst.OSVersion = src.OSVersion
+	dst.OSFeatures = append([]string(nil), src.OSFeatures...)
+
+	if *overrideOS != "" && *overrideOS != src.OS {
+		// The OS version and features only describe the source's OS.
+		dst.OS = *overrideOS
+		dst.OSVersion = ""
+		dst.OSFeatures = nil
+	}
+	if *overrideArch != "" {
+		arch, variant, err := parseArch(*overrideArch)
+		if err != nil {
+			return err
+		}
+		dst.Architecture = arch
+		dst.Variant = variant
+	}
+	from := v1.Platform{OS: src.OS, Architecture: src.Architecture, Variant: src.Variant}
+	to := v1.Platform{OS: dst.OS, Architecture: dst.Architecture, Variant: dst.Variant}
+	if !from.Equals(to) {
+		// It's only a label: nothing checks that the files are built for it.
+		was := platformString(&from)
+		if from.OS == "" && from.Architecture == "" {
+			was = "no platform"
+		}
+		logf("Warning: labeling the squashed image %s, while the source config says %s; its files are unchanged", platformString(&to), was)
+	}
+	return nil
+}
+
+// parseArch parses an architecture with an optional variant, like "amd64"
+// or "arm/v7".
+func parseArch(s string) (arch, variant string, err error) {
+	arch, variant, _ = strings.Cut(s, "/")
+	if arch == "" || strings.Contains(variant, "/") {
+		return "", "", fmt.Errorf("invalid architecture %q (expected ARCH or ARCH/VARIANT)", s)
+	}
+	return arch, variant, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+var (
+	// failOn holds the -fail-on flag values.
+	failOn stringsFlag
+	// warnOn holds the -warn-on flag values.
+	warnOn stringsFlag
+)
+
+// policyConditions are the conditions that can be passed to -fail-on and
+// -warn-on, with their descriptions.
+var policyConditions = map[string]string{
+	"secrets":            "files contain what look like private keys or access tokens",
+	"size-over-budget":   "total file size exceeds -size-budget",
+	"setuid":             "setuid or setgid files are present",
+	"foreign-layers":     "the source has foreign (non-distributable) layers, whose content ends up in the squashed layer",
+	"xattrs":             "files have extended attributes (like file capabilities), which some runtimes and registries drop",
+	"unsafe-symlinks":    "symlinks point outside the image root, or into volatile paths like /tmp or /run, which break on read-only and rootless runtimes",
+	"unsafe-permissions": "files are world-writable, have file capabilities but can't be executed, or can't be read by the image's USER",
+}
+
+// policyConditionNames returns the policy condition names, sorted.
+func policyConditionNames() []string {
+	var names []string
+	for name := range policyConditions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkPolicyFlags validates the -fail-on and -warn-on conditions.
+func checkPolicyFlags() error {
+	for _, cond := range append(append([]string(nil), failOn...), warnOn...) {
+		if _, ok := policyConditions[cond]; !ok {
+			return fmt.Errorf("unknown policy condition %q (must be one of %s)", cond, strings.Join(policyConditionNames(), ", "))
+		}
+		if cond == "size-over-budget" && *sizeBudget == "" {
+			return fmt.Errorf("the size-over-budget condition requires -size-budget")
+		}
+	}
+	if *sizeBudget != "" {
+		if _, err := humanize.ParseBytes(*sizeBudget); err != nil {
+			return fmt.Errorf("invalid -size-budget: %w", err)
+		}
+	}
+	return nil
+}
+
+// policyEnabled returns whether cond was passed to -fail-on or -warn-on.
+func policyEnabled(cond string) bool {
+	for _, c := range append(append([]string(nil), failOn...), warnOn...) {
+		if c == cond {
+			return true
+		}
+	}
+	return false
+}
+
+// policyFinding is an occurrence of a policy condition.
+type policyFinding struct {
+	Condition string
+	Detail    string
+}
+
+// maxPolicyDetails is how many findings are listed per condition.
+const maxPolicyDetails = 10
+
+// enforcePolicy warns about findings whose condition is passed to
+// -warn-on, and fails if any finding's condition is passed to -fail-on.
+func enforcePolicy(findings []policyFinding) error {
+	byCond := map[string][]string{}
+	for _, f := range findings {
+		byCond[f.Condition] = append(byCond[f.Condition], f.Detail)
+	}
+	var failures []string
+	for _, cond := range policyConditionNames() {
+		details := byCond[cond]
+		if len(details) == 0 {
+			continue
+		}
+		msg := fmt.Sprintf("%s: %s", cond, policyConditions[cond])
+		for i, d := range details {
+			if i == maxPolicyDetails {
+				msg += fmt.Sprintf("\n  ... and %d more", len(details)-i)
+				break
+			}
+			msg += "\n  " + d
+		}
+		switch {
+		case contains(failOn, cond):
+			failures = append(failures, msg)
+		case contains(warnOn, cond):
+			logf("Warning: %s", msg)
+		}
+	}
+	if len(failures) > 0 {
+		return withExitCode(exitVerification, fmt.Errorf("policy check failed:\n%s", strings.Join(failures, "\n")))
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkForeignLayers enforces the foreign-layers policy condition on the
+// source image.
+func checkForeignLayers(img v1.Image) error {
+	if !policyEnabled("foreign-layers") {
+		return nil
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return fmt.Errorf("get manifest: %w", err)
+	}
+	var findings []policyFinding
+	for _, desc := range m.Layers {
+		if !desc.MediaType.IsDistributable() {
+			findings = append(findings, policyFinding{"foreign-layers", fmt.Sprintf("%s (%s)", desc.Digest, desc.MediaType)})
+		}
+	}
+	return enforcePolicy(findings)
+}
+
+// maxSecretScanSize is the largest file scanned for secrets.
+const maxSecretScanSize = 1024 * 1024
+
+var secretPatterns = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"private key", regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |ENCRYPTED |PGP )?PRIVATE KEY(?: BLOCK)?-----`)},
+	{"AWS access key ID", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"npm token", regexp.MustCompile(`_authToken=[^\s$]`)},
+}
+
+// policyVisitor collects findings for the policy conditions that need the
+// squashed rootfs.
+type policyVisitor struct {
+	secrets, setuid, xattrs, symlinks bool
+	findings                          []policyFinding
+	totalSize                         int64
+}
+
+var _ rootfsVisitor = (*policyVisitor)(nil)
+
+// newPolicyVisitor returns a visitor for the enabled rootfs policy
+// conditions, or nil if there are none.
+func newPolicyVisitor() *policyVisitor {
+	v := &policyVisitor{
+		secrets:  policyEnabled("secrets"),
+		setuid:   policyEnabled("setuid"),
+		xattrs:   policyEnabled("xattrs"),
+		symlinks: policyEnabled("unsafe-symlinks") || *auditSymlinks,
+	}
+	if !v.secrets && !v.setuid && !v.xattrs && !v.symlinks && !policyEnabled("size-over-budget") {
+		return nil
+	}
+	return v
+}
+
+func (v *policyVisitor) WantsContent(hdr *tar.Header) bool {
+	return v.secrets && hdr.Size <= maxSecretScanSize
+}
+
+func (v *policyVisitor) Visit(hdr *tar.Header, content []byte) error {
+	name := "/" + cleanTarPath(hdr.Name)
+	if hdr.Typeflag == tar.TypeReg {
+		v.totalSize += hdr.Size
+		if v.setuid && hdr.Mode&06000 != 0 {
+			v.findings = append(v.findings, policyFinding{"setuid", fmt.Sprintf("%s (mode %04o)", name, hdr.Mode&07777)})
+		}
+	}
+	if v.symlinks && hdr.Typeflag == tar.TypeSymlink {
+		if problem := symlinkProblem(name, hdr.Linkname); problem != "" {
+			v.findings = append(v.findings, policyFinding{"unsafe-symlinks", fmt.Sprintf("%s -> %s (%s)", name, hdr.Linkname, problem)})
+		}
+	}
+	if v.xattrs {
+		var keys []string
+		for k := range hdr.PAXRecords {
+			if x, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+				keys = append(keys, x)
+			}
+		}
+		if len(keys) > 0 {
+			sort.Strings(keys)
+			v.findings = append(v.findings, policyFinding{"xattrs", fmt.Sprintf("%s (%s)", name, strings.Join(keys, ", "))})
+		}
+	}
+	if content != nil {
+		for _, p := range secretPatterns {
+			if p.re.Match(content) {
+				v.findings = append(v.findings, policyFinding{"secrets", fmt.Sprintf("%s (%s)", name, p.name)})
+			}
+		}
+	}
+	return nil
+}
+
+// enforce applies the policy to what was found in the rootfs, after
+// printing the -audit-symlinks report.
+func (v *policyVisitor) enforce() error {
+	findings := v.findings
+	if *auditSymlinks {
+		var lines []string
+		for _, f := range findings {
+			if f.Condition == "unsafe-symlinks" {
+				lines = append(lines, "\n  "+f.Detail)
+			}
+		}
+		logf("Symlink audit: %d unsafe symlinks%s", len(lines), strings.Join(lines, ""))
+	}
+	if policyEnabled("size-over-budget") {
+		budget, _ := humanize.ParseBytes(*sizeBudget)
+		if v.totalSize > int64(budget) {
+			findings = append(findings, policyFinding{"size-over-budget", fmt.Sprintf("%s of files, budget is %s", humanize.Bytes(uint64(v.totalSize)), humanize.Bytes(budget))})
+		}
+	}
+	return enforcePolicy(findings)
+}
+
+// volatilePaths are directories that runtimes typically mount as tmpfs, so
+// that anything a symlink expects to find there is gone at startup.
+var volatilePaths = []string{"/tmp", "/var/tmp", "/run", "/var/run", "/dev/shm"}
+
+// symlinkProblem describes why the symlink at name (an absolute path) with
+// the given target is unsafe, or returns "" if it isn't. Targets are
+// resolved lexically, without following other symlinks.
+func symlinkProblem(name, target string) string {
+	if !path.IsAbs(target) {
+		// path.Join would clamp ".." at the root, so count the depth.
+		depth := strings.Count(path.Dir(name), "/")
+		if path.Dir(name) == "/" {
+			depth = 0
+		}
+		for _, elem := range strings.Split(target, "/") {
+			switch elem {
+			case "..":
+				depth--
+			case "", ".":
+			default:
+				depth++
+			}
+			if depth < 0 {
+				return "escapes the image root"
+			}
+		}
+		target = path.Join(path.Dir(name), target)
+	}
+	target = path.Clean(target)
+	for _, v := range volatilePaths {
+		if inDir(name, v) {
+			// Links inside volatile paths, like the usual /var/run -> /run,
+			// only matter while they exist.
+			return ""
+		}
+	}
+	for _, v := range volatilePaths {
+		if inDir(target, v) {
+			return "points into volatile " + v
+		}
+	}
+	return ""
+}
+
+// inDir returns whether p is dir or inside it.
+func inDir(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// squashedRootfs returns a reader for the flattened rootfs of img, after
+// applying any in-filesystem post-processing requested with -run, -filter
+// and -optimize, fitting it to -target-size, checking
+// or fixing ownership with -enforce-owner, clamping mtimes with
+// -reproducible, dropping owner names with -numeric-owner, and
+// canonicalized if -canonical-tar is set. The time this takes, apart from
+// extracting img, is timed as phaseFilter.
+func squashedRootfs(img v1.Image) (io.ReadCloser, error) {
+	defer startPhase(phaseFilter, phaseExtract, phasePull).end()
+	rc, err := postprocessedRootfs(img)
+	if err != nil {
+		return nil, err
+	}
+	if len(filterFlags) > 0 {
+		// Already validated.
+		rules, _ := parseFilters(filterFlags)
+		rc = filterEntries(rc, rules)
+	}
+	if *optimizeFlag != "" {
+		// Already validated.
+		heuristics, _ := parseOptimize(*optimizeFlag)
+		optimized, err := optimizeRootfs(rc, heuristics)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		rc = optimized
+	}
+	if *targetSize != "" {
+		fitted, err := fitTargetSize(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		rc = fitted
+	}
+	if len(enforceOwnerFlags) > 0 {
+		// Already validated.
+		rules, _ := parseOwnerRules(enforceOwnerFlags)
+		if err := resolveOwnerRules(rules, img); err != nil {
+			rc.Close()
+			return nil, err
+		}
+		rc = enforceOwners(rc, rules)
+	}
+	if *reproducible {
+		t, err := outputCreated()
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		rc = clampMtimes(rc, t)
+	}
+	if *numericOwner {
+		rc = numericOwners(rc)
+	}
+	if *canonicalTar {
+		canonical, err := canonicalizeTar(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		rc = canonical
+	}
+	return timeReadCloser(rc, phaseFilter, phaseExtract, phasePull), nil
+}
+
+func postprocessedRootfs(img v1.Image) (io.ReadCloser, error) {
+	if len(runCmds) == 0 {
+		return extractSquashedRootfs(img), nil
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("get config file: %w", err)
+	}
+
+	// Lay the rootfs out as an OCI bundle so that it can be run by either
+	// chroot or an OCI runtime.
+	bundle, err := mkdirTemp("docker-squash-run-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %w", err)
+	}
+	rootfs := filepath.Join(bundle, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return nil, err
+	}
+	logf("Unpacking squashed rootfs to %q", rootfs)
+	rc := extractSquashedRootfs(img)
+	defer rc.Close()
+	u, err := unpackRootfs(rc, rootfs)
+	if err != nil {
+		return nil, fmt.Errorf("unpack rootfs: %w", err)
+	}
+
+	for _, cmd := range runCmds {
+		logf("Running %q", cmd)
+		if err := runInRootfs(bundle, cmd, cfg); err != nil {
+			return nil, fmt.Errorf("run %q: %w", cmd, err)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(u.pack(pw))
+	}()
+	return pr, nil
+}
+
+// runInRootfs runs the shell command cmd inside the rootfs of the given
+// bundle directory, using the runtime selected with -run-runtime.
+func runInRootfs(bundle, cmd string, cfg *v1.ConfigFile) error {
+	rootfs := filepath.Join(bundle, "rootfs")
+	env := cfg.Config.Env
+	if len(env) == 0 {
+		env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+	}
+
+	var c *exec.Cmd
+	if *runRuntime == "chroot" {
+		c = exec.Command("/bin/sh", "-c", cmd)
+		c.Dir = "/"
+		c.Env = env
+		attr, err := chrootAttr(rootfs)
+		if err != nil {
+			return err
+		}
+		c.SysProcAttr = attr
+	} else {
+		spec := ociRuntimeSpec([]string{"/bin/sh", "-c", cmd}, env)
+		b, err := json.MarshalIndent(spec, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(bundle, "config.json"), b, 0644); err != nil {
+			return err
+		}
+		id := fmt.Sprintf("docker-squash-%d", os.Getpid())
+		c = exec.Command(*runRuntime, "run", "--bundle", bundle, id)
+	}
+	// Send the command's output to stderr, so it doesn't get mixed up with
+	// any output written to stdout.
+	c.Stdout = os.Stderr
+	c.Stderr = os.Stderr
+	return c.Run()
+}
+
+// ociRuntimeSpec returns a minimal OCI runtime config.json for running
+// args in a bundle's rootfs, with the host network so that commands like
+// package manager cleanups can still reach the network.
+func ociRuntimeSpec(args, env []string) map[string]any {
+	return map[string]any{
+		"ociVersion": "1.0.2",
+		"process": map[string]any{
+			"user": map[string]any{"uid": 0, "gid": 0},
+			"args": args,
+			"env":  env,
+			"cwd":  "/",
+		},
+		"root":     map[string]any{"path": "rootfs"},
+		"hostname": "docker-squash",
+		"mounts": []map[string]any{
+			{"destination": "/proc", "type": "proc", "source": "proc"},
+			{"destination": "/dev", "type": "tmpfs", "source": "tmpfs", "options": []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{"destination": "/dev/pts", "type": "devpts", "source": "devpts", "options": []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}},
+			{"destination": "/dev/shm", "type": "tmpfs", "source": "shm", "options": []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{"destination": "/sys", "type": "sysfs", "source": "sysfs", "options": []string{"nosuid", "noexec", "nodev", "ro"}},
+		},
+		"linux": map[string]any{
+			"namespaces": []map[string]any{
+				{"type": "pid"},
+				{"type": "ipc"},
+				{"type": "uts"},
+				{"type": "mount"},
+			},
+		},
+	}
+}
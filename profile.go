@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// lambdaMaxImageSize is the maximum uncompressed image size supported by
+// AWS Lambda container images.
+const lambdaMaxImageSize = 10 * 1024 * 1024 * 1024
+
+// lambdaLayerPlan splits the rootfs following AWS Lambda container image
+// best practices: rarely-changing OS and runtime files first, then
+// dependencies, then the function code in LAMBDA_TASK_ROOT (/var/task)
+// last, so that code-only changes only invalidate a small top layer.
+var lambdaLayerPlan = layerPlan{
+	{Name: "base"},
+	{Name: "dependencies", Prefixes: []string{
+		"opt",
+		"var/task/node_modules",
+		"var/task/vendor",
+		"var/task/lib",
+		"var/task/python",
+	}},
+	{Name: "code", Prefixes: []string{"var/task"}},
+}
+
+// profileLayerPlan returns the layer plan for the given -profile value.
+// A nil plan means the image is squashed into a single layer.
+func profileLayerPlan(profile string) (layerPlan, error) {
+	switch profile {
+	case "":
+		return nil, nil
+	case "lambda":
+		return lambdaLayerPlan, nil
+	default:
+		return nil, fmt.Errorf("unknown profile %q", profile)
+	}
+}
+
+// checkProfile validates the squashed image against any platform limits
+// imposed by the given profile.
+func checkProfile(profile string, cfg *v1.ConfigFile, layerSizes []int64) error {
+	if profile != "lambda" {
+		return nil
+	}
+	if cfg.Architecture != "amd64" && cfg.Architecture != "arm64" {
+		logf("Warning: AWS Lambda only supports amd64 and arm64 images (image architecture is %q)", cfg.Architecture)
+	}
+	var total int64
+	for _, size := range layerSizes {
+		total += size
+	}
+	if total > lambdaMaxImageSize {
+		return withExitCode(exitVerification, fmt.Errorf("squashed image is %d bytes uncompressed, which exceeds the AWS Lambda limit of %d bytes", total, int64(lambdaMaxImageSize)))
+	}
+	return nil
+}
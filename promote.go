@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+var (
+	// promoteMode is set for the promote subcommand.
+	promoteMode bool
+	// promoteDests are the promote subcommand's DEST arguments.
+	promoteDests []string
+)
+
+// checkCosign verifies that cosign is installed if -cosign-key is set.
+func checkCosign() error {
+	if *cosignKey == "" {
+		return nil
+	}
+	if _, err := exec.LookPath("cosign"); err != nil {
+		return fmt.Errorf("-cosign-key requires cosign to be installed: %w", err)
+	}
+	return nil
+}
+
+// promote pushes t to the repository of each of refs by digest, signs it
+// if -cosign-key is set, and then tags it. Tags are only written once every
+// push and signature has succeeded.
+func promote(refs []name.Reference, t remote.Taggable) error {
+	digest, err := taggableDigest(t)
+	if err != nil {
+		return err
+	}
+	var pinned []name.Digest
+	for i := 0; i < len(refs); i++ {
+		d := refs[i].Context().Digest(digest)
+		logf("Pushing %s", d)
+		pushed, err := pushWithFallback(d.RegistryStr(), t, func(t remote.Taggable) error {
+			digest, err := taggableDigest(t)
+			if err != nil {
+				return err
+			}
+			return remote.Push(d.Context().Digest(digest), t, remote.WithAuthFromKeychain(keychain))
+		})
+		if err != nil {
+			return fmt.Errorf("push to %s: %w", refs[i].Context(), err)
+		}
+		if pushed != t {
+			// Push the converted manifest everywhere, so that every
+			// destination ends up with the same digest.
+			t = pushed
+			if digest, err = taggableDigest(t); err != nil {
+				return err
+			}
+			pinned, i = nil, -1
+			continue
+		}
+		pinned = append(pinned, d)
+	}
+	if *cosignKey != "" {
+		for _, d := range pinned {
+			logf("Signing %s", d)
+			cmd := exec.Command("cosign", "sign", "--yes", "--key", *cosignKey, d.String())
+			cmd.Stdout = os.Stderr
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("sign %s: %w", d, err)
+			}
+		}
+	}
+	for _, ref := range refs {
+		tag, ok := ref.(name.Tag)
+		if !ok {
+			continue
+		}
+		if err := remote.Tag(tag, t, remote.WithAuthFromKeychain(keychain)); err != nil {
+			return fmt.Errorf("tag %s: %w", tag, err)
+		}
+		logf("Promoted %s to %s", digest, tag)
+	}
+	return nil
+}
+
+// taggableDigest returns the digest of t's manifest.
+func taggableDigest(t remote.Taggable) (string, error) {
+	raw, err := t.RawManifest()
+	if err != nil {
+		return "", fmt.Errorf("get manifest: %w", err)
+	}
+	h, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return "", err
+	}
+	return h.String(), nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// provenanceFile is the name of the provenance member of local output
+// archives.
+const provenanceFile = "docker-squash.json"
+
+// provenance describes how an output archive was made. It's written to the
+// archive as provenanceFile, next to the image blobs, so that the archive
+// describes itself.
+type provenance struct {
+	// SchemaVersion is incremented for incompatible changes.
+	SchemaVersion int    `json:"schemaVersion"`
+	Tool          string `json:"tool"`
+	// Version is the docker-squash module version, if known.
+	Version string    `json:"version,omitempty"`
+	Created time.Time `json:"created"`
+	// Operation is "squash", or "copy" with -no-squash.
+	Operation string             `json:"operation"`
+	Sources   []provenanceSource `json:"sources"`
+	// Options are the flags that were set and affect the output, except
+	// that file flags like -apply are recorded with the file's digest.
+	Options map[string]any `json:"options,omitempty"`
+	Output  struct {
+		Digest    string            `json:"digest"`
+		MediaType string            `json:"mediaType"`
+		Images    []provenanceImage `json:"images"`
+	} `json:"output"`
+}
+
+// provenanceSource is a SOURCE argument.
+type provenanceSource struct {
+	Source string `json:"source"`
+	// Digest is the digest of the image or index it was resolved to.
+	Digest string `json:"digest,omitempty"`
+}
+
+// provenanceImage is an image in the output.
+type provenanceImage struct {
+	Digest   string `json:"digest"`
+	Platform string `json:"platform,omitempty"`
+	// SourceDigest and SourceLayers are those recorded in the image's
+	// labels: the source image and the layer blobs squashed into it.
+	SourceDigest string   `json:"sourceDigest,omitempty"`
+	SourceLayers []string `json:"sourceLayers,omitempty"`
+}
+
+// newProvenance starts the provenance of squashing src, opened from the
+// SOURCE argument inputPath.
+func newProvenance(inputPath string, src *source) (*provenance, error) {
+	p := &provenance{SchemaVersion: 1, Tool: "docker-squash", Operation: "squash"}
+	if *noSquash {
+		p.Operation = "copy"
+	}
+	p.Version = moduleVersion()
+	created, err := outputCreated()
+	if err != nil {
+		return nil, err
+	}
+	p.Created = created.UTC()
+
+	if len(platformSourceFlags) > 0 {
+		for _, s := range platformSourceFlags {
+			p.Sources = append(p.Sources, provenanceSource{Source: s})
+		}
+	} else {
+		var t interface{ Digest() (v1.Hash, error) } = src.Image
+		if src.Index != nil {
+			t = src.Index
+		}
+		digest, err := t.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("get source digest: %w", err)
+		}
+		p.Sources = []provenanceSource{{Source: inputPath, Digest: digest.String()}}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		if nonContentFlags[f.Name] || err != nil {
+			return
+		}
+		if p.Options == nil {
+			p.Options = map[string]any{}
+		}
+		var value any = f.Value.String()
+		if v, ok := f.Value.(*stringsFlag); ok {
+			value = []string(*v)
+		} else if fileFlags[f.Name] && f.Value.String() != "" {
+			var b []byte
+			if b, err = os.ReadFile(f.Value.String()); err != nil {
+				return
+			}
+			sum := sha256.Sum256(b)
+			value = "sha256:" + hex.EncodeToString(sum[:])
+		}
+		p.Options[f.Name] = value
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// marshal completes p with the output image or index t, returning its JSON
+// encoding.
+func (p *provenance) marshal(t remote.Taggable) ([]byte, error) {
+	var imgs []v1.Image
+	switch t := t.(type) {
+	case v1.ImageIndex:
+		im, err := t.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range im.Manifests {
+			img, err := t.Image(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			imgs = append(imgs, img)
+		}
+		digest, err := t.Digest()
+		if err != nil {
+			return nil, err
+		}
+		p.Output.Digest, p.Output.MediaType = digest.String(), string(im.MediaType)
+	case v1.Image:
+		digest, err := t.Digest()
+		if err != nil {
+			return nil, err
+		}
+		mt, err := t.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		p.Output.Digest, p.Output.MediaType = digest.String(), string(mt)
+		imgs = []v1.Image{t}
+	}
+	p.Output.Images = nil
+	for _, img := range imgs {
+		digest, err := img.Digest()
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		pi := provenanceImage{Digest: digest.String(), Platform: platformString(cfg.Platform())}
+		pi.SourceDigest = cfg.Config.Labels[sourceDigestLabel]
+		if layers := cfg.Config.Labels[sourceLayersLabel]; layers != "" {
+			pi.SourceLayers = strings.Split(layers, ",")
+		}
+		p.Output.Images = append(p.Output.Images, pi)
+	}
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// writeTarWithProvenance copies the tar stream produced by write to w,
+// adding p as a provenanceFile member at the end.
+func writeTarWithProvenance(w io.Writer, p *provenance, t remote.Taggable, write func(io.Writer) error) error {
+	data, err := p.marshal(t)
+	if err != nil {
+		return fmt.Errorf("describe output: %w", err)
+	}
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(write(pw)) }()
+	defer pr.Close()
+	tr := tar.NewReader(pr)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		outputArchive.apply(hdr)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	// Let write finish the end-of-archive padding.
+	if _, err := io.Copy(io.Discard, pr); err != nil {
+		return err
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: provenanceFile, Mode: 0644, Size: int64(len(data)), ModTime: p.Created}
+	outputArchive.apply(hdr)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// pathOrigin is where a path of the squashed image came from, in the
+// -provenance-map: the source layer that had it, and the history entry of
+// the build step that made that layer, if the source's history says.
+type pathOrigin struct {
+	Layer      v1.Hash `json:"layer"`
+	DiffID     v1.Hash `json:"diffID"`
+	LayerIndex int     `json:"layerIndex"`
+	History    *int    `json:"history,omitempty"`
+	CreatedBy  string  `json:"createdBy,omitempty"`
+}
+
+// provenanceMap is the -provenance-map of a squash.
+type provenanceMap struct {
+	Source v1.Hash `json:"source"`
+	// Paths maps every path of the squashed image to its origin, or to
+	// null if it isn't at that path in any source layer, like what -run
+	// created or a -filter moved.
+	Paths map[string]*pathOrigin `json:"paths"`
+}
+
+// writeProvenanceMap writes the -provenance-map of squashing src into out
+// to file. It's a pass over the headers of each, so it works the same when
+// out is a cached result.
+func writeProvenanceMap(file string, src, out v1.Image) error {
+	origins, err := layerOrigins(src)
+	if err != nil {
+		return err
+	}
+	m := provenanceMap{Paths: map[string]*pathOrigin{}}
+	if m.Source, err = src.Digest(); err != nil {
+		return fmt.Errorf("get source image digest: %w", err)
+	}
+	// Paths are looked up by their position in the flattened filesystem,
+	// which whichever layer of src they came from had too.
+	fromLayer := map[string]int{}
+	err = walkImage(src, nil, func(layer int, hdr *tar.Header, _ io.Reader) error {
+		fromLayer[originPath(hdr.Name)] = layer
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("read source layers: %w", err)
+	}
+	err = walkImage(out, nil, func(_ int, hdr *tar.Header, _ io.Reader) error {
+		p := originPath(hdr.Name)
+		if p == "" {
+			return nil
+		}
+		if layer, ok := fromLayer[p]; ok {
+			m.Paths[p] = &origins[layer]
+		} else {
+			m.Paths[p] = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("read squashed layers: %w", err)
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("write -provenance-map: %w", err)
+	}
+	logf("Wrote provenance map (%d paths) to %q", len(m.Paths), file)
+	return nil
+}
+
+// layerOrigins returns the origin of the paths of each layer of img.
+func layerOrigins(img v1.Image) ([]pathOrigin, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("get source layers: %w", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("get source config file: %w", err)
+	}
+	// The history entries that aren't empty layers are the layers, in
+	// order, unless the history is incomplete.
+	var nonEmpty []int
+	for i, h := range cfg.History {
+		if !h.EmptyLayer {
+			nonEmpty = append(nonEmpty, i)
+		}
+	}
+	if len(nonEmpty) != len(layers) {
+		nonEmpty = nil
+	}
+	origins := make([]pathOrigin, len(layers))
+	for i, l := range layers {
+		o := &origins[i]
+		o.LayerIndex = i
+		if o.Layer, err = l.Digest(); err != nil {
+			return nil, fmt.Errorf("get layer digest: %w", err)
+		}
+		if o.DiffID, err = l.DiffID(); err != nil {
+			return nil, fmt.Errorf("get layer diff ID: %w", err)
+		}
+		if nonEmpty != nil {
+			h := nonEmpty[i]
+			o.History = &h
+			o.CreatedBy = cfg.History[h].CreatedBy
+		}
+	}
+	return origins, nil
+}
+
+// originPath returns name as a relative path without a trailing slash.
+func originPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// hubQuota is the Docker Hub pull quota, as last reported by the RateLimit
+// headers of a manifest response.
+var hubQuota struct {
+	sync.Mutex
+	known            bool
+	limit, remaining int
+	window           time.Duration
+}
+
+// rateLimitTransport records the Docker Hub pull quota from the responses
+// it sees.
+type rateLimitTransport struct {
+	inner http.RoundTripper
+}
+
+// pullTransport is the transport used to pull source images. Requests
+// answered from the metadata cache don't count against the quota, so don't
+// update it.
+var pullTransport http.RoundTripper = &timedTransport{inner: &metadataCacheTransport{inner: &rateLimitTransport{inner: http.DefaultTransport}}}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil || !isDockerHub(req.URL.Host) || !strings.Contains(req.URL.Path, "/manifests/") {
+		return resp, err
+	}
+	// Like "ratelimit-remaining: 76;w=21600" (76 pulls left in a 6h window).
+	limit, _, ok1 := parseRateLimit(resp.Header.Get("RateLimit-Limit"))
+	remaining, window, ok2 := parseRateLimit(resp.Header.Get("RateLimit-Remaining"))
+	if ok1 && ok2 {
+		hubQuota.Lock()
+		hubQuota.known = true
+		hubQuota.limit, hubQuota.remaining, hubQuota.window = limit, remaining, window
+		hubQuota.Unlock()
+	}
+	return resp, err
+}
+
+func parseRateLimit(v string) (n int, window time.Duration, ok bool) {
+	count, params, _ := strings.Cut(v, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return 0, 0, false
+	}
+	if w, ok := strings.CutPrefix(strings.TrimSpace(params), "w="); ok {
+		if secs, err := strconv.Atoi(w); err == nil {
+			window = time.Duration(secs) * time.Second
+		}
+	}
+	return n, window, true
+}
+
+func isDockerHub(host string) bool {
+	return host == name.DefaultRegistry || host == "registry-1.docker.io" || host == "docker.io"
+}
+
+// hubPullQuota is the Docker Hub pull quota, as reported in the -json
+// result and notifications.
+type hubPullQuota struct {
+	Limit     int `json:"limit"`
+	Remaining int `json:"remaining"`
+	// WindowSeconds is the length of the window the limit applies to, if
+	// the registry says.
+	WindowSeconds float64 `json:"windowSeconds,omitempty"`
+}
+
+// currentHubQuota returns the Docker Hub pull quota, or nil if unknown.
+func currentHubQuota() *hubPullQuota {
+	hubQuota.Lock()
+	defer hubQuota.Unlock()
+	if !hubQuota.known {
+		return nil
+	}
+	return &hubPullQuota{Limit: hubQuota.limit, Remaining: hubQuota.remaining, WindowSeconds: hubQuota.window.Seconds()}
+}
+
+// logHubQuota logs the remaining Docker Hub pull quota, if known.
+func logHubQuota() {
+	hubQuota.Lock()
+	defer hubQuota.Unlock()
+	if !hubQuota.known {
+		return
+	}
+	msg := "Docker Hub pull quota: %d of %d pulls remaining"
+	args := []any{hubQuota.remaining, hubQuota.limit}
+	if hubQuota.window > 0 {
+		msg += " per %s"
+		args = append(args, hubQuota.window)
+	}
+	logf(msg, args...)
+}
+
+// checkHubQuota warns if pulling n more manifests from Docker Hub, for
+// what, would exceed the remaining pull quota.
+func checkHubQuota(n int, what string) {
+	hubQuota.Lock()
+	defer hubQuota.Unlock()
+	if hubQuota.known && n > hubQuota.remaining {
+		logf("Warning: %s needs %d more Docker Hub pulls, but only %d remain; expect 429 Too Many Requests errors (try 'docker login' for a higher limit)", what, n, hubQuota.remaining)
+	}
+}
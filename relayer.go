@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// layerSpec describes one output layer when re-splitting a flattened
+// rootfs into multiple layers.
+type layerSpec struct {
+	// Name is a short human-readable name for the layer, recorded in the
+	// image history.
+	Name string
+	// Prefixes are the rootfs paths (without a leading "/") that belong
+	// to this layer. A path belongs to the layer with the longest matching
+	// prefix; paths matching no prefix go to the layer with no prefixes.
+	Prefixes []string
+}
+
+// layerPlan assigns each path in a flattened rootfs to one of a list of
+// output layers.
+type layerPlan []layerSpec
+
+// defaultLayer returns the index of the catch-all layer in the plan.
+func (p layerPlan) defaultLayer() int {
+	for i, spec := range p {
+		if len(spec.Prefixes) == 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// layerFor returns the index of the layer that the given (cleaned) path
+// belongs to.
+func (p layerPlan) layerFor(name string) int {
+	best, bestLen := p.defaultLayer(), -1
+	for i, spec := range p {
+		for _, prefix := range spec.Prefixes {
+			prefix = strings.TrimSuffix(prefix, "/")
+			if name != prefix && !strings.HasPrefix(name, prefix+"/") {
+				continue
+			}
+			if len(prefix) > bestLen {
+				best, bestLen = i, len(prefix)
+			}
+		}
+	}
+	return best
+}
+
+// splitLayers reads a flattened rootfs tarball from r and writes each entry
+// to the writer for the layer it belongs to according to plan. Parent
+// directories are repeated in every layer that needs them so that each
+// layer is self-contained, and hardlinks are always written to the same
+// layer as their target. It returns the size in bytes of each layer
+// tarball.
+func splitLayers(r io.Reader, plan layerPlan, ws []io.Writer) ([]int64, error) {
+	if len(ws) != len(plan) {
+		return nil, fmt.Errorf("got %d writers for %d layers", len(ws), len(plan))
+	}
+	tws := make([]*tar.Writer, len(ws))
+	counters := make([]*countingWriter, len(ws))
+	for i, w := range ws {
+		counters[i] = &countingWriter{w: w}
+		tws[i] = tar.NewWriter(counters[i])
+	}
+	// Directory headers seen so far, so they can be replayed into layers
+	// that need them.
+	dirs := map[string]*tar.Header{}
+	// Directories already written to each layer.
+	written := make([]map[string]bool, len(ws))
+	for i := range written {
+		written[i] = map[string]bool{}
+	}
+	// Layer that each regular file was written to, for resolving hardlinks.
+	fileLayer := map[string]int{}
+
+	var ensureParents func(i int, name string) error
+	ensureParents = func(i int, name string) error {
+		parent := path.Dir(name)
+		if parent == "." || parent == "/" || written[i][parent] {
+			return nil
+		}
+		if err := ensureParents(i, parent); err != nil {
+			return err
+		}
+		hdr, ok := dirs[parent]
+		if !ok {
+			return nil
+		}
+		written[i][parent] = true
+		return tws[i].WriteHeader(hdr)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := cleanTarPath(hdr.Name)
+		i := plan.layerFor(name)
+		if hdr.Typeflag == tar.TypeLink {
+			if target, ok := fileLayer[cleanTarPath(hdr.Linkname)]; ok {
+				i = target
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dirs[name] = hdr
+			if written[i][name] {
+				continue
+			}
+			written[i][name] = true
+		case tar.TypeReg:
+			fileLayer[name] = i
+		}
+		if err := ensureParents(i, name); err != nil {
+			return nil, err
+		}
+		if err := tws[i].WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(tws[i], tr); err != nil {
+			return nil, err
+		}
+	}
+	sizes := make([]int64, len(ws))
+	for i, tw := range tws {
+		if err := tw.Close(); err != nil {
+			return nil, err
+		}
+		sizes[i] = counters[i].n
+	}
+	return sizes, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// runState is the progress of a squash saved in -cache-dir for -resume,
+// in the directory runs/$KEY, where $KEY is the result cache key. Every
+// file in it is complete: they're written under a ".partial" name and
+// renamed into place once done. It's removed once the squash result is
+// cached, after which reruns use the result instead.
+//
+// Like the cache entry, it's only used while holding the entry's lock.
+type runState struct {
+	dir string
+	mu  sync.Mutex
+
+	// Blobs are the digests of the source layer blobs saved in full, in
+	// blobs/.
+	Blobs []string `json:"blobs,omitempty"`
+	// Rootfs describes the squashed rootfs tarball, rootfs.tar, once it's
+	// complete.
+	Rootfs *runFile `json:"rootfs,omitempty"`
+	// Layer describes the compressed squashed layer, layer.blob, once
+	// it's complete.
+	Layer *runLayer `json:"layer,omitempty"`
+}
+
+type runFile struct {
+	Size   int64   `json:"size"`
+	Digest v1.Hash `json:"digest"`
+}
+
+type runLayer struct {
+	Size      int64           `json:"size"`
+	Digest    v1.Hash         `json:"digest"`
+	DiffID    v1.Hash         `json:"diffID"`
+	MediaType types.MediaType `json:"mediaType"`
+}
+
+func (c *resultCache) runPath(key string) string {
+	return filepath.Join(c.dir, "runs", key)
+}
+
+// openRun returns the saved state of the squash for key, which is empty if
+// there's none.
+func (c *resultCache) openRun(key string) (*runState, error) {
+	r := &runState{dir: c.runPath(key)}
+	b, err := os.ReadFile(filepath.Join(r.dir, "state.json"))
+	if os.IsNotExist(err) {
+		return r, os.MkdirAll(filepath.Join(r.dir, "blobs"), 0755)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, r); err != nil {
+		logf("Warning: -resume: ignoring unreadable %s: %v", filepath.Join(r.dir, "state.json"), err)
+		*r = runState{dir: r.dir}
+	}
+	// Files that went missing are redone.
+	r.Blobs = slices.DeleteFunc(r.Blobs, func(d string) bool { return !r.fileHasSize(r.blobPath(d), -1) })
+	if r.Rootfs != nil && !r.fileHasSize(r.rootfsPath(), r.Rootfs.Size) {
+		r.Rootfs = nil
+	}
+	if r.Layer != nil && (r.Rootfs == nil || r.Layer.DiffID != r.Rootfs.Digest || !r.fileHasSize(r.layerPath(), r.Layer.Size)) {
+		r.Layer = nil
+	}
+	var done []string
+	if len(r.Blobs) > 0 {
+		done = append(done, plural(len(r.Blobs), "source layer blob"))
+	}
+	if r.Rootfs != nil {
+		done = append(done, "the squashed rootfs")
+	}
+	if r.Layer != nil {
+		done = append(done, "the compressed layer")
+	}
+	if len(done) > 0 {
+		logf("Resuming an earlier run of this squash, which saved %s", strings.Join(done, ", "))
+	}
+	return r, os.MkdirAll(filepath.Join(r.dir, "blobs"), 0755)
+}
+
+func (r *runState) blobPath(digest string) string {
+	return filepath.Join(r.dir, "blobs", strings.ReplaceAll(digest, ":", "-"))
+}
+
+func (r *runState) rootfsPath() string { return filepath.Join(r.dir, "rootfs.tar") }
+func (r *runState) layerPath() string  { return filepath.Join(r.dir, "layer.blob") }
+
+// fileHasSize returns whether the file at path exists with the given size,
+// or any size if size is negative.
+func (r *runState) fileHasSize(path string, size int64) bool {
+	info, err := os.Stat(path)
+	return err == nil && (size < 0 || info.Size() == size)
+}
+
+// save writes the state to state.json, replacing it atomically.
+func (r *runState) save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(r.dir, "state.json.partial")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(r.dir, "state.json"))
+}
+
+// remove deletes the saved state, once the squash it describes is done.
+func (r *runState) remove() error {
+	return os.RemoveAll(r.dir)
+}
+
+// complete renames the finished file f into place at path and saves the
+// state, after update records it.
+func (r *runState) complete(f *os.File, path string, update func()) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	update()
+	r.mu.Unlock()
+	return r.save()
+}
+
+// hasBlob returns whether the source blob digest is saved.
+func (r *runState) hasBlob(digest string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Contains(r.Blobs, digest)
+}
+
+// wrapImage returns img with its layer blobs read from the saved state
+// when they're there, and saved to it as they're read in full otherwise.
+// Foreign layers are left alone, to keep their descriptors and URLs.
+func (r *runState) wrapImage(img v1.Image) v1.Image {
+	return &resumeImage{Image: img, run: r}
+}
+
+type resumeImage struct {
+	v1.Image
+	run *runState
+}
+
+func (i *resumeImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]v1.Layer, len(layers))
+	for n, l := range layers {
+		if wrapped[n], err = i.run.wrapLayer(l); err != nil {
+			return nil, err
+		}
+	}
+	return wrapped, nil
+}
+
+func (i *resumeImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.run.wrapLayer(l)
+}
+
+func (i *resumeImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDiffID(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.run.wrapLayer(l)
+}
+
+func (r *runState) wrapLayer(l v1.Layer) (v1.Layer, error) {
+	mt, err := l.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	if !mt.IsDistributable() {
+		return l, nil
+	}
+	// Wrapped as a partial.CompressedLayer, so that the uncompressed
+	// contents are decompressed from the saved blob too.
+	return partial.CompressedToLayer(&resumeBlob{layer: l, run: r})
+}
+
+// resumeBlob is a source layer whose compressed blob is saved with -resume.
+type resumeBlob struct {
+	layer v1.Layer
+	run   *runState
+}
+
+func (b *resumeBlob) Digest() (v1.Hash, error)            { return b.layer.Digest() }
+func (b *resumeBlob) DiffID() (v1.Hash, error)            { return b.layer.DiffID() }
+func (b *resumeBlob) Size() (int64, error)                { return b.layer.Size() }
+func (b *resumeBlob) MediaType() (types.MediaType, error) { return b.layer.MediaType() }
+
+func (b *resumeBlob) Compressed() (io.ReadCloser, error) {
+	digest, err := b.layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	path := b.run.blobPath(digest.String())
+	if b.run.hasBlob(digest.String()) {
+		return os.Open(path)
+	}
+	rc, err := b.layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path + ".partial")
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &savingReader{rc: rc, f: f, h: sha256.New(), digest: digest, path: path, run: b.run}, nil
+}
+
+// savingReader reads a source layer blob, saving it to the run state once
+// it has been read in full and matches its digest.
+type savingReader struct {
+	rc     io.ReadCloser
+	f      *os.File
+	h      hash.Hash
+	digest v1.Hash
+	path   string
+	run    *runState
+	err    error
+}
+
+func (r *savingReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if r.err == nil && n > 0 {
+		r.h.Write(p[:n])
+		_, r.err = r.f.Write(p[:n])
+	}
+	if errors.Is(err, io.EOF) && r.err == nil && r.f != nil {
+		if fmt.Sprintf("%x", r.h.Sum(nil)) == r.digest.Hex {
+			r.err = r.run.complete(r.f, r.path, func() { r.run.Blobs = append(r.run.Blobs, r.digest.String()) })
+		} else {
+			r.err = fmt.Errorf("digest mismatch")
+		}
+		if r.err != nil {
+			logf("Warning: -resume: not saving blob %s: %v", r.digest, r.err)
+		}
+		r.f = nil
+	}
+	return n, err
+}
+
+func (r *savingReader) Close() error {
+	if r.f != nil {
+		// Read only in part.
+		r.f.Close()
+		os.Remove(r.f.Name())
+	}
+	return r.rc.Close()
+}
+
+// squashedLayer returns the compressed layer of the saved squashed rootfs,
+// compressing it into the run state unless an earlier run already has.
+func (r *runState) squashedLayer() (v1.Layer, error) {
+	open := func() (io.ReadCloser, error) { return os.Open(r.rootfsPath()) }
+	if l := r.Layer; l != nil {
+		logf("Reusing the compressed layer saved by an earlier run")
+		return &digestedLayer{uncompressed: open, compressedPath: r.layerPath(), digest: l.Digest, diffID: l.DiffID, size: l.Size, mediaType: l.MediaType}, nil
+	}
+	f, err := os.Create(r.layerPath() + ".partial")
+	if err != nil {
+		return nil, err
+	}
+	l, err := compressLayer(open, f, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	err = r.complete(f, r.layerPath(), func() {
+		r.Layer = &runLayer{Size: l.size, Digest: l.digest, DiffID: l.diffID, MediaType: l.mediaType}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("save compressed layer for -resume: %w", err)
+	}
+	l.compressedPath = r.layerPath()
+	return l, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// reusableLayer returns the source image's layer if it has exactly one, and
+// no flags require reading or changing its content. Squashing such an image
+// would produce the same filesystem, so the layer can be reused as-is.
+func reusableLayer(img v1.Image) (v1.Layer, bool) {
+	if len(runCmds) > 0 || *profile != "" || *layerMapFile != "" || *previous != "" || *keepForeignLayers || *scanner != "" || *licensesOutput != "" || *reportPackages || *canonicalTar || *numericOwner || len(filterFlags) > 0 || *optimizeFlag != "" || *targetSize != "" || *reproducible || len(enforceOwnerFlags) > 0 || newPolicyVisitor() != nil || auditsPermissions() {
+		return nil, false
+	}
+	layers, err := img.Layers()
+	if err != nil || len(layers) != 1 {
+		return nil, false
+	}
+	return layers[0], true
+}
+
+// reuseLayer returns an image containing just layer, along with its DiffID.
+// The layer's compressed blob is copied as-is unless -recompress or
+// -compressor is set, or it's zstd-compressed and -media-types=docker asks
+// for Docker media types, which have no zstd layer type.
+func reuseLayer(layer v1.Layer) (v1.Image, []v1.Hash, error) {
+	mt, err := layer.MediaType()
+	if err != nil {
+		return nil, nil, fmt.Errorf("get layer media type: %w", err)
+	}
+	zstdToDocker := mt == types.OCILayerZStd && *mediaTypes == "docker"
+	if *recompress || zstdToDocker || *compressorFlag != "gzip" {
+		if zstdToDocker {
+			logf("Recompressing the zstd layer with gzip for -media-types=docker")
+		}
+		layer, err = digestLayer(layer.Uncompressed)
+		if err != nil {
+			return nil, nil, fmt.Errorf("recompress layer: %w", err)
+		}
+	}
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return nil, nil, fmt.Errorf("get layer digest: %w", err)
+	}
+	flat, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("append layer to empty image: %w", err)
+	}
+	return flat, []v1.Hash{diffID}, nil
+}
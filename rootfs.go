@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// unpackedRootfs is a flattened rootfs extracted to a local directory, so
+// that it can be modified in place and then re-packed.
+type unpackedRootfs struct {
+	// Dir is the directory containing the rootfs.
+	Dir string
+
+	// headers holds the original tar header of each unpacked path, so that
+	// metadata which can't be represented on the local filesystem
+	// (ownership when not running as root, xattrs) survives a round trip.
+	headers map[string]*tar.Header
+	// devices holds device node headers, which are never created on disk
+	// and are instead re-emitted as-is when packing.
+	devices []*tar.Header
+}
+
+// unpackRootfs extracts the rootfs tarball r into dir, which must exist
+// and be empty.
+func unpackRootfs(r io.Reader, dir string) (*unpackedRootfs, error) {
+	u := &unpackedRootfs{Dir: dir, headers: map[string]*tar.Header{}}
+	canChown := os.Geteuid() == 0
+	var dirs []*tar.Header
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rel := cleanTarPath(hdr.Name)
+		if rel == "" {
+			continue
+		}
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := checkNoSymlinkParents(dir, rel); err != nil {
+			return nil, err
+		}
+		u.headers[rel] = hdr
+
+		// Replace whatever is already there, unless both are directories.
+		if fi, err := os.Lstat(p); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(p); err != nil {
+				return nil, err
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// Keep directories writable until everything is unpacked; the
+			// real mode is applied at the end.
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return nil, err
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, p); err != nil {
+				return nil, err
+			}
+		case tar.TypeLink:
+			target, err := hardlinkTarget(dir, hdr)
+			if err != nil {
+				return nil, err
+			}
+			if err := os.Link(target, p); err != nil {
+				return nil, err
+			}
+			// The link shares the target's inode, whose owner, mode and
+			// times are already those of the target's entry.
+			continue
+		case tar.TypeFifo:
+			if err := mkfifo(p, uint32(hdr.Mode&0777)); err != nil {
+				return nil, err
+			}
+		case tar.TypeChar, tar.TypeBlock:
+			u.devices = append(u.devices, hdr)
+			continue
+		default:
+			logf("Warning: skipping unsupported tar entry %q (type %q)", hdr.Name, hdr.Typeflag)
+			continue
+		}
+
+		if canChown {
+			if err := os.Lchown(p, hdr.Uid, hdr.Gid); err != nil {
+				return nil, err
+			}
+		}
+		if hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeDir {
+			if err := os.Chmod(p, hdr.FileInfo().Mode()); err != nil {
+				return nil, err
+			}
+			if err := os.Chtimes(p, hdr.ModTime, hdr.ModTime); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Apply directory modes and times deepest-first, so that restricting
+	// a parent's permissions doesn't prevent updating its children.
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name > dirs[j].Name })
+	for _, hdr := range dirs {
+		p := filepath.Join(dir, filepath.FromSlash(cleanTarPath(hdr.Name)))
+		if err := os.Chmod(p, hdr.FileInfo().Mode()); err != nil {
+			return nil, err
+		}
+		if err := os.Chtimes(p, hdr.ModTime, hdr.ModTime); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// hardlinkTarget returns the path in dir of the target of the hardlink
+// entry hdr, or an error if it isn't an existing non-directory in dir. Like
+// entry paths, the target mustn't have a symlink parent, through which the
+// link could share, and then get chowned or chmodded as, a file outside dir.
+func hardlinkTarget(dir string, hdr *tar.Header) (string, error) {
+	rel := cleanTarPath(hdr.Linkname)
+	if rel == "" {
+		return "", fmt.Errorf("refusing to unpack hardlink %q to %q, which is the root", hdr.Name, hdr.Linkname)
+	}
+	if err := checkNoSymlinkParents(dir, rel); err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, filepath.FromSlash(rel))
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return "", fmt.Errorf("unpack hardlink %q: %w", hdr.Name, err)
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("refusing to unpack hardlink %q to directory %q", hdr.Name, hdr.Linkname)
+	}
+	return target, nil
+}
+
+// checkNoSymlinkParents returns an error if any parent directory of rel
+// within dir is a symlink, which could otherwise be used to write outside
+// of dir.
+func checkNoSymlinkParents(dir, rel string) error {
+	parts := strings.Split(rel, "/")
+	p := dir
+	for _, part := range parts[:len(parts)-1] {
+		p = filepath.Join(p, part)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to unpack %q: parent %q is a symlink", rel, strings.TrimPrefix(p, dir))
+		}
+	}
+	return nil
+}
+
+// pack writes the (possibly modified) rootfs to w as a tarball.
+func (u *unpackedRootfs) pack(w io.Writer) error {
+	fromFS := os.Geteuid() == 0
+	seen := map[inode]string{}
+
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(u.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == u.Dir {
+			return nil
+		}
+		rel := filepath.ToSlash(strings.TrimPrefix(p, u.Dir+string(filepath.Separator)))
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		var link string
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		// Host user and group names are meaningless inside the image.
+		hdr.Uname, hdr.Gname = "", ""
+
+		orig := u.headers[rel]
+		if orig != nil && orig.Typeflag == hdr.Typeflag {
+			hdr.PAXRecords = orig.PAXRecords
+		}
+		if !fromFS {
+			// Without root we couldn't chown on unpack, so take ownership
+			// from the original entry (or root, for new files).
+			hdr.Uid, hdr.Gid = 0, 0
+			if orig != nil {
+				hdr.Uid, hdr.Gid = orig.Uid, orig.Gid
+			}
+		}
+		if orig != nil && orig.Uid == hdr.Uid && orig.Gid == hdr.Gid {
+			hdr.Uname, hdr.Gname = orig.Uname, orig.Gname
+		}
+
+		if key, ok := hardlinkInode(fi); ok && fi.Mode().IsRegular() {
+			if first, ok := seen[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+				return tw.WriteHeader(hdr)
+			}
+			seen[key] = rel
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, hdr := range u.devices {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
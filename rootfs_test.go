@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnpackRootfsHardlinkThroughSymlink(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "shadow")
+	if err := os.WriteFile(outside, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, hdr := range []*tar.Header{
+		{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: filepath.Dir(outside), Mode: 0777},
+		// Would make the host's file world-writable, through the link.
+		{Name: "shadow", Typeflag: tar.TypeLink, Linkname: "evil/shadow", Mode: 0666},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := unpackRootfs(&b, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Fatalf("unpackRootfs = %v, want a symlink parent error", err)
+	}
+	fi, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode of the file outside the rootfs changed to %v", fi.Mode().Perm())
+	}
+}
+
+func TestUnpackRootfsHardlink(t *testing.T) {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, f := range []struct {
+		hdr  *tar.Header
+		body string
+	}{
+		{&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "bin/python3.12", Typeflag: tar.TypeReg, Mode: 0755, Size: 6}, "python"},
+		// A link entry's own mode is ignored: it's the target's inode.
+		{&tar.Header{Name: "bin/python3", Typeflag: tar.TypeLink, Linkname: "bin/python3.12", Mode: 0600}, ""},
+	} {
+		if err := tw.WriteHeader(f.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if _, err := unpackRootfs(&b, dir); err != nil {
+		t.Fatal(err)
+	}
+	target, err := os.Stat(filepath.Join(dir, "bin", "python3.12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Stat(filepath.Join(dir, "bin", "python3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(target, link) || target.Mode().Perm() != 0755 {
+		t.Errorf("got link %v and target %v, want the same file with mode 0755", link.Mode(), target.Mode())
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// severities are vulnerability severities in increasing order.
+var severities = []string{"UNKNOWN", "NEGLIGIBLE", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+func severityRank(s string) int {
+	return slices.Index(severities, strings.ToUpper(s))
+}
+
+// vulnerability is a single scanner finding.
+type vulnerability struct {
+	ID       string
+	Package  string
+	Severity string
+}
+
+// scanRootfs runs the scanner selected with -scan over the unpacked rootfs
+// in dir, writing the scanner's JSON report to reportPath, and returns the
+// findings.
+func scanRootfs(dir, reportPath string) ([]vulnerability, error) {
+	var cmd *exec.Cmd
+	switch *scanner {
+	case "trivy":
+		cmd = exec.Command("trivy", "rootfs", "--quiet", "--format", "json", "--output", reportPath, dir)
+	case "grype":
+		cmd = exec.Command("grype", "dir:"+dir, "--quiet", "--output", "json", "--file", reportPath)
+	default:
+		return nil, fmt.Errorf("unknown scanner %q", *scanner)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("run %s: %w", *scanner, err)
+	}
+	b, err := os.ReadFile(reportPath)
+	if err != nil {
+		return nil, fmt.Errorf("read scan report: %w", err)
+	}
+	return parseScanReport(*scanner, b)
+}
+
+func parseScanReport(scanner string, b []byte) ([]vulnerability, error) {
+	var vulns []vulnerability
+	switch scanner {
+	case "trivy":
+		var report struct {
+			Results []struct {
+				Vulnerabilities []struct {
+					VulnerabilityID string
+					PkgName         string
+					Severity        string
+				}
+			}
+		}
+		if err := json.Unmarshal(b, &report); err != nil {
+			return nil, fmt.Errorf("parse trivy report: %w", err)
+		}
+		for _, r := range report.Results {
+			for _, v := range r.Vulnerabilities {
+				vulns = append(vulns, vulnerability{ID: v.VulnerabilityID, Package: v.PkgName, Severity: v.Severity})
+			}
+		}
+	case "grype":
+		var report struct {
+			Matches []struct {
+				Vulnerability struct {
+					ID       string `json:"id"`
+					Severity string `json:"severity"`
+				} `json:"vulnerability"`
+				Artifact struct {
+					Name string `json:"name"`
+				} `json:"artifact"`
+			} `json:"matches"`
+		}
+		if err := json.Unmarshal(b, &report); err != nil {
+			return nil, fmt.Errorf("parse grype report: %w", err)
+		}
+		for _, m := range report.Matches {
+			vulns = append(vulns, vulnerability{ID: m.Vulnerability.ID, Package: m.Artifact.Name, Severity: m.Vulnerability.Severity})
+		}
+	}
+	return vulns, nil
+}
+
+// scanReportPath returns where to write the scan report: the -scan-report
+// flag if set, otherwise next to a local DEST.
+func scanReportPath(outputPath string) string {
+	if *scanReport != "" {
+		return *scanReport
+	}
+	if isRegistryDest(outputPath) {
+		return "docker-squash-scan.json"
+	}
+	return outputPath + ".scan.json"
+}
+
+// scanLayers unpacks the given squashed layer tarballs into a temp dir,
+// scans them, and returns an error if any vulnerability is at or above
+// the -severity-threshold.
+func scanLayers(layerPaths []string, outputPath string) error {
+	return scanUnpacked(outputPath, func(dir string) error {
+		for _, p := range layerPaths {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			_, err = unpackRootfs(f, dir)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scanImage is like scanLayers, but scans the rootfs of img, for cached
+// results: the vulnerability database may have changed since img was
+// squashed.
+func scanImage(img v1.Image, outputPath string) error {
+	return scanUnpacked(outputPath, func(dir string) error {
+		rc := extractImage(img)
+		defer rc.Close()
+		_, err := unpackRootfs(rc, dir)
+		return err
+	})
+}
+
+// scanUnpacked scans the rootfs that unpack unpacks into a temp dir.
+func scanUnpacked(outputPath string, unpack func(dir string) error) error {
+	dir, err := mkdirTemp("docker-squash-scan-*")
+	if err != nil {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	logf("Unpacking squashed rootfs to %q for scanning", dir)
+	if err := unpack(dir); err != nil {
+		return fmt.Errorf("unpack rootfs: %w", err)
+	}
+
+	reportPath := scanReportPath(outputPath)
+	logf("Scanning squashed rootfs with %s", *scanner)
+	vulns, err := scanRootfs(dir, reportPath)
+	if err != nil {
+		return err
+	}
+	threshold := severityRank(*severityThreshold)
+	var failing []vulnerability
+	for _, v := range vulns {
+		if severityRank(v.Severity) >= threshold {
+			failing = append(failing, v)
+		}
+	}
+	logf("Scan found %d vulnerabilities (%d at or above %s); report written to %q", len(vulns), len(failing), strings.ToUpper(*severityThreshold), reportPath)
+	if len(failing) > 0 {
+		for _, v := range failing {
+			logf("  %s %s (%s)", v.Severity, v.ID, v.Package)
+		}
+		return withExitCode(exitVerification, fmt.Errorf("scan found %d vulnerabilities with severity %s or higher (see %q)", len(failing), strings.ToUpper(*severityThreshold), reportPath))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// schema1Manifest is a Docker Image Manifest V2, Schema 1. Both lists are
+// ordered from the top layer down.
+type schema1Manifest struct {
+	FSLayers []struct {
+		BlobSum v1.Hash `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// schema1Compat is the part of a schema1 v1Compatibility entry we need.
+type schema1Compat struct {
+	// Throwaway marks history entries (like ENV instructions) whose
+	// layer is empty.
+	Throwaway bool `json:"throwaway"`
+}
+
+// schema1Image adapts a legacy schema1 image, which has no config blob or
+// schema2-style manifest, to what squashing needs: its layers, and a config
+// converted from the topmost v1Compatibility entry. Everything else is
+// delegated to ggcr's schema1 image.
+type schema1Image struct {
+	v1.Image
+	layers []v1.Layer
+	config *v1.ConfigFile
+
+	manifestOnce sync.Once
+	manifest     *v1.Manifest
+	manifestErr  error
+}
+
+// convertSchema1 converts the schema1 image described by desc.
+func convertSchema1(desc *remote.Descriptor) (v1.Image, error) {
+	var m schema1Manifest
+	if err := json.Unmarshal(desc.Manifest, &m); err != nil {
+		return nil, fmt.Errorf("parse schema1 manifest: %w", err)
+	}
+	if len(m.FSLayers) == 0 || len(m.FSLayers) != len(m.History) {
+		return nil, fmt.Errorf("invalid schema1 manifest: %d layers but %d history entries", len(m.FSLayers), len(m.History))
+	}
+	img, err := desc.Schema1()
+	if err != nil {
+		return nil, err
+	}
+	s := &schema1Image{Image: img, config: &v1.ConfigFile{}}
+	if err := json.Unmarshal([]byte(m.History[0].V1Compatibility), s.config); err != nil {
+		return nil, fmt.Errorf("parse schema1 image config: %w", err)
+	}
+	s.config.RootFS.Type = "layers"
+	for i := len(m.FSLayers) - 1; i >= 0; i-- {
+		var compat schema1Compat
+		if err := json.Unmarshal([]byte(m.History[i].V1Compatibility), &compat); err != nil {
+			return nil, fmt.Errorf("parse schema1 history: %w", err)
+		}
+		if compat.Throwaway {
+			continue
+		}
+		layer, err := img.LayerByDigest(m.FSLayers[i].BlobSum)
+		if err != nil {
+			return nil, err
+		}
+		s.layers = append(s.layers, layer)
+	}
+	logf("Converting legacy schema1 manifest (%d layers)", len(s.layers))
+	return s, nil
+}
+
+func (s *schema1Image) Layers() ([]v1.Layer, error) { return s.layers, nil }
+
+func (s *schema1Image) ConfigFile() (*v1.ConfigFile, error) { return s.config, nil }
+
+func (s *schema1Image) RawConfigFile() ([]byte, error) { return json.Marshal(s.config) }
+
+// Manifest returns a schema2-style manifest with the image's layers. Their
+// sizes aren't in the schema1 manifest, so are fetched from the registry.
+func (s *schema1Image) Manifest() (*v1.Manifest, error) {
+	s.manifestOnce.Do(func() { s.manifest, s.manifestErr = s.computeManifest() })
+	return s.manifest, s.manifestErr
+}
+
+func (s *schema1Image) computeManifest() (*v1.Manifest, error) {
+	m := &v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.DockerManifestSchema2,
+		Config:        v1.Descriptor{MediaType: types.DockerConfigJSON},
+	}
+	for _, layer := range s.layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+		m.Layers = append(m.Layers, v1.Descriptor{MediaType: types.DockerLayer, Digest: digest, Size: size})
+	}
+	return m, nil
+}
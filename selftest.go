@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bduffany/docker-squash/pkg/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// selftestFlags returns the flags of the selftest subcommand, and its -v.
+func selftestFlags() (*flag.FlagSet, *bool) {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	return flags, flags.Bool("v", false, "Show the output of each squash")
+}
+
+// selftestMain implements the selftest subcommand. It pushes an image with
+// the cases squashing has to get right (see testutil.SampleLayers) to an
+// in-process registry, squashes it with this binary to the registry twice
+// and to a tarball under the temp directory, with -reproducible, and checks
+// each result against the filesystem its layers describe, and the results
+// against each other.
+func selftestMain(args []string) error {
+	flags, verbose := selftestFlags()
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s selftest [-v]", os.Args[0]))
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("find this binary: %w", err)
+	}
+	defer removeTemps()
+	dir, err := mkdirTemp("docker-squash-selftest-*")
+	if err != nil {
+		return fmt.Errorf("create temp directory: %w", err)
+	}
+
+	reg, err := testutil.StartRegistry()
+	if err != nil {
+		return fmt.Errorf("start registry: %w", err)
+	}
+	defer reg.Close()
+	layers := testutil.SampleLayers()
+	img, err := testutil.Image(layers...)
+	if err != nil {
+		return fmt.Errorf("synthesize source image: %w", err)
+	}
+	src, err := reg.Push("selftest:source", img)
+	if err != nil {
+		return err
+	}
+
+	squash := func(dest string) error {
+		// Caching would skip the squash being tested, and -reproducible is
+		// what promises identical outputs.
+		cmd := exec.Command(exe, "-cache-dir=", "-reproducible", "docker://"+src.String(), dest)
+		var out bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &out, &out
+		if *verbose {
+			cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		}
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("squash to %s: %w\n%s", dest, err, out.String())
+		}
+		return nil
+	}
+	outputs := map[string]v1.Image{}
+	for _, repo := range []string{"selftest:squashed", "selftest:again"} {
+		if err := squash("docker://" + reg.Host + "/" + repo); err != nil {
+			return err
+		}
+		if outputs[repo], err = reg.Pull(repo); err != nil {
+			return err
+		}
+	}
+	tarPath := filepath.Join(dir, "squashed.tar")
+	if err := squash(tarPath); err != nil {
+		return err
+	}
+	if outputs["tarball"], err = tarball.ImageFromPath(tarPath, nil); err != nil {
+		return fmt.Errorf("read %s: %w", tarPath, err)
+	}
+
+	want := testutil.Flatten(layers...)
+	failed := 0
+	check := func(name string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			return
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+	for _, out := range []string{"selftest:squashed", "tarball"} {
+		img := outputs[out]
+		check(out+": one layer", checkOneLayer(img))
+		check(out+": filesystem", testutil.CheckSquashed(img, want))
+		check(out+": hardlinks", checkHardlinks(img, "app/hard", "app/main.py"))
+	}
+	check("registry squashes are identical", sameDigest(outputs["selftest:squashed"], outputs["selftest:again"], v1.Image.Digest))
+	check("tarball and registry image IDs are identical", sameDigest(outputs["selftest:squashed"], outputs["tarball"], v1.Image.ConfigName))
+	if failed > 0 {
+		return withExitCode(exitVerification, fmt.Errorf("%d self-test checks failed", failed))
+	}
+	return nil
+}
+
+func checkOneLayer(img v1.Image) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	if len(layers) != 1 {
+		return fmt.Errorf("%d layers", len(layers))
+	}
+	return nil
+}
+
+// checkHardlinks checks that the paths, which are hardlinked in the source,
+// are still one file in the squashed layer of img.
+func checkHardlinks(img v1.Image, paths ...string) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	rc, err := layers[len(layers)-1].Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	linked := map[string]string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.Trim(path.Clean("/"+hdr.Name), "/")
+		if hdr.Typeflag == tar.TypeLink {
+			linked[name] = strings.Trim(path.Clean("/"+hdr.Linkname), "/")
+		}
+	}
+	// One of the paths is stored as the file, and the others link to it.
+	var files []string
+	for _, p := range paths {
+		if _, ok := linked[p]; !ok {
+			files = append(files, p)
+		}
+	}
+	if len(files) != 1 {
+		return fmt.Errorf("%s are stored as %d files, want 1", strings.Join(paths, " and "), len(files))
+	}
+	for _, p := range paths {
+		if target, ok := linked[p]; ok && target != files[0] {
+			return fmt.Errorf("%s links to %s, want %s", p, target, files[0])
+		}
+	}
+	return nil
+}
+
+// sameDigest checks that digest is the same for a and b.
+func sameDigest(a, b v1.Image, digest func(v1.Image) (v1.Hash, error)) error {
+	da, err := digest(a)
+	if err != nil {
+		return err
+	}
+	db, err := digest(b)
+	if err != nil {
+		return err
+	}
+	if da != db {
+		return fmt.Errorf("%s != %s", da, db)
+	}
+	return nil
+}
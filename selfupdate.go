@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// defaultReleasesURL is the GitHub API endpoint of the docker-squash
+// releases.
+const defaultReleasesURL = "https://api.github.com/repos/bduffany/docker-squash/releases"
+
+// Release assets, besides the binaries named by releaseBinaryName:
+// checksums.txt lists the SHA-256 of each, as sha256sum prints them, and is
+// signed by the release workflow, keylessly with the bundle or with a key
+// with the signature.
+const (
+	checksumsAsset       = "checksums.txt"
+	checksumsBundleAsset = "checksums.txt.sigstore.json"
+	checksumsSigAsset    = "checksums.txt.sig"
+)
+
+// releaseIdentity and releaseIssuer are the keyless signing identity of
+// the release workflow, for 'cosign verify-blob'.
+const (
+	releaseIdentity = `^https://github\.com/bduffany/docker-squash/\.github/workflows/`
+	releaseIssuer   = "https://token.actions.githubusercontent.com"
+)
+
+// release is a GitHub release, as the API describes it.
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// asset returns the URL of the asset called name.
+func (r *release) asset(name string) (string, error) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, nil
+		}
+	}
+	return "", fmt.Errorf("release %s has no %s", r.TagName, name)
+}
+
+// releaseBinaryName is the name of the release binary for this platform,
+// like "docker-squash-linux-amd64".
+func releaseBinaryName() string {
+	name := "docker-squash-" + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// selfUpdateOptions are the flags of the self-update subcommand.
+type selfUpdateOptions struct {
+	tag, key, releasesURL       *string
+	skipSignature, check, force *bool
+}
+
+// selfUpdateFlags returns the flags of the self-update subcommand.
+func selfUpdateFlags() (*flag.FlagSet, selfUpdateOptions) {
+	flags := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	return flags, selfUpdateOptions{
+		tag:           flags.String("version", "", "Release to install, like v1.2.3 (default the latest)"),
+		key:           flags.String("key", "", "Verify checksums.txt.sig with this cosign public key, instead of the release workflow's keyless signature"),
+		skipSignature: flags.Bool("skip-signature", false, "Only check the binary against checksums.txt, without verifying its signature, for when cosign isn't installed"),
+		check:         flags.Bool("check", false, "Only report whether a newer release is available"),
+		force:         flags.Bool("force", false, "Install the release even if it isn't newer than the running version"),
+		releasesURL:   flags.String("releases", defaultReleasesURL, "GitHub API URL of the releases, for mirrors"),
+	}
+}
+
+// selfUpdateMain implements the self-update subcommand, which replaces the
+// running executable with the release binary for this platform, once its
+// checksum matches the release's checksums.txt and that file's signature
+// is verified with cosign.
+func selfUpdateMain(args []string) error {
+	flags, opts := selfUpdateFlags()
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s self-update [-version TAG] [-key KEY] [-check]", os.Args[0]))
+	}
+	defer removeTemps()
+
+	rel, err := fetchRelease(*opts.releasesURL, *opts.tag)
+	if err != nil {
+		return err
+	}
+	if !semver.IsValid(rel.TagName) {
+		return fmt.Errorf("release %s isn't tagged with a semantic version", rel.TagName)
+	}
+	// A "devel" build, say, isn't comparable, so every release is newer.
+	current := currentBuildInfo().Version
+	if semver.IsValid(current) && !*opts.force {
+		switch c := semver.Compare(rel.TagName, current); {
+		case c == 0:
+			logf("docker-squash %s is up to date", current)
+			return nil
+		case c < 0 && *opts.tag == "":
+			// Only a -version given explicitly downgrades.
+			logf("docker-squash %s is newer than the latest release, %s", current, rel.TagName)
+			return nil
+		}
+	}
+	if *opts.check {
+		logf("docker-squash %s is available (running %s)", rel.TagName, current)
+		return nil
+	}
+	binaryURL, err := rel.asset(releaseBinaryName())
+	if err != nil {
+		return err
+	}
+	want, err := verifiedChecksum(rel, *opts.key, *opts.skipSignature)
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return fmt.Errorf("find the running executable: %w", err)
+	}
+	// Download next to the executable, so that it can be renamed into
+	// place.
+	f, err := os.CreateTemp(filepath.Dir(exe), ".docker-squash-update-*")
+	if err != nil {
+		return fmt.Errorf("create the new executable: %w", err)
+	}
+	defer os.Remove(f.Name())
+	logf("Downloading %s", binaryURL)
+	h := sha256.New()
+	err = download(binaryURL, io.MultiWriter(f, h))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return withExitCode(exitVerification, fmt.Errorf("%s has SHA-256 %s, but checksums.txt says %s", releaseBinaryName(), got, want))
+	}
+	if err := os.Chmod(f.Name(), 0755); err != nil {
+		return err
+	}
+	if err := replaceExecutable(exe, f.Name()); err != nil {
+		return fmt.Errorf("replace %s: %w", exe, err)
+	}
+	logf("Updated %s to docker-squash %s", exe, rel.TagName)
+	return nil
+}
+
+// fetchRelease fetches the release tag, or the latest one, from the
+// releases API base.
+func fetchRelease(base, tag string) (*release, error) {
+	u := strings.TrimSuffix(base, "/") + "/latest"
+	if tag != "" {
+		u = strings.TrimSuffix(base, "/") + "/tags/" + url.PathEscape(tag)
+	}
+	var b bytes.Buffer
+	if err := download(u, &b); err != nil {
+		return nil, err
+	}
+	var rel release
+	if err := json.Unmarshal(b.Bytes(), &rel); err != nil {
+		return nil, fmt.Errorf("parse release %s: %w", u, err)
+	}
+	return &rel, nil
+}
+
+// verifiedChecksum returns the SHA-256 of this platform's binary in rel's
+// checksums.txt, once its signature is verified (unless skipSignature).
+func verifiedChecksum(rel *release, key string, skipSignature bool) (string, error) {
+	dir, err := mkdirTemp("docker-squash-self-update-*")
+	if err != nil {
+		return "", err
+	}
+	checksums := filepath.Join(dir, checksumsAsset)
+	if err := downloadAsset(rel, checksumsAsset, checksums); err != nil {
+		return "", err
+	}
+	if skipSignature {
+		logf("Warning: not verifying the signature of %s's checksums.txt (-skip-signature)", rel.TagName)
+	} else if err := verifyChecksumsSignature(rel, dir, checksums, key); err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(checksums)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// sha256sum lines are "HASH  NAME", or "HASH *NAME" in binary mode.
+		sum, name, ok := strings.Cut(s.Text(), " ")
+		if ok && strings.TrimLeft(name, " *") == releaseBinaryName() {
+			return strings.ToLower(sum), nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", withExitCode(exitVerification, fmt.Errorf("checksums.txt of %s has no entry for %s", rel.TagName, releaseBinaryName()))
+}
+
+// verifyChecksumsSignature verifies the signature of the checksums file
+// of rel, with 'cosign verify-blob', downloading it or its bundle to dir.
+func verifyChecksumsSignature(rel *release, dir, checksums, key string) error {
+	if _, err := exec.LookPath("cosign"); err != nil {
+		return fmt.Errorf("verifying the release signature requires cosign, which isn't installed (-skip-signature only checks the checksum): %w", err)
+	}
+	var cmd *exec.Cmd
+	if key != "" {
+		sig := filepath.Join(dir, checksumsSigAsset)
+		if err := downloadAsset(rel, checksumsSigAsset, sig); err != nil {
+			return err
+		}
+		cmd = exec.Command("cosign", "verify-blob", "--key", key, "--signature", sig, checksums)
+	} else {
+		bundle := filepath.Join(dir, checksumsBundleAsset)
+		if err := downloadAsset(rel, checksumsBundleAsset, bundle); err != nil {
+			return err
+		}
+		cmd = exec.Command("cosign", "verify-blob", "--bundle", bundle,
+			"--certificate-identity-regexp", releaseIdentity, "--certificate-oidc-issuer", releaseIssuer, checksums)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return withExitCode(exitVerification, fmt.Errorf("verify the signature of %s's checksums.txt: %s", rel.TagName, strings.TrimSpace(stderr.String())))
+	}
+	logf("Verified the signature of %s's checksums.txt", rel.TagName)
+	return nil
+}
+
+// downloadAsset downloads the asset called name of rel to path.
+func downloadAsset(rel *release, name, path string) error {
+	u, err := rel.asset(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := download(u, f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// download writes the body of a GET of u to w. Requests to the GitHub API
+// are authenticated with $GITHUB_TOKEN or $GH_TOKEN, if set, for its higher
+// rate limit on shared CI runners.
+func download(u string, w io.Writer) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if req.URL.Host == "api.github.com" {
+		req.Header.Set("Accept", "application/vnd.github+json")
+		token := os.Getenv("GITHUB_TOKEN")
+		if token == "" {
+			token = os.Getenv("GH_TOKEN")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return withExitCode(exitNetwork, fmt.Errorf("download %s: %w", u, err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return withExitCode(exitSourceNotFound, fmt.Errorf("download %s: %s", u, resp.Status))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", u, resp.Status)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return withExitCode(exitNetwork, fmt.Errorf("download %s: %w", u, err))
+	}
+	return nil
+}
+
+// replaceExecutable renames the file at tmp over the executable exe. A
+// running executable can't be replaced on Windows, but it can be renamed,
+// so it's moved aside to exe+".old" first, and removed on the next update.
+func replaceExecutable(exe, tmp string) error {
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, exe); err != nil {
+			os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(tmp, exe)
+}
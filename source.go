@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// isRegistrySource returns whether the SOURCE argument refers to a remote
+// registry rather than a local tarball path.
+func isRegistrySource(inputPath string) bool {
+	return strings.HasPrefix(inputPath, "docker://")
+}
+
+// source is an opened SOURCE image.
+type source struct {
+	Image v1.Image
+	// Refs are the source image's references, if known: the parsed ref for
+	// registry sources, or the tarball's RepoTags for local tarballs.
+	Refs []name.Reference
+	// IndexAnnotations are the annotations of the image index that the
+	// image was selected from, if any.
+	IndexAnnotations map[string]string
+	// Index is the image index that Image was selected from, if any.
+	Index v1.ImageIndex
+	// Uncompressed is set if the image's layers are stored uncompressed, as
+	// in classic docker-save tarballs, so reading their compressed blobs
+	// means compressing them.
+	Uncompressed bool
+	// Registry is set if the image is pulled from a registry.
+	Registry bool
+}
+
+// openSource opens the image referred to by the SOURCE argument.
+func openSource(inputPath string) (*source, error) {
+	if isRegistrySource(inputPath) {
+		ref, err := parseDockerRef(strings.TrimPrefix(inputPath, "docker://"))
+		if err != nil {
+			return nil, fmt.Errorf("parse input reference: %w", err)
+		}
+		reqs, err := checkRegistryTrust(ref)
+		if err != nil {
+			return nil, err
+		}
+		opts := []remote.Option{remote.WithAuthFromKeychain(keychain), remote.WithTransport(pullTransport)}
+		if sourcePlatform != nil {
+			opts = append(opts, remote.WithPlatform(*sourcePlatform))
+		}
+		desc, err := remote.Get(ref, opts...)
+		if err != nil {
+			err = fmt.Errorf("pull image %q: %w", ref, err)
+			if isNotFound(err) {
+				err = withExitCode(exitSourceNotFound, err)
+			}
+			return nil, err
+		}
+		if err := verifyTrust(reqs, ref, desc.Digest); err != nil {
+			return nil, err
+		}
+		if isDockerHub(ref.Context().RegistryStr()) {
+			logHubQuota()
+		}
+		src := &source{Refs: []name.Reference{ref}, Registry: true}
+		if desc.MediaType.IsIndex() {
+			idx, err := desc.ImageIndex()
+			if err != nil {
+				return nil, fmt.Errorf("pull image index %q: %w", ref, err)
+			}
+			m, err := idx.IndexManifest()
+			if err != nil {
+				return nil, fmt.Errorf("pull image index %q: %w", ref, err)
+			}
+			src.IndexAnnotations = m.Annotations
+			src.Index = idx
+		}
+		if desc.MediaType == types.DockerManifestSchema1 || desc.MediaType == types.DockerManifestSchema1Signed {
+			src.Image, err = convertSchema1(desc)
+			if err != nil {
+				return nil, fmt.Errorf("pull image %q: %w", ref, err)
+			}
+			return src, nil
+		}
+		// This resolves the -platform (or default) image if the ref is an
+		// index.
+		src.Image, err = desc.Image()
+		if err != nil {
+			return nil, fmt.Errorf("pull image %q: %w", ref, err)
+		}
+		return src, nil
+	}
+
+	if isLayoutSource(inputPath) {
+		if err := checkLocalTrust("oci", inputPath); err != nil {
+			return nil, err
+		}
+		return openLayoutSource(inputPath)
+	}
+	idx, err := indexTarball(inputPath)
+	if err == nil && isOCIArchive(idx) {
+		if err := checkLocalTrust("oci-archive", inputPath); err != nil {
+			return nil, err
+		}
+		return openOCIArchive(inputPath, idx)
+	}
+	if err == nil {
+		if err := checkLocalTrust("docker-archive", inputPath); err != nil {
+			return nil, err
+		}
+	}
+	var img v1.Image
+	var m tarball.Manifest
+	var uncompressed bool
+	if err == nil {
+		img, m, uncompressed, err = imageFromIndexedTarball(inputPath, idx)
+	}
+	if err != nil {
+		err = fmt.Errorf("read image tarball from %q: %w", inputPath, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = withExitCode(exitSourceNotFound, err)
+		}
+		return nil, err
+	}
+	src := &source{Image: img, Uncompressed: uncompressed}
+	for _, desc := range m {
+		for _, t := range desc.RepoTags {
+			// Ignore unparseable tags; they just won't be available for
+			// templating or -keep-source-tags.
+			if ref, err := name.ParseReference(t); err == nil {
+				src.Refs = append(src.Refs, ref)
+			}
+		}
+	}
+	return src, nil
+}
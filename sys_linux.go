@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioprio_set(2) values: the best-effort class at its lowest level, which
+// unlike the idle class can't starve the process entirely.
+const (
+	ioprioWhoProcess    = 1
+	ioprioClassBE       = 2
+	ioprioClassShift    = 13
+	ioprioLowestLevel   = 7
+	lowPriorityNiceness = 10
+)
+
+// lowerPriority sets the niceness and I/O priority of every thread of the
+// process. On Linux both are per-thread, but threads (and child processes,
+// like -run commands and scanners) inherit them from the thread that
+// creates them, so setting them on the existing threads covers the rest.
+func lowerPriority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, lowPriorityNiceness); err != nil {
+			return fmt.Errorf("set niceness: %w", err)
+		}
+		ioprio := ioprioClassBE<<ioprioClassShift | ioprioLowestLevel
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+			return fmt.Errorf("set I/O priority: %w", errno)
+		}
+	}
+	return nil
+}
+
+// cgroupMemoryLimit returns the memory limit of the process's cgroup, if it
+// has one. Both cgroup v2 (memory.max) and v1 (memory.limit_in_bytes) are
+// supported.
+func cgroupMemoryLimit() (int64, bool) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// hierarchy-ID:controllers:path, like "0::/user.slice" (v2) or
+		// "4:memory:/docker/abc" (v1).
+		parts := strings.SplitN(sc.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		var candidates []string
+		switch {
+		case parts[0] == "0" && parts[1] == "":
+			candidates = []string{
+				filepath.Join("/sys/fs/cgroup", parts[2], "memory.max"),
+				// Inside a cgroup namespace the path may not be mounted.
+				"/sys/fs/cgroup/memory.max",
+			}
+		case slices.Contains(strings.Split(parts[1], ","), "memory"):
+			candidates = []string{
+				filepath.Join("/sys/fs/cgroup/memory", parts[2], "memory.limit_in_bytes"),
+				"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+			}
+		default:
+			continue
+		}
+		for _, p := range candidates {
+			b, err := os.ReadFile(p)
+			if err != nil {
+				continue
+			}
+			// cgroup v2 says "max" when unlimited, and v1 a huge number.
+			n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+			if err != nil || n <= 0 || n >= 1<<62 {
+				return 0, false
+			}
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// preallocate allocates size bytes of disk for f with fallocate(2), which
+// also extends f to size.
+func preallocate(f *os.File, size int64) error {
+	if err := unix.Fallocate(int(f.Fd()), 0, 0, size); err != nil {
+		return fmt.Errorf("fallocate %q: %w", f.Name(), err)
+	}
+	return nil
+}
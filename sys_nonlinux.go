@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func lowerPriority() error {
+	return errors.New("-low-priority is only supported on Linux")
+}
+
+func cgroupMemoryLimit() (int64, bool) {
+	return 0, false
+}
+
+func preallocate(f *os.File, size int64) error {
+	return errors.New("preallocating temp files is only supported on Linux")
+}
@@ -0,0 +1,61 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// inode identifies a file on the local filesystem.
+type inode struct{ dev, ino uint64 }
+
+// hardlinkInode returns the inode of fi if it's a file with multiple hard
+// links.
+func hardlinkInode(fi os.FileInfo) (inode, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink <= 1 {
+		return inode{}, false
+	}
+	return inode{uint64(st.Dev), uint64(st.Ino)}, true
+}
+
+func mkfifo(path string, mode uint32) error {
+	return syscall.Mkfifo(path, mode)
+}
+
+// umask returns the process umask. It can only be read by setting it, so
+// it's briefly zero.
+func umask() os.FileMode {
+	m := syscall.Umask(0)
+	syscall.Umask(m)
+	return os.FileMode(m)
+}
+
+// chrootAttr returns process attributes for running a command chrooted
+// into dir.
+func chrootAttr(dir string) (*syscall.SysProcAttr, error) {
+	return &syscall.SysProcAttr{Chroot: dir}, nil
+}
+
+// tryLockFile takes an exclusive advisory lock on f without blocking,
+// returning errLocked if another process holds it.
+func tryLockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
+
+// lockFile takes an exclusive advisory lock on f, blocking until it's
+// available.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+// shellCommand returns a command running cmd in the shell.
+func shellCommand(cmd string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", cmd)
+}
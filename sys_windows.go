@@ -0,0 +1,46 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+type inode struct{}
+
+func hardlinkInode(fi os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
+
+func mkfifo(path string, mode uint32) error {
+	return errors.New("named pipes are not supported on Windows")
+}
+
+func umask() os.FileMode {
+	return 0
+}
+
+func chrootAttr(dir string) (*syscall.SysProcAttr, error) {
+	return nil, errors.New("chroot is not supported on Windows; use -run-runtime to select an OCI runtime")
+}
+
+func tryLockFile(f *os.File) error {
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &windows.Overlapped{})
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return errLocked
+	}
+	return err
+}
+
+func lockFile(f *os.File) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &windows.Overlapped{})
+}
+
+func shellCommand(cmd string) *exec.Cmd {
+	return exec.Command("cmd.exe", "/C", cmd)
+}
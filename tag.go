@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	// defaultTagTemplate is used for -tag when the source image's
+	// reference is known.
+	defaultTagTemplate = "{{.Repo}}:{{.Tag}}-squashed"
+	// fallbackTagTemplate is used for -tag when the source image has no
+	// known reference, e.g. a tarball without RepoTags.
+	fallbackTagTemplate = "docker-squash-{{.Timestamp}}"
+	// reproducibleFallbackTagTemplate replaces fallbackTagTemplate with
+	// -reproducible, which can't depend on the time.
+	reproducibleFallbackTagTemplate = "docker-squash-{{.ShortDigest}}"
+)
+
+// tagVars are the variables available to the -tag template.
+type tagVars struct {
+	// Repo is the source repository as written in the source reference,
+	// like "gcr.io/my-project/app" or "ubuntu".
+	Repo string
+	// Registry is the source registry host, like "gcr.io".
+	Registry string
+	// Repository is the source repository path without the registry, like
+	// "my-project/app".
+	Repository string
+	// Tag is the source tag, like "v1.2.3". For digest references, it's
+	// the short digest.
+	Tag string
+	// Digest is the source image's manifest digest, like "sha256:abc...".
+	Digest string
+	// ShortDigest is the first 12 hex characters of Digest.
+	ShortDigest string
+	// Timestamp is the current time in nanoseconds since the Unix epoch.
+	Timestamp int64
+}
+
+// parseTagTemplate parses the -tag flag value as a template.
+func parseTagTemplate(text string) (*template.Template, error) {
+	return template.New("tag").Option("missingkey=error").Parse(text)
+}
+
+// resolveTag renders the -tag template (or the default template, if -tag is
+// empty) using variables from the source image, and parses the result into
+// a reference.
+func resolveTag(text string, srcRef name.Reference, img v1.Image) (name.Reference, error) {
+	vars := tagVars{Timestamp: time.Now().UnixNano()}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("get image digest: %w", err)
+	}
+	vars.Digest = digest.String()
+	vars.ShortDigest = digest.Hex[:12]
+	if srcRef != nil {
+		vars.Repo = srcRef.String()
+		vars.Repo = strings.TrimSuffix(vars.Repo, "@"+srcRef.Identifier())
+		vars.Repo = strings.TrimSuffix(vars.Repo, ":"+srcRef.Identifier())
+		vars.Registry = srcRef.Context().RegistryStr()
+		vars.Repository = srcRef.Context().RepositoryStr()
+		switch ref := srcRef.(type) {
+		case name.Tag:
+			vars.Tag = ref.TagStr()
+		case name.Digest:
+			vars.Tag = vars.ShortDigest
+		}
+	}
+
+	if text == "" {
+		switch {
+		case srcRef != nil:
+			text = defaultTagTemplate
+		case *reproducible:
+			text = reproducibleFallbackTagTemplate
+		default:
+			text = fallbackTagTemplate
+		}
+	} else if srcRef == nil && needsSourceRef(text) {
+		return nil, fmt.Errorf("-tag %q uses source reference variables, but the source image has no reference (pass an explicit -tag)", text)
+	}
+	tmpl, err := parseTagTemplate(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse -tag template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return nil, fmt.Errorf("render -tag template: %w", err)
+	}
+	ref, err := name.ParseReference(buf.String())
+	if err != nil {
+		return nil, fmt.Errorf("parse tag %q: %w", buf.String(), err)
+	}
+	return ref, nil
+}
+
+// needsSourceRef returns whether a tag template refers to any variables
+// derived from the source image's reference.
+func needsSourceRef(text string) bool {
+	for _, v := range []string{".Repo", ".Registry", ".Repository", ".Tag"} {
+		if strings.Contains(text, v) {
+			return true
+		}
+	}
+	return false
+}
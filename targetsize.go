@@ -0,0 +1,272 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// parseExcludeRules parses an -exclude-rules file: one glob of rootfs paths
+// per line, like "/opt/models/*.bin", that -auto-exclude-largest may exclude
+// along with everything below them. "#" starts a comment.
+func parseExcludeRules(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		glob := strings.TrimPrefix(path.Clean("/"+line), "/")
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid glob %q: %w", file, n, line, err)
+		}
+		rules = append(rules, glob)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%s: no rules", file)
+	}
+	return rules, nil
+}
+
+// matchesExcludeRule returns whether name, or a directory above it, matches
+// one of rules.
+func matchesExcludeRule(rules []string, name string) bool {
+	for p := name; p != "." && p != ""; p = path.Dir(p) {
+		for _, glob := range rules {
+			if ok, _ := path.Match(glob, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sizeCandidate is a file or directory that could be excluded to meet
+// -target-size, with the total size of the files in it.
+type sizeCandidate struct {
+	name string
+	size int64
+}
+
+// sizeCandidates returns the regular files of fs and the directories below
+// the top level, with their sizes, largest first. Top-level directories
+// like /usr are never worth excluding whole.
+func sizeCandidates(fs *rootfsListing) []sizeCandidate {
+	sizes := map[string]int64{}
+	for _, name := range fs.names {
+		hdr := fs.headers[name]
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			continue
+		}
+		sizes[name] += hdr.Size
+		for dir := path.Dir(name); strings.Contains(dir, "/"); dir = path.Dir(dir) {
+			if fs.isDir(dir) {
+				sizes[dir] += hdr.Size
+			}
+		}
+	}
+	candidates := make([]sizeCandidate, 0, len(sizes))
+	for name, size := range sizes {
+		candidates = append(candidates, sizeCandidate{name, size})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].size != candidates[j].size {
+			return candidates[i].size > candidates[j].size
+		}
+		return candidates[i].name < candidates[j].name
+	})
+	return candidates
+}
+
+// overlapsAny returns whether name is one of cs, or is above or below one.
+func overlapsAny(cs []sizeCandidate, name string) bool {
+	for _, c := range cs {
+		if c.name == name || strings.HasPrefix(name, c.name+"/") || strings.HasPrefix(c.name, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// planExclusions proposes candidates to exclude until gap bytes are saved,
+// preferring the smallest candidate that closes the remaining gap by
+// itself, and otherwise the largest. Candidates that overlap one already
+// proposed are skipped. accept decides on each proposal; declined ones
+// aren't proposed again. It returns the accepted candidates and the
+// declined ones, in the order they were proposed.
+func planExclusions(candidates []sizeCandidate, gap int64, accept func(sizeCandidate) (bool, error)) (accepted, declined []sizeCandidate, err error) {
+	decided := map[string]bool{}
+	for saved := int64(0); saved < gap; {
+		best := -1
+		for i, c := range candidates {
+			if decided[c.name] || overlapsAny(accepted, c.name) {
+				continue
+			}
+			if best < 0 {
+				best = i
+			}
+			if c.size >= gap-saved {
+				// Sorted largest first, so this is the smallest so far
+				// that closes the gap.
+				best = i
+			} else {
+				break
+			}
+		}
+		if best < 0 {
+			break
+		}
+		c := candidates[best]
+		decided[c.name] = true
+		ok, err := accept(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			accepted = append(accepted, c)
+			saved += c.size
+		} else {
+			declined = append(declined, c)
+		}
+	}
+	return accepted, declined, nil
+}
+
+// maxSizeSuggestions is how many exclusions are suggested when the squashed
+// rootfs stays over -target-size.
+const maxSizeSuggestions = 10
+
+// fitTargetSize returns the tar stream r, spooled to a temp file, with the
+// exclusions needed to bring its total file size within -target-size. With
+// -auto-exclude-largest, the largest paths matching -exclude-rules are
+// excluded, or, without rules, the largest paths that are confirmed on the
+// terminal (or all of them, with -yes). It fails if r stays over the
+// target, suggesting what else to exclude.
+func fitTargetSize(r io.Reader) (io.ReadCloser, error) {
+	// Already validated.
+	target, _ := humanize.ParseBytes(*targetSize)
+	spool, err := createTemp("docker-squash-target-*.tar")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	if _, err := io.Copy(tempWriter(spool), r); err != nil {
+		return nil, fmt.Errorf("spool squashed rootfs: %w", err)
+	}
+	fs, err := listRootfs(spool, false)
+	if err != nil {
+		return nil, fmt.Errorf("read squashed rootfs: %w", err)
+	}
+	var total int64
+	for _, hdr := range fs.headers {
+		if hdr.Typeflag == tar.TypeReg {
+			total += hdr.Size
+		}
+	}
+	edits := map[string]string{}
+	if total > int64(target) {
+		all := sizeCandidates(fs)
+		candidates := all
+		if *excludeRules != "" {
+			// Already validated.
+			rules, _ := parseExcludeRules(*excludeRules)
+			candidates = nil
+			for _, c := range all {
+				if matchesExcludeRule(rules, c.name) {
+					candidates = append(candidates, c)
+				}
+			}
+		}
+		yes := func(sizeCandidate) (bool, error) { return true, nil }
+		var decide func(sizeCandidate) (bool, error)
+		hint := ""
+		switch {
+		case !*autoExcludeLargest:
+		case *excludeRules != "" || *assumeYes:
+			decide = yes
+		case canPrompt():
+			logf("The squashed rootfs is %s of files, %s over -target-size %s", humanize.Bytes(uint64(total)), humanize.Bytes(uint64(total)-target), humanize.Bytes(target))
+			decide = func(c sizeCandidate) (bool, error) {
+				return confirm(fmt.Sprintf("Exclude /%s (%s)?", c.name, humanize.Bytes(uint64(c.size))))
+			}
+		default:
+			hint = " (without a terminal to confirm exclusions on, -auto-exclude-largest needs -exclude-rules or -yes)"
+		}
+		var accepted, declined []sizeCandidate
+		if decide != nil {
+			if accepted, declined, err = planExclusions(candidates, total-int64(target), decide); err != nil {
+				return nil, err
+			}
+		}
+		for _, c := range accepted {
+			for name, target := range removeAll(fs.tree(c.name)) {
+				edits[name] = target
+			}
+		}
+		keepLinkTargets(fs, edits)
+		for _, c := range accepted {
+			logf("-target-size: excluding /%s (%s)", c.name, humanize.Bytes(uint64(c.size)))
+		}
+		for name := range edits {
+			if hdr := fs.headers[name]; hdr.Typeflag == tar.TypeReg {
+				total -= hdr.Size
+			}
+		}
+		if total > int64(target) {
+			// Plan the rest without asking, to suggest what else could go.
+			var rest []sizeCandidate
+			for _, c := range all {
+				if !overlapsAny(accepted, c.name) && !slices.Contains(declined, c) {
+					rest = append(rest, c)
+				}
+			}
+			suggested, _, _ := planExclusions(rest, total-int64(target), yes)
+			return nil, withExitCode(exitVerification, fmt.Errorf("the squashed rootfs is %s of files, over -target-size %s%s%s", humanize.Bytes(uint64(total)), humanize.Bytes(target), hint, sizeSuggestions(suggested)))
+		}
+	}
+	logf("The squashed rootfs is %s of files, within -target-size %s", humanize.Bytes(uint64(total)), humanize.Bytes(target))
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeOptimized(pw, spool, fs, edits))
+	}()
+	return pr, nil
+}
+
+// sizeSuggestions lists the first few of cs, as paths to exclude.
+func sizeSuggestions(cs []sizeCandidate) string {
+	if len(cs) == 0 {
+		return ""
+	}
+	s := "; excluding these would meet it:"
+	for _, c := range cs[:min(len(cs), maxSizeSuggestions)] {
+		s += fmt.Sprintf("\n  /%s (%s)", c.name, humanize.Bytes(uint64(c.size)))
+	}
+	if len(cs) > maxSizeSuggestions {
+		s += fmt.Sprintf("\n  (and %d more)", len(cs)-maxSizeSuggestions)
+	}
+	return s
+}
+
+// confirmsExclusions returns whether -target-size exclusions may be decided
+// on the terminal, which makes the result unfit for caching.
+func confirmsExclusions() bool {
+	return *autoExcludeLargest && *excludeRules == "" && !*assumeYes
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// tarIndex records where each member of a tar archive is stored, so members
+// can be read with ReadAt instead of re-scanning the archive from the start
+// each time, which is what ggcr's tarball package does for every manifest,
+// config and layer read.
+type tarIndex struct {
+	f       *os.File
+	entries map[string]tarIndexEntry
+}
+
+type tarIndexEntry struct {
+	typeflag byte
+	linkname string
+	offset   int64
+	size     int64
+}
+
+// indexTarball scans the tar archive at path once, recording the offset of
+// each member's content. The file is kept open for reading members.
+func indexTarball(path string) (*tarIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := &tarIndex{f: f, entries: map[string]tarIndexEntry{}}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return idx, nil
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// tar.Reader reads headers with exact-sized reads and seeks past
+		// content, so the file offset is now at the start of the content.
+		off, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		idx.entries[hdr.Name] = tarIndexEntry{
+			typeflag: hdr.Typeflag,
+			linkname: hdr.Linkname,
+			offset:   off,
+			size:     hdr.Size,
+		}
+	}
+}
+
+// open returns the content of the named member, following symlinks and
+// hardlinks the same way ggcr's tarball package does.
+func (x *tarIndex) open(name string) (io.ReadCloser, error) {
+	sr, err := x.section(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(sr), nil
+}
+
+func (x *tarIndex) section(name string) (*io.SectionReader, error) {
+	for range 40 {
+		e, ok := x.entries[name]
+		if !ok {
+			return nil, fmt.Errorf("file %s not found in tar", name)
+		}
+		if e.typeflag != tar.TypeSymlink && e.typeflag != tar.TypeLink {
+			return io.NewSectionReader(x.f, e.offset, e.size), nil
+		}
+		name = path.Join(path.Dir(name), path.Clean(e.linkname))
+	}
+	return nil, fmt.Errorf("too many levels of links resolving %s in tar", name)
+}
+
+// member returns the name under which the archive stores the member at the
+// clean path name, which archives made with "tar -C dir ." prefix with
+// "./".
+func (x *tarIndex) member(name string) string {
+	if _, ok := x.entries[name]; !ok {
+		if _, ok := x.entries["./"+name]; ok {
+			return "./" + name
+		}
+	}
+	return name
+}
+
+func (x *tarIndex) opener(name string) tarball.Opener {
+	return func() (io.ReadCloser, error) { return x.open(name) }
+}
+
+// readAll returns the content of the named member, a manifest, index or
+// config, which must be within -max-metadata-size.
+func (x *tarIndex) readAll(name string) ([]byte, error) {
+	sr, err := x.section(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMetadataSize(name, sr.Size()); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(sr)
+}
+
+// indexedImage is a v1.Image read from a docker-save tarball via a
+// tarIndex. It behaves like tarball.Image, and is wrapped the same way by
+// partial.CompressedToImage or partial.UncompressedToImage depending on
+// whether the layers are compressed.
+type indexedImage struct {
+	idx    *tarIndex
+	desc   tarball.Descriptor
+	config []byte
+}
+
+// imageFromIndexedTarball returns the single image in the docker-save
+// tarball at path, indexed by idx, along with the tarball's manifest.
+func imageFromIndexedTarball(path string, idx *tarIndex) (img v1.Image, m tarball.Manifest, uncompressed bool, err error) {
+	// Decoded as it's read, rather than read into memory first.
+	sr, err := idx.section("manifest.json")
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if err := checkMetadataSize("manifest.json", sr.Size()); err != nil {
+		return nil, nil, false, err
+	}
+	if err := json.NewDecoder(sr).Decode(&m); err != nil {
+		return nil, nil, false, fmt.Errorf("parse manifest.json: %w", err)
+	}
+	if len(m) != 1 {
+		return nil, nil, false, errors.New("tarball must contain only a single image")
+	}
+	if len(m[0].LayerSources) > 0 {
+		// Foreign layers need their descriptors carried over; leave that
+		// to ggcr.
+		img, err := tarball.ImageFromPath(path, nil)
+		return img, m, false, err
+	}
+	base := &indexedImage{idx: idx, desc: m[0]}
+	if base.config, err = idx.readAll(base.desc.Config); err != nil {
+		return nil, nil, false, err
+	}
+	if len(base.desc.Layers) > 0 {
+		compressed, err := base.layersCompressed()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if compressed {
+			img, err := partial.CompressedToImage(&compressedIndexedImage{indexedImage: base})
+			return img, m, false, err
+		}
+	}
+	img, err = partial.UncompressedToImage(&uncompressedIndexedImage{indexedImage: base})
+	return img, m, true, err
+}
+
+// layersCompressed peeks at the first layer for gzip or zstd magic.
+func (i *indexedImage) layersCompressed() (bool, error) {
+	rc, err := i.idx.open(i.desc.Layers[0])
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(rc, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	magic = magic[:n]
+	return bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) || bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}), nil
+}
+
+func (i *indexedImage) RawConfigFile() ([]byte, error) { return i.config, nil }
+
+func (i *indexedImage) MediaType() (types.MediaType, error) {
+	return types.DockerManifestSchema2, nil
+}
+
+type uncompressedIndexedImage struct {
+	*indexedImage
+}
+
+func (i *uncompressedIndexedImage) LayerByDiffID(h v1.Hash) (partial.UncompressedLayer, error) {
+	cfg, err := partial.ConfigFile(i)
+	if err != nil {
+		return nil, err
+	}
+	for n, diffID := range cfg.RootFS.DiffIDs {
+		if diffID == h && n < len(i.desc.Layers) {
+			return &uncompressedIndexedLayer{diffID: diffID, open: i.idx.opener(i.desc.Layers[n])}, nil
+		}
+	}
+	return nil, fmt.Errorf("diff id %q not found", h)
+}
+
+type uncompressedIndexedLayer struct {
+	diffID v1.Hash
+	open   tarball.Opener
+}
+
+func (l *uncompressedIndexedLayer) DiffID() (v1.Hash, error)             { return l.diffID, nil }
+func (l *uncompressedIndexedLayer) Uncompressed() (io.ReadCloser, error) { return l.open() }
+func (l *uncompressedIndexedLayer) MediaType() (types.MediaType, error) {
+	return types.DockerLayer, nil
+}
+
+type compressedIndexedImage struct {
+	*indexedImage
+
+	manifestOnce sync.Once
+	manifest     *v1.Manifest
+	manifestErr  error
+}
+
+func (i *compressedIndexedImage) Manifest() (*v1.Manifest, error) {
+	i.manifestOnce.Do(func() {
+		i.manifest, i.manifestErr = i.computeManifest()
+	})
+	return i.manifest, i.manifestErr
+}
+
+func (i *compressedIndexedImage) computeManifest() (*v1.Manifest, error) {
+	cfgHash, cfgSize, err := v1.SHA256(bytes.NewReader(i.config))
+	if err != nil {
+		return nil, err
+	}
+	m := &v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.DockerManifestSchema2,
+		Config: v1.Descriptor{
+			MediaType: types.DockerConfigJSON,
+			Size:      cfgSize,
+			Digest:    cfgHash,
+		},
+	}
+	for _, p := range i.desc.Layers {
+		rc, err := i.idx.open(p)
+		if err != nil {
+			return nil, err
+		}
+		h, size, err := v1.SHA256(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		m.Layers = append(m.Layers, v1.Descriptor{
+			MediaType: types.DockerLayer,
+			Size:      size,
+			Digest:    h,
+		})
+	}
+	return m, nil
+}
+
+func (i *compressedIndexedImage) RawManifest() ([]byte, error) {
+	return partial.RawManifest(i)
+}
+
+func (i *compressedIndexedImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	m, err := i.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	for n, desc := range m.Layers {
+		if desc.Digest == h {
+			return &compressedIndexedLayer{desc: desc, open: i.idx.opener(i.desc.Layers[n])}, nil
+		}
+	}
+	return nil, fmt.Errorf("blob %v not found", h)
+}
+
+type compressedIndexedLayer struct {
+	desc v1.Descriptor
+	open tarball.Opener
+}
+
+func (l *compressedIndexedLayer) Digest() (v1.Hash, error)           { return l.desc.Digest, nil }
+func (l *compressedIndexedLayer) Compressed() (io.ReadCloser, error) { return l.open() }
+func (l *compressedIndexedLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+func (l *compressedIndexedLayer) Size() (int64, error) { return l.desc.Size, nil }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+// With -encrypt-tmp, the temp files holding image contents (the squashed
+// rootfs tarballs, their compressed layers and the spools of -optimize,
+// -target-size and -canonical-tar) are encrypted with AES-256 in CTR mode,
+// under a key generated for the run and only kept in memory, so their
+// plaintext never reaches the disk. Each file has its own random IV, and
+// CTR mode lets them be read back at any offset.
+//
+// It's for confidentiality only: what's read back isn't authenticated.
+
+// tempKey is the -encrypt-tmp key, or nil if temp files are plaintext.
+var tempKey cipher.Block
+
+// tempIVs maps the names of encrypted temp files to their IVs.
+var tempIVs sync.Map
+
+// initTempEncryption generates the -encrypt-tmp key.
+func initTempEncryption() error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("generate -encrypt-tmp key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	tempKey = block
+	return nil
+}
+
+// tempWriter returns a writer of the new temp file f, which encrypts what's
+// written with -encrypt-tmp. f must be written sequentially from the start,
+// and read back with tempReaderAt, tempReader or openTemp.
+func tempWriter(f *os.File) io.Writer {
+	if tempKey == nil {
+		return f
+	}
+	iv := make([]byte, aes.BlockSize)
+	// crypto/rand.Read doesn't fail.
+	rand.Read(iv)
+	tempIVs.Store(f.Name(), iv)
+	return &encryptingWriter{w: f, iv: iv}
+}
+
+type encryptingWriter struct {
+	w   io.Writer
+	iv  []byte
+	off int64
+	buf []byte
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	// p mustn't be modified.
+	w.buf = append(w.buf[:0], p...)
+	xorKeyStreamAt(w.iv, w.buf, w.off)
+	n, err := w.w.Write(w.buf)
+	w.off += int64(n)
+	return n, err
+}
+
+// tempReaderAt returns the plaintext of the temp file f, decrypting it if
+// it was written with tempWriter.
+func tempReaderAt(f *os.File) io.ReaderAt {
+	iv, ok := tempIVs.Load(f.Name())
+	if !ok {
+		return f
+	}
+	return &decryptingReaderAt{f: f, iv: iv.([]byte)}
+}
+
+type decryptingReaderAt struct {
+	f  *os.File
+	iv []byte
+}
+
+func (r *decryptingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.f.ReadAt(p, off)
+	xorKeyStreamAt(r.iv, p[:n], off)
+	return n, err
+}
+
+// tempReader returns a reader of the plaintext of the temp file f from the
+// start, regardless of f's offset.
+func tempReader(f *os.File) *io.SectionReader {
+	return io.NewSectionReader(tempReaderAt(f), 0, math.MaxInt64)
+}
+
+// openTemp opens the temp file at path to read its plaintext.
+func openTemp(path string) (io.ReadSeekCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		*io.SectionReader
+		io.Closer
+	}{tempReader(f), f}, nil
+}
+
+// xorKeyStreamAt XORs p with the -encrypt-tmp key stream for iv, starting
+// at offset off.
+func xorKeyStreamAt(iv, p []byte, off int64) {
+	ctr := make([]byte, aes.BlockSize)
+	copy(ctr, iv)
+	// Add the index of the block at off to the big-endian counter.
+	carry := uint64(off / aes.BlockSize)
+	for i := len(ctr) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(ctr[i]) + carry&0xff
+		ctr[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	s := cipher.NewCTR(tempKey, ctr)
+	if skip := off % aes.BlockSize; skip > 0 {
+		pad := make([]byte, skip)
+		s.XORKeyStream(pad, pad)
+	}
+	s.XORKeyStream(p, p)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	tempMu    sync.Mutex
+	tempFiles []*os.File
+	tempDirs  []string
+)
+
+// defaultTempPrefix starts the name patterns of all temp files and
+// directories, and is replaced by -tmp-prefix.
+const defaultTempPrefix = "docker-squash"
+
+// tempPattern returns pattern with -tmp-prefix in place of
+// defaultTempPrefix.
+func tempPattern(pattern string) string {
+	return *tmpPrefix + strings.TrimPrefix(pattern, defaultTempPrefix)
+}
+
+// createTemp creates a temp file which is removed by removeTemps.
+func createTemp(pattern string) (*os.File, error) {
+	f, err := os.CreateTemp("", tempPattern(pattern))
+	if err != nil {
+		return nil, err
+	}
+	tempMu.Lock()
+	defer tempMu.Unlock()
+	tempFiles = append(tempFiles, f)
+	return f, nil
+}
+
+// mkdirTemp creates a temp directory which is removed by removeTemps.
+func mkdirTemp(pattern string) (string, error) {
+	return mkdirTempIn("", pattern)
+}
+
+// mkdirTempIn is like mkdirTemp, but creates the directory in parent.
+func mkdirTempIn(parent, pattern string) (string, error) {
+	dir, err := os.MkdirTemp(parent, tempPattern(pattern))
+	if err != nil {
+		return "", err
+	}
+	tempMu.Lock()
+	defer tempMu.Unlock()
+	tempDirs = append(tempDirs, dir)
+	return dir, nil
+}
+
+// removeTemps removes all temp files and directories created so far.
+func removeTemps() {
+	tempMu.Lock()
+	defer tempMu.Unlock()
+	for _, f := range tempFiles {
+		fmt.Fprintf(os.Stderr, "Removing %q\n", f.Name())
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+	for _, dir := range tempDirs {
+		fmt.Fprintf(os.Stderr, "Removing %q\n", dir)
+		_ = os.RemoveAll(dir)
+	}
+	tempFiles, tempDirs = nil, nil
+}
+
+// preallocateTemp reserves size bytes of disk for the temp file f, which
+// is about to be written, so that filesystems prone to fragmentation can
+// lay it out contiguously. Once f is written, truncating it to the size
+// written releases what wasn't needed. Failing to preallocate, as on
+// filesystems that don't support it, is only logged.
+func preallocateTemp(f *os.File, size int64) {
+	if size <= 0 {
+		return
+	}
+	if err := preallocate(f, size); err != nil {
+		logf("Warning: -preallocate: %v", err)
+		return
+	}
+	logf("Preallocated %s for %q", humanize.Bytes(uint64(size)), f.Name())
+}
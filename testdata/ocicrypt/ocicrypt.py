@@ -0,0 +1,329 @@
+#!/usr/bin/env python3
+"""Encrypts and decrypts OCI image layouts as ocicrypt does, with OpenSSL.
+
+This is an implementation of ocicrypt's JWE layer encryption independent of
+docker-squash's, so that the tests check interoperability rather than a
+round trip: the primitives are OpenSSL's (the openssl command, and libcrypto
+through ctypes for AES-GCM, which 'openssl enc' doesn't do), and the formats
+are those of github.com/containers/ocicrypt as 'skopeo copy
+--encryption-key jwe:KEY' writes them:
+
+- Each layer blob is encrypted with AES-256-CTR under a random key and
+  16-byte nonce, and its media type gets "+encrypted" appended.
+- org.opencontainers.image.enc.pubopts is the base64 JSON
+  {"cipher":"AES_256_CTR_HMAC_SHA256","hmac":...,"cipheroptions":{}}, with
+  the HMAC-SHA256 of the ciphertext under the key.
+- org.opencontainers.image.enc.keys.jwe is the base64 JWE, encrypted with
+  A256GCM, of {"symkey":...,"digest":...,"cipheroptions":{"nonce":...}},
+  where digest is that of the plaintext blob. RSA recipients get RSA-OAEP
+  and EC (P-256) ones ECDH-ES+A256KW. As go-jose serializes it, a single
+  recipient's header is merged into the protected header and the JWE is
+  flattened; several recipients get the general serialization.
+
+Usage:
+
+    ocicrypt.py gen DIR
+        Writes the fixture: an RSA and an EC key pair, and DIR/layout, an
+        OCI layout with the two-layer image of TestOcicryptInterop
+        encrypted for the RSA key ("rsa") and for both keys ("multi").
+    ocicrypt.py decrypt LAYOUT KEY OUTDIR
+        Decrypts the encrypted layers of each image in LAYOUT with the
+        private key KEY, checking their HMACs and digests, and writes the
+        plaintext blobs to OUTDIR/N.tar.gz, numbered in manifest order.
+
+The fixture should be regenerated with skopeo where it's available:
+    skopeo copy --encryption-key jwe:rsa.pub.pem oci:plain:latest oci:layout:rsa
+"""
+
+import base64
+import ctypes
+import ctypes.util
+import gzip
+import hashlib
+import hmac
+import io
+import json
+import os
+import subprocess
+import sys
+import tarfile
+import tempfile
+
+ANNOTATION_PREFIX = "org.opencontainers.image.enc."
+JWE_ANNOTATION = ANNOTATION_PREFIX + "keys.jwe"
+PUBOPTS_ANNOTATION = ANNOTATION_PREFIX + "pubopts"
+CIPHER = "AES_256_CTR_HMAC_SHA256"
+# The DER SubjectPublicKeyInfo of a P-256 key, before its uncompressed
+# point.
+P256_SPKI_PREFIX = bytes.fromhex("3059301306072a8648ce3d020106082a8648ce3d030107034200")
+
+
+def b64(b):
+    return base64.b64encode(b).decode()
+
+
+def b64url(b):
+    return base64.urlsafe_b64encode(b).rstrip(b"=").decode()
+
+
+def unb64url(s):
+    return base64.urlsafe_b64decode(s + "=" * (-len(s) % 4))
+
+
+def openssl(*args, input=None):
+    return subprocess.run(["openssl", *args], input=input, capture_output=True, check=True).stdout
+
+
+def aes_ctr(key, nonce, data):
+    return openssl("enc", "-aes-256-ctr", "-K", key.hex(), "-iv", nonce.hex(), input=data)
+
+
+def aes_kw(kek, key, decrypt=False):
+    args = ["enc", "-id-aes%d-wrap" % (len(kek) * 8), "-K", kek.hex(), "-iv", "A6A6A6A6A6A6A6A6"]
+    return openssl(*args, *(["-d"] if decrypt else []), input=key)
+
+
+libcrypto = ctypes.CDLL(ctypes.util.find_library("crypto"))
+libcrypto.EVP_CIPHER_CTX_new.restype = ctypes.c_void_p
+libcrypto.EVP_aes_256_gcm.restype = ctypes.c_void_p
+for f in ("EVP_CipherInit_ex", "EVP_CipherUpdate", "EVP_CipherFinal_ex", "EVP_CIPHER_CTX_ctrl"):
+    getattr(libcrypto, f).argtypes = None
+libcrypto.EVP_CIPHER_CTX_free.argtypes = [ctypes.c_void_p]
+EVP_CTRL_GCM_GET_TAG = 0x10
+EVP_CTRL_GCM_SET_TAG = 0x11
+
+
+def aes_gcm(key, iv, data, aad, tag=None):
+    """Encrypts data, returning the ciphertext and tag, or decrypts it if
+    tag is given."""
+    ctx = ctypes.c_void_p(libcrypto.EVP_CIPHER_CTX_new())
+    try:
+        enc = int(tag is None)
+        ok = libcrypto.EVP_CipherInit_ex(ctx, ctypes.c_void_p(libcrypto.EVP_aes_256_gcm()), None, key, iv, enc)
+        n = ctypes.c_int()
+        ok &= libcrypto.EVP_CipherUpdate(ctx, None, ctypes.byref(n), aad, len(aad))
+        out = ctypes.create_string_buffer(len(data) + 16)
+        ok &= libcrypto.EVP_CipherUpdate(ctx, out, ctypes.byref(n), data, len(data))
+        size = n.value
+        if tag is not None:
+            ok &= libcrypto.EVP_CIPHER_CTX_ctrl(ctx, EVP_CTRL_GCM_SET_TAG, len(tag), tag)
+        final = ctypes.create_string_buffer(16)
+        ok &= libcrypto.EVP_CipherFinal_ex(ctx, final, ctypes.byref(n))
+        if not ok:
+            raise ValueError("AES-GCM failed")
+        if tag is not None:
+            return out.raw[:size]
+        t = ctypes.create_string_buffer(16)
+        if not libcrypto.EVP_CIPHER_CTX_ctrl(ctx, EVP_CTRL_GCM_GET_TAG, 16, t):
+            raise ValueError("AES-GCM tag failed")
+        return out.raw[:size], t.raw
+    finally:
+        libcrypto.EVP_CIPHER_CTX_free(ctx)
+
+
+def concat_kdf(z, alg):
+    # RFC 7518 section 4.6.2, with empty apu and apv: a single round for a
+    # 256-bit key.
+    info = len(alg).to_bytes(4, "big") + alg.encode() + bytes(8) + (256).to_bytes(4, "big")
+    return hashlib.sha256((1).to_bytes(4, "big") + z + info).digest()
+
+
+def key_type(path):
+    text = openssl("pkey", "-pubin", "-in", path, "-text", "-noout").decode()
+    return "EC" if "ASN1 OID" in text else "RSA"
+
+
+def wrap(cek, pub, tmp):
+    if key_type(pub) == "RSA":
+        ek = openssl("pkeyutl", "-encrypt", "-pubin", "-inkey", pub, "-pkeyopt", "rsa_padding_mode:oaep", input=cek)
+        return {"alg": "RSA-OAEP"}, ek
+    eph = os.path.join(tmp, "eph.pem")
+    openssl("ecparam", "-name", "prime256v1", "-genkey", "-noout", "-out", eph)
+    z = openssl("pkeyutl", "-derive", "-inkey", eph, "-peerkey", pub)
+    point = openssl("pkey", "-in", eph, "-pubout", "-outform", "DER")[len(P256_SPKI_PREFIX) + 1:]
+    epk = {"crv": "P-256", "kty": "EC", "x": b64url(point[:32]), "y": b64url(point[32:])}
+    alg = "ECDH-ES+A256KW"
+    return {"alg": alg, "epk": epk}, aes_kw(concat_kdf(z, alg), cek)
+
+
+def unwrap(header, ek, priv, tmp):
+    if header["alg"] == "RSA-OAEP":
+        return openssl("pkeyutl", "-decrypt", "-inkey", priv, "-pkeyopt", "rsa_padding_mode:oaep", input=ek)
+    if header["alg"] != "ECDH-ES+A256KW" or header["epk"]["crv"] != "P-256":
+        raise ValueError("unsupported key wrapping %r" % header)
+    epk = header["epk"]
+    der = P256_SPKI_PREFIX + b"\x04" + unb64url(epk["x"]) + unb64url(epk["y"])
+    peer = os.path.join(tmp, "epk.der")
+    with open(peer, "wb") as f:
+        f.write(der)
+    z = openssl("pkeyutl", "-derive", "-inkey", priv, "-peerkey", peer, "-peerform", "DER")
+    return aes_kw(concat_kdf(z, header["alg"]), ek, decrypt=True)
+
+
+def encrypt_jwe(payload, pubs, tmp):
+    cek, iv = os.urandom(32), os.urandom(12)
+    recipients = [wrap(cek, pub, tmp) for pub in pubs]
+    protected = {"enc": "A256GCM"}
+    if len(recipients) == 1:
+        protected.update(recipients[0][0])
+    protected = b64url(json.dumps(protected, sort_keys=True, separators=(",", ":")).encode())
+    ciphertext, tag = aes_gcm(cek, iv, payload, protected.encode())
+    jwe = {"protected": protected}
+    if len(recipients) == 1:
+        jwe["encrypted_key"] = b64url(recipients[0][1])
+    else:
+        jwe["recipients"] = [{"header": h, "encrypted_key": b64url(ek)} for h, ek in recipients]
+    jwe.update(iv=b64url(iv), ciphertext=b64url(ciphertext), tag=b64url(tag))
+    return json.dumps(jwe, separators=(",", ":")).encode()
+
+
+def decrypt_jwe(data, priv, tmp):
+    jwe = json.loads(data)
+    protected = json.loads(unb64url(jwe["protected"]))
+    recipients = jwe.get("recipients") or [{"header": {}, "encrypted_key": jwe["encrypted_key"]}]
+    for r in recipients:
+        header = {**protected, **jwe.get("unprotected", {}), **r.get("header", {})}
+        if header["enc"] != "A256GCM":
+            raise ValueError("unsupported enc %r" % header["enc"])
+        try:
+            cek = unwrap(header, unb64url(r["encrypted_key"]), priv, tmp)
+        except subprocess.CalledProcessError:
+            continue
+        return aes_gcm(cek, unb64url(jwe["iv"]), unb64url(jwe["ciphertext"]), jwe["protected"].encode(), unb64url(jwe["tag"]))
+    raise ValueError("none of the recipients is %s" % priv)
+
+
+def encrypt_layer(blob, pubs, tmp):
+    key, nonce = os.urandom(32), os.urandom(16)
+    encrypted = aes_ctr(key, nonce, blob)
+    priv = {"symkey": b64(key), "digest": "sha256:" + hashlib.sha256(blob).hexdigest(), "cipheroptions": {"nonce": b64(nonce)}}
+    pub = {"cipher": CIPHER, "hmac": b64(hmac.new(key, encrypted, hashlib.sha256).digest()), "cipheroptions": {}}
+    annotations = {
+        JWE_ANNOTATION: b64(encrypt_jwe(json.dumps(priv, separators=(",", ":")).encode(), pubs, tmp)),
+        PUBOPTS_ANNOTATION: b64(json.dumps(pub, separators=(",", ":")).encode()),
+    }
+    return encrypted, annotations
+
+
+def decrypt_layer(blob, annotations, priv, tmp):
+    pub = json.loads(base64.b64decode(annotations[PUBOPTS_ANNOTATION]))
+    if pub["cipher"] != CIPHER:
+        raise ValueError("unsupported cipher %r" % pub["cipher"])
+    for jwe in annotations[JWE_ANNOTATION].split(","):
+        try:
+            opts = json.loads(decrypt_jwe(base64.b64decode(jwe), priv, tmp))
+            break
+        except ValueError:
+            continue
+    else:
+        raise ValueError("layer isn't encrypted for %s" % priv)
+    key = base64.b64decode(opts["symkey"])
+    if not hmac.compare_digest(hmac.new(key, blob, hashlib.sha256).digest(), base64.b64decode(pub["hmac"])):
+        raise ValueError("HMAC mismatch")
+    plain = aes_ctr(key, base64.b64decode(opts["cipheroptions"]["nonce"]), blob)
+    if "sha256:" + hashlib.sha256(plain).hexdigest() != opts["digest"]:
+        raise ValueError("plaintext digest mismatch")
+    return plain
+
+
+class Layout:
+    def __init__(self, path):
+        self.path = path
+
+    def blob_path(self, digest):
+        return os.path.join(self.path, "blobs", *digest.split(":"))
+
+    def read(self, digest):
+        with open(self.blob_path(digest), "rb") as f:
+            return f.read()
+
+    def write(self, data, media_type, annotations=None):
+        digest = "sha256:" + hashlib.sha256(data).hexdigest()
+        os.makedirs(os.path.dirname(self.blob_path(digest)), exist_ok=True)
+        with open(self.blob_path(digest), "wb") as f:
+            f.write(data)
+        desc = {"mediaType": media_type, "digest": digest, "size": len(data)}
+        if annotations:
+            desc["annotations"] = annotations
+        return desc
+
+
+def layer_tar(entries):
+    buf = io.BytesIO()
+    with tarfile.open(fileobj=buf, mode="w", format=tarfile.PAX_FORMAT) as tf:
+        for name, body, mode in entries:
+            info = tarfile.TarInfo(name)
+            info.mode, info.mtime = mode, 0
+            if body is None:
+                info.type = tarfile.DIRTYPE
+                tf.addfile(info)
+            else:
+                info.size = len(body)
+                tf.addfile(info, io.BytesIO(body.encode()))
+    return buf.getvalue()
+
+
+def gen(out):
+    for name in ("rsa", "ec"):
+        priv, pub = os.path.join(out, name + ".pem"), os.path.join(out, name + ".pub.pem")
+        if not os.path.exists(priv):
+            if name == "rsa":
+                openssl("genpkey", "-algorithm", "RSA", "-pkeyopt", "rsa_keygen_bits:2048", "-out", priv)
+            else:
+                openssl("ecparam", "-name", "prime256v1", "-genkey", "-noout", "-out", priv)
+        openssl("pkey", "-in", priv, "-pubout", "-out", pub)
+    # The layers of TestOcicryptInterop.
+    tars = [
+        layer_tar([("etc", None, 0o755), ("etc/secret.conf", "password=hunter2", 0o600), ("etc/stale", "stale", 0o644)]),
+        layer_tar([("etc/.wh.stale", "", 0o644), ("etc/app.conf", "v2", 0o644)]),
+    ]
+    layout = Layout(os.path.join(out, "layout"))
+    os.makedirs(layout.path, exist_ok=True)
+    with open(os.path.join(layout.path, "oci-layout"), "w") as f:
+        json.dump({"imageLayoutVersion": "1.0.0"}, f)
+    blobs = [gzip.compress(t, mtime=0) for t in tars]
+    config = layout.write(json.dumps({
+        "architecture": "amd64",
+        "os": "linux",
+        "config": {"Env": ["PATH=/usr/bin:/bin"]},
+        "rootfs": {"type": "layers", "diff_ids": ["sha256:" + hashlib.sha256(t).hexdigest() for t in tars]},
+    }).encode(), "application/vnd.oci.image.config.v1+json")
+    manifests = []
+    with tempfile.TemporaryDirectory() as tmp:
+        for ref, pubs in (("rsa", ["rsa.pub.pem"]), ("multi", ["rsa.pub.pem", "ec.pub.pem"])):
+            layers = []
+            for blob in blobs:
+                encrypted, annotations = encrypt_layer(blob, [os.path.join(out, p) for p in pubs], tmp)
+                layers.append(layout.write(encrypted, "application/vnd.oci.image.layer.v1.tar+gzip+encrypted", annotations))
+            manifest = {"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "config": config, "layers": layers}
+            desc = layout.write(json.dumps(manifest).encode(), manifest["mediaType"], {"org.opencontainers.image.ref.name": ref})
+            manifests.append(desc)
+    with open(os.path.join(layout.path, "index.json"), "w") as f:
+        json.dump({"schemaVersion": 2, "manifests": manifests}, f)
+
+
+def decrypt(path, priv, out):
+    layout = Layout(path)
+    with open(os.path.join(path, "index.json")) as f:
+        index = json.load(f)
+    n = 0
+    with tempfile.TemporaryDirectory() as tmp:
+        for desc in index["manifests"]:
+            for layer in json.loads(layout.read(desc["digest"]))["layers"]:
+                if not layer["mediaType"].endswith("+encrypted"):
+                    continue
+                plain = decrypt_layer(layout.read(layer["digest"]), layer.get("annotations", {}), priv, tmp)
+                with open(os.path.join(out, "%d.tar.gz" % n), "wb") as f:
+                    f.write(plain)
+                n += 1
+    if n == 0:
+        raise ValueError("no encrypted layers in %s" % path)
+
+
+if __name__ == "__main__":
+    if sys.argv[1:2] == ["gen"] and len(sys.argv) == 3:
+        gen(sys.argv[2])
+    elif sys.argv[1:2] == ["decrypt"] and len(sys.argv) == 5:
+        decrypt(*sys.argv[2:])
+    else:
+        sys.exit(__doc__)
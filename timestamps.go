@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// createdAnnotation is the OCI annotation (and label) holding the image
+// creation time, which tools cross-check against the config's Created.
+const createdAnnotation = "org.opencontainers.image.created"
+
+// outputCreated returns the creation time of the squashed image: -created
+// if set; otherwise, with -reproducible, $SOURCE_DATE_EPOCH or the Unix
+// epoch; otherwise the current time.
+func outputCreated() (time.Time, error) {
+	if *createdFlag != "" {
+		return parseCreated(*createdFlag)
+	}
+	if *reproducible {
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			t, err := parseCreated(epoch)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %w", err)
+			}
+			return t, nil
+		}
+		return time.Unix(0, 0).UTC(), nil
+	}
+	return time.Now(), nil
+}
+
+// parseCreated parses an RFC 3339 time or a number of seconds since the
+// Unix epoch.
+func parseCreated(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor Unix seconds", s)
+	}
+	return t, nil
+}
+
+// clampMtimes returns a copy of the tar stream rc in which modification
+// times later than t are set to t, so that no file appears newer than the
+// image itself. rc is closed once it has been copied.
+func clampMtimes(rc io.ReadCloser, t time.Time) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer rc.Close()
+		pw.CloseWithError(copyClampingMtimes(pw, rc, t))
+	}()
+	return pr
+}
+
+func copyClampingMtimes(w io.Writer, r io.Reader, t time.Time) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.ModTime.After(t) {
+			hdr.ModTime = t
+		}
+		// Access and change times aren't restored on extraction, and would
+		// otherwise leak the build time.
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The phases of a squash that are timed for the summary printed at the
+// end of a run.
+const (
+	phasePull     = "pull"
+	phaseExtract  = "extract"
+	phaseFilter   = "filter"
+	phaseCompress = "compress"
+	phaseHash     = "hash"
+	phaseWrite    = "write"
+	phasePush     = "push"
+
+	// phaseCompressWait is the time the compressor spends blocked on its
+	// consumers, which isn't compressing. It isn't reported.
+	phaseCompressWait = "compress wait"
+)
+
+// reportedPhases are the phases in the summary, in pipeline order.
+var reportedPhases = []string{phasePull, phaseExtract, phaseFilter, phaseCompress, phaseHash, phaseWrite, phasePush}
+
+// phaseTimes is the time spent in each phase so far.
+var phaseTimes struct {
+	sync.Mutex
+	d map[string]time.Duration
+}
+
+func addPhaseTime(phase string, d time.Duration) {
+	phaseTimes.Lock()
+	defer phaseTimes.Unlock()
+	if phaseTimes.d == nil {
+		phaseTimes.d = map[string]time.Duration{}
+	}
+	phaseTimes.d[phase] += d
+}
+
+// sumPhaseTimes returns the total time spent in phases.
+func sumPhaseTimes(phases []string) time.Duration {
+	phaseTimes.Lock()
+	defer phaseTimes.Unlock()
+	var d time.Duration
+	for _, phase := range phases {
+		d += phaseTimes.d[phase]
+	}
+	return d
+}
+
+// phaseSpan measures time for phase, less the time spent meanwhile in the
+// nested phases it waits on, such as pulling the compressed blob a
+// decompressor reads from. Since the stages of a squash are streamed into
+// each other, this is what tells them apart.
+type phaseSpan struct {
+	phase  string
+	nested []string
+	start  time.Time
+	before time.Duration
+}
+
+func startPhase(phase string, nested ...string) phaseSpan {
+	return phaseSpan{phase: phase, nested: nested, start: time.Now(), before: sumPhaseTimes(nested)}
+}
+
+func (s phaseSpan) end() {
+	d := time.Since(s.start) - (sumPhaseTimes(s.nested) - s.before)
+	addPhaseTime(s.phase, max(d, 0))
+}
+
+// timedReader adds the time spent in Read to phase, less nested phases.
+type timedReader struct {
+	r      io.Reader
+	phase  string
+	nested []string
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	defer startPhase(r.phase, r.nested...).end()
+	return r.r.Read(p)
+}
+
+// timedReadCloser is a timedReader that closes the underlying reader.
+type timedReadCloser struct {
+	timedReader
+	io.Closer
+}
+
+func timeReadCloser(rc io.ReadCloser, phase string, nested ...string) io.ReadCloser {
+	return &timedReadCloser{timedReader{rc, phase, nested}, rc}
+}
+
+// timedWriter adds the time spent in Write to phase, less nested phases.
+type timedWriter struct {
+	w      io.Writer
+	phase  string
+	nested []string
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	defer startPhase(w.phase, w.nested...).end()
+	return w.w.Write(p)
+}
+
+// timedTransport adds the time spent waiting for responses and reading
+// their bodies to phasePull.
+type timedTransport struct {
+	inner http.RoundTripper
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span := startPhase(phasePull)
+	resp, err := t.inner.RoundTrip(req)
+	span.end()
+	if err == nil {
+		resp.Body = timeReadCloser(resp.Body, phasePull)
+	}
+	return resp, err
+}
+
+// reportPhaseTimes logs the time spent in each phase, out of total, and
+// returns them in seconds for the notification payload.
+func reportPhaseTimes(total time.Duration) map[string]float64 {
+	phaseTimes.Lock()
+	defer phaseTimes.Unlock()
+	seconds := map[string]float64{}
+	var lines []string
+	for _, phase := range reportedPhases {
+		d := phaseTimes.d[phase]
+		if d <= 0 {
+			continue
+		}
+		seconds[phase] = d.Seconds()
+		lines = append(lines, fmt.Sprintf("  %8s  %3.0f%%  %s", d.Round(time.Millisecond), 100*d.Seconds()/max(total.Seconds(), 1e-9), phase))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	// Streamed phases overlap, so they needn't add up to the total.
+	logf("Time by phase (%s in total):", total.Round(time.Millisecond))
+	for _, line := range lines {
+		logf("%s", line)
+	}
+	return seconds
+}
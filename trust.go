@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// trustPolicy is a trust policy in the policy.json format of
+// containers/image (see containers-policy.json(5)), deciding which sources
+// may be squashed: the requirements of the most specific scope matching a
+// source apply, or else the transport's "" scope, or else the default.
+//
+// The "docker" transport's scopes are registry references, like
+// "registry.example.com/team/app:1.0", "registry.example.com/team",
+// "registry.example.com" or "*.example.com". Local sources use the
+// "docker-archive", "oci-archive" and "oci" (layout directory) transports,
+// whose scopes are absolute paths and their parent directories.
+type trustPolicy struct {
+	Default    []trustRequirement                       `json:"default"`
+	Transports map[string]map[string][]trustRequirement `json:"transports"`
+}
+
+// trustRequirement is a policy requirement: "insecureAcceptAnything",
+// "reject", or "sigstoreSigned" with a public key, which is checked with
+// 'cosign verify'. GPG ("signedBy") and keyless Fulcio requirements aren't
+// supported, and signedIdentity is ignored: a signature by the key on the
+// pulled digest is enough.
+type trustRequirement struct {
+	Type     string   `json:"type"`
+	KeyPath  string   `json:"keyPath,omitempty"`
+	KeyPaths []string `json:"keyPaths,omitempty"`
+	KeyData  string   `json:"keyData,omitempty"`
+	// Fulcio is only decoded to reject keyless requirements.
+	Fulcio json.RawMessage `json:"fulcio,omitempty"`
+}
+
+// trust is the -trust-policy, if one was given.
+var trust *trustPolicy
+
+// loadTrustPolicy reads and checks the trust policy at path.
+func loadTrustPolicy(path string) (*trustPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p trustPolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	// As with containers/image, a missing default is an error rather than
+	// silently accepting or rejecting everything else.
+	if len(p.Default) == 0 {
+		return nil, fmt.Errorf("%s has no default requirements", path)
+	}
+	if err := checkRequirements(p.Default); err != nil {
+		return nil, fmt.Errorf("%s: default: %w", path, err)
+	}
+	for transport, scopes := range p.Transports {
+		for scope, reqs := range scopes {
+			if len(reqs) == 0 {
+				return nil, fmt.Errorf("%s: %s scope %q has no requirements", path, transport, scope)
+			}
+			if err := checkRequirements(reqs); err != nil {
+				return nil, fmt.Errorf("%s: %s scope %q: %w", path, transport, scope, err)
+			}
+		}
+	}
+	return &p, nil
+}
+
+func checkRequirements(reqs []trustRequirement) error {
+	for _, r := range reqs {
+		switch r.Type {
+		case "insecureAcceptAnything", "reject":
+		case "sigstoreSigned":
+			if r.Fulcio != nil {
+				return fmt.Errorf("sigstoreSigned with fulcio (keyless) isn't supported; use keyPath, keyPaths or keyData")
+			}
+			n := 0
+			for _, set := range []bool{r.KeyPath != "", len(r.KeyPaths) > 0, r.KeyData != ""} {
+				if set {
+					n++
+				}
+			}
+			if n != 1 {
+				return fmt.Errorf("sigstoreSigned needs exactly one of keyPath, keyPaths or keyData")
+			}
+			if r.KeyData != "" {
+				if _, err := base64.StdEncoding.DecodeString(r.KeyData); err != nil {
+					return fmt.Errorf("sigstoreSigned keyData: %w", err)
+				}
+			}
+		case "signedBy":
+			return fmt.Errorf("signedBy (GPG) requirements aren't supported; use sigstoreSigned")
+		default:
+			return fmt.Errorf("unknown requirement type %q", r.Type)
+		}
+	}
+	return nil
+}
+
+// registryScopes returns the policy scopes of ref, most specific first.
+func registryScopes(ref name.Reference) []string {
+	repo := ref.Context().RepositoryStr()
+	host := ref.Context().RegistryStr()
+	if host == name.DefaultRegistry {
+		// containers/image spells Docker Hub this way.
+		host = "docker.io"
+	}
+	full := host + "/" + repo
+	var scopes []string
+	switch r := ref.(type) {
+	case name.Tag:
+		scopes = append(scopes, full+":"+r.TagStr())
+	case name.Digest:
+		scopes = append(scopes, full+"@"+r.DigestStr())
+	}
+	for s := full; ; {
+		scopes = append(scopes, s)
+		i := strings.LastIndex(s, "/")
+		if i < 0 {
+			break
+		}
+		s = s[:i]
+	}
+	// Wildcards match subdomains, like "*.example.com" for
+	// "registry.example.com".
+	for h := host; ; {
+		_, rest, ok := strings.Cut(h, ".")
+		if !ok {
+			break
+		}
+		scopes = append(scopes, "*."+rest)
+		h = rest
+	}
+	return scopes
+}
+
+// pathScopes returns the policy scopes of the local source at path, most
+// specific first.
+func pathScopes(path string) []string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	var scopes []string
+	for s := filepath.ToSlash(abs); ; {
+		scopes = append(scopes, s)
+		parent := filepath.ToSlash(filepath.Dir(s))
+		if parent == s {
+			break
+		}
+		s = parent
+	}
+	return scopes
+}
+
+// check returns the requirements that apply to the source described by
+// what, in transport with scopes, or an error if the policy rejects it.
+// Signature requirements are left for verifyTrust.
+func (p *trustPolicy) check(transport string, scopes []string, what string) ([]trustRequirement, error) {
+	reqs, scope := p.Default, "default"
+	if byScope, ok := p.Transports[transport]; ok {
+		found := false
+		for _, s := range scopes {
+			if r, ok := byScope[s]; ok {
+				reqs, scope, found = r, fmt.Sprintf("%s scope %q", transport, s), true
+				break
+			}
+		}
+		if r, ok := byScope[""]; ok && !found {
+			reqs, scope = r, fmt.Sprintf("%s default", transport)
+		}
+	}
+	for _, r := range reqs {
+		if r.Type == "reject" {
+			return nil, withExitCode(exitVerification, fmt.Errorf("%s is rejected by the -trust-policy (%s)", what, scope))
+		}
+	}
+	return reqs, nil
+}
+
+// checkRegistryTrust checks the registry source ref against the -trust-policy,
+// before pulling it.
+func checkRegistryTrust(ref name.Reference) ([]trustRequirement, error) {
+	if trust == nil {
+		return nil, nil
+	}
+	return trust.check("docker", registryScopes(ref), ref.String())
+}
+
+// checkLocalTrust checks the local source at path, in transport, against
+// the -trust-policy. Local sources have no signatures to verify, so
+// signature requirements reject them.
+func checkLocalTrust(transport, path string) error {
+	if trust == nil {
+		return nil
+	}
+	reqs, err := trust.check(transport, pathScopes(path), fmt.Sprintf("%q", path))
+	if err != nil {
+		return err
+	}
+	for _, r := range reqs {
+		if r.Type == "sigstoreSigned" {
+			return withExitCode(exitVerification, fmt.Errorf("the -trust-policy requires %q to be signed, but signatures can only be verified for registry sources", path))
+		}
+	}
+	return nil
+}
+
+// verifyTrust checks the signature requirements reqs for the image ref,
+// pinned to digest, with 'cosign verify'. Each requirement needs a valid
+// signature from one of its keys.
+func verifyTrust(reqs []trustRequirement, ref name.Reference, digest v1.Hash) error {
+	pinned := ref.Context().Digest(digest.String())
+	for _, r := range reqs {
+		if r.Type != "sigstoreSigned" {
+			continue
+		}
+		keys := r.KeyPaths
+		if r.KeyPath != "" {
+			keys = []string{r.KeyPath}
+		}
+		if r.KeyData != "" {
+			f, err := createTemp("trust-key-*.pub")
+			if err != nil {
+				return err
+			}
+			// Already validated.
+			data, _ := base64.StdEncoding.DecodeString(r.KeyData)
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("write -trust-policy key: %w", err)
+			}
+			keys = []string{f.Name()}
+		}
+		if err := cosignVerify(pinned, keys); err != nil {
+			return withExitCode(exitVerification, err)
+		}
+	}
+	return nil
+}
+
+// cosignVerify checks that ref has a cosign signature by one of keys.
+func cosignVerify(ref name.Digest, keys []string) error {
+	if _, err := exec.LookPath("cosign"); err != nil {
+		return fmt.Errorf("the -trust-policy requires a signature on %s, but cosign isn't installed: %w", ref, err)
+	}
+	var stderr bytes.Buffer
+	for _, key := range keys {
+		stderr.Reset()
+		cmd := exec.Command("cosign", "verify", "--key", key, ref.String())
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err == nil {
+			logf("Verified the signature of %s with %s", ref, key)
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid signature on %s by the -trust-policy keys %s: %s", ref, strings.Join(keys, ", "), strings.TrimSpace(stderr.String()))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// unixSockets maps the placeholder registry hosts of unix socket
+// registries to their socket paths.
+var unixSockets sync.Map
+
+// parseDockerRef parses a "docker://" argument, without the prefix. Refs
+// like "unix:///run/registry.sock/repo:tag" name an image in a registry
+// listening on a unix socket, which is given a placeholder host name.
+func parseDockerRef(s string) (name.Reference, error) {
+	rest, ok := strings.CutPrefix(s, "unix://")
+	if !ok {
+		return name.ParseReference(s)
+	}
+	sock, repo, err := splitSocketPath(rest)
+	if err != nil {
+		return nil, err
+	}
+	// A ".localhost" host makes go-containerregistry use plain HTTP, which
+	// is what registries on unix sockets speak.
+	sum := sha256.Sum256([]byte(sock))
+	host := fmt.Sprintf("sock-%x.localhost", sum[:6])
+	if _, loaded := unixSockets.LoadOrStore(host, sock); !loaded {
+		logf("Using the registry on unix socket %s as %s", sock, host)
+	}
+	return name.ParseReference(host + "/" + repo)
+}
+
+// splitSocketPath splits a path like "/run/registry.sock/repo:tag" into
+// the socket path and the image reference within the registry. The socket
+// is the first path prefix that isn't a directory.
+func splitSocketPath(p string) (sock, repo string, err error) {
+	if !strings.HasPrefix(p, "/") {
+		return "", "", fmt.Errorf("unix socket path in %q must be absolute, like unix:///run/registry.sock/repo:tag", "unix://"+p)
+	}
+	for i := 1; i < len(p); i++ {
+		if p[i] != '/' {
+			continue
+		}
+		fi, err := os.Stat(p[:i])
+		if err != nil {
+			return "", "", fmt.Errorf("find unix socket in %q: %w", "unix://"+p, err)
+		}
+		if !fi.IsDir() {
+			return p[:i], p[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("%q has no image reference after the unix socket path", "unix://"+p)
+}
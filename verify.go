@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+)
+
+// verifyOutput re-reads the local output at path, just written from the
+// image or index t, for -verify-output: every blob is read back and checked
+// against its digest and size, the layers against the config's diffIDs,
+// and the output's manifests against t's, so that a torn write is caught
+// before anything consumes it. Registries check digests themselves, and
+// pipes and devices can't be read back, so they're skipped.
+func verifyOutput(path string, t remote.Taggable) error {
+	if isRegistryDest(path) {
+		return nil
+	}
+	if isStreamDest(path) {
+		logf("-verify-output: skipping %s, a pipe or device, which can't be read back", path)
+		return nil
+	}
+	logf("Verifying %q", path)
+	if err := verifyLocalOutput(path, t); err != nil {
+		return withExitCode(exitVerification, fmt.Errorf("-verify-output: %s: %w", path, err))
+	}
+	return nil
+}
+
+func verifyLocalOutput(path string, t remote.Taggable) error {
+	digest, err := taggableDigest(t)
+	if err != nil {
+		return err
+	}
+	want, err := v1.NewHash(digest)
+	if err != nil {
+		return err
+	}
+	if isLayoutSource(path) {
+		idx, err := layout.ImageIndexFromPath(path)
+		if err != nil {
+			return err
+		}
+		return verifyIndexEntry(idx, want)
+	}
+	x, err := indexTarball(path)
+	if err != nil {
+		return err
+	}
+	defer x.f.Close()
+	if isOCIArchive(x) {
+		raw, err := x.readAll(x.member("index.json"))
+		if err != nil {
+			return fmt.Errorf("read index.json: %w", err)
+		}
+		return verifyIndexEntry(&archiveIndex{archive: x, mediaType: types.OCIImageIndex, raw: raw}, want)
+	}
+
+	// A docker-archive has no manifest of its own, so it's compared by
+	// its config and layer blobs.
+	img, _, _, err := imageFromIndexedTarball(path, x)
+	if err != nil {
+		return err
+	}
+	if err := validate.Image(img); err != nil {
+		return err
+	}
+	wantImg, ok := t.(v1.Image)
+	if !ok {
+		return fmt.Errorf("a docker-archive can't hold an index")
+	}
+	if err := sameDigest(wantImg, img, v1.Image.ConfigName); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	got, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	m, err := wantImg.Manifest()
+	if err != nil {
+		return err
+	}
+	if len(got.Layers) != len(m.Layers) {
+		return fmt.Errorf("%d layers, want %d", len(got.Layers), len(m.Layers))
+	}
+	for i, l := range got.Layers {
+		if l.Digest != m.Layers[i].Digest {
+			return fmt.Errorf("layer %d: %s, want %s", i, l.Digest, m.Layers[i].Digest)
+		}
+	}
+	return nil
+}
+
+// verifyIndexEntry verifies the image or index with digest want in idx,
+// which is an OCI layout's index.json.
+func verifyIndexEntry(idx v1.ImageIndex, want v1.Hash) error {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return fmt.Errorf("read index.json: %w", err)
+	}
+	for _, desc := range im.Manifests {
+		if desc.Digest == want {
+			return verifyDescriptor(idx, desc)
+		}
+	}
+	return fmt.Errorf("index.json has no entry for %s", want)
+}
+
+// verifyDescriptor verifies the image or index desc in idx, and for an
+// index, each of its children. Unlike validate.Index, it doesn't check
+// that platforms match configs, which is up to the source.
+func verifyDescriptor(idx v1.ImageIndex, desc v1.Descriptor) error {
+	var t remote.Taggable
+	if desc.MediaType.IsIndex() {
+		child, err := idx.ImageIndex(desc.Digest)
+		if err != nil {
+			return err
+		}
+		im, err := child.IndexManifest()
+		if err != nil {
+			return fmt.Errorf("%s: %w", desc.Digest, err)
+		}
+		t = child
+		for _, c := range im.Manifests {
+			if err := verifyDescriptor(child, c); err != nil {
+				return err
+			}
+		}
+	} else {
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+		if err := validate.Image(img); err != nil {
+			return fmt.Errorf("%s: %w", desc.Digest, err)
+		}
+		t = img
+	}
+	raw, err := t.RawManifest()
+	if err != nil {
+		return fmt.Errorf("%s: %w", desc.Digest, err)
+	}
+	got, size, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	if got != desc.Digest || size != desc.Size {
+		return fmt.Errorf("manifest %s is %d bytes with digest %s, want %d bytes", desc.Digest, size, got, desc.Size)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version is the docker-squash version, set at build time with
+// -ldflags "-X main.version=v1.2.3". If empty, it's the module version
+// that 'go install' records, if any.
+var version string
+
+// buildInfo describes the docker-squash binary, for the version
+// subcommand and -version flag.
+type buildInfo struct {
+	Version string `json:"version"`
+	// Commit is the git commit the binary was built from, with "-dirty"
+	// appended if the tree had local changes.
+	Commit              string   `json:"commit,omitempty"`
+	GoContainerRegistry string   `json:"goContainerRegistry,omitempty"`
+	GoVersion           string   `json:"goVersion"`
+	Platform            string   `json:"platform"`
+	Compressors         []string `json:"compressors"`
+	SourceTransports    []string `json:"sourceTransports"`
+	DestTransports      []string `json:"destTransports"`
+	CompletionShells    []string `json:"completionShells"`
+}
+
+// moduleVersion returns the docker-squash version, or "" if unknown, as in
+// builds from a source checkout without -ldflags.
+func moduleVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return ""
+}
+
+// currentBuildInfo returns the buildInfo of the running binary.
+func currentBuildInfo() buildInfo {
+	b := buildInfo{
+		Version:          moduleVersion(),
+		GoVersion:        runtime.Version(),
+		Platform:         runtime.GOOS + "/" + runtime.GOARCH,
+		Compressors:      []string{"gzip", "pgzip", "zstd", "none", "exec"},
+		SourceTransports: []string{"docker-archive", "oci-archive", "oci", "docker"},
+		DestTransports:   []string{"docker-archive", "oci-archive", "oci", "wsl", "docker", "pipe"},
+		CompletionShells: []string{"bash", "zsh", "fish", "powershell"},
+	}
+	if b.Version == "" {
+		b.Version = "devel"
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	dirty := false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Commit = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if dirty && b.Commit != "" {
+		b.Commit += "-dirty"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/google/go-containerregistry" {
+			b.GoContainerRegistry = dep.Version
+			if dep.Replace != nil {
+				b.GoContainerRegistry = dep.Replace.Version
+			}
+		}
+	}
+	return b
+}
+
+// printVersion writes the build info of the binary, as JSON if asJSON is
+// set.
+func printVersion(asJSON bool) error {
+	b := currentBuildInfo()
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(b)
+	}
+	fmt.Printf("docker-squash %s\n", b.Version)
+	for _, f := range [][2]string{
+		{"commit", b.Commit},
+		{"go-containerregistry", b.GoContainerRegistry},
+		{"go", b.GoVersion + " " + b.Platform},
+		{"compressors", strings.Join(b.Compressors, ", ")},
+		{"sources", strings.Join(b.SourceTransports, ", ")},
+		{"dests", strings.Join(b.DestTransports, ", ")},
+		{"completion", strings.Join(b.CompletionShells, ", ")},
+	} {
+		if f[1] != "" {
+			fmt.Printf("  %-22s%s\n", f[0]+":", f[1])
+		}
+	}
+	return nil
+}
+
+// versionFlags returns the flags of the version subcommand, and its -json.
+func versionFlags() (*flag.FlagSet, *bool) {
+	flags := flag.NewFlagSet("version", flag.ContinueOnError)
+	return flags, flags.Bool("json", false, "Print the build info as JSON, for wrappers checking which features are supported")
+}
+
+// versionMain implements the version subcommand.
+func versionMain(args []string) error {
+	flags, asJSON := versionFlags()
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return withExitCode(exitUsage, err)
+	}
+	if flags.NArg() != 0 {
+		return withExitCode(exitUsage, fmt.Errorf("usage: %s version [-json]", os.Args[0]))
+	}
+	return printVersion(*asJSON)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// rootfsVisitor inspects the entries of the squashed rootfs, for reports
+// and audits that don't modify it.
+type rootfsVisitor interface {
+	// WantsContent returns whether Visit needs the content of the given
+	// entry. Content is only read for regular files.
+	WantsContent(hdr *tar.Header) bool
+	// Visit is called for each entry, with its content if requested.
+	Visit(hdr *tar.Header, content []byte) error
+}
+
+// visitLayers makes a single pass over the given squashed layer tarballs,
+// calling each visitor for every entry.
+func visitLayers(layerPaths []string, visitors []rootfsVisitor) error {
+	for _, p := range layerPaths {
+		if err := visitLayer(p, visitors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func visitLayer(path string, visitors []rootfsVisitor) error {
+	f, err := openTemp(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return visitTar(f, visitors)
+}
+
+// visitTar calls each visitor for every entry of the tar stream r.
+func visitTar(r io.Reader, visitors []rootfsVisitor) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var content []byte
+		if hdr.Typeflag == tar.TypeReg {
+			for _, v := range visitors {
+				if v.WantsContent(hdr) {
+					if content, err = io.ReadAll(tr); err != nil {
+						return err
+					}
+					break
+				}
+			}
+		}
+		for _, v := range visitors {
+			if err := v.Visit(hdr, content); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// inspectRootfs runs the rootfs reports and policy checks requested by flags, using visit to
+// make the pass over the squashed rootfs of an image whose USER is user. The extra visitors
+// always run.
+func inspectRootfs(user string, visit func(visitors []rootfsVisitor) error, extra ...rootfsVisitor) error {
+	visitors := extra
+	var licenses *licenseInventory
+	if *licensesOutput != "" {
+		licenses = &licenseInventory{}
+		visitors = append(visitors, licenses)
+	}
+	var packages *packageUsage
+	if *reportPackages {
+		packages = newPackageUsage()
+		visitors = append(visitors, packages)
+	}
+	perms := newPermissionAudit(user)
+	if perms != nil {
+		visitors = append(visitors, perms)
+	}
+	policy := newPolicyVisitor()
+	if policy != nil {
+		visitors = append(visitors, policy)
+	}
+	if len(visitors) == 0 {
+		return nil
+	}
+	if err := visit(visitors); err != nil {
+		return fmt.Errorf("inspect squashed rootfs: %w", err)
+	}
+	if licenses != nil {
+		if err := licenses.Write(*licensesOutput); err != nil {
+			return fmt.Errorf("write license inventory: %w", err)
+		}
+		logf("Wrote license inventory (%d files, %d packages) to %q", len(licenses.Files), len(licenses.Packages), *licensesOutput)
+	}
+	if packages != nil {
+		packages.report()
+	}
+	if perms != nil {
+		if err := enforcePolicy(perms.report()); err != nil {
+			return err
+		}
+	}
+	if policy != nil {
+		return policy.enforce()
+	}
+	return nil
+}
+
+// inspectImageRootfs runs the rootfs reports against the flattened
+// filesystem of img, such as a cached squash result.
+func inspectImageRootfs(img v1.Image) error {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("get config file: %w", err)
+	}
+	return inspectRootfs(cfg.Config.User, func(visitors []rootfsVisitor) error {
+		rc := extractImage(img)
+		defer rc.Close()
+		return visitTar(rc, visitors)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// wslConf returns the contents of /etc/wsl.conf to write into the WSL
+// rootfs, or "" if the image's own wsl.conf (if any) should be left alone.
+func wslConf() string {
+	var sections []string
+	if *wslSystemd {
+		sections = append(sections, "[boot]\nsystemd=true\n")
+	}
+	if *wslHostname != "" {
+		sections = append(sections, fmt.Sprintf("[network]\nhostname=%s\n", *wslHostname))
+	}
+	if *wslDefaultUser != "" {
+		sections = append(sections, fmt.Sprintf("[user]\ndefault=%s\n", *wslDefaultUser))
+	}
+	return strings.Join(sections, "\n")
+}
+
+// writeWSLTarball writes the flattened root filesystem of img to
+// outputPath in the layout expected by 'wsl --import': a plain tarball of
+// the rootfs, gzip-compressed if outputPath ends in ".gz".
+func writeWSLTarball(outputPath string, img v1.Image) error {
+	logf("Writing WSL rootfs to %q", outputPath)
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output file: %w", err)
+	}
+	defer out.Close()
+	progress := &progressWriter{}
+	var w io.Writer = io.MultiWriter(out, progress)
+	var gw *gzip.Writer
+	if strings.HasSuffix(outputPath, ".gz") {
+		gw = gzip.NewWriter(w)
+		w = gw
+	}
+	if err := writeWSLRootfs(w, img); err != nil {
+		return fmt.Errorf("write WSL rootfs to %q: %w", outputPath, err)
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			return fmt.Errorf("write WSL rootfs to %q: %w", outputPath, err)
+		}
+	}
+	progress.Print()
+	return nil
+}
+
+func writeWSLRootfs(w io.Writer, img v1.Image) error {
+	rc, err := squashedRootfs(img)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	conf := wslConf()
+	tr := tar.NewReader(rc)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// Replace the image's own wsl.conf if we're generating one.
+		if conf != "" && cleanTarPath(hdr.Name) == "etc/wsl.conf" {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	if conf != "" {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "etc/wsl.conf",
+			Mode:     0644,
+			Size:     int64(len(conf)),
+			ModTime:  time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, conf); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// cleanTarPath normalizes a tar entry name to a relative slash-separated
+// path without a leading "./" or "/", e.g. "./etc/hosts" -> "etc/hosts".
+func cleanTarPath(name string) string {
+	p := path.Clean("/" + name)
+	return strings.TrimPrefix(p, "/")
+}